@@ -0,0 +1,224 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+)
+
+/*
+This code compares the track flown in AUTO mode with the legs of the mission. The legs run from home
+through the navigation waypoints in the order they are flown: a DO_JUMP is followed to its target as
+many times as its repeat count, and a jump repeated forever is followed once, so the fixes flown on
+later laps are measured against the legs of the last one. Every GPS fix logged in AUTO is matched to the leg
+being flown, which advances once the vehicle passes the end of the current leg, and its cross-track
+error is the horizontal distance from the leg. Positions are projected onto a local plane around
+the start of the leg, which is accurate to well under a meter over the length of a mission leg.
+*/
+
+const (
+	autoMode          = "AUTO"
+	commandDoJump     = 177   // MAV_CMD_DO_JUMP: Prm1 is the target item, Prm2 the repeat count
+	maxFlownWaypoints = 10000 // bound on the waypoints of a mission with many nested jumps
+)
+
+// CrossTrackSample is the cross-track error of a GPS fix logged in AUTO mode
+type CrossTrackSample struct {
+	Time  time.Duration // time since boot
+	Leg   int           // index into CrossTrackReport.Legs
+	Lat   float64
+	Lng   float64
+	Error float64 // distance from the leg in meters
+}
+
+// LegDeviation is the cross-track error along one mission leg
+type LegDeviation struct {
+	From    MissionItem
+	To      MissionItem
+	Length  float64 // meters
+	Samples int
+	Max     float64
+	Mean    float64
+	RMS     float64
+}
+
+// CrossTrackReport holds the cross-track error of the flown track against the mission legs
+type CrossTrackReport struct {
+	Legs    []LegDeviation
+	Samples []CrossTrackSample
+	Max     float64
+	Mean    float64
+	RMS     float64
+}
+
+// CrossTrackError reads the whole log and compares the GPS track flown in AUTO mode with the legs
+// of the mission. The reader is rewound before and after.
+func CrossTrackError(reader *fileparser.BinaryDataFileReader, mission *Mission) (*CrossTrackReport, error) {
+	report := &CrossTrackReport{Legs: missionLegs(mission), Samples: []CrossTrackSample{}}
+	if len(report.Legs) == 0 {
+		return report, nil
+	}
+
+	reader.Rewind()
+	defer reader.Rewind()
+
+	leg := 0
+	wasAuto := false
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log: %w", err)
+		}
+		if message.GetType() != fileparser.MsgTypeGPS {
+			continue
+		}
+
+		inAuto := reader.FlightMode() == autoMode
+		if inAuto && !wasAuto {
+			// the mission restarts from the first leg unless it is resumed, so search from the start
+			leg = 0
+		}
+		wasAuto = inAuto
+		if !inAuto {
+			continue
+		}
+
+		lat, lng, _, ok := fileparser.GPSFixPosition(message)
+		if !ok {
+			continue
+		}
+
+		distance, along := report.Legs[leg].distance(lat, lng)
+		for along >= 1 && leg+1 < len(report.Legs) {
+			leg++
+			distance, along = report.Legs[leg].distance(lat, lng)
+		}
+
+		bootUS, _ := message.TimeUS()
+		report.Samples = append(report.Samples, CrossTrackSample{
+			Time:  time.Duration(bootUS) * time.Microsecond,
+			Leg:   leg,
+			Lat:   lat,
+			Lng:   lng,
+			Error: distance,
+		})
+	}
+
+	report.summarise()
+	return report, nil
+}
+
+// returns the legs between home and the consecutive navigation waypoints of a mission
+func missionLegs(mission *Mission) []LegDeviation {
+	waypoints := []MissionItem{}
+	if home, ok := mission.Home(); ok && (home.Lat != 0 || home.Lng != 0) {
+		waypoints = append(waypoints, home)
+	}
+	waypoints = append(waypoints, flownWaypoints(mission)...)
+
+	legs := []LegDeviation{}
+	for i := 1; i < len(waypoints); i++ {
+		from, to := waypoints[i-1], waypoints[i]
+		legs = append(legs, LegDeviation{From: from, To: to, Length: haversineDistance(from.Lat, from.Lng, to.Lat, to.Lng)})
+	}
+	return legs
+}
+
+// returns the navigation waypoints of a mission, excluding home, in the order they are flown when
+// every DO_JUMP is followed
+func flownWaypoints(mission *Mission) []MissionItem {
+	positions := map[int]int{} // index in mission.Items of each item number
+	for i, item := range mission.Items {
+		positions[item.Seq] = i
+	}
+	jumpsLeft := map[int]int{} // jumps left of each DO_JUMP taken at least once
+
+	waypoints := []MissionItem{}
+	for i := 0; i < len(mission.Items) && len(waypoints) < maxFlownWaypoints; i++ {
+		item := mission.Items[i]
+		if item.Seq == homeSequence {
+			continue
+		}
+		if item.Command != commandDoJump {
+			if item.IsNavigation() {
+				waypoints = append(waypoints, item)
+			}
+			continue
+		}
+
+		left, taken := jumpsLeft[item.Seq]
+		if !taken {
+			left = int(item.Params[1])
+			if left < 0 {
+				left = 1
+			}
+		}
+		target, ok := positions[int(item.Params[0])]
+		if left <= 0 || !ok {
+			continue
+		}
+		jumpsLeft[item.Seq] = left - 1
+		i = target - 1
+	}
+	return waypoints
+}
+
+// returns the distance in meters of a position from the leg, and how far along the leg it lies, 0
+// at the start and 1 at the end
+func (leg LegDeviation) distance(lat float64, lng float64) (float64, float64) {
+	scale := math.Cos(leg.From.Lat * degreesToRadians)
+	project := func(pointLat float64, pointLng float64) (float64, float64) {
+		x := (pointLng - leg.From.Lng) * degreesToRadians * earthRadiusMeters * scale
+		y := (pointLat - leg.From.Lat) * degreesToRadians * earthRadiusMeters
+		return x, y
+	}
+
+	endX, endY := project(leg.To.Lat, leg.To.Lng)
+	x, y := project(lat, lng)
+
+	lengthSquared := endX*endX + endY*endY
+	if lengthSquared == 0 {
+		return math.Hypot(x, y), 1
+	}
+
+	along := (x*endX + y*endY) / lengthSquared
+	clamped := math.Max(0, math.Min(1, along))
+	return math.Hypot(x-clamped*endX, y-clamped*endY), along
+}
+
+// fills in the per leg and overall statistics from the samples
+func (report *CrossTrackReport) summarise() {
+	sums := make([]float64, len(report.Legs))
+	squares := make([]float64, len(report.Legs))
+	total, totalSquares := 0.0, 0.0
+
+	for _, sample := range report.Samples {
+		leg := &report.Legs[sample.Leg]
+		leg.Samples++
+		leg.Max = math.Max(leg.Max, sample.Error)
+		sums[sample.Leg] += sample.Error
+		squares[sample.Leg] += sample.Error * sample.Error
+
+		report.Max = math.Max(report.Max, sample.Error)
+		total += sample.Error
+		totalSquares += sample.Error * sample.Error
+	}
+
+	for i := range report.Legs {
+		if count := float64(report.Legs[i].Samples); count > 0 {
+			report.Legs[i].Mean = sums[i] / count
+			report.Legs[i].RMS = math.Sqrt(squares[i] / count)
+		}
+	}
+	if count := float64(len(report.Samples)); count > 0 {
+		report.Mean = total / count
+		report.RMS = math.Sqrt(totalSquares / count)
+	}
+}
@@ -0,0 +1,490 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+)
+
+/*
+This code builds a summary of a flight from a log: the vehicle and firmware, when and where it took
+off and landed, how long and how far it flew, the altitude, speed and climb rate extremes, battery
+consumption, the flight modes used, the GPS quality and the number of errors and warnings. The
+summary is rendered as JSON, Markdown or HTML by summary_report.go.
+*/
+
+const (
+	earthRadiusMeters  = 6371008.8
+	degreesToRadians   = math.Pi / 180.0
+	latLngScale        = 1e-7 // 'L' fields are degrees * 1e7
+	centivoltsPerVolt  = 100.0
+	minimumGPSFixState = 3 // GPS Status of a 3D fix
+	errorCodeResolved  = 0
+)
+
+// words of MSG texts counted as warnings, matched case-insensitively against whole words so that
+// "low" does not match "Flow" or "below"
+var warningKeywords = map[string]bool{
+	"warning": true, "fail": true, "failed": true, "failure": true, "failsafe": true, "error": true,
+	"bad": true, "prearm": true, "low": true, "lost": true, "glitch": true, "crash": true,
+}
+
+// SummaryPoint is the time and position of a takeoff or landing
+type SummaryPoint struct {
+	BootTime    time.Duration // time since boot
+	UTC         time.Time     // zero when the log has no GPS time
+	Lat         float64
+	Lng         float64
+	Alt         float64
+	HasPosition bool
+}
+
+// ModeUsage is the time spent in a flight mode over the whole log
+type ModeUsage struct {
+	Mode     string
+	Duration time.Duration
+	Count    int // number of times the mode was entered
+}
+
+// GPSStats describes the GPS quality over the log
+type GPSStats struct {
+	Messages       int
+	Fixes          int // messages with a 3D fix or better
+	MinSatellites  int
+	MaxSatellites  int
+	MeanSatellites float64
+	MeanHDop       float64
+	MaxHDop        float64
+}
+
+// FlightSummary is the summary of a single log
+type FlightSummary struct {
+	Vehicle  string
+	MavType  string
+	Firmware string
+	GitHash  string
+	Board    string
+	Frame    string
+
+	Takeoff    *SummaryPoint // nil when no takeoff was found
+	Landing    *SummaryPoint // nil when no landing was found
+	FlightTime time.Duration
+
+	Distance            float64 // meters flown between takeoff and landing, or over the whole log
+	MaxAltitude         float64 // GPS altitude above mean sea level in meters
+	MaxRelativeAltitude float64 // meters above the takeoff altitude
+	MaxGroundSpeed      float64 // m/s
+	MaxClimbRate        float64 // m/s
+
+	BatteryConsumed float64 // mAh
+	MinVoltage      float64 // volts, 0 when the log records no battery voltage
+
+	Modes []ModeUsage
+	GPS   GPSStats
+
+	Errors   int // ERR messages reporting a fault, resolutions are not counted
+	Warnings int // MSG texts that read as warnings
+}
+
+// sensorReadings holds what the single pass over the log gathers for the summary beyond the events
+// and flight modes
+type sensorReadings struct {
+	fixes     []gpsFix
+	batteries map[string]float64 // last consumed capacity of each battery instance
+	order     []string           // battery instances in the order they were first seen
+}
+
+// gpsFix is a GPS message with a 3D fix, kept until the takeoff and landing are known
+type gpsFix struct {
+	position SummaryPoint
+	speed    float64
+	climb    float64
+	hasSpeed bool
+	hasClimb bool
+}
+
+// NewFlightSummary reads the whole log once and summarises the flight. The reader is rewound
+// before and after.
+func NewFlightSummary(reader *fileparser.BinaryDataFileReader) (*FlightSummary, error) {
+	summary := &FlightSummary{}
+
+	info := reader.VehicleInfo()
+	summary.Vehicle = info.Vehicle
+	summary.MavType = info.MavType.String()
+	summary.GitHash = info.GitHash
+	summary.Board = info.BoardName
+	summary.Frame = strings.Trim(info.FrameClass+"/"+info.FrameType, "/")
+	if info.Vehicle != "" {
+		summary.Firmware = fmt.Sprintf("%s %s", info.Vehicle, info.Version)
+	}
+
+	reader.Rewind()
+	defer reader.Rewind()
+
+	events := reader.NewEventRecorder()
+	modes := &fileparser.FlightModeRecorder{}
+	detectorOptions := DefaultDetectorOptions()
+	detectorOptions.Vehicle = info.Vehicle
+	detector := NewTakeoffLandingDetector(detectorOptions)
+	sensors := &sensorReadings{batteries: map[string]float64{}}
+	messages := 0
+
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log: %w", err)
+		}
+		messages++
+
+		events.Add(message)
+		modes.Add(message)
+		detector.Update(message, reader.Armed())
+		summary.readSensors(message, sensors)
+	}
+	if messages == 0 {
+		return nil, fmt.Errorf("no messages found in log")
+	}
+
+	// prefer the vehicle's own landing detection, then the sensor based detector, then arming
+	summary.Takeoff, summary.Landing = takeoffAndLanding(events.Events(), false)
+	if summary.Takeoff == nil {
+		summary.Takeoff, summary.Landing = detectedTakeoffAndLanding(detector.Events())
+	}
+	if summary.Takeoff == nil {
+		summary.Takeoff, summary.Landing = takeoffAndLanding(events.Events(), true)
+	}
+	if summary.Takeoff != nil && summary.Landing != nil {
+		summary.FlightTime = summary.Landing.BootTime - summary.Takeoff.BootTime
+	}
+	summary.countErrorsAndWarnings(events.Events())
+	summary.Modes = modeUsage(modes.Spans(reader.MavType))
+	summary.addFlight(sensors)
+	return summary, nil
+}
+
+// finds the takeoff and landing from the EV and ARM events. The first NOT_LANDED event is the
+// takeoff, falling back to the first arming when requested, and the first LAND_COMPLETE after it
+// is the landing, falling back to the next disarming.
+func takeoffAndLanding(events []fileparser.Event, armingFallback bool) (*SummaryPoint, *SummaryPoint) {
+	var takeoff, armed *fileparser.Event
+	for i := range events {
+		event := &events[i]
+		if event.Name == "NOT_LANDED" {
+			takeoff = event
+			break
+		}
+		if armed == nil && isArmingEvent(event, true) {
+			armed = event
+		}
+	}
+	if takeoff == nil && armingFallback {
+		takeoff = armed
+	}
+	if takeoff == nil {
+		return nil, nil
+	}
+
+	var landing, disarmed *fileparser.Event
+	for i := range events {
+		event := &events[i]
+		if event.Time < takeoff.Time {
+			continue
+		}
+		if event.Name == "LAND_COMPLETE" {
+			landing = event
+			break
+		}
+		if disarmed == nil && isArmingEvent(event, false) {
+			disarmed = event
+		}
+	}
+	if landing == nil {
+		landing = disarmed
+	}
+
+	if landing == nil {
+		return summaryPoint(takeoff), nil
+	}
+	return summaryPoint(takeoff), summaryPoint(landing)
+}
+
+// returns the first detected takeoff and the landing that follows it
+func detectedTakeoffAndLanding(detected []DetectedEvent) (*SummaryPoint, *SummaryPoint) {
+	var takeoff, landing *SummaryPoint
+	for _, event := range detected {
+		point := &SummaryPoint{
+			BootTime:    event.Time,
+			UTC:         event.UTC,
+			Lat:         event.Lat,
+			Lng:         event.Lng,
+			Alt:         event.Alt,
+			HasPosition: event.HasPosition,
+		}
+		switch {
+		case event.Kind == DetectedTakeoff && takeoff == nil:
+			takeoff = point
+		case event.Kind == DetectedLanding && takeoff != nil:
+			return takeoff, point
+		}
+	}
+	return takeoff, landing
+}
+
+// reports whether an event arms (or disarms) the vehicle
+func isArmingEvent(event *fileparser.Event, armed bool) bool {
+	if event.Category != fileparser.EventCategoryArming && event.Category != fileparser.EventCategoryEvent {
+		return false
+	}
+	if armed {
+		return event.Name == "ARMED" || event.Name == "AUTO_ARMED"
+	}
+	return event.Name == "DISARMED"
+}
+
+func summaryPoint(event *fileparser.Event) *SummaryPoint {
+	return &SummaryPoint{
+		BootTime:    event.Time,
+		UTC:         event.UTC,
+		Lat:         event.Lat,
+		Lng:         event.Lng,
+		Alt:         event.Alt,
+		HasPosition: event.HasPosition,
+	}
+}
+
+// counts the ERR faults and the MSG warnings
+func (summary *FlightSummary) countErrorsAndWarnings(events []fileparser.Event) {
+	for _, event := range events {
+		switch event.Category {
+		case fileparser.EventCategoryError:
+			if event.Code != errorCodeResolved {
+				summary.Errors++
+			}
+		case fileparser.EventCategoryMessage:
+			if hasWarningKeyword(event.Name) {
+				summary.Warnings++
+			}
+		}
+	}
+}
+
+// reports whether a MSG text contains one of the warning keywords as a whole word
+func hasWarningKeyword(text string) bool {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if warningKeywords[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// totals the time spent in each flight mode, in the order the modes were first entered
+func modeUsage(spans []fileparser.FlightModeSpan) []ModeUsage {
+	usage := []ModeUsage{}
+	index := map[string]int{}
+	for i, span := range spans {
+		// consecutive MODE messages for the same mode do not enter it again
+		entered := i == 0 || spans[i-1].Mode != span.Mode
+
+		position, ok := index[span.Mode]
+		if !ok {
+			index[span.Mode] = len(usage)
+			usage = append(usage, ModeUsage{Mode: span.Mode})
+			position = len(usage) - 1
+		}
+		usage[position].Duration += span.End - span.Start
+		if entered {
+			usage[position].Count++
+		}
+	}
+	return usage
+}
+
+// records the GPS quality, the GPS fixes and the battery state of a message
+func (summary *FlightSummary) readSensors(message *fileparser.DataFileMessage, sensors *sensorReadings) {
+	switch message.GetType() {
+	case fileparser.MsgTypeGPS:
+		summary.GPS.Messages++
+		if fix, ok := summary.readGPS(message); ok {
+			sensors.fixes = append(sensors.fixes, fix)
+		}
+	case "BAT":
+		summary.readBattery(message, 1, sensors)
+	case "CURR":
+		// older logs record the voltage in centivolts
+		summary.readBattery(message, centivoltsPerVolt, sensors)
+	}
+}
+
+// records the GPS quality of a message. Returns the fix of a message with a 3D fix.
+func (summary *FlightSummary) readGPS(message *fileparser.DataFileMessage) (gpsFix, bool) {
+	status, _ := numberAttribute(message, "Status")
+	if status < minimumGPSFixState {
+		return gpsFix{}, false
+	}
+	lat, okLat := numberAttribute(message, "Lat")
+	lng, okLng := numberAttribute(message, "Lng")
+	if !okLat || !okLng || (lat == 0 && lng == 0) {
+		return gpsFix{}, false
+	}
+
+	gps := &summary.GPS
+	gps.Fixes++
+	if sats, ok := numberAttribute(message, "NSats"); ok {
+		gps.MeanSatellites += sats
+		if gps.Fixes == 1 || int(sats) < gps.MinSatellites {
+			gps.MinSatellites = int(sats)
+		}
+		gps.MaxSatellites = int(math.Max(float64(gps.MaxSatellites), sats))
+	}
+	if dop, ok := numberAttribute(message, "HDop"); ok {
+		gps.MeanHDop += dop
+		gps.MaxHDop = math.Max(gps.MaxHDop, dop)
+	}
+
+	bootUS, _ := message.TimeUS()
+	fix := gpsFix{position: SummaryPoint{
+		BootTime:    time.Duration(bootUS) * time.Microsecond,
+		Lat:         lat * latLngScale,
+		Lng:         lng * latLngScale,
+		HasPosition: true,
+	}}
+	fix.position.Alt, _ = numberAttribute(message, "Alt")
+	fix.speed, fix.hasSpeed = numberAttribute(message, "Spd")
+	// VZ is the NED down velocity
+	if down, ok := numberAttribute(message, "VZ"); ok {
+		fix.climb, fix.hasClimb = -down, true
+	}
+	return fix, true
+}
+
+// records the consumed capacity of the battery instance and the lowest voltage of a BAT or CURR
+// message
+func (summary *FlightSummary) readBattery(message *fileparser.DataFileMessage, voltageDivisor float64, sensors *sensorReadings) {
+	if consumed, ok := numberAttribute(message, "CurrTot"); ok {
+		instance := message.GetType() + batteryInstance(message)
+		if _, seen := sensors.batteries[instance]; !seen {
+			sensors.order = append(sensors.order, instance)
+		}
+		sensors.batteries[instance] = consumed
+	}
+	if volt, ok := numberAttribute(message, "Volt"); ok && volt > 0 {
+		volt /= voltageDivisor
+		if summary.MinVoltage == 0 || volt < summary.MinVoltage {
+			summary.MinVoltage = volt
+		}
+	}
+}
+
+// returns the battery instance of a message, empty for logs with a single battery
+func batteryInstance(message *fileparser.DataFileMessage) string {
+	fields := []string{"Instance", "Inst"}
+	if message.Format.InstanceField != nil {
+		fields = []string{*message.Format.InstanceField}
+	}
+	for _, field := range fields {
+		if instance, ok := numberAttribute(message, field); ok {
+			return fmt.Sprint(instance)
+		}
+	}
+	return ""
+}
+
+// totals what depends on the takeoff and landing: the distance flown, the altitude, speed and climb
+// rate extremes, and the battery consumed by every instance
+func (summary *FlightSummary) addFlight(sensors *sensorReadings) {
+	if summary.GPS.Fixes > 0 {
+		summary.GPS.MeanSatellites /= float64(summary.GPS.Fixes)
+		summary.GPS.MeanHDop /= float64(summary.GPS.Fixes)
+	}
+
+	var previous *SummaryPoint
+	for i := range sensors.fixes {
+		fix := &sensors.fixes[i]
+		if !summary.flying(fix.position.BootTime) {
+			continue
+		}
+		first := previous == nil
+		if !first {
+			summary.Distance += haversineDistance(previous.Lat, previous.Lng, fix.position.Lat, fix.position.Lng)
+		}
+		previous = &fix.position
+
+		// the maximum altitude starts from the first fix, a flight may stay below sea level
+		if first || fix.position.Alt > summary.MaxAltitude {
+			summary.MaxAltitude = fix.position.Alt
+		}
+		if summary.Takeoff != nil && summary.Takeoff.HasPosition {
+			summary.MaxRelativeAltitude = math.Max(summary.MaxRelativeAltitude, fix.position.Alt-summary.Takeoff.Alt)
+		}
+		if fix.hasSpeed {
+			summary.MaxGroundSpeed = math.Max(summary.MaxGroundSpeed, fix.speed)
+		}
+		if fix.hasClimb {
+			summary.MaxClimbRate = math.Max(summary.MaxClimbRate, fix.climb)
+		}
+	}
+
+	for _, instance := range sensors.order {
+		summary.BatteryConsumed += sensors.batteries[instance]
+	}
+}
+
+// reports whether the vehicle was flying at a time since boot. Logs without a takeoff are treated
+// as flying throughout.
+func (summary *FlightSummary) flying(bootTime time.Duration) bool {
+	if summary.Takeoff == nil {
+		return true
+	}
+	if bootTime < summary.Takeoff.BootTime {
+		return false
+	}
+	return summary.Landing == nil || bootTime <= summary.Landing.BootTime
+}
+
+// returns the modes sorted by the time spent in them, longest first
+func (summary *FlightSummary) modesByDuration() []ModeUsage {
+	modes := make([]ModeUsage, len(summary.Modes))
+	copy(modes, summary.Modes)
+	sort.SliceStable(modes, func(i, j int) bool { return modes[i].Duration > modes[j].Duration })
+	return modes
+}
+
+// returns a numeric attribute as a float64
+func numberAttribute(message *fileparser.DataFileMessage, field string) (float64, bool) {
+	value, err := message.GetAttribute(field)
+	if err != nil {
+		return 0, false
+	}
+
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
+
+// great circle distance between two positions in meters
+func haversineDistance(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	phi1, phi2 := lat1*degreesToRadians, lat2*degreesToRadians
+	dPhi := phi2 - phi1
+	dLambda := (lng2 - lng1) * degreesToRadians
+
+	h := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
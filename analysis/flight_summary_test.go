@@ -0,0 +1,107 @@
+package analysis
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+func TestHasWarningKeyword(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"PreArm: Compass not calibrated", true},
+		{"Battery 1 is low 10.5V", true},
+		{"GPS Glitch", true},
+		{"EKF3 lane switch, Failsafe", true},
+		{"Flow sensor initialised", false},
+		{"Terrain follow enabled", false},
+		{"Descending below 10m", false},
+		{"Mission: 3 WP", false},
+	}
+	for _, test := range tests {
+		if got := hasWarningKeyword(test.text); got != test.want {
+			t.Errorf("hasWarningKeyword(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestFlightSummaryBatteryAndWarnings(t *testing.T) {
+	const batType = 150
+	builder := binlogtest.NewBuilder()
+	formats := []binlogtest.Format{
+		{Type: batType, Name: "BAT", Format: "QBff", Columns: "TimeUS,Inst,Volt,CurrTot"},
+		{Type: testMSGType, Name: "MSG", Format: "QZ", Columns: "TimeUS,Message"},
+	}
+	for _, format := range formats {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages := [][]interface{}{
+		{testMSGType, 1000, "Flow sensor initialised"},
+		{batType, 2000, 0, 12.6, 100.0},
+		{batType, 2000, 1, 12.5, 50.0},
+		{batType, 3000, 0, 12.1, 400.0},
+		{batType, 3000, 1, 11.9, 250.0},
+		{testMSGType, 4000, "Battery 1 is low"},
+	}
+	for _, message := range messages {
+		if err := builder.Message(message[0].(int), message[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := NewFlightSummary(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.BatteryConsumed != 650 {
+		t.Errorf("got %v mAh consumed, want the last capacity of both batteries, 650", summary.BatteryConsumed)
+	}
+	if summary.MinVoltage < 11.89 || summary.MinVoltage > 11.91 {
+		t.Errorf("got minimum voltage %v, want 11.9", summary.MinVoltage)
+	}
+	if summary.Warnings != 1 {
+		t.Errorf("got %d warnings, want 1", summary.Warnings)
+	}
+}
+
+func TestFlightSummaryBelowSeaLevel(t *testing.T) {
+	// the ground is 1000 m below the GPS altitude of the other tests, 416 m below sea level
+	second := time.Second
+	data := flightLog(t, fileparser.VehicleCopter, true, []flightPhase{
+		{duration: second, alt: -1000},
+		{duration: 2 * second, armed: true, throttle: 0.1, alt: -1000},
+		{duration: 10 * second, armed: true, throttle: 0.5, alt: -990},
+		{duration: 3 * second, armed: true, throttle: 0.1, alt: -1000},
+		{duration: second, alt: -1000},
+	})
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := NewFlightSummary(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Takeoff == nil || summary.Landing == nil {
+		t.Fatalf("got takeoff %+v and landing %+v", summary.Takeoff, summary.Landing)
+	}
+	if math.Abs(summary.MaxAltitude+406) > 0.01 {
+		t.Errorf("got maximum altitude %v, want -406", summary.MaxAltitude)
+	}
+	if math.Abs(summary.MaxRelativeAltitude-10) > 0.01 {
+		t.Errorf("got maximum relative altitude %v, want 10", summary.MaxRelativeAltitude)
+	}
+}
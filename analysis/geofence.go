@@ -0,0 +1,465 @@
+package analysis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/peterstace/simplefeatures/geom"
+)
+
+/*
+This code checks that a flight stayed within its approved areas. The areas are GeoJSON polygons or
+multipolygons, each optionally limited to a maximum altitude, given as a "max_altitude" property in
+meters above home or, with "altitude_reference": "amsl", above mean sea level. Home is the position
+of the first GPS fix while armed. Every GPS fix logged while armed must lie inside at least one area
+and below the altitude limit of one of the areas containing it; logs without ARM messages or arming
+events have the whole track checked instead, from its first fix. Each run of fixes that does not is
+reported as an excursion. A flight without any fix checked is not compliant, as nothing shows it
+stayed inside. The areas and positions are projected onto a local plane in meters around the areas,
+so distances outside an area are in meters. The FENCE parameters and fence breach events the vehicle
+logged itself are reported alongside.
+*/
+
+// excursion kinds
+const (
+	ExcursionOutside  = "outside"
+	ExcursionAltitude = "altitude"
+)
+
+const (
+	zoneNameProperty         = "name"
+	zoneMaxAltitudeProperty  = "max_altitude"
+	zoneAltitudeRefProperty  = "altitude_reference"
+	zoneAltitudeAMSL         = "amsl"
+	fenceParameterPrefix     = "FENCE_"
+	fenceFailsafeSubsystem   = "FAILSAFE_FENCE"
+	fenceKeyword             = "FENCE"
+	geoJSONFeatureCollection = "FeatureCollection"
+	geoJSONFeature           = "Feature"
+)
+
+// FenceZone is an approved area with an optional altitude limit
+type FenceZone struct {
+	Name         string
+	Area         geom.Geometry // polygon or multipolygon in longitude and latitude
+	MaxAltitude  float64       // 0 when the area has no altitude limit
+	AltitudeAMSL bool          // MaxAltitude is above mean sea level instead of above home
+	projected    geom.Geometry // Area in meters on the local plane
+}
+
+// Excursion is a run of GPS fixes outside the approved areas or above their altitude limit
+type Excursion struct {
+	Kind         string        // ExcursionOutside or ExcursionAltitude
+	Zone         string        // the nearest area for ExcursionOutside, the area whose limit was exceeded for ExcursionAltitude
+	Start        time.Duration // time since boot of the first fix of the excursion
+	End          time.Duration // time since boot of the first fix back in compliance, or of the last fix of the log
+	StartUTC     time.Time     // zero when the log has no GPS time yet
+	EndUTC       time.Time
+	MaxDistance  float64 // meters outside the nearest area, or above the altitude limit
+	PeakAltitude float64 // highest GPS altitude (AMSL) during the excursion
+	Samples      int
+}
+
+// ComplianceReport holds the result of checking a flight against its approved areas
+type ComplianceReport struct {
+	Zones           []string
+	Checked         int  // GPS fixes checked while armed, or in the whole log without arming information
+	ArmingLogged    bool // false when the log has no arming information and the whole track was checked
+	Excursions      []Excursion
+	FenceParameters map[string]float64 // final values of the FENCE_* parameters of the log
+	FenceEvents     []fileparser.Event // fence breaches and fence events logged by the vehicle
+}
+
+// LoadFenceZones reads the approved areas from a GeoJSON feature collection, feature or geometry.
+// Features that are not polygons or multipolygons are ignored.
+func LoadFenceZones(r io.Reader) ([]FenceZone, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fence zones: %v", err)
+	}
+
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("failed to parse fence zones: %v", err)
+	}
+
+	features := geom.GeoJSONFeatureCollection{}
+	switch header.Type {
+	case geoJSONFeatureCollection:
+		if err := json.Unmarshal(data, &features); err != nil {
+			return nil, fmt.Errorf("failed to parse fence zones: %v", err)
+		}
+	case geoJSONFeature:
+		var feature geom.GeoJSONFeature
+		if err := json.Unmarshal(data, &feature); err != nil {
+			return nil, fmt.Errorf("failed to parse fence zones: %v", err)
+		}
+		features = append(features, feature)
+	default:
+		geometry, err := geom.UnmarshalGeoJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse fence zones: %v", err)
+		}
+		features = append(features, geom.GeoJSONFeature{Geometry: geometry})
+	}
+
+	zones := []FenceZone{}
+	for i, feature := range features {
+		if !feature.Geometry.IsPolygon() && !feature.Geometry.IsMultiPolygon() {
+			continue
+		}
+
+		zone := FenceZone{Name: fmt.Sprintf("zone %d", i+1), Area: feature.Geometry}
+		if name, ok := feature.Properties[zoneNameProperty].(string); ok && name != "" {
+			zone.Name = name
+		}
+		if altitude, ok := feature.Properties[zoneMaxAltitudeProperty].(float64); ok {
+			zone.MaxAltitude = altitude
+		}
+		if reference, ok := feature.Properties[zoneAltitudeRefProperty].(string); ok {
+			zone.AltitudeAMSL = strings.EqualFold(reference, zoneAltitudeAMSL)
+		}
+		zones = append(zones, zone)
+	}
+
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no polygon fence zones found")
+	}
+	return zones, nil
+}
+
+// localPlane projects longitude and latitude onto a plane in meters around an origin
+type localPlane struct {
+	originLat float64
+	originLng float64
+	scale     float64
+}
+
+func newLocalPlane(zones []FenceZone) localPlane {
+	envelope := zones[0].Area.Envelope()
+	for _, zone := range zones[1:] {
+		envelope = envelope.ExpandToIncludeEnvelope(zone.Area.Envelope())
+	}
+	center, _ := envelope.Center().XY()
+	return localPlane{originLat: center.Y, originLng: center.X, scale: math.Cos(center.Y * degreesToRadians)}
+}
+
+func (plane localPlane) project(position geom.XY) geom.XY {
+	return geom.XY{
+		X: (position.X - plane.originLng) * degreesToRadians * earthRadiusMeters * plane.scale,
+		Y: (position.Y - plane.originLat) * degreesToRadians * earthRadiusMeters,
+	}
+}
+
+// CheckCompliance reads the whole log and checks the GPS track flown while armed against the
+// approved areas, or the whole track when the log does not record arming. The reader is rewound
+// before and after.
+func CheckCompliance(reader *fileparser.BinaryDataFileReader, zones []FenceZone) (*ComplianceReport, error) {
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no fence zones to check against")
+	}
+
+	// the zones are projected into a copy, so the caller's zones can be checked concurrently
+	plane := newLocalPlane(zones)
+	report := &ComplianceReport{Zones: []string{}, Excursions: []Excursion{}}
+	projected := make([]FenceZone, len(zones))
+	for i, zone := range zones {
+		zone.projected = zone.Area.TransformXY(plane.project)
+		projected[i] = zone
+		report.Zones = append(report.Zones, zone.Name)
+	}
+
+	params, err := reader.ParameterSet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parameters: %w", err)
+	}
+	events, err := reader.EventTimeline()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	report.FenceParameters = fenceParameters(params)
+	report.FenceEvents = fenceEvents(events)
+	report.ArmingLogged = armingLogged(events)
+
+	reader.Rewind()
+	defer reader.Rewind()
+
+	var current *Excursion
+	homeAlt, hasHome := 0.0, false
+
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log: %w", err)
+		}
+		if message.GetType() != fileparser.MsgTypeGPS {
+			continue
+		}
+
+		lat, lng, alt, ok := fileparser.GPSFixPosition(message)
+		if !ok || (report.ArmingLogged && !reader.Armed()) {
+			continue
+		}
+		if !hasHome {
+			homeAlt, hasHome = alt, true
+		}
+
+		bootUS, _ := message.TimeUS()
+		at := time.Duration(bootUS) * time.Microsecond
+		utc, _ := message.UTC()
+		report.Checked++
+
+		kind, zone, distance := checkPosition(projected, plane.project(geom.XY{X: lng, Y: lat}), alt, homeAlt)
+		if current != nil && (kind == "" || kind != current.Kind) {
+			current.End, current.EndUTC = at, utc
+			report.Excursions = append(report.Excursions, *current)
+			current = nil
+		}
+		if kind == "" {
+			continue
+		}
+
+		if current == nil {
+			current = &Excursion{Kind: kind, Zone: zone, Start: at, StartUTC: utc, PeakAltitude: alt}
+		}
+		current.Samples++
+		current.End, current.EndUTC = at, utc
+		current.PeakAltitude = math.Max(current.PeakAltitude, alt)
+		if distance > current.MaxDistance {
+			current.MaxDistance, current.Zone = distance, zone
+		}
+	}
+	if current != nil {
+		report.Excursions = append(report.Excursions, *current)
+	}
+	return report, nil
+}
+
+// reports whether the events include an ARM message or an armed or disarmed event, the messages
+// the reader takes the arming state from
+func armingLogged(events []fileparser.Event) bool {
+	for _, event := range events {
+		if event.Category == fileparser.EventCategoryArming {
+			return true
+		}
+		if event.Category == fileparser.EventCategoryEvent && (event.Code == fileparser.EventIDArmed || event.Code == fileparser.EventIDDisarmed) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the excursion kind of a projected position, "" when it complies, with the zone concerned
+// and the distance outside it or above its limit
+func checkPosition(zones []FenceZone, position geom.XY, alt float64, homeAlt float64) (string, string, float64) {
+	point := position.AsPoint().AsGeometry()
+
+	inside := false
+	nearest, nearestDistance := "", math.Inf(1)
+	lowestExcess, exceeded := math.Inf(1), ""
+	for _, zone := range zones {
+		if !geom.Intersects(zone.projected, point) {
+			if distance, ok := geom.Distance(zone.projected, point); ok && distance < nearestDistance {
+				nearest, nearestDistance = zone.Name, distance
+			}
+			continue
+		}
+
+		inside = true
+		if zone.MaxAltitude == 0 {
+			return "", "", 0
+		}
+		limit := zone.MaxAltitude
+		if !zone.AltitudeAMSL {
+			limit += homeAlt
+		}
+		if alt <= limit {
+			return "", "", 0
+		}
+		if alt-limit < lowestExcess {
+			lowestExcess, exceeded = alt-limit, zone.Name
+		}
+	}
+
+	if inside {
+		return ExcursionAltitude, exceeded, lowestExcess
+	}
+	return ExcursionOutside, nearest, nearestDistance
+}
+
+// returns the final values of the FENCE_* parameters
+func fenceParameters(params *fileparser.ParameterSet) map[string]float64 {
+	values := map[string]float64{}
+	for _, name := range params.Names() {
+		if !strings.HasPrefix(name, fenceParameterPrefix) {
+			continue
+		}
+		if value, ok := params.Final(name); ok {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// returns the fence failsafes, fence events and fence messages of the event timeline
+func fenceEvents(events []fileparser.Event) []fileparser.Event {
+	fence := []fileparser.Event{}
+	for _, event := range events {
+		if event.Name == fenceFailsafeSubsystem || strings.Contains(strings.ToUpper(event.Name), fenceKeyword) ||
+			strings.Contains(strings.ToUpper(event.Description), fenceKeyword) {
+			fence = append(fence, event)
+		}
+	}
+	return fence
+}
+
+// Compliant reports whether the flight never left the approved areas or exceeded their limits. It
+// is false when no GPS fix was checked.
+func (report *ComplianceReport) Compliant() bool {
+	return report.Checked > 0 && len(report.Excursions) == 0
+}
+
+// WriteText writes the report as text, with one line per excursion, FENCE parameter and fence event
+func (report *ComplianceReport) WriteText(w io.Writer) error {
+	status := "COMPLIANT"
+	switch {
+	case report.Checked == 0:
+		status = "NOT CHECKED"
+	case !report.Compliant():
+		status = "NOT COMPLIANT"
+	}
+	lines := []string{
+		fmt.Sprintf("%s: %d excursions in %d GPS fixes checked against %s", status, len(report.Excursions), report.Checked, strings.Join(report.Zones, ", ")),
+	}
+	if !report.ArmingLogged {
+		lines = append(lines, "no arming information, the whole track was checked")
+	}
+
+	for _, excursion := range report.Excursions {
+		distance := fmt.Sprintf("%.1f m outside %s", excursion.MaxDistance, excursion.Zone)
+		if excursion.Kind == ExcursionAltitude {
+			distance = fmt.Sprintf("%.1f m above the limit of %s", excursion.MaxDistance, excursion.Zone)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s to %s: %s, peak altitude %.1f m",
+			excursion.Kind, formatComplianceTime(excursion.Start, excursion.StartUTC), formatComplianceTime(excursion.End, excursion.EndUTC),
+			distance, excursion.PeakAltitude))
+	}
+
+	names := []string{}
+	for name := range report.FenceParameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("param %s = %g", name, report.FenceParameters[name]))
+	}
+
+	for _, event := range report.FenceEvents {
+		lines = append(lines, fmt.Sprintf("event %s %s %s", formatComplianceTime(event.Time, event.UTC), event.Name, event.Description))
+	}
+
+	if _, err := io.WriteString(w, strings.Join(lines, "\n")+"\n"); err != nil {
+		return fmt.Errorf("failed to write compliance report: %v", err)
+	}
+	return nil
+}
+
+func formatComplianceTime(bootTime time.Duration, utc time.Time) string {
+	if utc.IsZero() {
+		return bootTime.Round(time.Millisecond).String()
+	}
+	return utc.Format(time.RFC3339Nano)
+}
+
+// excursionJSON is the JSON form of an Excursion, with times in seconds since boot and RFC 3339
+type excursionJSON struct {
+	Kind         string  `json:"kind"`
+	Zone         string  `json:"zone"`
+	Start        float64 `json:"start_s"`
+	End          float64 `json:"end_s"`
+	StartUTC     *string `json:"start_utc,omitempty"`
+	EndUTC       *string `json:"end_utc,omitempty"`
+	MaxDistance  float64 `json:"max_distance_m"`
+	PeakAltitude float64 `json:"peak_altitude_m"`
+	Samples      int     `json:"samples"`
+}
+
+type fenceEventJSON struct {
+	Time        float64 `json:"time_s"`
+	UTC         *string `json:"utc,omitempty"`
+	Category    string  `json:"category"`
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+}
+
+type complianceReportJSON struct {
+	Compliant       bool               `json:"compliant"`
+	Zones           []string           `json:"zones"`
+	Checked         int                `json:"checked"`
+	ArmingLogged    bool               `json:"arming_logged"`
+	Excursions      []excursionJSON    `json:"excursions"`
+	FenceParameters map[string]float64 `json:"fence_parameters"`
+	FenceEvents     []fenceEventJSON   `json:"fence_events"`
+}
+
+// WriteJSON writes the report as an indented JSON document
+func (report *ComplianceReport) WriteJSON(w io.Writer) error {
+	document := complianceReportJSON{
+		Compliant:       report.Compliant(),
+		Zones:           report.Zones,
+		Checked:         report.Checked,
+		ArmingLogged:    report.ArmingLogged,
+		Excursions:      []excursionJSON{},
+		FenceParameters: report.FenceParameters,
+		FenceEvents:     []fenceEventJSON{},
+	}
+	for _, excursion := range report.Excursions {
+		document.Excursions = append(document.Excursions, excursionJSON{
+			Kind:         excursion.Kind,
+			Zone:         excursion.Zone,
+			Start:        excursion.Start.Seconds(),
+			End:          excursion.End.Seconds(),
+			StartUTC:     utcJSON(excursion.StartUTC),
+			EndUTC:       utcJSON(excursion.EndUTC),
+			MaxDistance:  excursion.MaxDistance,
+			PeakAltitude: excursion.PeakAltitude,
+			Samples:      excursion.Samples,
+		})
+	}
+	for _, event := range report.FenceEvents {
+		document.FenceEvents = append(document.FenceEvents, fenceEventJSON{
+			Time:        event.Time.Seconds(),
+			UTC:         utcJSON(event.UTC),
+			Category:    event.Category,
+			Name:        event.Name,
+			Description: event.Description,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("failed to write compliance report: %v", err)
+	}
+	return nil
+}
+
+func utcJSON(utc time.Time) *string {
+	if utc.IsZero() {
+		return nil
+	}
+	formatted := utc.Format(time.RFC3339Nano)
+	return &formatted
+}
@@ -0,0 +1,285 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// half the side of the square fence zone around the home of the synthetic flights, in degrees
+const testFenceHalfSide = 0.001
+
+// a square of about 200 m around the home of the synthetic flights, limited to 5 m above home
+func testFenceZones(t *testing.T) []FenceZone {
+	t.Helper()
+	return testFenceZone(t, `"name":"field","max_altitude":5`)
+}
+
+// the square around the home of the synthetic flights, with the given GeoJSON properties
+func testFenceZone(t *testing.T, properties string) []FenceZone {
+	t.Helper()
+	square := fmt.Sprintf(`{"type":"Feature","properties":{%[5]s},"geometry":{"type":"Polygon","coordinates":[[[%[1]f,%[2]f],[%[3]f,%[2]f],[%[3]f,%[4]f],[%[1]f,%[4]f],[%[1]f,%[2]f]]]}}`,
+		testHomeLng-testFenceHalfSide, testHomeLat-testFenceHalfSide, testHomeLng+testFenceHalfSide, testHomeLat+testFenceHalfSide, properties)
+	zones, err := LoadFenceZones(strings.NewReader(square))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zones
+}
+
+func checkFlight(t *testing.T, data []byte, zones []FenceZone) *ComplianceReport {
+	t.Helper()
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := CheckCompliance(reader, zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestCheckComplianceExcursions(t *testing.T) {
+	second := time.Second
+	// the north edge of the zone, in meters north of home
+	edge := testFenceHalfSide * degreesToRadians * earthRadiusMeters
+
+	tests := []struct {
+		name       string
+		properties string
+		phases     []flightPhase
+		want       Excursion // UTC times are checked against the times since boot
+	}{
+		{
+			name:       "inside",
+			properties: `"name":"field","max_altitude":5`,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 10 * second, armed: true, alt: 4, north: 50},
+				{duration: second},
+			},
+		},
+		{
+			name:       "outside",
+			properties: `"name":"field"`,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true},
+				{duration: 4 * second, armed: true, alt: 50, north: 300},
+				{duration: 2 * second, armed: true, north: 150},
+				{duration: 2 * second, armed: true},
+				{duration: second},
+			},
+			want: Excursion{Kind: ExcursionOutside, Zone: "field", Start: 4 * second, End: 10 * second, MaxDistance: 300 - edge, PeakAltitude: 634, Samples: 30},
+		},
+		{
+			name:       "above home",
+			properties: `"name":"field","max_altitude":5`,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true},
+				{duration: 3 * second, armed: true, alt: 12},
+				// still above the limit when disarmed, so the excursion ends at the last fix armed
+				{duration: 2 * second, armed: true, alt: 8},
+				{duration: second},
+			},
+			want: Excursion{Kind: ExcursionAltitude, Zone: "field", Start: 4 * second, End: 8800 * time.Millisecond, MaxDistance: 7, PeakAltitude: 596, Samples: 25},
+		},
+		{
+			name:       "above mean sea level",
+			properties: `"name":"field","max_altitude":590,"altitude_reference":"amsl"`,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true, alt: 5},
+				{duration: 3 * second, armed: true, alt: 12},
+				{duration: 2 * second, armed: true, alt: 5},
+				{duration: second},
+			},
+			want: Excursion{Kind: ExcursionAltitude, Zone: "field", Start: 4 * second, End: 7 * second, MaxDistance: 6, PeakAltitude: 596, Samples: 15},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := flightLog(t, fileparser.VehicleCopter, true, test.phases)
+			report := checkFlight(t, data, testFenceZone(t, test.properties))
+			if !report.ArmingLogged || report.Checked == 0 {
+				t.Fatalf("got %d fixes checked, arming logged %v", report.Checked, report.ArmingLogged)
+			}
+			if test.want.Kind == "" {
+				if !report.Compliant() || len(report.Excursions) != 0 {
+					t.Errorf("got excursions %+v, want none", report.Excursions)
+				}
+				return
+			}
+			if report.Compliant() || len(report.Excursions) != 1 {
+				t.Fatalf("got excursions %+v, want one", report.Excursions)
+			}
+
+			got := report.Excursions[0]
+			if got.Kind != test.want.Kind || got.Zone != test.want.Zone || got.Samples != test.want.Samples {
+				t.Errorf("got %s excursion of %s with %d fixes, want %s of %s with %d", got.Kind, got.Zone, got.Samples, test.want.Kind, test.want.Zone, test.want.Samples)
+			}
+			if got.Start != test.want.Start || got.End != test.want.End {
+				t.Errorf("got excursion from %v to %v, want %v to %v", got.Start, got.End, test.want.Start, test.want.End)
+			}
+			// the fitted clock places the fixes within microseconds of their times since boot
+			if duration := got.EndUTC.Sub(got.StartUTC); got.StartUTC.IsZero() || (duration-(got.End-got.Start)).Abs() > time.Millisecond {
+				t.Errorf("got UTC times %v to %v for %v to %v", got.StartUTC, got.EndUTC, got.Start, got.End)
+			}
+			if math.Abs(got.MaxDistance-test.want.MaxDistance) > 0.05 {
+				t.Errorf("got max distance %.3f m, want %.3f m", got.MaxDistance, test.want.MaxDistance)
+			}
+			if math.Abs(got.PeakAltitude-test.want.PeakAltitude) > 1e-3 {
+				t.Errorf("got peak altitude %v, want %v", got.PeakAltitude, test.want.PeakAltitude)
+			}
+		})
+	}
+}
+
+func TestCheckComplianceWithoutArming(t *testing.T) {
+	second := time.Second
+	// no phase is armed, so the log has no arming events
+	data := flightLog(t, fileparser.VehicleCopter, true, []flightPhase{
+		{duration: 2 * second},
+		{duration: 2 * second, north: 300},
+		{duration: 2 * second},
+	})
+
+	report := checkFlight(t, data, testFenceZones(t))
+	if report.ArmingLogged {
+		t.Errorf("got arming logged, want none")
+	}
+	if report.Checked != 30 {
+		t.Errorf("got %d fixes checked, want the whole track of 30", report.Checked)
+	}
+	if report.Compliant() || len(report.Excursions) != 1 || report.Excursions[0].Kind != ExcursionOutside {
+		t.Errorf("got excursions %+v, want one outside", report.Excursions)
+	}
+}
+
+func TestCheckComplianceNothingChecked(t *testing.T) {
+	// armed for a single sample between two GPS fixes
+	data := flightLog(t, fileparser.VehicleCopter, true, []flightPhase{
+		{duration: 1100 * time.Millisecond},
+		{duration: testSamplePeriod, armed: true},
+		{duration: time.Second},
+	})
+
+	report := checkFlight(t, data, testFenceZones(t))
+	if report.Checked != 0 || !report.ArmingLogged {
+		t.Fatalf("got %d fixes checked, arming logged %v", report.Checked, report.ArmingLogged)
+	}
+	if report.Compliant() {
+		t.Errorf("a flight without any fix checked is compliant")
+	}
+	var text bytes.Buffer
+	if err := report.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(text.String(), "NOT CHECKED:") {
+		t.Errorf("got report %q, want NOT CHECKED", text.String())
+	}
+}
+
+func TestCheckComplianceFenceLog(t *testing.T) {
+	const (
+		parmType = 150
+		errType  = 151
+	)
+	builder := binlogtest.NewBuilder()
+	formats := []binlogtest.Format{
+		binlogtest.StandardFormats()[0],
+		{Type: parmType, Name: "PARM", Format: "QNf", Columns: "TimeUS,Name,Value"},
+		{Type: errType, Name: "ERR", Format: "QBB", Columns: "TimeUS,Subsys,ECode"},
+		{Type: testEVType, Name: "EV", Format: "QB", Columns: "TimeUS,Id"},
+		{Type: testMSGType, Name: "MSG", Format: "QZ", Columns: "TimeUS,Message"},
+	}
+	for _, format := range formats {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages := [][]interface{}{
+		{parmType, 1000, "FENCE_ENABLE", 1.0},
+		{parmType, 1000, "FENCE_ALT_MAX", 100.0},
+		{parmType, 1000, "ARMING_CHECK", 1.0},
+		{testEVType, 2000000, testEventArmed},
+		{binlogtest.GPSType, 2000000, 0, 3, 2000, testGPSWeek, 12, 0.8, int(math.Round(testHomeLat * 1e7)), int(math.Round(testHomeLng * 1e7)), 584.0, 0.0, 90.0, 0.0, 0.0, 1},
+		{parmType, 3000000, "FENCE_ALT_MAX", 120.0},
+		{errType, 4000000, 9, 1},
+		{testMSGType, 4000000, "Fence breached"},
+		{testMSGType, 4000000, "Mission: 1 Takeoff"},
+		{testEVType, 5000000, testEventDisarm},
+	}
+	for _, message := range messages {
+		if err := builder.Message(message[0].(int), message[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := checkFlight(t, builder.Bytes(), testFenceZones(t))
+	if fmt.Sprint(report.FenceParameters) != "map[FENCE_ALT_MAX:120 FENCE_ENABLE:1]" {
+		t.Errorf("got fence parameters %v", report.FenceParameters)
+	}
+	names := []string{}
+	for _, event := range report.FenceEvents {
+		names = append(names, fmt.Sprintf("%s@%v", event.Name, event.Time))
+	}
+	if fmt.Sprint(names) != "[FAILSAFE_FENCE@4s Fence breached@4s]" {
+		t.Errorf("got fence events %v", names)
+	}
+	if report.Checked != 1 || !report.Compliant() {
+		t.Errorf("got %d fixes checked and excursions %+v, want one compliant fix", report.Checked, report.Excursions)
+	}
+}
+
+func TestCheckComplianceLeavesZonesAlone(t *testing.T) {
+	second := time.Second
+	data := flightLog(t, fileparser.VehicleCopter, true, []flightPhase{
+		{duration: second},
+		{duration: 2 * second, armed: true, throttle: 0.1},
+		{duration: 10 * second, armed: true, throttle: 0.5, alt: 10},
+		{duration: 3 * second, armed: true, throttle: 0.1},
+		{duration: second},
+	})
+	zones := testFenceZones(t)
+
+	const checks = 4
+	reports := make([]*ComplianceReport, checks)
+	errs := make([]error, checks)
+	var wait sync.WaitGroup
+	for i := 0; i < checks; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			reports[i], errs[i] = CheckCompliance(reader, zones)
+		}(i)
+	}
+	wait.Wait()
+
+	for i := 0; i < checks; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if len(reports[i].Excursions) != 1 || reports[i].Excursions[0].Kind != ExcursionAltitude {
+			t.Errorf("check %d: got excursions %+v, want one altitude excursion", i, reports[i].Excursions)
+		}
+	}
+	if !zones[0].projected.IsEmpty() {
+		t.Errorf("CheckCompliance projected the caller's zones")
+	}
+}
@@ -0,0 +1,239 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+)
+
+/*
+This code extracts the uploaded mission from the CMD messages of a log. ArduPilot logs a CMD message
+for every mission item when the mission is written, with the item number (CNum), the mission size
+(CTot), the MAV_CMD command id, its parameters and its position. Item 0 is the home position. When
+the mission is uploaded again during the log, the items of the latest upload replace the earlier
+ones. The mission can be written as a QGroundControl .plan, a Mission Planner .waypoints or a GeoJSON
+file by mission_export.go.
+*/
+
+const (
+	missionCommandMessage = "CMD"
+	homeSequence          = 0
+)
+
+// MAV_FRAME values used by mission items
+const (
+	FrameGlobal            = 0
+	FrameGlobalRelativeAlt = 3
+	FrameGlobalTerrainAlt  = 10
+)
+
+// MAV_CMD ids of the mission commands ArduPilot supports
+var missionCommandNames = map[int]string{
+	16:   "NAV_WAYPOINT",
+	17:   "NAV_LOITER_UNLIM",
+	18:   "NAV_LOITER_TURNS",
+	19:   "NAV_LOITER_TIME",
+	20:   "NAV_RETURN_TO_LAUNCH",
+	21:   "NAV_LAND",
+	22:   "NAV_TAKEOFF",
+	30:   "NAV_CONTINUE_AND_CHANGE_ALT",
+	31:   "NAV_LOITER_TO_ALT",
+	82:   "NAV_SPLINE_WAYPOINT",
+	83:   "NAV_ALTITUDE_WAIT",
+	84:   "NAV_VTOL_TAKEOFF",
+	85:   "NAV_VTOL_LAND",
+	92:   "NAV_GUIDED_ENABLE",
+	93:   "NAV_DELAY",
+	94:   "NAV_PAYLOAD_PLACE",
+	112:  "CONDITION_DELAY",
+	113:  "CONDITION_CHANGE_ALT",
+	114:  "CONDITION_DISTANCE",
+	115:  "CONDITION_YAW",
+	177:  "DO_JUMP",
+	178:  "DO_CHANGE_SPEED",
+	179:  "DO_SET_HOME",
+	181:  "DO_SET_RELAY",
+	182:  "DO_REPEAT_RELAY",
+	183:  "DO_SET_SERVO",
+	184:  "DO_REPEAT_SERVO",
+	189:  "DO_LAND_START",
+	191:  "DO_GO_AROUND",
+	201:  "DO_SET_ROI",
+	202:  "DO_DIGICAM_CONFIGURE",
+	203:  "DO_DIGICAM_CONTROL",
+	205:  "DO_MOUNT_CONTROL",
+	206:  "DO_SET_CAM_TRIGG_DIST",
+	207:  "DO_FENCE_ENABLE",
+	208:  "DO_PARACHUTE",
+	211:  "DO_GRIPPER",
+	212:  "DO_AUTOTUNE_ENABLE",
+	213:  "NAV_SET_YAW_SPEED",
+	214:  "DO_SET_CAM_TRIGG_INTERVAL",
+	222:  "DO_GUIDED_LIMITS",
+	223:  "DO_ENGINE_CONTROL",
+	2500: "VIDEO_START_CAPTURE",
+	2501: "VIDEO_STOP_CAPTURE",
+	3000: "DO_VTOL_TRANSITION",
+}
+
+// MAV_CMD ids of the navigation commands without a position of their own
+var positionlessNavCommands = map[int]bool{
+	20: true, // NAV_RETURN_TO_LAUNCH
+	92: true, // NAV_GUIDED_ENABLE
+	93: true, // NAV_DELAY
+}
+
+// first MAV_CMD id that is not a navigation command
+const firstNonNavCommand = 100
+
+// MissionItem is a single mission command
+type MissionItem struct {
+	Seq         int
+	Command     int
+	CommandName string
+	Frame       int // MAV_FRAME of the altitude; when the log does not record it, FrameGlobal for home and FrameGlobalRelativeAlt otherwise
+	Params      [4]float64
+	Lat         float64
+	Lng         float64
+	Alt         float64
+	Logged      time.Duration // time since boot of the CMD message
+}
+
+// Mission is the mission uploaded to the vehicle, with the home position as item 0
+type Mission struct {
+	Items []MissionItem
+}
+
+// IsNavigation reports whether the item is a navigation command the vehicle flies to
+func (item MissionItem) IsNavigation() bool {
+	return item.Command < firstNonNavCommand && !positionlessNavCommands[item.Command] && (item.Lat != 0 || item.Lng != 0)
+}
+
+// MissionCommandString returns the name of a MAV_CMD id
+func MissionCommandString(command int) string {
+	if name, ok := missionCommandNames[command]; ok {
+		return name
+	}
+	return fmt.Sprintf("Command(%d)", command)
+}
+
+// ExtractMission reads the whole log and returns the latest mission written to the vehicle. The
+// reader is rewound before and after.
+func ExtractMission(reader *fileparser.BinaryDataFileReader) (*Mission, error) {
+	reader.Rewind()
+	defer reader.Rewind()
+
+	items := map[int]MissionItem{}
+	total := 0
+	var lastTime time.Duration
+
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log: %w", err)
+		}
+		if bootUS, ok := message.TimeUS(); ok {
+			lastTime = time.Duration(bootUS) * time.Microsecond
+		}
+		if message.GetType() != missionCommandMessage {
+			continue
+		}
+
+		item, itemTotal, ok := missionItem(message)
+		if !ok {
+			continue
+		}
+		item.Logged = lastTime
+		items[item.Seq] = item
+		total = itemTotal
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no mission (CMD) messages found in log")
+	}
+
+	mission := &Mission{Items: []MissionItem{}}
+	for _, item := range items {
+		// items beyond the size of the latest upload belong to an earlier, longer mission
+		if total > 0 && item.Seq >= total {
+			continue
+		}
+		mission.Items = append(mission.Items, item)
+	}
+	sort.Slice(mission.Items, func(i, j int) bool { return mission.Items[i].Seq < mission.Items[j].Seq })
+	return mission, nil
+}
+
+// decodes a CMD message. Copter 3.x logs COpt and a single Prm1, newer firmware logs Prm1 to Prm4
+// and the Frame. The home altitude is above mean sea level, so home is in FrameGlobal when the log
+// has no Frame.
+func missionItem(message *fileparser.DataFileMessage) (MissionItem, int, bool) {
+	seq, ok := numberAttribute(message, "CNum")
+	if !ok {
+		return MissionItem{}, 0, false
+	}
+	command, _ := numberAttribute(message, "CId")
+	total, _ := numberAttribute(message, "CTot")
+
+	item := MissionItem{
+		Seq:         int(seq),
+		Command:     int(command),
+		CommandName: MissionCommandString(int(command)),
+		Frame:       FrameGlobalRelativeAlt,
+	}
+	for i, field := range []string{"Prm1", "Prm2", "Prm3", "Prm4"} {
+		item.Params[i], _ = numberAttribute(message, field)
+	}
+	if item.Seq == homeSequence {
+		item.Frame = FrameGlobal
+	}
+	if frame, ok := numberAttribute(message, "Frame"); ok {
+		item.Frame = int(frame)
+	}
+	item.Lat, _ = degreesAttribute(message, "Lat")
+	item.Lng, _ = degreesAttribute(message, "Lng")
+	item.Alt, _ = numberAttribute(message, "Alt")
+	return item, int(total), true
+}
+
+// returns a latitude or longitude in degrees. 'L' fields are logged as integers in degrees * 1e7.
+func degreesAttribute(message *fileparser.DataFileMessage, field string) (float64, bool) {
+	value, err := message.GetAttribute(field)
+	if err != nil {
+		return 0, false
+	}
+
+	switch degrees := value.(type) {
+	case int:
+		return float64(degrees) * latLngScale, true
+	case float64:
+		return degrees, true
+	}
+	return 0, false
+}
+
+// Home returns the home position, item 0 of the mission
+func (mission *Mission) Home() (MissionItem, bool) {
+	if len(mission.Items) > 0 && mission.Items[0].Seq == homeSequence {
+		return mission.Items[0], true
+	}
+	return MissionItem{}, false
+}
+
+// NavigationItems returns the items the vehicle flies to, in mission order, excluding home
+func (mission *Mission) NavigationItems() []MissionItem {
+	items := []MissionItem{}
+	for _, item := range mission.Items {
+		if item.Seq != homeSequence && item.IsNavigation() {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,188 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/peterstace/simplefeatures/geom"
+)
+
+/*
+This code writes a mission as a QGroundControl .plan file, a Mission Planner .waypoints file or a
+GeoJSON feature collection. The .plan and .waypoints files can be loaded back into the ground station
+to inspect or fly the mission again. The GeoJSON holds a point for every item with a position and a
+line through the navigation waypoints.
+*/
+
+const (
+	planFileType        = "Plan"
+	planGroundStation   = "telemetry_parser"
+	planVersion         = 1
+	planMissionVersion  = 2
+	planFirmwareArdu    = 3 // MAV_AUTOPILOT_ARDUPILOTMEGA
+	planVehicleGeneric  = 0 // MAV_TYPE_GENERIC
+	planAutoContinue    = true
+	waypointsHeader     = "QGC WPL 110"
+	waypointsPrecision  = 8
+	missionFeaturePoint = "item"
+	missionFeaturePath  = "path"
+)
+
+// planItem is a SimpleItem of a QGroundControl plan
+type planItem struct {
+	AutoContinue bool       `json:"autoContinue"`
+	Command      int        `json:"command"`
+	DoJumpID     int        `json:"doJumpId"`
+	Frame        int        `json:"frame"`
+	Params       [7]float64 `json:"params"`
+	Type         string     `json:"type"`
+}
+
+type planMission struct {
+	CruiseSpeed         float64    `json:"cruiseSpeed"`
+	FirmwareType        int        `json:"firmwareType"`
+	HoverSpeed          float64    `json:"hoverSpeed"`
+	Items               []planItem `json:"items"`
+	PlannedHomePosition [3]float64 `json:"plannedHomePosition"`
+	VehicleType         int        `json:"vehicleType"`
+	Version             int        `json:"version"`
+}
+
+type planGeoFence struct {
+	Circles  []interface{} `json:"circles"`
+	Polygons []interface{} `json:"polygons"`
+	Version  int           `json:"version"`
+}
+
+type planRallyPoints struct {
+	Points  []interface{} `json:"points"`
+	Version int           `json:"version"`
+}
+
+type planFile struct {
+	FileType      string          `json:"fileType"`
+	GeoFence      planGeoFence    `json:"geoFence"`
+	GroundStation string          `json:"groundStation"`
+	Mission       planMission     `json:"mission"`
+	RallyPoints   planRallyPoints `json:"rallyPoints"`
+	Version       int             `json:"version"`
+}
+
+// WritePlan writes the mission as a QGroundControl .plan file. Home is written as the planned home
+// position, the other items as mission items.
+func (mission *Mission) WritePlan(w io.Writer) error {
+	document := planFile{
+		FileType:      planFileType,
+		GeoFence:      planGeoFence{Circles: []interface{}{}, Polygons: []interface{}{}, Version: 2},
+		GroundStation: planGroundStation,
+		Mission: planMission{
+			FirmwareType: planFirmwareArdu,
+			Items:        []planItem{},
+			VehicleType:  planVehicleGeneric,
+			Version:      planMissionVersion,
+		},
+		RallyPoints: planRallyPoints{Points: []interface{}{}, Version: 2},
+		Version:     planVersion,
+	}
+
+	if home, ok := mission.Home(); ok {
+		document.Mission.PlannedHomePosition = [3]float64{home.Lat, home.Lng, home.Alt}
+	}
+	for _, item := range mission.Items {
+		if item.Seq == homeSequence {
+			continue
+		}
+		document.Mission.Items = append(document.Mission.Items, planItem{
+			AutoContinue: planAutoContinue,
+			Command:      item.Command,
+			DoJumpID:     item.Seq,
+			Frame:        item.Frame,
+			Params:       [7]float64{item.Params[0], item.Params[1], item.Params[2], item.Params[3], item.Lat, item.Lng, item.Alt},
+			Type:         "SimpleItem",
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("failed to write mission plan: %v", err)
+	}
+	return nil
+}
+
+// WriteWaypoints writes the mission as a Mission Planner .waypoints file, one tab separated line per
+// item with home as item 0
+func (mission *Mission) WriteWaypoints(w io.Writer) error {
+	var file strings.Builder
+	file.WriteString(waypointsHeader + "\n")
+
+	for _, item := range mission.Items {
+		current := 0
+		if item.Seq == homeSequence {
+			current = 1
+		}
+		fields := []string{strconv.Itoa(item.Seq), strconv.Itoa(current), strconv.Itoa(item.Frame), strconv.Itoa(item.Command)}
+		for _, value := range []float64{item.Params[0], item.Params[1], item.Params[2], item.Params[3], item.Lat, item.Lng, item.Alt} {
+			fields = append(fields, strconv.FormatFloat(value, 'f', waypointsPrecision, 64))
+		}
+		fields = append(fields, "1") // autocontinue
+		file.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+
+	if _, err := io.WriteString(w, file.String()); err != nil {
+		return fmt.Errorf("failed to write mission waypoints: %v", err)
+	}
+	return nil
+}
+
+// WriteGeoJSON writes the mission as a GeoJSON feature collection with a point for every item that
+// has a position and a line string through home and the navigation waypoints
+func (mission *Mission) WriteGeoJSON(w io.Writer) error {
+	features := geom.GeoJSONFeatureCollection{}
+	path := []float64{}
+
+	if home, ok := mission.Home(); ok && (home.Lat != 0 || home.Lng != 0) {
+		path = append(path, home.Lng, home.Lat, home.Alt)
+	}
+	for _, item := range mission.Items {
+		if item.Lat == 0 && item.Lng == 0 {
+			continue
+		}
+
+		point := geom.Coordinates{XY: geom.XY{X: item.Lng, Y: item.Lat}, Z: item.Alt, Type: geom.DimXYZ}.AsPoint()
+		features = append(features, geom.GeoJSONFeature{
+			Geometry: point.AsGeometry(),
+			ID:       item.Seq,
+			Properties: map[string]interface{}{
+				"kind":    missionFeaturePoint,
+				"seq":     item.Seq,
+				"command": item.CommandName,
+				"frame":   item.Frame,
+				"params":  item.Params,
+			},
+		})
+		if item.Seq != homeSequence && item.IsNavigation() {
+			path = append(path, item.Lng, item.Lat, item.Alt)
+		}
+	}
+
+	if len(path) >= 2*3 {
+		line := geom.NewLineString(geom.NewSequence(path, geom.DimXYZ))
+		features = append(features, geom.GeoJSONFeature{
+			Geometry:   line.AsGeometry(),
+			Properties: map[string]interface{}{"kind": missionFeaturePath},
+		})
+	}
+
+	document, err := features.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to write mission GeoJSON: %v", err)
+	}
+	if _, err := w.Write(append(document, '\n')); err != nil {
+		return fmt.Errorf("failed to write mission GeoJSON: %v", err)
+	}
+	return nil
+}
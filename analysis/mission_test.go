@@ -0,0 +1,91 @@
+package analysis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+const testCMDType = 145
+
+// builds a mission from CMD messages of a copter 3.x log, which has no Frame field
+func missionLog(t *testing.T, items [][]interface{}) *Mission {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	format := binlogtest.Format{Type: testCMDType, Name: "CMD", Format: "QHHHfLLf", Columns: "TimeUS,CTot,CNum,CId,Prm1,Lat,Lng,Alt"}
+	if err := builder.Declare(format); err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range items {
+		values := append([]interface{}{1000 * (i + 1), len(items)}, item...)
+		if err := builder.Message(testCMDType, values...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mission, err := ExtractMission(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mission
+}
+
+func TestHomeFrameWithoutFrameField(t *testing.T) {
+	mission := missionLog(t, [][]interface{}{
+		{0, 16, 0, -353632621, 1491652374, 584.0},
+		{1, 16, 0, -353632000, 1491652000, 30.0},
+	})
+	if mission.Items[0].Frame != FrameGlobal || mission.Items[1].Frame != FrameGlobalRelativeAlt {
+		t.Errorf("got frames %d and %d, want %d for home and %d for waypoints", mission.Items[0].Frame, mission.Items[1].Frame, FrameGlobal, FrameGlobalRelativeAlt)
+	}
+
+	output := bytes.Buffer{}
+	if err := mission.WriteWaypoints(&output); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(output.String(), "\n")
+	if fields := strings.Split(lines[1], "\t"); len(fields) < 3 || fields[2] != "0" {
+		t.Errorf("home line %q, want frame 0", lines[1])
+	}
+}
+
+func TestFlownWaypointsFollowJumps(t *testing.T) {
+	waypoint := func(seq int) MissionItem {
+		return MissionItem{Seq: seq, Command: 16, Lat: -35 + float64(seq)*1e-3, Lng: 149}
+	}
+	jump := func(seq int, target float64, repeat float64) MissionItem {
+		return MissionItem{Seq: seq, Command: commandDoJump, Params: [4]float64{target, repeat}}
+	}
+	tests := []struct {
+		name  string
+		items []MissionItem
+		want  []int
+	}{
+		{"no jump", []MissionItem{waypoint(0), waypoint(1), waypoint(2)}, []int{1, 2}},
+		{"repeat twice", []MissionItem{waypoint(0), waypoint(1), waypoint(2), jump(3, 1, 2), waypoint(4)}, []int{1, 2, 1, 2, 1, 2, 4}},
+		{"repeat forever", []MissionItem{waypoint(0), waypoint(1), waypoint(2), jump(3, 2, -1), waypoint(4)}, []int{1, 2, 2, 4}},
+		{"missing target", []MissionItem{waypoint(0), waypoint(1), jump(2, 9, 3), waypoint(3)}, []int{1, 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []int{}
+			for _, item := range flownWaypoints(&Mission{Items: test.items}) {
+				got = append(got, item.Seq)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	reportTimeFormat = "2006-01-02 15:04:05 UTC"
+	notAvailable     = "n/a"
+)
+
+// summaryPointJSON is the JSON form of a SummaryPoint
+type summaryPointJSON struct {
+	BootTime float64  `json:"boot_time_s"`
+	UTC      *string  `json:"utc,omitempty"`
+	Lat      *float64 `json:"lat,omitempty"`
+	Lng      *float64 `json:"lng,omitempty"`
+	Alt      *float64 `json:"alt,omitempty"`
+}
+
+type modeUsageJSON struct {
+	Mode     string  `json:"mode"`
+	Duration float64 `json:"duration_s"`
+	Count    int     `json:"count"`
+}
+
+type gpsStatsJSON struct {
+	Messages       int     `json:"messages"`
+	Fixes          int     `json:"fixes"`
+	MinSatellites  int     `json:"min_satellites"`
+	MaxSatellites  int     `json:"max_satellites"`
+	MeanSatellites float64 `json:"mean_satellites"`
+	MeanHDop       float64 `json:"mean_hdop"`
+	MaxHDop        float64 `json:"max_hdop"`
+}
+
+// flightSummaryJSON is the JSON form of a FlightSummary, with durations in seconds and UTC times
+// in RFC 3339
+type flightSummaryJSON struct {
+	Vehicle             string            `json:"vehicle"`
+	MavType             string            `json:"mav_type"`
+	Firmware            string            `json:"firmware"`
+	GitHash             string            `json:"git_hash"`
+	Board               string            `json:"board"`
+	Frame               string            `json:"frame"`
+	Takeoff             *summaryPointJSON `json:"takeoff"`
+	Landing             *summaryPointJSON `json:"landing"`
+	FlightTime          float64           `json:"flight_time_s"`
+	Distance            float64           `json:"distance_m"`
+	MaxAltitude         float64           `json:"max_altitude_m"`
+	MaxRelativeAltitude float64           `json:"max_relative_altitude_m"`
+	MaxGroundSpeed      float64           `json:"max_ground_speed_ms"`
+	MaxClimbRate        float64           `json:"max_climb_rate_ms"`
+	BatteryConsumed     float64           `json:"battery_consumed_mah"`
+	MinVoltage          float64           `json:"min_voltage_v"`
+	Modes               []modeUsageJSON   `json:"modes"`
+	GPS                 gpsStatsJSON      `json:"gps"`
+	Errors              int               `json:"errors"`
+	Warnings            int               `json:"warnings"`
+}
+
+// WriteJSON writes the summary as an indented JSON document
+func (summary *FlightSummary) WriteJSON(w io.Writer) error {
+	document := flightSummaryJSON{
+		Vehicle:             summary.Vehicle,
+		MavType:             summary.MavType,
+		Firmware:            summary.Firmware,
+		GitHash:             summary.GitHash,
+		Board:               summary.Board,
+		Frame:               summary.Frame,
+		Takeoff:             pointJSON(summary.Takeoff),
+		Landing:             pointJSON(summary.Landing),
+		FlightTime:          summary.FlightTime.Seconds(),
+		Distance:            summary.Distance,
+		MaxAltitude:         summary.MaxAltitude,
+		MaxRelativeAltitude: summary.MaxRelativeAltitude,
+		MaxGroundSpeed:      summary.MaxGroundSpeed,
+		MaxClimbRate:        summary.MaxClimbRate,
+		BatteryConsumed:     summary.BatteryConsumed,
+		MinVoltage:          summary.MinVoltage,
+		Modes:               []modeUsageJSON{},
+		GPS:                 gpsStatsJSON(summary.GPS),
+		Errors:              summary.Errors,
+		Warnings:            summary.Warnings,
+	}
+	for _, mode := range summary.Modes {
+		document.Modes = append(document.Modes, modeUsageJSON{Mode: mode.Mode, Duration: mode.Duration.Seconds(), Count: mode.Count})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Errorf("failed to write flight summary: %v", err)
+	}
+	return nil
+}
+
+func pointJSON(point *SummaryPoint) *summaryPointJSON {
+	if point == nil {
+		return nil
+	}
+
+	document := &summaryPointJSON{BootTime: point.BootTime.Seconds()}
+	if !point.UTC.IsZero() {
+		utc := point.UTC.Format(time.RFC3339Nano)
+		document.UTC = &utc
+	}
+	if point.HasPosition {
+		document.Lat, document.Lng, document.Alt = &point.Lat, &point.Lng, &point.Alt
+	}
+	return document
+}
+
+// reportRow is a label and value line of the Markdown and HTML reports
+type reportRow struct {
+	Label string
+	Value string
+}
+
+// returns the summary as label and value rows, shared by the Markdown and HTML reports
+func (summary *FlightSummary) reportRows() []reportRow {
+	return []reportRow{
+		{"Vehicle", orNotAvailable(summary.Vehicle)},
+		{"Vehicle type", summary.MavType},
+		{"Firmware", orNotAvailable(strings.TrimSpace(summary.Firmware + " " + summary.GitHash))},
+		{"Board", orNotAvailable(summary.Board)},
+		{"Frame", orNotAvailable(summary.Frame)},
+		{"Takeoff", formatPoint(summary.Takeoff)},
+		{"Landing", formatPoint(summary.Landing)},
+		{"Flight time", summary.FlightTime.Round(time.Second).String()},
+		{"Distance flown", fmt.Sprintf("%.0f m", summary.Distance)},
+		{"Max altitude (AMSL)", fmt.Sprintf("%.1f m", summary.MaxAltitude)},
+		{"Max altitude above takeoff", fmt.Sprintf("%.1f m", summary.MaxRelativeAltitude)},
+		{"Max ground speed", fmt.Sprintf("%.1f m/s", summary.MaxGroundSpeed)},
+		{"Max climb rate", fmt.Sprintf("%.1f m/s", summary.MaxClimbRate)},
+		{"Battery consumed", fmt.Sprintf("%.0f mAh", summary.BatteryConsumed)},
+		{"Min voltage", formatVoltage(summary.MinVoltage)},
+		{"GPS fixes", fmt.Sprintf("%d of %d messages", summary.GPS.Fixes, summary.GPS.Messages)},
+		{"Satellites", fmt.Sprintf("min %d, mean %.1f, max %d", summary.GPS.MinSatellites, summary.GPS.MeanSatellites, summary.GPS.MaxSatellites)},
+		{"HDop", fmt.Sprintf("mean %.2f, max %.2f", summary.GPS.MeanHDop, summary.GPS.MaxHDop)},
+		{"Errors", fmt.Sprint(summary.Errors)},
+		{"Warnings", fmt.Sprint(summary.Warnings)},
+	}
+}
+
+// WriteMarkdown writes the summary as a Markdown report
+func (summary *FlightSummary) WriteMarkdown(w io.Writer) error {
+	var report strings.Builder
+	report.WriteString("# Flight summary\n\n| | |\n|---|---|\n")
+	for _, row := range summary.reportRows() {
+		fmt.Fprintf(&report, "| %s | %s |\n", row.Label, escapeMarkdown(row.Value))
+	}
+
+	report.WriteString("\n## Flight modes\n\n| Mode | Time | Entered |\n|---|---|---|\n")
+	for _, mode := range summary.modesByDuration() {
+		fmt.Fprintf(&report, "| %s | %s | %d |\n", mode.Mode, mode.Duration.Round(time.Second), mode.Count)
+	}
+
+	if _, err := io.WriteString(w, report.String()); err != nil {
+		return fmt.Errorf("failed to write flight summary: %v", err)
+	}
+	return nil
+}
+
+var htmlReport = template.Must(template.New("summary").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Flight summary</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #f0f0f0; }
+</style>
+</head>
+<body>
+<h1>Flight summary</h1>
+<table>
+{{- range .Rows}}
+<tr><th>{{.Label}}</th><td>{{.Value}}</td></tr>
+{{- end}}
+</table>
+<h2>Flight modes</h2>
+<table>
+<tr><th>Mode</th><th>Time</th><th>Entered</th></tr>
+{{- range .Modes}}
+<tr><td>{{.Mode}}</td><td>{{.Duration}}</td><td>{{.Count}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes the summary as a standalone HTML report
+func (summary *FlightSummary) WriteHTML(w io.Writer) error {
+	modes := []ModeUsage{}
+	for _, mode := range summary.modesByDuration() {
+		mode.Duration = mode.Duration.Round(time.Second)
+		modes = append(modes, mode)
+	}
+
+	data := struct {
+		Rows  []reportRow
+		Modes []ModeUsage
+	}{summary.reportRows(), modes}
+
+	if err := htmlReport.Execute(w, data); err != nil {
+		return fmt.Errorf("failed to write flight summary: %v", err)
+	}
+	return nil
+}
+
+func formatPoint(point *SummaryPoint) string {
+	if point == nil {
+		return notAvailable
+	}
+
+	parts := []string{}
+	if !point.UTC.IsZero() {
+		parts = append(parts, point.UTC.Format(reportTimeFormat))
+	} else {
+		parts = append(parts, fmt.Sprintf("%s after boot", point.BootTime.Round(time.Millisecond)))
+	}
+	if point.HasPosition {
+		parts = append(parts, fmt.Sprintf("%.6f, %.6f, %.1f m", point.Lat, point.Lng, point.Alt))
+	}
+	return strings.Join(parts, " at ")
+}
+
+func formatVoltage(volts float64) string {
+	if volts == 0 {
+		return notAvailable
+	}
+	return fmt.Sprintf("%.2f V", volts)
+}
+
+func orNotAvailable(value string) string {
+	if value == "" {
+		return notAvailable
+	}
+	return value
+}
+
+// escapes the characters that would break a Markdown table cell
+func escapeMarkdown(value string) string {
+	return strings.ReplaceAll(value, "|", `\|`)
+}
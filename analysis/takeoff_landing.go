@@ -0,0 +1,333 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+)
+
+/*
+This code detects takeoffs and landings from the sensor data instead of the LAND_COMPLETE and
+NOT_LANDED events, which older firmware and PX4 logs do not record. While the vehicle is armed it is
+considered flying once the throttle is above a minimum and it has climbed from its ground altitude,
+is moving over the ground or its accelerometers show the vibration of flight. It is considered
+landed once it is disarmed, or once it is back at its ground altitude, not moving and either
+vibrating no more or at low throttle, for a while. Low throttle alone does not land it, as a plane
+glides at idle. Logs without a throttle source, such as Copter logs without CTUN, rely on the
+altitude, ground speed and vibration alone. The ground altitude is the barometric altitude last
+seen on the ground, so baro drift between flights does not accumulate.
+*/
+
+// takeoff and landing event kinds
+const (
+	DetectedTakeoff = "takeoff"
+	DetectedLanding = "landing"
+)
+
+const (
+	pwmMinimum         = 1000.0
+	pwmRange           = 1000.0
+	permilleScale      = 1000.0
+	percentScale       = 100.0
+	minimumAccelWindow = 2
+)
+
+// DetectorOptions holds the thresholds of the takeoff and landing detector
+type DetectorOptions struct {
+	// MinThrottle is the throttle output, from 0 to 1, above which the vehicle may be flying.
+	MinThrottle float64
+	// ClimbAltitude is the barometric climb in meters above the ground altitude that shows the
+	// vehicle has left the ground.
+	ClimbAltitude float64
+	// MinGroundSpeed is the GPS ground speed in m/s that shows the vehicle is flying, for vehicles
+	// that take off without climbing much such as planes.
+	MinGroundSpeed float64
+	// AccelVariance is the variance of the accelerometer magnitude in (m/s²)² over AccelWindow
+	// above which the vehicle is considered flying. Spinning propellers on the ground stay below it.
+	AccelVariance float64
+	AccelWindow   time.Duration
+	// LandedDuration is how long the ground conditions must hold before a landing is reported.
+	LandedDuration time.Duration
+	// Vehicle is the firmware family of the log, e.g. fileparser.VehiclePlane, which selects how
+	// the throttle is logged. DetectTakeoffsAndLandings takes it from the log when it is empty.
+	Vehicle string
+}
+
+// DefaultDetectorOptions returns thresholds suited to small multirotors and planes
+func DefaultDetectorOptions() DetectorOptions {
+	return DetectorOptions{
+		MinThrottle:    0.15,
+		ClimbAltitude:  0.5,
+		MinGroundSpeed: 3.0,
+		AccelVariance:  0.25,
+		AccelWindow:    time.Second,
+		LandedDuration: 2 * time.Second,
+	}
+}
+
+// DetectedEvent is a takeoff or landing found by the detector
+type DetectedEvent struct {
+	Kind        string        // DetectedTakeoff or DetectedLanding
+	Time        time.Duration // time since boot
+	UTC         time.Time     // zero when the log has no GPS time yet
+	Lat         float64
+	Lng         float64
+	Alt         float64
+	HasPosition bool
+}
+
+// accelSample is an accelerometer magnitude at a time since boot
+type accelSample struct {
+	time      time.Duration
+	magnitude float64
+}
+
+// TakeoffLandingDetector tracks the sensor state of a log and reports takeoffs and landings
+type TakeoffLandingDetector struct {
+	options DetectorOptions
+
+	flying         bool
+	throttle       float64
+	hasThrottle    bool
+	hasCTUN        bool
+	baroAlt        float64
+	groundAlt      float64
+	hasBaro        bool
+	groundSpeed    float64
+	accel          []accelSample
+	groundSince    time.Duration // start of the current ground conditions while flying, -1 when not on the ground
+	lastTime       time.Duration
+	lastUTC        time.Time // UTC time of lastTime, zero while the log has no GPS time
+	lat, lng, alt  float64
+	hasPosition    bool
+	detectedEvents []DetectedEvent
+}
+
+// NewTakeoffLandingDetector creates a detector with the given thresholds
+func NewTakeoffLandingDetector(options DetectorOptions) *TakeoffLandingDetector {
+	return &TakeoffLandingDetector{options: options, groundSince: -1, detectedEvents: []DetectedEvent{}}
+}
+
+// DetectTakeoffsAndLandings reads the whole log and returns its takeoffs and landings in order. The
+// reader is rewound before and after.
+func DetectTakeoffsAndLandings(reader *fileparser.BinaryDataFileReader, options DetectorOptions) ([]DetectedEvent, error) {
+	reader.Rewind()
+	defer reader.Rewind()
+
+	if options.Vehicle == "" {
+		options.Vehicle = reader.VehicleInfo().Vehicle
+	}
+
+	detector := NewTakeoffLandingDetector(options)
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log: %w", err)
+		}
+		detector.Update(message, reader.Armed())
+	}
+	return detector.Events(), nil
+}
+
+// Events returns the takeoffs and landings detected so far
+func (detector *TakeoffLandingDetector) Events() []DetectedEvent {
+	return detector.detectedEvents
+}
+
+// Update records the sensor values of a message and checks for a takeoff or landing. armed is the
+// arming state of the vehicle after the message.
+func (detector *TakeoffLandingDetector) Update(message *fileparser.DataFileMessage, armed bool) {
+	if bootUS, ok := message.TimeUS(); ok {
+		detector.lastTime = time.Duration(bootUS) * time.Microsecond
+		detector.lastUTC, _ = message.UTC()
+	}
+
+	switch message.GetType() {
+	case fileparser.MsgTypeGPS:
+		if lat, lng, alt, ok := fileparser.GPSFixPosition(message); ok {
+			detector.lat, detector.lng, detector.alt, detector.hasPosition = lat, lng, alt, true
+		}
+		if speed, ok := numberAttribute(message, "Spd"); ok {
+			detector.groundSpeed = speed
+		}
+	case "BARO":
+		if alt, ok := numberAttribute(message, "Alt"); ok {
+			detector.baroAlt = alt
+			if !detector.hasBaro {
+				detector.groundAlt = alt
+			}
+			detector.hasBaro = true
+		}
+	case "CTUN":
+		if throttle, ok := ctunThrottle(message, detector.options.Vehicle); ok {
+			detector.throttle = throttle
+			detector.hasThrottle = true
+			detector.hasCTUN = true
+		}
+	case "RCOU":
+		if detector.hasCTUN {
+			break
+		}
+		if throttle, ok := rcouThrottle(message, detector.options.Vehicle); ok {
+			detector.throttle = throttle
+			detector.hasThrottle = true
+		}
+	case "IMU":
+		detector.addAccel(message)
+	}
+
+	detector.evaluate(armed)
+}
+
+// checks the sensor state for a takeoff while on the ground, or a landing while flying
+func (detector *TakeoffLandingDetector) evaluate(armed bool) {
+	options := detector.options
+	climbed := detector.hasBaro && detector.baroAlt-detector.groundAlt >= options.ClimbAltitude
+	moving := detector.groundSpeed >= options.MinGroundSpeed
+	vibrating := detector.accelVariance() >= options.AccelVariance
+	// without a throttle source the other conditions decide
+	throttleUp := !detector.hasThrottle || detector.throttle >= options.MinThrottle
+
+	if !detector.flying {
+		// follow the baro drift while on the ground
+		if detector.hasBaro && !climbed {
+			detector.groundAlt = math.Min(detector.groundAlt, detector.baroAlt)
+			if !armed {
+				detector.groundAlt = detector.baroAlt
+			}
+		}
+
+		if armed && throttleUp && (climbed || moving || vibrating) {
+			detector.flying = true
+			detector.groundSince = -1
+			detector.emit(DetectedTakeoff, detector.lastTime)
+		}
+		return
+	}
+
+	if !armed {
+		landedAt := detector.lastTime
+		if detector.groundSince >= 0 {
+			landedAt = detector.groundSince
+		}
+		detector.land(landedAt)
+		return
+	}
+
+	// spinning propellers vibrate on the ground, a gliding plane at idle is still flying
+	onGround := !climbed && !moving && (!throttleUp || !vibrating)
+	switch {
+	case !onGround:
+		detector.groundSince = -1
+	case detector.groundSince < 0:
+		detector.groundSince = detector.lastTime
+	case detector.lastTime-detector.groundSince >= options.LandedDuration:
+		detector.land(detector.groundSince)
+	}
+}
+
+func (detector *TakeoffLandingDetector) land(at time.Duration) {
+	detector.flying = false
+	detector.groundSince = -1
+	detector.groundAlt = detector.baroAlt
+	detector.emit(DetectedLanding, at)
+}
+
+func (detector *TakeoffLandingDetector) emit(kind string, at time.Duration) {
+	detector.detectedEvents = append(detector.detectedEvents, DetectedEvent{
+		Kind:        kind,
+		Time:        at,
+		UTC:         detector.utcAt(at),
+		Lat:         detector.lat,
+		Lng:         detector.lng,
+		Alt:         detector.alt,
+		HasPosition: detector.hasPosition,
+	})
+}
+
+// returns the UTC time of a time since boot at or before the last message
+func (detector *TakeoffLandingDetector) utcAt(at time.Duration) time.Time {
+	if detector.lastUTC.IsZero() {
+		return time.Time{}
+	}
+	return detector.lastUTC.Add(at - detector.lastTime)
+}
+
+// adds the accelerometer magnitude of an IMU message to the variance window
+func (detector *TakeoffLandingDetector) addAccel(message *fileparser.DataFileMessage) {
+	x, okX := numberAttribute(message, "AccX")
+	y, okY := numberAttribute(message, "AccY")
+	z, okZ := numberAttribute(message, "AccZ")
+	if !okX || !okY || !okZ {
+		return
+	}
+
+	detector.accel = append(detector.accel, accelSample{time: detector.lastTime, magnitude: math.Sqrt(x*x + y*y + z*z)})
+	start := 0
+	for start < len(detector.accel) && detector.lastTime-detector.accel[start].time > detector.options.AccelWindow {
+		start++
+	}
+	detector.accel = detector.accel[start:]
+}
+
+// returns the variance of the accelerometer magnitude over the window. Logs without IMU messages
+// show no vibration so the other conditions decide.
+func (detector *TakeoffLandingDetector) accelVariance() float64 {
+	if len(detector.accel) < minimumAccelWindow {
+		return 0
+	}
+
+	mean := 0.0
+	for _, sample := range detector.accel {
+		mean += sample.magnitude
+	}
+	mean /= float64(len(detector.accel))
+
+	variance := 0.0
+	for _, sample := range detector.accel {
+		variance += (sample.magnitude - mean) * (sample.magnitude - mean)
+	}
+	return variance / float64(len(detector.accel))
+}
+
+// returns the throttle output of a CTUN message from 0 to 1. Plane and Rover log it in percent,
+// as ThrOut or ThO. Copter 3.x logs ThrOut in permille and newer Copter firmware logs ThO as a
+// fraction; logs of an unknown vehicle are read as Copter logs.
+func ctunThrottle(message *fileparser.DataFileMessage, vehicle string) (float64, bool) {
+	for _, field := range []string{"ThO", "ThrOut"} {
+		throttle, ok := numberAttribute(message, field)
+		if !ok {
+			continue
+		}
+		switch {
+		case vehicle == fileparser.VehiclePlane || vehicle == fileparser.VehicleRover:
+			return throttle / percentScale, true
+		case field == "ThrOut":
+			return throttle / permilleScale, true
+		}
+		return throttle, true
+	}
+	return 0, false
+}
+
+// returns the throttle output from the PWM of the throttle channel of an RCOU message, from 0 to 1.
+// Only Plane and Rover drive the throttle from channel 3; on a multirotor it drives a motor, so
+// other vehicles rely on CTUN.
+func rcouThrottle(message *fileparser.DataFileMessage, vehicle string) (float64, bool) {
+	if vehicle != fileparser.VehiclePlane && vehicle != fileparser.VehicleRover {
+		return 0, false
+	}
+	for _, field := range []string{"C3", "Chan3"} {
+		if pwm, ok := numberAttribute(message, field); ok && pwm > 0 {
+			return math.Max(0, math.Min(1, (pwm-pwmMinimum)/pwmRange)), true
+		}
+	}
+	return 0, false
+}
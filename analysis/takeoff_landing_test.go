@@ -0,0 +1,332 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// message types of the synthetic flight logs
+const (
+	testBAROType = 140
+	testCTUNType = 141
+	testRCOUType = 142
+	testEVType   = 143
+	testMSGType  = 144
+)
+
+const (
+	testSamplePeriod = 100 * time.Millisecond
+	testGPSPeriod    = 200 * time.Millisecond
+	testEventArmed   = 10
+	testEventDisarm  = 11
+	testGPSWeek      = 2200
+	testHomeLat      = -35.3632621
+	testHomeLng      = 149.1652374
+)
+
+// flightPhase is a part of a synthetic flight, held for its duration
+type flightPhase struct {
+	duration time.Duration
+	armed    bool
+	throttle float64 // 0 to 1
+	alt      float64 // barometric altitude above the ground in meters
+	speed    float64 // GPS ground speed in m/s
+	north    float64 // GPS position in meters north of home
+}
+
+// flightLog builds a log of a vehicle flying the phases, logging BARO, RCOU and CTUN at 10 Hz and
+// GPS at 5 Hz. The banner names the vehicle and the throttle is logged the way it logs it.
+func flightLog(t *testing.T, vehicle string, withCTUN bool, phases []flightPhase) []byte {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	formats := []binlogtest.Format{
+		binlogtest.StandardFormats()[0],
+		{Type: testBAROType, Name: "BARO", Format: "Qf", Columns: "TimeUS,Alt"},
+		{Type: testCTUNType, Name: "CTUN", Format: "Qf", Columns: "TimeUS,ThO"},
+		{Type: testRCOUType, Name: "RCOU", Format: "QHHHH", Columns: "TimeUS,C1,C2,C3,C4"},
+		{Type: testEVType, Name: "EV", Format: "QB", Columns: "TimeUS,Id"},
+		{Type: testMSGType, Name: "MSG", Format: "QZ", Columns: "TimeUS,Message"},
+	}
+	for _, format := range formats {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(builder.Message(testMSGType, 0, vehicle+" V4.3.0 (12345678)"))
+
+	at := time.Second
+	armed := false
+	for _, phase := range phases {
+		if phase.armed != armed {
+			id := testEventDisarm
+			if phase.armed {
+				id = testEventArmed
+			}
+			check(builder.Message(testEVType, int(at.Microseconds()), id))
+			armed = phase.armed
+		}
+
+		for end := at + phase.duration; at < end; at += testSamplePeriod {
+			timeUS := int(at.Microseconds())
+			check(builder.Message(testBAROType, timeUS, phase.alt))
+
+			ctun := phase.throttle
+			if vehicle == fileparser.VehiclePlane {
+				ctun *= percentScale
+			}
+			if withCTUN {
+				check(builder.Message(testCTUNType, timeUS, ctun))
+			}
+			pwm := int(pwmMinimum + phase.throttle*pwmRange)
+			check(builder.Message(testRCOUType, timeUS, pwm, pwm, pwm, pwm))
+
+			if at%testGPSPeriod == 0 {
+				towMS := int(at.Milliseconds())
+				lat := testHomeLat + phase.north/(degreesToRadians*earthRadiusMeters)
+				check(builder.Message(binlogtest.GPSType, timeUS, 0, 3, towMS, testGPSWeek, 12, 0.8,
+					int(math.Round(lat*1e7)), int(math.Round(testHomeLng*1e7)), 584.0+phase.alt, phase.speed, 90.0, 0.0, 0.0, 1))
+			}
+		}
+	}
+	return builder.Bytes()
+}
+
+func TestDetectTakeoffsAndLandings(t *testing.T) {
+	second := time.Second
+	tests := []struct {
+		name     string
+		vehicle  string
+		withCTUN bool
+		phases   []flightPhase
+		want     []string // kind@time since boot
+	}{
+		{
+			name:     "copter flight",
+			vehicle:  fileparser.VehicleCopter,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true, throttle: 0.1},
+				{duration: 10 * second, armed: true, throttle: 0.5, alt: 10},
+				{duration: 3 * second, armed: true, throttle: 0.1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@14s"},
+		},
+		{
+			name:     "copter landing disarmed at once",
+			vehicle:  fileparser.VehicleCopter,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true, throttle: 0.1},
+				{duration: 10 * second, armed: true, throttle: 0.5, alt: 10},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@14s"},
+		},
+		{
+			name:     "copter bounce on takeoff",
+			vehicle:  fileparser.VehicleCopter,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true, throttle: 0.1},
+				{duration: second, armed: true, throttle: 0.5, alt: 2},
+				{duration: second, armed: true, throttle: 0.5},
+				{duration: 10 * second, armed: true, throttle: 0.5, alt: 10},
+				{duration: 3 * second, armed: true, throttle: 0.1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@16s"},
+		},
+		{
+			name:     "copter lands and takes off again while armed",
+			vehicle:  fileparser.VehicleCopter,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true, throttle: 0.1},
+				{duration: 5 * second, armed: true, throttle: 0.5, alt: 10},
+				{duration: 3 * second, armed: true, throttle: 0.1},
+				{duration: 5 * second, armed: true, throttle: 0.5, alt: 10},
+				{duration: 3 * second, armed: true, throttle: 0.1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@9s", "takeoff@12s", "landing@17s"},
+		},
+		{
+			name:     "copter without throttle messages",
+			vehicle:  fileparser.VehicleCopter,
+			withCTUN: false,
+			phases: []flightPhase{
+				{duration: second},
+				// the motor outputs are not throttle
+				{duration: 2 * second, armed: true, throttle: 0.9},
+				{duration: 10 * second, armed: true, throttle: 0.9, alt: 10},
+				{duration: 3 * second, armed: true, throttle: 0.1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@14s"},
+		},
+		{
+			name:     "plane flight",
+			vehicle:  fileparser.VehiclePlane,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true},
+				{duration: 20 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				{duration: 5 * second, armed: true, speed: 1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@24s"},
+		},
+		{
+			name:     "plane taxiing at 1% throttle",
+			vehicle:  fileparser.VehiclePlane,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 10 * second, armed: true, throttle: 0.01, speed: 5},
+				{duration: second},
+			},
+			want: []string{},
+		},
+		{
+			name:     "plane gliding at idle throttle",
+			vehicle:  fileparser.VehiclePlane,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true},
+				{duration: 10 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				{duration: 5 * second, armed: true, alt: 30, speed: 15},
+				{duration: 10 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				{duration: 5 * second, armed: true, speed: 1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@29s"},
+		},
+		{
+			name:     "plane touch-and-go",
+			vehicle:  fileparser.VehiclePlane,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true},
+				{duration: 10 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				// rolling on the runway at speed before climbing out again
+				{duration: 3 * second, armed: true, throttle: 0.3, speed: 15},
+				{duration: 10 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				{duration: 5 * second, armed: true, speed: 1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@27s"},
+		},
+		{
+			name:     "plane full stop and go",
+			vehicle:  fileparser.VehiclePlane,
+			withCTUN: true,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true},
+				{duration: 10 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				{duration: 3 * second, armed: true, speed: 1},
+				{duration: 10 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				{duration: 5 * second, armed: true, speed: 1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@14s", "takeoff@17s", "landing@27s"},
+		},
+		{
+			name:     "plane throttle from RCOU",
+			vehicle:  fileparser.VehiclePlane,
+			withCTUN: false,
+			phases: []flightPhase{
+				{duration: second},
+				{duration: 2 * second, armed: true},
+				{duration: 20 * second, armed: true, throttle: 0.8, alt: 30, speed: 20},
+				{duration: 5 * second, armed: true, speed: 1},
+				{duration: second},
+			},
+			want: []string{"takeoff@4s", "landing@24s"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := flightLog(t, test.vehicle, test.withCTUN, test.phases)
+			reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			detected, err := DetectTakeoffsAndLandings(reader, DefaultDetectorOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, event := range detected {
+				got = append(got, fmt.Sprintf("%s@%v", event.Kind, event.Time.Round(time.Second)))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCTUNThrottleScale(t *testing.T) {
+	tests := []struct {
+		vehicle string
+		field   string
+		value   float64
+		want    float64
+	}{
+		{fileparser.VehicleCopter, "ThO", 0.5, 0.5},
+		{fileparser.VehicleCopter, "ThrOut", 500, 0.5},
+		{fileparser.VehiclePlane, "ThO", 1, 0.01},
+		{fileparser.VehiclePlane, "ThrOut", 50, 0.5},
+		{fileparser.VehicleRover, "ThO", 20, 0.2},
+		{"", "ThO", 0.3, 0.3},
+	}
+
+	for _, test := range tests {
+		builder := binlogtest.NewBuilder()
+		if err := builder.Declare(binlogtest.Format{Type: testCTUNType, Name: "CTUN", Format: "Qf", Columns: "TimeUS," + test.field}); err != nil {
+			t.Fatal(err)
+		}
+		if err := builder.Message(testCTUNType, 0, test.value); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message *fileparser.DataFileMessage
+		for message == nil || message.GetType() != "CTUN" {
+			if message, err = reader.ParseNext(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, ok := ctunThrottle(message, test.vehicle)
+		if !ok || math.Abs(got-test.want) > 1e-6 {
+			t.Errorf("%s %s=%v: got %v, want %v", test.vehicle, test.field, test.value, got, test.want)
+		}
+	}
+}
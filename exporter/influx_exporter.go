@@ -0,0 +1,361 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+)
+
+/*
+This code exports the numeric columns of every message as time-series points. The InfluxDB line
+protocol output uses the message name as the measurement, the vehicle type, instance and log id as
+tags, and the UTC time of the message in nanoseconds as the timestamp. The Prometheus text
+exposition format holds a single sample per series, so it only carries the last value of every field
+as a snapshot of the end of the log; the history is only available as line protocol.
+*/
+
+const (
+	defaultInfluxBatchSize = 5000
+	defaultHTTPTimeout     = 30 * time.Second
+	influxContentType      = "text/plain; charset=utf-8"
+	influxPrecision        = "ns" // precision of the line protocol timestamps
+	tagVehicle             = "vehicle"
+	tagInstance            = "instance"
+	tagLogID               = "log_id"
+)
+
+// InfluxOptions configures the tags and HTTP behaviour of an InfluxExporter
+type InfluxOptions struct {
+	LogID       string       // value of the log_id tag, omitted when empty
+	VehicleType string       // value of the vehicle tag, defaults to the MavType detected by the reader
+	BatchSize   int          // number of lines sent per HTTP request, defaults to 5000
+	Client      *http.Client // client used by Post, defaults to a client with a 30 second timeout
+	Token       string       // API token sent by Post in the Authorization header, omitted when empty
+}
+
+// InfluxExporter writes the messages of a binary data file as InfluxDB line protocol
+type InfluxExporter struct {
+	reader  *fileparser.BinaryDataFileReader
+	options InfluxOptions
+}
+
+// timeSeriesPoint is a single message reduced to its tags, numeric fields and timestamp
+type timeSeriesPoint struct {
+	measurement string
+	tags        [][2]string
+	fields      [][2]string
+	timestamp   int64 // nanoseconds since the Unix epoch
+}
+
+// NewInfluxExporter creates a new exporter for the messages read by the given reader
+func NewInfluxExporter(reader *fileparser.BinaryDataFileReader, options InfluxOptions) *InfluxExporter {
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultInfluxBatchSize
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	return &InfluxExporter{
+		reader:  reader,
+		options: options,
+	}
+}
+
+// Export writes every message with at least one numeric field to w as InfluxDB line protocol
+func (exporter *InfluxExporter) Export(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	err := exporter.eachPoint(func(point timeSeriesPoint) error {
+		_, err := buffered.WriteString(point.lineProtocol())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// ExportPrometheus writes the last value of every numeric field to w in the Prometheus text
+// exposition format. Each field is a gauge named <message>_<field> with the exporter tags as
+// labels, and each series holds a single sample timestamped in milliseconds with the time of the
+// last message that logged it. Use Export or Post for the values over the whole log.
+func (exporter *InfluxExporter) ExportPrometheus(w io.Writer) error {
+	samples := map[string]prometheusSample{}
+	err := exporter.eachPoint(func(point timeSeriesPoint) error {
+		for _, sample := range point.prometheusSamples() {
+			samples[sample.metric+sample.labels] = sample
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	series := make([]prometheusSample, 0, len(samples))
+	for _, sample := range samples {
+		series = append(series, sample)
+	}
+	// the samples of a metric must be written together, after its TYPE line
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].metric != series[j].metric {
+			return series[i].metric < series[j].metric
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	buffered := bufio.NewWriter(w)
+	for i, sample := range series {
+		if i == 0 || series[i-1].metric != sample.metric {
+			if _, err := buffered.WriteString("# TYPE " + sample.metric + " gauge\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := buffered.WriteString(sample.metric + sample.labels + " " + sample.value + " " + sample.timestamp + "\n"); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// Post sends the line protocol to an HTTP write endpoint, such as a local InfluxDB
+// http://localhost:8086/api/v2/write?org=...&bucket=..., in batches of BatchSize lines. The
+// precision query parameter is set to nanoseconds unless the url sets it.
+func (exporter *InfluxExporter) Post(endpoint string) error {
+	writeURL, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid write endpoint %q: %v", endpoint, err)
+	}
+	query := writeURL.Query()
+	if query.Get("precision") == "" {
+		query.Set("precision", influxPrecision)
+		writeURL.RawQuery = query.Encode()
+	}
+	target := writeURL.String()
+
+	var batch bytes.Buffer
+	lines := 0
+
+	err = exporter.eachPoint(func(point timeSeriesPoint) error {
+		batch.WriteString(point.lineProtocol())
+		lines++
+		if lines < exporter.options.BatchSize {
+			return nil
+		}
+
+		lines = 0
+		return exporter.postBatch(target, &batch)
+	})
+	if err != nil {
+		return err
+	}
+
+	if lines > 0 {
+		return exporter.postBatch(target, &batch)
+	}
+	return nil
+}
+
+// sends one batch of lines and empties the buffer
+func (exporter *InfluxExporter) postBatch(target string, batch *bytes.Buffer) error {
+	defer batch.Reset()
+
+	request, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(batch.Bytes()))
+	if err != nil {
+		return fmt.Errorf("failed to create line protocol request: %v", err)
+	}
+	request.Header.Set("Content-Type", influxContentType)
+	if exporter.options.Token != "" {
+		request.Header.Set("Authorization", "Token "+exporter.options.Token)
+	}
+
+	response, err := exporter.options.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to post line protocol: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("line protocol write rejected with status %d: %s", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// reads every message from the start of the file and passes the resulting points to handle.
+// Messages without numeric fields, or without a UTC time, are skipped.
+func (exporter *InfluxExporter) eachPoint(handle func(point timeSeriesPoint) error) error {
+	if !exporter.reader.UTCClock().Valid() && exporter.reader.Clock().Timebase == 0 {
+		return fmt.Errorf("no GPS time base found, unable to timestamp messages")
+	}
+
+	vehicle := exporter.options.VehicleType
+	if vehicle == "" {
+		vehicle = exporter.reader.MavType.String()
+	}
+
+	exporter.reader.Rewind()
+	defer exporter.reader.Rewind()
+
+	for {
+		message, err := exporter.reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log: %w", err)
+		}
+		utc, ok := message.UTC()
+		if !ok {
+			continue
+		}
+
+		fields := numericFields(message)
+		if len(fields) == 0 {
+			continue
+		}
+
+		tags := [][2]string{}
+		if instance, ok := instanceValue(message); ok {
+			tags = append(tags, [2]string{tagInstance, instance})
+		}
+		if exporter.options.LogID != "" {
+			tags = append(tags, [2]string{tagLogID, exporter.options.LogID})
+		}
+		tags = append(tags, [2]string{tagVehicle, vehicle})
+
+		point := timeSeriesPoint{
+			measurement: message.GetType(),
+			tags:        tags,
+			fields:      fields,
+			timestamp:   utc.UnixNano(),
+		}
+		if err := handle(point); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the numeric columns of a message formatted as line protocol field values
+func numericFields(message *fileparser.DataFileMessage) [][2]string {
+	fields := [][2]string{}
+	for i, column := range message.FieldNames {
+		if i >= len(message.Elements) || i >= len(message.Format.Format) {
+			break
+		}
+
+		switch value := columnValue(message.Format.Format[i], message.Elements[i]).(type) {
+		case int:
+			fields = append(fields, [2]string{column, strconv.Itoa(value) + "i"})
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			fields = append(fields, [2]string{column, strconv.FormatFloat(value, 'f', -1, 64)})
+		}
+	}
+	return fields
+}
+
+// returns the value of the instance field of a message, for formats that declare one through FMTU
+func instanceValue(message *fileparser.DataFileMessage) (string, bool) {
+	if message.Format.InstanceField == nil {
+		return "", false
+	}
+
+	value, err := message.GetAttribute(*message.Format.InstanceField)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// formats the point as a single line of InfluxDB line protocol
+func (point timeSeriesPoint) lineProtocol() string {
+	var line strings.Builder
+	line.WriteString(escapeInflux(point.measurement, ", "))
+
+	for _, tag := range point.tags {
+		line.WriteString("," + escapeInflux(tag[0], ",= ") + "=" + escapeInflux(tag[1], ",= "))
+	}
+
+	for i, field := range point.fields {
+		if i == 0 {
+			line.WriteString(" ")
+		} else {
+			line.WriteString(",")
+		}
+		line.WriteString(escapeInflux(field[0], ",= ") + "=" + field[1])
+	}
+
+	line.WriteString(" " + strconv.FormatInt(point.timestamp, 10) + "\n")
+	return line.String()
+}
+
+// prometheusSample is the sample of a field in the Prometheus text exposition format
+type prometheusSample struct {
+	metric    string
+	labels    string // {name="value",...}
+	value     string
+	timestamp string // milliseconds since the Unix epoch
+}
+
+// returns one Prometheus sample per field of the point
+func (point timeSeriesPoint) prometheusSamples() []prometheusSample {
+	labels := make([]string, 0, len(point.tags))
+	for _, tag := range point.tags {
+		labels = append(labels, prometheusName(tag[0])+"="+strconv.Quote(tag[1]))
+	}
+	sort.Strings(labels)
+
+	timestamp := strconv.FormatInt(point.timestamp/int64(time.Millisecond), 10)
+
+	samples := make([]prometheusSample, 0, len(point.fields))
+	for _, field := range point.fields {
+		samples = append(samples, prometheusSample{
+			metric:    prometheusName(point.measurement + "_" + field[0]),
+			labels:    "{" + strings.Join(labels, ",") + "}",
+			value:     strings.TrimSuffix(field[1], "i"),
+			timestamp: timestamp,
+		})
+	}
+	return samples
+}
+
+// escapes the characters that have a special meaning in line protocol identifiers
+func escapeInflux(value string, special string) string {
+	var escaped strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(special, r) || r == '\\' {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// converts a message or field name into a valid Prometheus metric or label name
+func prometheusName(name string) string {
+	var result strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			result.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			result.WriteRune(r)
+		default:
+			result.WriteRune('_')
+		}
+	}
+	return strings.ToLower(result.String())
+}
@@ -0,0 +1,215 @@
+package exporter
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// sampleReader returns a reader of a synthetic flight of the given number of seconds
+func sampleReader(t *testing.T, seconds int) *fileparser.BinaryDataFileReader {
+	t.Helper()
+	data, err := binlogtest.SampleLog(seconds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+// writeRequest is a request received by the stand-in write endpoint
+type writeRequest struct {
+	path          string
+	precision     string
+	bucket        string
+	authorization string
+	contentType   string
+	body          string
+}
+
+// influxStandIn starts an HTTP server recording the requests it receives and answering them with
+// status
+func influxStandIn(t *testing.T, status int) (*httptest.Server, func() []writeRequest) {
+	t.Helper()
+	var mutex sync.Mutex
+	requests := []writeRequest{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		requests = append(requests, writeRequest{
+			path:          r.URL.Path,
+			precision:     r.URL.Query().Get("precision"),
+			bucket:        r.URL.Query().Get("bucket"),
+			authorization: r.Header.Get("Authorization"),
+			contentType:   r.Header.Get("Content-Type"),
+			body:          string(body),
+		})
+		mutex.Unlock()
+
+		w.WriteHeader(status)
+		if status != http.StatusNoContent {
+			io.WriteString(w, `{"code":"invalid","message":"unable to parse points"}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []writeRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]writeRequest{}, requests...)
+	}
+}
+
+func TestInfluxPost(t *testing.T) {
+	options := InfluxOptions{LogID: "flight-1", Token: "secret", BatchSize: 100}
+	var want bytes.Buffer
+	if err := NewInfluxExporter(sampleReader(t, 5), options).Export(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	server, received := influxStandIn(t, http.StatusNoContent)
+	if err := NewInfluxExporter(sampleReader(t, 5), options).Post(server.URL + "/api/v2/write?org=fleet&bucket=logs"); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := received()
+	lines := strings.Count(want.String(), "\n")
+	if wantRequests := (lines + options.BatchSize - 1) / options.BatchSize; len(requests) != wantRequests {
+		t.Fatalf("got %d requests for %d lines, want %d", len(requests), lines, wantRequests)
+	}
+
+	var body strings.Builder
+	for _, request := range requests {
+		if request.path != "/api/v2/write" || request.bucket != "logs" {
+			t.Errorf("got path %s bucket %q, want /api/v2/write bucket logs", request.path, request.bucket)
+		}
+		if request.precision != influxPrecision {
+			t.Errorf("got precision %q, want %q", request.precision, influxPrecision)
+		}
+		if request.authorization != "Token secret" {
+			t.Errorf("got Authorization %q, want %q", request.authorization, "Token secret")
+		}
+		if request.contentType != influxContentType {
+			t.Errorf("got Content-Type %q, want %q", request.contentType, influxContentType)
+		}
+		body.WriteString(request.body)
+	}
+	if body.String() != want.String() {
+		t.Errorf("posted line protocol differs from Export")
+	}
+
+	// GPS carries the instance tag declared by FMTU, the log id and the vehicle
+	firstGPS := ""
+	for _, line := range strings.Split(want.String(), "\n") {
+		if strings.HasPrefix(line, "GPS,") {
+			firstGPS = line
+			break
+		}
+	}
+	if !strings.HasPrefix(firstGPS, "GPS,instance=0,log_id=flight-1,vehicle=") || !strings.Contains(firstGPS, ",Lat=-35.3632621,") {
+		t.Errorf("unexpected GPS line %q", firstGPS)
+	}
+}
+
+func TestInfluxPostKeepsPrecision(t *testing.T) {
+	server, received := influxStandIn(t, http.StatusNoContent)
+	if err := NewInfluxExporter(sampleReader(t, 1), InfluxOptions{}).Post(server.URL + "/write?db=logs&precision=s"); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range received() {
+		if request.path != "/write" || request.precision != "s" || request.authorization != "" {
+			t.Errorf("got path %s precision %q Authorization %q, want /write, s and none", request.path, request.precision, request.authorization)
+		}
+	}
+}
+
+func TestInfluxPostRejected(t *testing.T) {
+	server, received := influxStandIn(t, http.StatusBadRequest)
+	err := NewInfluxExporter(sampleReader(t, 5), InfluxOptions{BatchSize: 10}).Post(server.URL + "/api/v2/write")
+	if err == nil {
+		t.Fatal("got no error for a rejected write")
+	}
+	if !strings.Contains(err.Error(), "status 400") || !strings.Contains(err.Error(), "unable to parse points") {
+		t.Errorf("error %q does not carry the status and response", err)
+	}
+	if len(received()) != 1 {
+		t.Errorf("got %d requests, want the first batch only", len(received()))
+	}
+}
+
+func TestPrometheusHasOneSamplePerSeries(t *testing.T) {
+	var output bytes.Buffer
+	if err := NewInfluxExporter(sampleReader(t, 5), InfluxOptions{LogID: "flight-1"}).ExportPrometheus(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	series := map[string]bool{}
+	typed := map[string]bool{}
+	current := ""
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			metric := strings.Fields(line)[2]
+			if typed[metric] {
+				t.Errorf("metric %s typed twice", metric)
+			}
+			typed[metric], current = true, metric
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("unexpected sample %q", line)
+		}
+		if series[fields[0]] {
+			t.Errorf("duplicate series %s", fields[0])
+		}
+		series[fields[0]] = true
+		if !strings.HasPrefix(fields[0], current+"{") {
+			t.Errorf("sample %s is not grouped under its TYPE line", fields[0])
+		}
+	}
+
+	// two GPS instances, one series each
+	for _, name := range []string{`gps_lat{instance="0",log_id="flight-1",vehicle=`, `gps_lat{instance="1",log_id="flight-1",vehicle=`} {
+		found := false
+		for key := range series {
+			found = found || strings.HasPrefix(key, name)
+		}
+		if !found {
+			t.Errorf("no series %s...", name)
+		}
+	}
+}
+
+func TestPrometheusTimestampMilliseconds(t *testing.T) {
+	// a float64 holds this time to 256 ns and would round it up to the next millisecond
+	point := timeSeriesPoint{
+		measurement: "gps",
+		tags:        [][2]string{{tagVehicle, "copter"}},
+		fields:      [][2]string{{"lat", "-35.36"}, {"nsats", "12i"}},
+		timestamp:   1646827200123999999,
+	}
+	samples := point.prometheusSamples()
+	if len(samples) != 2 {
+		t.Fatalf("got %d samples, want 2", len(samples))
+	}
+	for _, sample := range samples {
+		if sample.timestamp != "1646827200123" {
+			t.Errorf("%s: got timestamp %s, want 1646827200123", sample.metric, sample.timestamp)
+		}
+	}
+	if samples[1].metric != "gps_nsats" || samples[1].value != "12" || samples[1].labels != `{vehicle="copter"}` {
+		t.Errorf("got sample %+v", samples[1])
+	}
+}
@@ -0,0 +1,468 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+)
+
+/*
+This code exports a binary data file as an MCAP file for playback in Foxglove Studio. Every message
+type is written on its own channel ("/GPS", "/ATT", ...) with a JSON schema derived from the
+DataFileFormat columns and units. GPS fixes are also published as foxglove.LocationFix on
+"/gps/fix", and the vehicle pose from ATT and POS as foxglove.FrameTransform on "/tf".
+
+Log times are the UTC times of the messages, from the boot time to UTC clock fitted by the reader.
+A message without a UTC time takes the time of the message before it; the messages at the start of
+the log, such as FMT and PARM, are held back until the first UTC time and written with it, so the
+timeline of the file does not start at the Unix epoch. Only so many are held back: the export fails
+when a log starts with a long boot without GPS time.
+*/
+
+const (
+	jsonSchemaEncoding      = "jsonschema"
+	jsonMessageEncoding     = "json"
+	locationFixTopic        = "/gps/fix"
+	frameTransformTopic     = "/tf"
+	locationFixSchemaName   = "foxglove.LocationFix"
+	frameTransformSchema    = "foxglove.FrameTransform"
+	worldFrameID            = "world"
+	vehicleFrameID          = "base_link"
+	gpsFrameID              = "gps"
+	earthRadiusMeters       = 6378137.0
+	degreesToRadians        = math.Pi / 180.0
+	minimumGPSFixStatus     = 3
+	unitMessageName         = "UNIT"
+	attitudeMessageName     = "ATT"
+	positionMessageName     = "POS"
+	firstFormatChannelID    = 3
+	locationFixChannelID    = 1
+	frameTransformChannelID = 2
+	maxPendingMessages      = 20000 // messages held back before the first UTC time
+)
+
+// ArduPilot unit identifiers used in FMTU messages, overridden by any UNIT messages in the log
+var defaultUnits = map[byte]string{
+	'-': "", '?': "unknown", 'A': "A", 'a': "Ah", 'b': "B", 'd': "deg", 'D': "deglatitude",
+	'e': "deg/s/s", 'E': "rad/s", 'G': "Gauss", 'h': "degheading", 'i': "A.s", 'J': "W.s",
+	'k': "deg/s", 'l': "l", 'L': "rad/s/s", 'm': "m", 'n': "m/s", 'o': "m/s/s", 'O': "degC",
+	'%': "%", 'P': "Pa", 'q': "rpm", 'r': "rad", 's': "s", 'S': "satellites", 'U': "deglongitude",
+	'u': "ppm", 'v': "V", 'w': "Ohm", 'W': "Watt", 'X': "W.h", 'Y': "us", 'z': "Hz", '#': "instance",
+}
+
+const locationFixSchemaJSON = `{"title":"foxglove.LocationFix","type":"object","properties":{` +
+	`"timestamp":{"type":"object","properties":{"sec":{"type":"integer"},"nsec":{"type":"integer"}}},` +
+	`"frame_id":{"type":"string"},"latitude":{"type":"number"},"longitude":{"type":"number"},` +
+	`"altitude":{"type":"number"},"position_covariance":{"type":"array","items":{"type":"number"},"minItems":9,"maxItems":9},` +
+	`"position_covariance_type":{"type":"integer"}}}`
+
+const frameTransformSchemaJSON = `{"title":"foxglove.FrameTransform","type":"object","properties":{` +
+	`"timestamp":{"type":"object","properties":{"sec":{"type":"integer"},"nsec":{"type":"integer"}}},` +
+	`"parent_frame_id":{"type":"string"},"child_frame_id":{"type":"string"},` +
+	`"translation":{"type":"object","properties":{"x":{"type":"number"},"y":{"type":"number"},"z":{"type":"number"}}},` +
+	`"rotation":{"type":"object","properties":{"x":{"type":"number"},"y":{"type":"number"},"z":{"type":"number"},"w":{"type":"number"}}}}}`
+
+// MCAPExporter writes the messages of a binary data file into an MCAP file
+type MCAPExporter struct {
+	reader *fileparser.BinaryDataFileReader
+}
+
+// mcapExport holds the state of a single export run
+type mcapExport struct {
+	writer      *mcapWriter
+	units       map[byte]string
+	channels    map[int]uint16
+	nextID      uint16
+	lastLogTime uint64                        // log time of the previous message, used for messages without a UTC time
+	pending     []*fileparser.DataFileMessage // messages read before the first UTC time, at most maxPendingMessages
+	origin      *geoPosition
+	position    *geoPosition
+	hasPOS      bool // POS messages take over from GPS as the source of the vehicle position
+}
+
+// geoPosition is a latitude/longitude in degrees and an altitude in meters
+type geoPosition struct {
+	lat float64
+	lng float64
+	alt float64
+}
+
+// foxgloveTime is the timestamp representation used by the foxglove schemas
+type foxgloveTime struct {
+	Sec  int64 `json:"sec"`
+	Nsec int64 `json:"nsec"`
+}
+
+type foxgloveVector3 struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+type foxgloveQuaternion struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+	W float64 `json:"w"`
+}
+
+type foxgloveLocationFix struct {
+	Timestamp              foxgloveTime `json:"timestamp"`
+	FrameID                string       `json:"frame_id"`
+	Latitude               float64      `json:"latitude"`
+	Longitude              float64      `json:"longitude"`
+	Altitude               float64      `json:"altitude"`
+	PositionCovariance     [9]float64   `json:"position_covariance"`
+	PositionCovarianceType int          `json:"position_covariance_type"`
+}
+
+type foxgloveFrameTransform struct {
+	Timestamp     foxgloveTime       `json:"timestamp"`
+	ParentFrameID string             `json:"parent_frame_id"`
+	ChildFrameID  string             `json:"child_frame_id"`
+	Translation   foxgloveVector3    `json:"translation"`
+	Rotation      foxgloveQuaternion `json:"rotation"`
+}
+
+// NewMCAPExporter creates a new exporter for the messages read by the given reader
+func NewMCAPExporter(reader *fileparser.BinaryDataFileReader) *MCAPExporter {
+	return &MCAPExporter{
+		reader: reader,
+	}
+}
+
+// Export writes every message of the file to w in the MCAP format
+func (exporter *MCAPExporter) Export(w io.Writer) error {
+	export := &mcapExport{
+		units:    make(map[byte]string),
+		channels: make(map[int]uint16),
+		nextID:   firstFormatChannelID,
+	}
+	for id, unit := range defaultUnits {
+		export.units[id] = unit
+	}
+
+	if !exporter.reader.UTCClock().Valid() {
+		return fmt.Errorf("no GPS time base found, unable to timestamp messages")
+	}
+
+	export.writer = newMCAPWriter(w, "")
+	export.addFoxgloveChannels()
+
+	exporter.reader.Rewind()
+	defer exporter.reader.Rewind()
+
+	for {
+		message, err := exporter.reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log: %w", err)
+		}
+		if err := export.addMessage(message); err != nil {
+			return err
+		}
+	}
+	if err := export.flushPending(); err != nil {
+		return err
+	}
+
+	return export.writer.close()
+}
+
+// registers the foxglove LocationFix and FrameTransform schemas and channels
+func (export *mcapExport) addFoxgloveChannels() {
+	export.writer.addSchema(mcapSchema{id: locationFixChannelID, name: locationFixSchemaName, encoding: jsonSchemaEncoding, data: []byte(locationFixSchemaJSON)})
+	export.writer.addChannel(mcapChannel{id: locationFixChannelID, schemaID: locationFixChannelID, topic: locationFixTopic, messageEncoding: jsonMessageEncoding})
+
+	export.writer.addSchema(mcapSchema{id: frameTransformChannelID, name: frameTransformSchema, encoding: jsonSchemaEncoding, data: []byte(frameTransformSchemaJSON)})
+	export.writer.addChannel(mcapChannel{id: frameTransformChannelID, schemaID: frameTransformChannelID, topic: frameTransformTopic, messageEncoding: jsonMessageEncoding})
+}
+
+// timestamps a message, holding it back until the first UTC time of the log
+func (export *mcapExport) addMessage(message *fileparser.DataFileMessage) error {
+	utc, ok := message.UTC()
+	if !ok {
+		if export.lastLogTime == 0 {
+			if len(export.pending) >= maxPendingMessages {
+				return fmt.Errorf("no UTC time in the first %d messages of the log, unable to timestamp them", maxPendingMessages)
+			}
+			export.pending = append(export.pending, message)
+			return nil
+		}
+		return export.writeMessage(message, export.lastLogTime)
+	}
+
+	export.lastLogTime = uint64(utc.UnixNano())
+	if err := export.flushPending(); err != nil {
+		return err
+	}
+	return export.writeMessage(message, export.lastLogTime)
+}
+
+// writes the messages held back with the first UTC time, or 0 when the log has none
+func (export *mcapExport) flushPending() error {
+	for _, message := range export.pending {
+		if err := export.writeMessage(message, export.lastLogTime); err != nil {
+			return err
+		}
+	}
+	export.pending = nil
+	return nil
+}
+
+// writes a message on its own channel and any foxglove messages derived from it
+func (export *mcapExport) writeMessage(message *fileparser.DataFileMessage, logTime uint64) error {
+	messageType := message.GetType()
+	if messageType == unitMessageName {
+		export.addUnit(message)
+	}
+
+	channelID, err := export.channelFor(message.Format)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(messageFields(message))
+	if err != nil {
+		return fmt.Errorf("failed to encode %s message at offset %d: %v", messageType, message.Offset, err)
+	}
+	export.writer.addMessage(channelID, logTime, data)
+
+	switch messageType {
+	case fileparser.MsgTypeGPS, fileparser.MsgTypeGPS2:
+		return export.addLocationFix(message, logTime)
+	case positionMessageName:
+		if position, ok := messagePosition(message); ok {
+			export.hasPOS = true
+			export.setPosition(position)
+		}
+	case attitudeMessageName:
+		return export.addFrameTransform(message, logTime)
+	}
+	return nil
+}
+
+// records the label of a UNIT message so it is used in the schemas written after it
+func (export *mcapExport) addUnit(message *fileparser.DataFileMessage) {
+	id, errID := message.GetAttribute("Id")
+	label, errLabel := message.GetAttribute("Label")
+	unitID, okID := id.(int)
+	unitLabel, okLabel := label.(string)
+	if errID != nil || errLabel != nil || !okID || !okLabel {
+		return
+	}
+	export.units[byte(unitID)] = unitLabel
+}
+
+// returns the channel for a message format, writing its schema and channel on first use
+func (export *mcapExport) channelFor(dataFormat *fileparser.DataFileFormat) (uint16, error) {
+	if id, ok := export.channels[dataFormat.Typ]; ok {
+		return id, nil
+	}
+
+	schema, err := json.Marshal(export.formatSchema(dataFormat))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build schema for %s: %v", dataFormat.Name, err)
+	}
+
+	id := export.nextID
+	export.nextID++
+	export.channels[dataFormat.Typ] = id
+
+	export.writer.addSchema(mcapSchema{id: id, name: dataFormat.Name, encoding: jsonSchemaEncoding, data: schema})
+	export.writer.addChannel(mcapChannel{
+		id:              id,
+		schemaID:        id,
+		topic:           "/" + dataFormat.Name,
+		messageEncoding: jsonMessageEncoding,
+		metadata:        map[string]string{"format": dataFormat.Format},
+	})
+	return id, nil
+}
+
+// builds the JSON schema of a message format, describing each column with its unit
+func (export *mcapExport) formatSchema(dataFormat *fileparser.DataFileFormat) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i, column := range tableColumns(dataFormat) {
+		property := jsonSchemaType(dataFormat.Format[i])
+		if dataFormat.UnitIds != nil && i < len(*dataFormat.UnitIds) {
+			if unit := export.units[(*dataFormat.UnitIds)[i]]; unit != "" {
+				property["description"] = unit
+			}
+		} else if dataFormat.Format[i] == 'L' {
+			property["description"] = "deg"
+		}
+		properties[column] = property
+	}
+
+	return map[string]interface{}{
+		"title":      dataFormat.Name,
+		"type":       "object",
+		"properties": properties,
+	}
+}
+
+// publishes a foxglove.LocationFix for a GPS message with a 3D fix
+func (export *mcapExport) addLocationFix(message *fileparser.DataFileMessage, logTime uint64) error {
+	if status, err := message.GetAttribute("Status"); err == nil {
+		if fixStatus, ok := status.(int); ok && fixStatus < minimumGPSFixStatus {
+			return nil
+		}
+	}
+
+	position, ok := messagePosition(message)
+	if !ok {
+		return nil
+	}
+	if !export.hasPOS {
+		export.setPosition(position)
+	}
+
+	return export.addJSON(locationFixChannelID, logTime, foxgloveLocationFix{
+		Timestamp: toFoxgloveTime(logTime),
+		FrameID:   gpsFrameID,
+		Latitude:  position.lat,
+		Longitude: position.lng,
+		Altitude:  position.alt,
+	})
+}
+
+// publishes a foxglove.FrameTransform for an ATT message using the latest known position. The
+// ArduPilot NED attitude is converted to the ENU convention used by Foxglove.
+func (export *mcapExport) addFrameTransform(message *fileparser.DataFileMessage, logTime uint64) error {
+	roll, okRoll := floatAttribute(message, "Roll")
+	pitch, okPitch := floatAttribute(message, "Pitch")
+	yaw, okYaw := floatAttribute(message, "Yaw")
+	if !okRoll || !okPitch || !okYaw {
+		return nil
+	}
+
+	translation := foxgloveVector3{}
+	if export.position != nil {
+		translation = localENU(*export.origin, *export.position)
+	}
+
+	return export.addJSON(frameTransformChannelID, logTime, foxgloveFrameTransform{
+		Timestamp:     toFoxgloveTime(logTime),
+		ParentFrameID: worldFrameID,
+		ChildFrameID:  vehicleFrameID,
+		Translation:   translation,
+		Rotation:      eulerToQuaternion(roll*degreesToRadians, -pitch*degreesToRadians, (90-yaw)*degreesToRadians),
+	})
+}
+
+func (export *mcapExport) addJSON(channelID uint16, logTime uint64, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	export.writer.addMessage(channelID, logTime, data)
+	return nil
+}
+
+// sets the current vehicle position, using the first position as the origin of the world frame
+func (export *mcapExport) setPosition(position geoPosition) {
+	if export.origin == nil {
+		origin := position
+		export.origin = &origin
+	}
+	export.position = &position
+}
+
+// returns the columns of a message as a map, with latitude/longitude scaled to degrees
+func messageFields(message *fileparser.DataFileMessage) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for i, column := range tableColumns(message.Format) {
+		if i < len(message.Elements) {
+			if array, ok := message.Elements[i].([]int16); ok {
+				fields[column] = array
+				continue
+			}
+			value := columnValue(message.Format.Format[i], message.Elements[i])
+			if number, ok := value.(float64); ok && (math.IsNaN(number) || math.IsInf(number, 0)) {
+				value = nil
+			}
+			fields[column] = value
+		}
+	}
+	return fields
+}
+
+// returns the position carried by a GPS or POS message
+func messagePosition(message *fileparser.DataFileMessage) (geoPosition, bool) {
+	lat, okLat := floatAttribute(message, "Lat")
+	lng, okLng := floatAttribute(message, "Lng")
+	alt, _ := floatAttribute(message, "Alt")
+	if !okLat || !okLng || (lat == 0 && lng == 0) {
+		return geoPosition{}, false
+	}
+	return geoPosition{lat: lat, lng: lng, alt: alt}, true
+}
+
+// returns a numeric attribute as a float64, with latitude/longitude scaled to degrees
+func floatAttribute(message *fileparser.DataFileMessage, field string) (float64, bool) {
+	index, ok := message.Format.ColumnHash[field]
+	if !ok || index >= len(message.Elements) || index >= len(message.Format.Format) {
+		return 0, false
+	}
+
+	switch value := columnValue(message.Format.Format[index], message.Elements[index]).(type) {
+	case int:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+// converts a position to east/north/up meters from the origin using an equirectangular projection
+func localENU(origin geoPosition, position geoPosition) foxgloveVector3 {
+	return foxgloveVector3{
+		X: (position.lng - origin.lng) * degreesToRadians * earthRadiusMeters * math.Cos(origin.lat*degreesToRadians),
+		Y: (position.lat - origin.lat) * degreesToRadians * earthRadiusMeters,
+		Z: position.alt - origin.alt,
+	}
+}
+
+// converts roll, pitch and yaw in radians into a quaternion
+func eulerToQuaternion(roll float64, pitch float64, yaw float64) foxgloveQuaternion {
+	cr, sr := math.Cos(roll/2), math.Sin(roll/2)
+	cp, sp := math.Cos(pitch/2), math.Sin(pitch/2)
+	cy, sy := math.Cos(yaw/2), math.Sin(yaw/2)
+
+	return foxgloveQuaternion{
+		W: cr*cp*cy + sr*sp*sy,
+		X: sr*cp*cy - cr*sp*sy,
+		Y: cr*sp*cy + sr*cp*sy,
+		Z: cr*cp*sy - sr*sp*cy,
+	}
+}
+
+// maps a format character to the JSON schema type of the column
+func jsonSchemaType(formatChar byte) map[string]interface{} {
+	switch sqlColumnType(formatChar) {
+	case sqlTypeInteger:
+		return map[string]interface{}{"type": "integer"}
+	case sqlTypeReal:
+		return map[string]interface{}{"type": "number"}
+	}
+
+	if formatChar == 'a' {
+		return map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}}
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+func toFoxgloveTime(logTime uint64) foxgloveTime {
+	return foxgloveTime{
+		Sec:  int64(logTime / uint64(time.Second)),
+		Nsec: int64(logTime % uint64(time.Second)),
+	}
+}
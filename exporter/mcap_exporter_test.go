@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// mcapRecord is a record read back from an MCAP file
+type mcapRecord struct {
+	opcode  byte
+	content []byte
+}
+
+// splits an unchunked MCAP file into its records
+func readMCAPRecords(t *testing.T, data []byte) []mcapRecord {
+	t.Helper()
+	if !bytes.HasPrefix(data, mcapMagic) {
+		t.Fatal("no MCAP magic")
+	}
+	records := []mcapRecord{}
+	for offset := len(mcapMagic); offset+9 <= len(data)-len(mcapMagic); {
+		length := int(binary.LittleEndian.Uint64(data[offset+1:]))
+		if offset+9+length > len(data) {
+			t.Fatalf("record at %d runs past the end of the file", offset)
+		}
+		records = append(records, mcapRecord{opcode: data[offset], content: data[offset+9 : offset+9+length]})
+		offset += 9 + length
+	}
+	return records
+}
+
+func TestMCAPLogTimesStartAtFirstUTCTime(t *testing.T) {
+	reader := sampleReader(t, 5)
+	output := bytes.Buffer{}
+	if err := NewMCAPExporter(reader).Export(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	topics := map[uint16]string{}
+	firstTimes := map[string]uint64{}
+	var startTime uint64
+	for _, record := range readMCAPRecords(t, output.Bytes()) {
+		switch record.opcode {
+		case mcapOpChannel:
+			id := binary.LittleEndian.Uint16(record.content)
+			length := binary.LittleEndian.Uint32(record.content[4:])
+			topics[id] = string(record.content[8 : 8+length])
+		case mcapOpMessage:
+			topic := topics[binary.LittleEndian.Uint16(record.content)]
+			if _, ok := firstTimes[topic]; !ok {
+				firstTimes[topic] = binary.LittleEndian.Uint64(record.content[6:])
+			}
+		case mcapOpStatistics:
+			startTime = binary.LittleEndian.Uint64(record.content[26:])
+		}
+	}
+
+	if _, ok := firstTimes["/FMT"]; !ok {
+		t.Fatalf("no FMT messages written, got topics %v", firstTimes)
+	}
+	if startTime != firstTimes["/FMT"] {
+		t.Errorf("statistics start at %d, want the time of the first message %d", startTime, firstTimes["/FMT"])
+	}
+	if start := time.Unix(0, int64(startTime)).UTC(); start.Year() < 2000 {
+		t.Errorf("log starts at %v, want the time of the first GPS fix", start)
+	}
+}
+
+// rebootReader returns a log starting with a boot of ATT messages without a GPS fix, followed
+// by a boot with GPS fixes
+func rebootReader(t *testing.T, withoutGPS int) *fileparser.BinaryDataFileReader {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	for _, format := range binlogtest.StandardFormats() {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < withoutGPS; i++ {
+		check(builder.Message(binlogtest.ATTType, 10000000+i*1000, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+	}
+	for second := 1; second <= 5; second++ {
+		check(builder.Message(binlogtest.GPSType, second*1000000, 0, 3, 100000000+second*1000, 2200, 12, 0.8, -353632621, 1491652374, 584.0, 0.0, 0.0, 0.0, 0.0, 1))
+		check(builder.Message(binlogtest.ATTType, second*1000000+500000, 0, 0, 0, 0, 0, 0, 0, 0, 0))
+	}
+
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+func TestMCAPHoldsBackALimitedNumberOfMessages(t *testing.T) {
+	// the messages of the boot without GPS time are written with the first UTC time of the next
+	output := bytes.Buffer{}
+	if err := NewMCAPExporter(rebootReader(t, 100)).Export(&output); err != nil {
+		t.Fatal(err)
+	}
+	messages := 0
+	for _, record := range readMCAPRecords(t, output.Bytes()) {
+		if record.opcode != mcapOpMessage {
+			continue
+		}
+		messages++
+		if logTime := time.Unix(0, int64(binary.LittleEndian.Uint64(record.content[6:]))); logTime.Year() < 2000 {
+			t.Fatalf("message written at %v, want the time of a GPS fix", logTime)
+		}
+	}
+	if messages < 100 {
+		t.Errorf("got %d messages written, want the 100 held back and more", messages)
+	}
+
+	err := NewMCAPExporter(rebootReader(t, maxPendingMessages+1)).Export(&bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "no UTC time") {
+		t.Errorf("got error %v, want one for too many messages without UTC time", err)
+	}
+}
@@ -0,0 +1,280 @@
+package exporter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+/*
+This code implements the subset of the MCAP container format (https://mcap.dev/spec) needed to
+write an unchunked file: the header, schemas, channels and messages in the data section, followed
+by a summary section that repeats the schemas and channels and records the file statistics so that
+readers such as Foxglove Studio can list the topics without scanning the whole file.
+*/
+
+const (
+	mcapOpHeader        = 0x01
+	mcapOpFooter        = 0x02
+	mcapOpSchema        = 0x03
+	mcapOpChannel       = 0x04
+	mcapOpMessage       = 0x05
+	mcapOpStatistics    = 0x0B
+	mcapOpSummaryOffset = 0x0E
+	mcapOpDataEnd       = 0x0F
+	mcapLibrary         = "telemetry_parser"
+)
+
+var mcapMagic = []byte{0x89, 'M', 'C', 'A', 'P', '0', '\r', '\n'}
+
+// mcapSchema is a schema record, kept so it can be repeated in the summary section
+type mcapSchema struct {
+	id       uint16
+	name     string
+	encoding string
+	data     []byte
+}
+
+// mcapChannel is a channel record, kept so it can be repeated in the summary section
+type mcapChannel struct {
+	id              uint16
+	schemaID        uint16
+	topic           string
+	messageEncoding string
+	metadata        map[string]string
+}
+
+// mcapWriter writes MCAP records to an underlying writer and keeps track of the file statistics
+type mcapWriter struct {
+	out           *bufio.Writer
+	written       uint64
+	schemas       []mcapSchema
+	channels      []mcapChannel
+	sequences     map[uint16]uint32
+	channelCounts map[uint16]uint64
+	messageCount  uint64
+	startTime     uint64
+	endTime       uint64
+	err           error
+}
+
+// creates a writer and writes the magic and header record
+func newMCAPWriter(w io.Writer, profile string) *mcapWriter {
+	writer := &mcapWriter{
+		out:           bufio.NewWriter(w),
+		sequences:     make(map[uint16]uint32),
+		channelCounts: make(map[uint16]uint64),
+	}
+
+	writer.write(mcapMagic)
+	writer.record(mcapOpHeader, func(content *mcapBuffer) {
+		content.putString(profile)
+		content.putString(mcapLibrary)
+	})
+	return writer
+}
+
+// adds a schema to the data section
+func (writer *mcapWriter) addSchema(schema mcapSchema) {
+	writer.schemas = append(writer.schemas, schema)
+	writer.writeSchema(schema)
+}
+
+// adds a channel to the data section
+func (writer *mcapWriter) addChannel(channel mcapChannel) {
+	writer.channels = append(writer.channels, channel)
+	writer.writeChannel(channel)
+}
+
+// writes a message on a channel with the log and publish time in nanoseconds since the Unix epoch
+func (writer *mcapWriter) addMessage(channelID uint16, logTime uint64, data []byte) {
+	sequence := writer.sequences[channelID]
+	writer.sequences[channelID] = sequence + 1
+
+	writer.record(mcapOpMessage, func(content *mcapBuffer) {
+		content.putUint16(channelID)
+		content.putUint32(sequence)
+		content.putUint64(logTime)
+		content.putUint64(logTime)
+		content.putBytes(data)
+	})
+
+	if writer.messageCount == 0 || logTime < writer.startTime {
+		writer.startTime = logTime
+	}
+	if logTime > writer.endTime {
+		writer.endTime = logTime
+	}
+	writer.messageCount++
+	writer.channelCounts[channelID]++
+}
+
+// ends the data section, writes the summary section and footer, and flushes the output
+func (writer *mcapWriter) close() error {
+	writer.record(mcapOpDataEnd, func(content *mcapBuffer) {
+		content.putUint32(0)
+	})
+
+	summaryStart := writer.written
+
+	schemaStart := writer.written
+	for _, schema := range writer.schemas {
+		writer.writeSchema(schema)
+	}
+	schemaLength := writer.written - schemaStart
+
+	channelStart := writer.written
+	for _, channel := range writer.channels {
+		writer.writeChannel(channel)
+	}
+	channelLength := writer.written - channelStart
+
+	statisticsStart := writer.written
+	writer.writeStatistics()
+	statisticsLength := writer.written - statisticsStart
+
+	summaryOffsetStart := writer.written
+	writer.writeSummaryOffset(mcapOpSchema, schemaStart, schemaLength)
+	writer.writeSummaryOffset(mcapOpChannel, channelStart, channelLength)
+	writer.writeSummaryOffset(mcapOpStatistics, statisticsStart, statisticsLength)
+
+	writer.record(mcapOpFooter, func(content *mcapBuffer) {
+		content.putUint64(summaryStart)
+		content.putUint64(summaryOffsetStart)
+		content.putUint32(0)
+	})
+	writer.write(mcapMagic)
+
+	if writer.err != nil {
+		return writer.err
+	}
+	return writer.out.Flush()
+}
+
+func (writer *mcapWriter) writeSchema(schema mcapSchema) {
+	writer.record(mcapOpSchema, func(content *mcapBuffer) {
+		content.putUint16(schema.id)
+		content.putString(schema.name)
+		content.putString(schema.encoding)
+		content.putUint32(uint32(len(schema.data)))
+		content.putBytes(schema.data)
+	})
+}
+
+func (writer *mcapWriter) writeChannel(channel mcapChannel) {
+	writer.record(mcapOpChannel, func(content *mcapBuffer) {
+		content.putUint16(channel.id)
+		content.putUint16(channel.schemaID)
+		content.putString(channel.topic)
+		content.putString(channel.messageEncoding)
+		content.putStringMap(channel.metadata)
+	})
+}
+
+func (writer *mcapWriter) writeStatistics() {
+	channelIDs := make([]int, 0, len(writer.channelCounts))
+	for id := range writer.channelCounts {
+		channelIDs = append(channelIDs, int(id))
+	}
+	sort.Ints(channelIDs)
+
+	writer.record(mcapOpStatistics, func(content *mcapBuffer) {
+		content.putUint64(writer.messageCount)
+		content.putUint16(uint16(len(writer.schemas)))
+		content.putUint32(uint32(len(writer.channels)))
+		content.putUint32(0) // attachments
+		content.putUint32(0) // metadata
+		content.putUint32(0) // chunks
+		content.putUint64(writer.startTime)
+		content.putUint64(writer.endTime)
+
+		counts := &mcapBuffer{}
+		for _, id := range channelIDs {
+			counts.putUint16(uint16(id))
+			counts.putUint64(writer.channelCounts[uint16(id)])
+		}
+		content.putUint32(uint32(len(counts.data)))
+		content.putBytes(counts.data)
+	})
+}
+
+func (writer *mcapWriter) writeSummaryOffset(opcode byte, start uint64, length uint64) {
+	if length == 0 {
+		return
+	}
+	writer.record(mcapOpSummaryOffset, func(content *mcapBuffer) {
+		content.putUint8(opcode)
+		content.putUint64(start)
+		content.putUint64(length)
+	})
+}
+
+// writes a record: opcode, content length and the content built by fill
+func (writer *mcapWriter) record(opcode byte, fill func(content *mcapBuffer)) {
+	content := &mcapBuffer{}
+	fill(content)
+
+	prefix := &mcapBuffer{}
+	prefix.putUint8(opcode)
+	prefix.putUint64(uint64(len(content.data)))
+
+	writer.write(prefix.data)
+	writer.write(content.data)
+}
+
+func (writer *mcapWriter) write(data []byte) {
+	if writer.err != nil {
+		return
+	}
+	n, err := writer.out.Write(data)
+	writer.written += uint64(n)
+	writer.err = err
+}
+
+// mcapBuffer builds the little-endian content of a record
+type mcapBuffer struct {
+	data []byte
+}
+
+func (buffer *mcapBuffer) putUint8(value uint8) {
+	buffer.data = append(buffer.data, value)
+}
+
+func (buffer *mcapBuffer) putUint16(value uint16) {
+	buffer.data = binary.LittleEndian.AppendUint16(buffer.data, value)
+}
+
+func (buffer *mcapBuffer) putUint32(value uint32) {
+	buffer.data = binary.LittleEndian.AppendUint32(buffer.data, value)
+}
+
+func (buffer *mcapBuffer) putUint64(value uint64) {
+	buffer.data = binary.LittleEndian.AppendUint64(buffer.data, value)
+}
+
+func (buffer *mcapBuffer) putBytes(value []byte) {
+	buffer.data = append(buffer.data, value...)
+}
+
+func (buffer *mcapBuffer) putString(value string) {
+	buffer.putUint32(uint32(len(value)))
+	buffer.data = append(buffer.data, value...)
+}
+
+// writes a map as its byte length followed by the key/value pairs in key order
+func (buffer *mcapBuffer) putStringMap(values map[string]string) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := &mcapBuffer{}
+	for _, key := range keys {
+		entries.putString(key)
+		entries.putString(values[key])
+	}
+	buffer.putUint32(uint32(len(entries.data)))
+	buffer.putBytes(entries.data)
+}
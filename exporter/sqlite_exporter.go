@@ -0,0 +1,335 @@
+package exporter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+
+	_ "modernc.org/sqlite" // pure Go SQLite driver, no cgo required
+)
+
+/*
+This code exports the contents of a binary data file into a SQLite database so the log can be
+queried with ad-hoc SQL. Every DataFileFormat becomes its own table with columns typed from the
+format string, and a "messages" table indexes every message by its byte offset in the file.
+*/
+
+const (
+	sqliteDriverName  = "sqlite"
+	messagesTableName = "messages"
+	paramsTableName   = "params"
+	offsetColumnName  = "_offset"
+	parameterMessage  = "PARM"
+	timeUSColumnName  = "TimeUS"
+	timeMSColumnName  = "TimeMS"
+	latLngScaleFactor = 1.0e-7
+	sqlTypeInteger    = "INTEGER"
+	sqlTypeReal       = "REAL"
+	sqlTypeText       = "TEXT"
+)
+
+// SQLiteExporter writes every message of a binary data file into a SQLite database
+type SQLiteExporter struct {
+	reader     *fileparser.BinaryDataFileReader
+	statements map[int]*sql.Stmt
+	tableNames map[int]string
+}
+
+// NewSQLiteExporter creates a new exporter for the messages read by the given reader
+func NewSQLiteExporter(reader *fileparser.BinaryDataFileReader) *SQLiteExporter {
+	return &SQLiteExporter{
+		reader:     reader,
+		statements: make(map[int]*sql.Stmt),
+		tableNames: make(map[int]string),
+	}
+}
+
+// Export creates the SQLite database at path, replacing any existing file, and writes one table
+// per message format, the messages index table and the params table into it. The database is left
+// without tables when a message cannot be read.
+func (exporter *SQLiteExporter) Export(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove existing database: %v", err)
+	}
+
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	if err := exporter.writeMessages(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// creates the tables and inserts every message in file offset order
+func (exporter *SQLiteExporter) writeMessages(tx *sql.Tx) error {
+	defer exporter.closeStatements()
+	exporter.tableNames = make(map[int]string)
+
+	if err := createFixedTables(tx); err != nil {
+		return err
+	}
+
+	messageStmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (offset, type_id, type, time_us) VALUES (?, ?, ?, ?)", messagesTableName))
+	if err != nil {
+		return fmt.Errorf("failed to prepare messages insert: %v", err)
+	}
+	defer messageStmt.Close()
+
+	paramStmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (offset, time_us, name, value) VALUES (?, ?, ?, ?)", paramsTableName))
+	if err != nil {
+		return fmt.Errorf("failed to prepare params insert: %v", err)
+	}
+	defer paramStmt.Close()
+
+	exporter.reader.Rewind()
+	defer exporter.reader.Rewind()
+
+	for {
+		message, err := exporter.reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log: %w", err)
+		}
+
+		stmt, err := exporter.statementFor(tx, message.Format)
+		if err != nil {
+			return err
+		}
+
+		timeUS, hasTime := message.TimeUS()
+		var timeValue interface{}
+		if hasTime {
+			timeValue = timeUS
+		}
+
+		if _, err := messageStmt.Exec(message.Offset, message.Format.Typ, message.Format.Name, timeValue); err != nil {
+			return fmt.Errorf("failed to insert message at offset %d: %v", message.Offset, err)
+		}
+
+		if _, err := stmt.Exec(rowValues(message)...); err != nil {
+			return fmt.Errorf("failed to insert %s message at offset %d: %v", message.Format.Name, message.Offset, err)
+		}
+
+		if message.GetType() == parameterMessage {
+			if err := insertParameter(paramStmt, message, timeValue); err != nil {
+				return err
+			}
+		}
+	}
+
+	return exporter.createTimeIndexes(tx)
+}
+
+// creates the messages index table and the params table
+func createFixedTables(tx *sql.Tx) error {
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s (offset INTEGER PRIMARY KEY, type_id INTEGER NOT NULL, type TEXT NOT NULL, time_us INTEGER)", messagesTableName),
+		fmt.Sprintf("CREATE INDEX idx_%s_type ON %s (type)", messagesTableName, messagesTableName),
+		fmt.Sprintf("CREATE INDEX idx_%s_time_us ON %s (time_us)", messagesTableName, messagesTableName),
+		fmt.Sprintf("CREATE TABLE %s (offset INTEGER PRIMARY KEY, time_us INTEGER, name TEXT NOT NULL, value REAL)", paramsTableName),
+		fmt.Sprintf("CREATE INDEX idx_%s_name ON %s (name)", paramsTableName, paramsTableName),
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create table: %v", err)
+		}
+	}
+	return nil
+}
+
+// inserts a PARM message into the params table
+func insertParameter(stmt *sql.Stmt, message *fileparser.DataFileMessage, timeValue interface{}) error {
+	name, err := message.GetAttribute("Name")
+	if err != nil {
+		return fmt.Errorf("failed to read parameter at offset %d: %w", message.Offset, err)
+	}
+	value, err := message.GetAttribute("Value")
+	if err != nil {
+		return fmt.Errorf("failed to read parameter at offset %d: %w", message.Offset, err)
+	}
+
+	if _, err := stmt.Exec(message.Offset, timeValue, name, value); err != nil {
+		return fmt.Errorf("failed to insert parameter at offset %d: %v", message.Offset, err)
+	}
+	return nil
+}
+
+// returns the prepared insert statement for a message format, creating its table on first use
+func (exporter *SQLiteExporter) statementFor(tx *sql.Tx, dataFormat *fileparser.DataFileFormat) (*sql.Stmt, error) {
+	if stmt, ok := exporter.statements[dataFormat.Typ]; ok {
+		return stmt, nil
+	}
+
+	tableName := exporter.uniqueTableName(dataFormat)
+	columns := tableColumns(dataFormat)
+
+	definitions := []string{quoteIdentifier(offsetColumnName) + " INTEGER PRIMARY KEY REFERENCES " + messagesTableName + "(offset)"}
+	names := []string{quoteIdentifier(offsetColumnName)}
+	placeholders := []string{"?"}
+	for i, column := range columns {
+		definitions = append(definitions, quoteIdentifier(column)+" "+sqlColumnType(dataFormat.Format[i]))
+		names = append(names, quoteIdentifier(column))
+		placeholders = append(placeholders, "?")
+	}
+
+	createTable := fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdentifier(tableName), strings.Join(definitions, ", "))
+	if _, err := tx.Exec(createTable); err != nil {
+		return nil, fmt.Errorf("failed to create table %s: %v", tableName, err)
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdentifier(tableName), strings.Join(names, ", "), strings.Join(placeholders, ", "))
+	stmt, err := tx.Prepare(insert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare insert for table %s: %v", tableName, err)
+	}
+
+	exporter.statements[dataFormat.Typ] = stmt
+	return stmt, nil
+}
+
+// picks a table name for the format. Formats are normally uniquely named, but a damaged file can
+// contain two FMT definitions with the same name and a different type id.
+func (exporter *SQLiteExporter) uniqueTableName(dataFormat *fileparser.DataFileFormat) string {
+	tableName := dataFormat.Name
+	if tableName == "" || strings.EqualFold(tableName, messagesTableName) || strings.EqualFold(tableName, paramsTableName) {
+		tableName = fmt.Sprintf("type_%d", dataFormat.Typ)
+	}
+
+	for _, existing := range exporter.tableNames {
+		if strings.EqualFold(existing, tableName) {
+			tableName = fmt.Sprintf("%s_%d", tableName, dataFormat.Typ)
+			break
+		}
+	}
+
+	exporter.tableNames[dataFormat.Typ] = tableName
+	return tableName
+}
+
+// adds an index on the time column of every table that has one
+func (exporter *SQLiteExporter) createTimeIndexes(tx *sql.Tx) error {
+	for typ, tableName := range exporter.tableNames {
+		dataFormat := exporter.reader.Formats()[typ]
+		if dataFormat == nil {
+			continue
+		}
+
+		for _, column := range []string{timeUSColumnName, timeMSColumnName} {
+			if _, ok := dataFormat.ColumnHash[column]; !ok {
+				continue
+			}
+
+			index := fmt.Sprintf("CREATE INDEX %s ON %s (%s)",
+				quoteIdentifier("idx_"+tableName+"_"+column), quoteIdentifier(tableName), quoteIdentifier(column))
+			if _, err := tx.Exec(index); err != nil {
+				return fmt.Errorf("failed to create index on %s.%s: %v", tableName, column, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func (exporter *SQLiteExporter) closeStatements() {
+	for typ, stmt := range exporter.statements {
+		stmt.Close()
+		delete(exporter.statements, typ)
+	}
+}
+
+// returns the column names of a format, limited to the number of format characters and made unique
+func tableColumns(dataFormat *fileparser.DataFileFormat) []string {
+	count := len(dataFormat.Columns)
+	if len(dataFormat.MessageFormats) < count {
+		count = len(dataFormat.MessageFormats)
+	}
+
+	seen := make(map[string]bool)
+	columns := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		column := dataFormat.Columns[i]
+		if column == "" || seen[strings.ToLower(column)] || strings.EqualFold(column, offsetColumnName) {
+			column = fmt.Sprintf("field_%d", i)
+		}
+		seen[strings.ToLower(column)] = true
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// maps a format character to the SQLite column type used to store it
+func sqlColumnType(formatChar byte) string {
+	switch formatChar {
+	case 'b', 'B', 'M', 'h', 'H', 'i', 'I', 'q', 'Q':
+		return sqlTypeInteger
+	case 'c', 'C', 'e', 'E', 'f', 'd', 'L':
+		return sqlTypeReal
+	default:
+		return sqlTypeText
+	}
+}
+
+// builds the values inserted for a message: its offset followed by one value per column
+func rowValues(message *fileparser.DataFileMessage) []interface{} {
+	columns := tableColumns(message.Format)
+	values := make([]interface{}, 0, len(columns)+1)
+	values = append(values, message.Offset)
+
+	for i := range columns {
+		var value interface{}
+		if i < len(message.Elements) {
+			value = columnValue(message.Format.Format[i], message.Elements[i])
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// converts an unpacked element into the value stored in the database
+func columnValue(formatChar byte, value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimRight(v, "\x00")
+	case []byte:
+		return strings.TrimRight(string(v), "\x00")
+	case []int16:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(encoded)
+	case int:
+		// latitude and longitude are stored as degrees * 1e7
+		if formatChar == 'L' {
+			return float64(v) * latLngScaleFactor
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// quotes an identifier so column names that clash with SQL keywords remain valid
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
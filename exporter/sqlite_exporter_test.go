@@ -0,0 +1,88 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// returns the names of the tables of the database at path
+func sqliteTables(t *testing.T, path string) []string {
+	t.Helper()
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	return tables
+}
+
+func TestSQLiteExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.db")
+	if err := NewSQLiteExporter(sampleReader(t, 2)).Export(path); err != nil {
+		t.Fatal(err)
+	}
+	if tables := sqliteTables(t, path); len(tables) < 3 {
+		t.Errorf("got tables %v", tables)
+	}
+}
+
+func TestSQLiteExportRollsBackOnReadError(t *testing.T) {
+	data, err := binlogtest.SampleLog(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := fileparser.NewBinaryDataFileReaderContext(ctx, bytes.NewReader(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	if err := NewSQLiteExporter(reader).Export(path); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if tables := sqliteTables(t, path); len(tables) != 0 {
+		t.Errorf("got tables %v after a failed export, want none", tables)
+	}
+}
+
+func TestSQLiteExportRejectsParameterWithoutName(t *testing.T) {
+	builder := binlogtest.NewBuilder()
+	parm := binlogtest.Format{Type: 150, Name: "PARM", Format: "Qf", Columns: "TimeUS,Value"}
+	if err := builder.Declare(parm); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Message(parm.Type, 1000, 1.5); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	if err := NewSQLiteExporter(reader).Export(path); !errors.Is(err, fileparser.ErrFieldType) {
+		t.Errorf("got %v, want ErrFieldType", err)
+	}
+}
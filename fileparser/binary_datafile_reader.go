@@ -1,10 +1,12 @@
 package fileparser
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 
@@ -25,6 +27,8 @@ const (
 	bytesPerInt16         = 2
 	MsgTypeGPS            = "GPS"
 	MsgTypeGPS2           = "GPS2"
+	EventIDArmed          = 10
+	EventIDDisarmed       = 11
 )
 
 type MavType int
@@ -75,64 +79,21 @@ const (
 	MavTypeWinch                                  // 42
 )
 
-// ArduPlane
-/*var modeMappingAPM = map[int]string{
-	0:  "MANUAL",
-	1:  "CIRCLE",
-	2:  "STABILIZE",
-	3:  "TRAINING",
-	4:  "ACRO",
-	5:  "FBWA",
-	6:  "FBWB",
-	7:  "CRUISE",
-	8:  "AUTOTUNE",
-	10: "AUTO",
-	11: "RTL",
-	12: "LOITER",
-	13: "TAKEOFF",
-	14: "AVOID_ADSB",
-	15: "GUIDED",
-	16: "INITIALISING",
-	17: "QSTABILIZE",
-	18: "QHOVER",
-	19: "QLOITER",
-	20: "QLAND",
-	21: "QRTL",
-	22: "QAUTOTUNE",
-	23: "QACRO",
-	24: "THERMAL",
-	25: "LOITERALTQLAND",
-}*/
-
-// ArduCopter
-var modeMappingACM = map[int]string{
-	0:  "STABILIZE",
-	1:  "ACRO",
-	2:  "ALT_HOLD",
-	3:  "AUTO",
-	4:  "GUIDED",
-	5:  "LOITER",
-	6:  "RTL",
-	7:  "CIRCLE",
-	8:  "POSITION",
-	9:  "LAND",
-	10: "OF_LOITER",
-	11: "DRIFT",
-	13: "SPORT",
-	14: "FLIP",
-	15: "AUTOTUNE",
-	16: "POSHOLD",
-	17: "BRAKE",
-	18: "THROW",
-	19: "AVOID_ADSB",
-	20: "GUIDED_NOGPS",
-	21: "SMART_RTL",
-	22: "FLOWHOLD",
-	23: "FOLLOW",
-	24: "ZIGZAG",
-	25: "SYSTEMID",
-	26: "AUTOROTATE",
-	27: "AUTO_RTL",
+var mavTypeNames = []string{
+	"GENERIC", "FIXED_WING", "QUADROTOR", "COAXIAL", "HELICOPTER", "ANTENNA_TRACKER", "GCS", "AIRSHIP",
+	"FREE_BALLOON", "ROCKET", "GROUND_ROVER", "SURFACE_BOAT", "SUBMARINE", "HEXAROTOR", "OCTOROTOR",
+	"TRICOPTER", "FLAPPING_WING", "KITE", "ONBOARD_CONTROLLER", "VTOL_TAILSITTER_DUOROTOR",
+	"VTOL_TAILSITTER_QUADROTOR", "VTOL_TILTROTOR", "VTOL_FIXEDROTOR", "VTOL_TAILSITTER", "VTOL_TILTWING",
+	"VTOL_RESERVED5", "GIMBAL", "ADSB", "PARAFOIL", "DODECAROTOR", "CAMERA", "CHARGING_STATION", "FLARM",
+	"SERVO", "ODID", "DECAROTOR", "BATTERY", "PARACHUTE", "LOG", "OSD", "IMU", "GPS", "WINCH",
+}
+
+// String returns the MAV_TYPE name of the vehicle type without the MAV_TYPE_ prefix
+func (mavType MavType) String() string {
+	if mavType >= 0 && int(mavType) < len(mavTypeNames) {
+		return mavTypeNames[mavType]
+	}
+	return fmt.Sprintf("MavType(%d)", int(mavType))
 }
 
 type UnpackerFunc func([]byte) ([]interface{}, error)
@@ -158,15 +119,35 @@ type BinaryDataFileReader struct {
 	params        map[string]interface{}
 	flightmodes   []interface{}
 	flightmode    string
+	armed         bool
+	vehicle       vehicleIdentity
 	Messages      map[string]*DataFileMessage
 	Percent       float64
 	clock         *GPSInterpolated
+	utcClock      *UTCClock
 	dataLen       int
 	binaryFormats []string
+
+	logger            *slog.Logger
+	diagnosticHandler func(Diagnostic)
+	report            *ParseReport
+	reported          map[diagnosticKey]bool
+	resync            ResyncMode
+	strictEnd         bool  // a message cut short by the end of the data is an error instead of the end
+	lastTimeUS        int64 // time since boot of the last message read, to check messages found by a resync
+	hasLastTime       bool
+	ctx               context.Context
+	progress          progressState
 }
 
 // NewBinaryDataFileReader creates a new reader for binary data files
-func NewBinaryDataFileReader(r io.Reader, zeroTimeBase bool) (*BinaryDataFileReader, error) {
+func NewBinaryDataFileReader(r io.Reader, zeroTimeBase bool, options ...ReaderOption) (*BinaryDataFileReader, error) {
+	return NewBinaryDataFileReaderContext(context.Background(), r, zeroTimeBase, options...)
+}
+
+// NewBinaryDataFileReaderContext creates a new reader for binary data files that stops reading once
+// ctx is cancelled, both while it is created and in every later ParseNext
+func NewBinaryDataFileReaderContext(ctx context.Context, r io.Reader, zeroTimeBase bool, options ...ReaderOption) (*BinaryDataFileReader, error) {
 	// Defining columns for the data file format
 	var columns = []string{"Type", "Length", "Name", "Format", "Columns"}
 	df, err := NewDataFileFormat(FmtTypeDefault, FormatName, FormatLength, FmtFormat, columns, nil)
@@ -187,11 +168,18 @@ func NewBinaryDataFileReader(r io.Reader, zeroTimeBase bool) (*BinaryDataFileRea
 		MavType:      MavTypeGeneric,
 		params:       make(map[string]interface{}),
 		flightmodes:  nil,
-		flightmode:   modeStringACM(0),
+		flightmode:   modeString(MavTypeGeneric, 0),
 		Messages:     map[string]*DataFileMessage{"MAV": nil, "__MAV__": nil},
 		Percent:      0.0,
 		clock:        nil,
 		formats:      make(map[int]*DataFileFormat),
+		report:       newParseReport(),
+		reported:     make(map[diagnosticKey]bool),
+		resync:       ResyncValidate,
+		ctx:          ctx,
+	}
+	for _, option := range options {
+		option(reader)
 	}
 
 	/* Add the initial format to the reader's formats map
@@ -222,7 +210,7 @@ func NewBinaryDataFileReader(r io.Reader, zeroTimeBase bool) (*BinaryDataFileRea
 			return nil, err
 		}
 	default:
-		reader.dataMap, err = io.ReadAll(r)
+		reader.dataMap, err = io.ReadAll(contextReader{ctx: ctx, r: r})
 		if err != nil {
 			return nil, err
 		}
@@ -231,21 +219,43 @@ func NewBinaryDataFileReader(r io.Reader, zeroTimeBase bool) (*BinaryDataFileRea
 	}
 
 	// Initialize the reader (BinaryDataFileReader).
-	reader.init()
+	if err := reader.init(); err != nil {
+		return nil, fmt.Errorf("failed to read data file: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read data file: %w", err)
+	}
 	return reader, nil
 }
 
-func (reader *BinaryDataFileReader) init() {
+func (reader *BinaryDataFileReader) init() error {
 	reader.offset = 0
 	reader.remaining = reader.dataLen
 	reader.prevType = 0
-	reader.initClock()
+	reader.startPass(ProgressClock)
+	if err := reader.initClock(); err != nil {
+		return err
+	}
+	if err := reader.initUTCClock(); err != nil {
+		return err
+	}
 	reader.rewind()
+	reader.startPass(ProgressIndex)
 	reader.initArrays()
+	// the index pass parses the first message of every type, so the latest messages, parameters,
+	// arming state and interpolation start over for the first read to be like any later one
+	reader.rewind()
+	reader.startPass(ProgressRead)
+	return nil
 }
 
 // initClock initializes the clock for timestamp handling, this is crucial for GPS data handling
-func (reader *BinaryDataFileReader) initClock() {
+func (reader *BinaryDataFileReader) initClock() error {
+	// the time base comes from the first GPS fixes, the clock pass reported is the one after
+	handler := reader.progress.handler
+	reader.progress.handler = nil
+	defer func() { reader.progress.handler = handler }()
+
 	reader.rewind()
 	reader.InitClockGPSInterpolated()
 
@@ -255,9 +265,12 @@ func (reader *BinaryDataFileReader) initClock() {
 	for {
 		count++
 		message, err := reader.ParseNext() //recvMsg()
-		if err != nil {
+		if errors.Is(err, io.EOF) {
 			break
 		}
+		if err != nil {
+			return err
+		}
 
 		msgType := message.GetType()
 		firstMsStamp = reader.getFirstMsStamp(firstMsStamp, msgType, message)
@@ -270,6 +283,7 @@ func (reader *BinaryDataFileReader) initClock() {
 	}
 
 	reader.rewind()
+	return nil
 }
 
 // finds the first valid millisecond timestamp in the data
@@ -294,12 +308,12 @@ func (reader *BinaryDataFileReader) processGPSTime(message *DataFileMessage, fir
 	// Extract TimeUS (microsecond timestamp) from the message
 	timeUS, err = processAttribute(message, "TimeUS")
 	if err != nil {
-		log.Println("Error processing TimeUS:", err)
+		reader.debug("GPS message without TimeUS", "error", err)
 	}
 
 	gps_week, err = processAttribute(message, "GWk")
 	if err != nil {
-		log.Println("Error processing GWk:", err)
+		reader.debug("GPS message without GWk", "error", err)
 	}
 
 	// If both TimeUS and gps_week are valid, use them to find the time base
@@ -313,13 +327,13 @@ func (reader *BinaryDataFileReader) processGPSTime(message *DataFileMessage, fir
 	// If TimeUS and GWk are not available, try to use T (millisecond timestamp) and Week
 	t, err = processAttribute(message, "T")
 	if err != nil {
-		log.Println("Error processing T:", err)
+		reader.debug("GPS message without T", "error", err)
 		return false
 	}
 
 	week, err = processAttribute(message, "Week")
 	if err != nil {
-		log.Println("Error processing Week:", err)
+		reader.debug("GPS message without Week", "error", err)
 		return false
 	}
 
@@ -369,12 +383,35 @@ func (reader *BinaryDataFileReader) InitClockGPSInterpolated() {
 	reader.clock = clock
 }
 
+// Clock returns the GPS interpolated clock used to timestamp the messages of this reader
+func (reader *BinaryDataFileReader) Clock() *GPSInterpolated {
+	return reader.clock
+}
+
+// FlightMode returns the name of the flight mode set by the most recent MODE message
+func (reader *BinaryDataFileReader) FlightMode() string {
+	return reader.flightmode
+}
+
+// Armed reports whether the vehicle was armed at the most recently read message
+func (reader *BinaryDataFileReader) Armed() bool {
+	return reader.armed
+}
+
+// Rewind resets the reader to the beginning of the data so the messages can be read again
+func (reader *BinaryDataFileReader) Rewind() {
+	reader.rewind()
+}
+
 // rewind resets the reader to the beginning of the data
 func (reader *BinaryDataFileReader) rewind() {
 	reader.offset = 0
 	reader.remaining = reader.dataLen
 	reader.typeNums = nil
 	reader.timestamp = 0
+	reader.lastTimeUS = 0
+	reader.hasLastTime = false
+	reader.startPass(reader.progress.stage)
 
 	reader.Messages = map[string]*DataFileMessage{
 		"MAV":     nil,
@@ -387,6 +424,8 @@ func (reader *BinaryDataFileReader) rewind() {
 		reader.flightmodes = []interface{}{"UNKNOWN"}
 	}
 	reader.Percent = 0.0
+	reader.armed = false
+	reader.params = make(map[string]interface{})
 	if reader.clock != nil {
 		reader.clock.RewindEvent()
 	}
@@ -424,14 +463,23 @@ func (reader *BinaryDataFileReader) processMessages() {
 	HEAD1 := int(reader.HEAD1)
 	HEAD2 := int(reader.HEAD2)
 
+	badStart := -1
+
 	for offset+headerSizeAdjustment < reader.dataLen {
 		// Check for valid message header
 		hdr := reader.dataMap[offset : offset+headerSizeAdjustment]
-		if int(hdr[0]) != HEAD1 || int(hdr[1]) != HEAD2 {
-			reader.handleBadHeader(offset, hdr)
+		if int(hdr[0]) != HEAD1 || int(hdr[1]) != HEAD2 ||
+			(badStart >= 0 && reader.resync != ResyncScan && !reader.confirmHeader(offset)) {
+			if badStart < 0 {
+				badStart = offset
+			}
 			offset++
 			continue
 		}
+		if badStart >= 0 {
+			reader.handleBadHeader(badStart, offset)
+			badStart = -1
+		}
 
 		mtype := int(hdr[2])
 		reader.offsets[mtype] = append(reader.offsets[mtype], offset)
@@ -439,6 +487,12 @@ func (reader *BinaryDataFileReader) processMessages() {
 		// Process first occurrence of a message type
 		if lengths[mtype] == -1 {
 			reader.processFirstMessageType(offset, mtype, lengths)
+			if lengths[mtype] == -1 {
+				// no length for an unknown type, resynchronise on the next header
+				reader.skip(offset, offset+1)
+				offset++
+				continue
+			}
 		} else {
 			// Process instance fields for known message types
 			reader.processInstanceField(offset, mtype, typeInstances)
@@ -447,6 +501,11 @@ func (reader *BinaryDataFileReader) processMessages() {
 		reader.counts[mtype]++
 		mlen := lengths[mtype]
 
+		reader.messageProgress(offset)
+		if reader.progress.messages%cancelCheckInterval == 0 && reader.ctx.Err() != nil {
+			return
+		}
+
 		// Process format messages
 		if mtype == int(FmtTypeDefault) {
 			reader.processDefaultFormat(mtype, offset, mlen)
@@ -459,14 +518,23 @@ func (reader *BinaryDataFileReader) processMessages() {
 
 		offset += mlen
 	}
+
+	if badStart >= 0 {
+		reader.handleBadHeader(badStart, offset)
+	}
+	reader.finishPass()
 }
 
-// log errors for invalid message headers
-func (reader *BinaryDataFileReader) handleBadHeader(offset int, header []byte) {
-	// Log error if not near end of file
-	if int(reader.dataLen)-offset >= EndOfFileGarbageLimit || reader.dataLen < EndOfFileGarbageLimit {
-		fmt.Fprintf(os.Stderr, "bad header 0x%02x 0x%02x at %d\n", header[0], header[1], offset)
+// records a run of bytes without a valid message header. A run near the end of the file is the
+// incomplete last block of a log that was cut off.
+func (reader *BinaryDataFileReader) handleBadHeader(start int, end int) {
+	reader.skip(start, end)
+	if int(reader.dataLen)-start >= EndOfFileGarbageLimit || reader.dataLen < EndOfFileGarbageLimit {
+		reader.diagnose(DiagnosticBadHeader, start, end-start, -1, "bad header 0x%02x 0x%02x at %d, skipped %d bytes",
+			reader.dataMap[start], reader.dataMap[start+1], start, end-start)
+		return
 	}
+	reader.diagnose(DiagnosticTruncated, start, end-start, -1, "incomplete data at end of file at %d, skipped %d bytes", start, end-start)
 }
 
 func (reader *BinaryDataFileReader) processFirstMessageType(offset int, messageType int, lengths []int) {
@@ -477,7 +545,7 @@ func (reader *BinaryDataFileReader) processFirstMessageType(offset int, messageT
 
 	reader.offset = offset
 	if _, err := reader.ParseNext(); err != nil {
-		fmt.Fprintf(os.Stderr, "error parsing next: %v\n", err)
+		// ParseNext has recorded the diagnostic
 		return
 	}
 
@@ -492,15 +560,21 @@ func (reader *BinaryDataFileReader) processFirstMessageType(offset int, messageT
 
 func (reader *BinaryDataFileReader) handleUnknownMessageType(offset int, messageType int) {
 	if int(reader.dataLen)-offset >= EndOfFileGarbageLimit || reader.dataLen < EndOfFileGarbageLimit {
-		fmt.Fprintf(os.Stderr, "unknown msg type 0x%02x (%d) at %d\n", messageType, messageType, offset)
+		reader.diagnose(DiagnosticUnknownType, offset, headerSizeAdjustment, messageType, "unknown msg type 0x%02x (%d) at %d", messageType, messageType, offset)
 	}
 }
 
 func (reader *BinaryDataFileReader) processInstanceField(offset int, messageType int, typeInstances map[int]map[string]struct{}) {
 	dataFileFormat := reader.formats[messageType]
 	if dataFileFormat.InstanceField != nil {
+		start := offset + headerSizeAdjustment + dataFileFormat.InstanceOffset
+		end := start + dataFileFormat.InstanceLength
+		if start < offset || end > reader.dataLen || end < start {
+			return
+		}
+
 		// Extract instance data
-		idata := reader.dataMap[offset+headerSizeAdjustment+dataFileFormat.InstanceOffset : offset+headerSizeAdjustment+dataFileFormat.InstanceOffset+dataFileFormat.InstanceLength]
+		idata := reader.dataMap[start:end]
 
 		// Initialize map for this message type if not exists
 		if _, ok := typeInstances[messageType]; !ok {
@@ -513,7 +587,7 @@ func (reader *BinaryDataFileReader) processInstanceField(offset int, messageType
 			typeInstances[messageType][idataStr] = struct{}{}
 			reader.offset = offset
 			if _, err := reader.ParseNext(); err != nil {
-				fmt.Fprintf(os.Stderr, "error parsing next: %v\n", err)
+				// ParseNext has recorded the diagnostic
 				return
 			}
 		}
@@ -534,10 +608,10 @@ func (reader *BinaryDataFileReader) resetOffset() {
 
 // handles the processing of format messages
 func (reader *BinaryDataFileReader) processDefaultFormat(messageType, offset, messageLength int) {
-	body := reader.dataMap[offset+headerSizeAdjustment : offset+messageLength]
-	if len(body)+headerSizeAdjustment < messageLength {
+	if offset+messageLength > reader.dataLen {
 		return
 	}
+	body := reader.dataMap[offset+headerSizeAdjustment : offset+messageLength]
 
 	unpacker := reader.unpackers[messageType]
 	if unpacker == nil {
@@ -550,8 +624,8 @@ func (reader *BinaryDataFileReader) processDefaultFormat(messageType, offset, me
 	}
 
 	err = reader.processFmtMessage(elements)
-	if err != nil{
-		fmt.Println("process FMT Message error.")
+	if err != nil {
+		reader.diagnose(DiagnosticBadFormat, offset, messageLength, messageType, "bad FMT message at %d: %v", offset, err)
 	}
 }
 
@@ -562,10 +636,10 @@ func (reader *BinaryDataFileReader) needFmtuType(messageType int) bool {
 // process FMTU (Format Unit) messages
 func (reader *BinaryDataFileReader) processFmtuType(messageType, offset, messageLength int) {
 	dataFormat := reader.formats[messageType]
-	body := reader.dataMap[offset+headerSizeAdjustment : offset+messageLength]
-	if len(body)+headerSizeAdjustment < messageLength {
+	if offset+messageLength > reader.dataLen {
 		return
 	}
+	body := reader.dataMap[offset+headerSizeAdjustment : offset+messageLength]
 
 	// Get the unpacker function for this message type
 	unpacker := reader.unpackers[messageType]
@@ -585,95 +659,158 @@ func (reader *BinaryDataFileReader) processFmtuType(messageType, offset, message
 	// Unit IDs and Multiplier IDs might be optional metadata for some data types.
 	// Only setting them when they exist allows the system to work with both detailed and simple data formats.
 
+	if len(elements) < 2 {
+		return
+	}
 	formatType, _ := elements[1].(int)
 	if fmt2, ok := reader.formats[formatType]; ok {
 		// If UnitIds exist in the column hash, set them for the format
-		if _, columnExists := dataFormat.ColumnHash["UnitIds"]; columnExists {
-			unitIds := nullTerm(string(elements[dataFormat.ColumnHash["UnitIds"]].([]byte)))
+		if unitIds, ok := stringElement(elements, dataFormat.ColumnHash, "UnitIds"); ok {
 			fmt2.SetUnitIds(&unitIds)
 		}
 
-		if _, columnExists := dataFormat.ColumnHash["MultIds"]; columnExists {
-			multIds := nullTerm(string(elements[dataFormat.ColumnHash["MultIds"]].([]byte)))
+		if multIds, ok := stringElement(elements, dataFormat.ColumnHash, "MultIds"); ok {
 			fmt2.SetMultIds(&multIds)
 		}
 	}
 }
 
 func (reader *BinaryDataFileReader) ParseNext() (*DataFileMessage, error) {
-	var messageType int
+	if err := reader.ctx.Err(); err != nil {
+		return nil, fmt.Errorf("parse cancelled at %d: %w", reader.offset, err)
+	}
 
-	// Loop until a valid message header is found
-	for {
-		if reader.dataLen-reader.offset < headerSizeAdjustment {
-			return nil, fmt.Errorf("insufficient data for message header")
-		}
+	// set once bytes have been skipped, the next header then has to be confirmed
+	resyncing := false
 
-		header := reader.dataMap[reader.offset : reader.offset+headerSizeAdjustment]
-		if header[0] == reader.HEAD1 && header[1] == reader.HEAD2 {
-			messageType = int(header[2])
+	for {
+		var messageType int
+
+		// Loop until a valid message header is found
+		for {
+			if reader.dataLen-reader.offset < headerSizeAdjustment {
+				if reader.progress.stage != ProgressIndex {
+					reader.finishPass()
+				}
+				return nil, io.EOF
+			}
 
-			// Check if the message type is known
-			if _, ok := reader.formats[messageType]; ok {
-				reader.prevType = messageType
-				break
+			header := reader.dataMap[reader.offset : reader.offset+headerSizeAdjustment]
+			if header[0] == reader.HEAD1 && header[1] == reader.HEAD2 {
+				messageType = int(header[2])
+
+				// Check if the message type is known
+				if dataFormat, ok := reader.formats[messageType]; ok {
+					if !resyncing || reader.confirmHeader(reader.offset) {
+						reader.prevType = messageType
+						break
+					}
+					reader.diagnose(DiagnosticFalseHeader, reader.offset, headerSizeAdjustment, messageType,
+						"false %s header at %d, the messages after it do not line up", dataFormat.Name, reader.offset)
+				}
 			}
+
+			reader.offset++
+			reader.remaining--
+			resyncing = reader.resync != ResyncScan
 		}
 
-		reader.offset++
-		reader.remaining--
-	}
+		messageOffset := reader.offset
+		reader.offset += headerSizeAdjustment
+		reader.remaining = len(reader.dataMap) - reader.offset
 
-	reader.offset += headerSizeAdjustment
-	reader.remaining = len(reader.dataMap) - reader.offset
+		// Get the format for this message type
+		dataFormat, ok := reader.formats[messageType]
+		if !ok {
+			return nil, newParseError(messageOffset, "", ErrUnknownFormat, "unknown message type: %d", messageType)
+		}
 
-	// Get the format for this message type
-	dataFormat, ok := reader.formats[messageType]
-	if !ok {
-		return nil, fmt.Errorf("unknown message type: %d", messageType)
-	}
+		// Check if there's enough data for the full message
+		if reader.remaining < dataFormat.Len-headerSizeAdjustment {
+			reader.diagnose(DiagnosticTruncated, messageOffset, reader.dataLen-messageOffset, messageType,
+				"truncated %s message at %d: %d of %d bytes", dataFormat.Name, messageOffset, reader.dataLen-messageOffset, dataFormat.Len)
+			if reader.truncatedTail(messageOffset) {
+				reader.offset = reader.dataLen
+				continue
+			}
+			if reader.resync == ResyncSalvage {
+				reader.salvageFrom(messageOffset)
+				resyncing = true
+				continue
+			}
+			return nil, newParseError(messageOffset, dataFormat.Name, ErrTruncated, "out of data")
+		}
 
-	// Check if there's enough data for the full message
-	if reader.remaining < dataFormat.Len-headerSizeAdjustment {
-		return nil, fmt.Errorf("out of data")
-	}
+		// Extract the message body
+		body := reader.dataMap[reader.offset : reader.offset+dataFormat.Len-headerSizeAdjustment]
 
-	// Extract the message body
-	body := reader.dataMap[reader.offset : reader.offset+dataFormat.Len-headerSizeAdjustment]
+		// Unpack the message elements
+		elements, err := reader.unpackMessageElements(messageOffset, messageType, dataFormat, body)
+		if err != nil {
+			if errors.Is(err, ErrTruncated) && reader.truncatedTail(messageOffset) {
+				reader.offset = reader.dataLen
+				continue
+			}
+			if reader.resync == ResyncSalvage {
+				reader.salvageFrom(messageOffset)
+				resyncing = true
+				continue
+			}
+			return nil, err
+		}
 
-	// Unpack the message elements
-	elements, err := reader.unpackMessageElements(messageType, dataFormat, body)
-	if err != nil {
-		return nil, err
-	}
+		if elements == nil {
+			continue
+		}
 
-	if elements == nil {
-		return reader.ParseNext()
-	}
+		dataFileMessage := NewDFMessage(dataFormat, elements, true, reader)
+		dataFileMessage.Offset = messageOffset
 
-	// If this is a format message, process it
-	if dataFormat.Name == FormatName {
-		if err := reader.processFmtMessage(elements); err != nil {
-			return reader.ParseNext()
+		// A header found after skipping bytes is only taken if its time fits the log, and an FMT
+		// message only if it does not redefine a known format
+		if resyncing && !reader.plausibleTime(dataFileMessage) {
+			reader.diagnose(DiagnosticFalseHeader, messageOffset, dataFormat.Len, messageType,
+				"false %s header at %d, its time since boot does not fit the log", dataFormat.Name, messageOffset)
+			reader.salvageFrom(messageOffset)
+			continue
+		}
+		if resyncing && dataFormat.Name == FormatName && !reader.plausibleFormat(elements) {
+			reader.diagnose(DiagnosticFalseHeader, messageOffset, dataFormat.Len, messageType,
+				"false %s header at %d, it redefines a known format", dataFormat.Name, messageOffset)
+			reader.salvageFrom(messageOffset)
+			continue
 		}
-	}
 
-	// Update reader state
-	reader.offset += dataFormat.Len - headerSizeAdjustment
-	reader.remaining = reader.dataLen - reader.offset
-	dataFileMessage := NewDFMessage(dataFormat, elements, true, reader)
+		// If this is a format message, process it. A rejected definition is still returned, so
+		// Validate can report it.
+		if dataFormat.Name == FormatName {
+			if err := reader.processFmtMessage(elements); err != nil {
+				reader.diagnose(DiagnosticBadFormat, messageOffset, dataFormat.Len, messageType, "bad FMT message at %d: %v", messageOffset, err)
+			}
+		}
+		if timeUS, ok := dataFileMessage.TimeUS(); ok {
+			reader.lastTimeUS, reader.hasLastTime = int64(timeUS), true
+		}
 
-	// Add the message to the reader's message list
-	reader.addMessage(dataFileMessage)
+		// Update reader state
+		reader.offset += dataFormat.Len - headerSizeAdjustment
+		reader.remaining = reader.dataLen - reader.offset
 
-	// Update progress percentage
-	reader.Percent = PercentMultiplier * float64(reader.offset) / float64(reader.dataLen)
+		// Add the message to the reader's message list
+		reader.addMessage(dataFileMessage)
 
-	return dataFileMessage, nil
+		// Update progress percentage
+		reader.Percent = PercentMultiplier * float64(reader.offset) / float64(reader.dataLen)
+		if reader.progress.stage != ProgressIndex {
+			reader.messageProgress(reader.offset)
+		}
+
+		return dataFileMessage, nil
+	}
 }
 
 // unpack the message elements based on the message type and format
-func (reader *BinaryDataFileReader) unpackMessageElements(messageType int, dataFormat *DataFileFormat, body []byte) ([]interface{}, error) {
+func (reader *BinaryDataFileReader) unpackMessageElements(messageOffset int, messageType int, dataFormat *DataFileFormat, body []byte) ([]interface{}, error) {
 	// If unpacker for this message type doesn't exist, create one
 	if _, ok := reader.unpackers[messageType]; !ok {
 		unpacker := dataFormat.getUnpacker()
@@ -687,29 +824,59 @@ func (reader *BinaryDataFileReader) unpackMessageElements(messageType int, dataF
 	if err != nil {
 		// Handle error if near end of file
 		if reader.remaining < EndOfFileGarbageLimit {
-			return nil, fmt.Errorf("no valid data")
+			reader.diagnose(DiagnosticTruncated, messageOffset, len(body)+headerSizeAdjustment, messageType,
+				"incomplete %s message at end of file at %d", dataFormat.Name, messageOffset)
+			return nil, newParseError(messageOffset, dataFormat.Name, ErrTruncated, "no valid data")
 		}
 
-		fmt.Fprintf(os.Stderr, "Failed to parse %s/%s with len %d (remaining %d)\n",
-			dataFormat.Name, dataFormat.MessageStruct, len(body), reader.remaining)
-		return nil, err
+		reader.diagnose(DiagnosticUnpackFailed, messageOffset, len(body)+headerSizeAdjustment, messageType,
+			"failed to parse %s/%s with len %d (remaining %d): %v", dataFormat.Name, dataFormat.MessageStruct, len(body), reader.remaining, err)
+		return nil, newParseError(messageOffset, dataFormat.Name, ErrFieldType, "%v", err)
+	}
+	if len(elements) != len(dataFormat.MessageFormats) {
+		reader.diagnose(DiagnosticUnpackFailed, messageOffset, len(body)+headerSizeAdjustment, messageType,
+			"failed to parse %s/%s: %d of %d fields in %d bytes", dataFormat.Name, dataFormat.Format, len(elements), len(dataFormat.MessageFormats), len(body))
+		return nil, newParseError(messageOffset, dataFormat.Name, ErrTruncated, "%d of %d fields in %d bytes", len(elements), len(dataFormat.MessageFormats), len(body))
 	}
 
 	// Convert specific elements to int16 slices if needed
 	for _, aIndex := range dataFormat.AIndexes {
 		if aIndex < len(elements) {
-			elements[aIndex], _ = bytesToInt16Slice(elements[aIndex].([]byte))
+			switch value := elements[aIndex].(type) {
+			case []byte:
+				elements[aIndex], _ = bytesToInt16Slice(value)
+			case string:
+				elements[aIndex], _ = bytesToInt16Slice([]byte(value))
+			}
 		}
 	}
 
 	return elements, nil
 }
 
+// returns a string field of an FMTU message, unpacked as a string or bytes
+func stringElement(elements []interface{}, columnHash map[string]int, column string) (string, bool) {
+	index, ok := columnHash[column]
+	if !ok || index >= len(elements) {
+		return "", false
+	}
+	switch value := elements[index].(type) {
+	case string:
+		return nullTerm(value), true
+	case []byte:
+		return nullTerm(string(value)), true
+	}
+	return "", false
+}
+
 // process a format (FMT) message
 func (reader *BinaryDataFileReader) processFmtMessage(elements []interface{}) error {
+	if len(elements) < 5 {
+		return fmt.Errorf("%w: FMT message with %d fields", ErrFieldType, len(elements))
+	}
 	formatType, ok := elements[0].(int)
 	if !ok {
-		return fmt.Errorf("unexpected type for FMT message")
+		return fmt.Errorf("%w: unexpected type for FMT message", ErrFieldType)
 	}
 
 	// Extract and process name, format, and columns
@@ -720,7 +887,22 @@ func (reader *BinaryDataFileReader) processFmtMessage(elements []interface{}) er
 	bytesSlice, _ := elements[4].(string)
 	btslicename := strings.TrimRight(bytesSlice, "\x00")
 	columns := strings.Split(btslicename, ",")
+	if btslicename == "" {
+		columns = []string{}
+	}
 	length, _ := elements[1].(int)
+	if length < headerSizeAdjustment {
+		return fmt.Errorf("%w: %s declares length %d", ErrUnknownFormat, name, length)
+	}
+	if len(columns) != len(format) {
+		return fmt.Errorf("%w: %s has %d columns for format %q", ErrUnknownFormat, name, len(columns), format)
+	}
+
+	// Keep the format when a later pass reads its FMT message again, with the units set by FMTU
+	if existing, ok := reader.formats[formatType]; ok && existing.Name == name && existing.Len == length &&
+		existing.Format == format && strings.Join(existing.Columns, ",") == btslicename {
+		return nil
+	}
 
 	// Create new data file format
 	dataFormat, err := NewDataFileFormat(formatType, name, length, format, columns, reader.formats[formatType])
@@ -753,6 +935,11 @@ func bytesToInt16Slice(b []byte) ([]int16, error) {
 	return result, nil
 }
 
+// Formats returns the message formats known to the reader, keyed by message type id
+func (reader *BinaryDataFileReader) Formats() map[int]*DataFileFormat {
+	return reader.formats
+}
+
 // finds an unused format type number. By searching for unused IDs, it ensures that new formats
 // don't overwrite or conflict with existing ones.
 func (reader *BinaryDataFileReader) FindUnusedFormat() int {
@@ -779,50 +966,46 @@ func (reader *BinaryDataFileReader) addMessage(dataMessage *DataFileMessage) {
 	messageType := dataMessage.GetType()
 	reader.Messages[messageType] = dataMessage
 
-	message := dataMessage.GetMessage()
-	if messageType == "MSG" && message != "" {
-		switch {
-		case strings.Contains(message, "Rover"):
-			reader.MavType = MavTypeGroundRover
-		case strings.Contains(message, "Plane"):
-			reader.MavType = MavTypeFixedWing
-		case strings.Contains(message, "Copter"):
-			reader.MavType = MavTypeQuadrotor
-		case strings.HasPrefix(message, "Antenna"):
-			reader.MavType = MavTypeAntennaTracker
-		case strings.Contains(message, "ArduSub"):
-			reader.MavType = MavTypeSubmarine
-		case strings.Contains(message, "Blimp"):
-			reader.MavType = MavTypeAirship
-		}
+	// Attach the UTC time of the message
+	reader.timestampMessage(dataMessage)
+
+	// Identify the vehicle and firmware from the VER, MSG banner, frame parameters and HEARTBEAT
+	reader.updateVehicleInfo(messageType, dataMessage)
+
+	if messageType == parameterMessage {
+		reader.updateParams(dataMessage)
 	}
 
 	// Code to demonstrate that we can capture the flightmode settings throughout the flight
 	if messageType == "MODE" {
 		mode := dataMessage.GetMode()
 		if mode != -1 {
-			reader.flightmode = modeStringACM(mode)
+			reader.flightmode = modeString(reader.MavType, mode)
 		} else {
 			reader.flightmode = "UNKNOWN"
 		}
 	}
 
+	// Track the arming state from ARM messages, or from the armed/disarmed events of older logs
+	switch messageType {
+	case "ARM":
+		if state, err := dataMessage.GetAttribute("ArmState"); err == nil {
+			armState, ok := state.(int)
+			reader.armed = ok && armState != 0
+		}
+	case "EV":
+		if id, err := dataMessage.GetAttribute("Id"); err == nil {
+			switch id {
+			case EventIDArmed:
+				reader.armed = true
+			case EventIDDisarmed:
+				reader.armed = false
+			}
+		}
+	}
+
 	// Future work around the PX4 not Ardupilot.
 	// if msgType == "STAT" && contains(m.FieldNames, "MainState") {
 	//	d.flightmode = m.MainState // Placeholder for px4(m.MainState)
 	//	}
 }
-
-func modeStringACM(modeNumber int) string {
-	if mode, ok := modeMappingACM[modeNumber]; ok {
-		return mode
-	}
-	return fmt.Sprintf("Mode(%d)", modeNumber)
-}
-
-// func modeStringAPM(modeNumber int) string {
-//	if mode, ok := modeMappingAPM[modeNumber]; ok {
-//		return mode
-//	}
-//	return fmt.Sprintf("Mode(%d)", modeNumber)
-// }
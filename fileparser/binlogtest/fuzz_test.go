@@ -0,0 +1,64 @@
+package binlogtest
+
+import (
+	"testing"
+)
+
+/*
+This code holds the fuzz targets of the reader. Each target is seeded with the synthetic logs of
+SeedCorpus and fails when the reader panics, does not end or allocates memory out of proportion to
+its input. Run one with go test -fuzz=FuzzParseNext ./fileparser/binlogtest; without -fuzz only the
+seeds are checked. The reader reads every input many times, so minimizing each new input takes long:
+add -fuzzminimizetime=1x to keep the fuzzer exploring.
+*/
+
+func FuzzNewBinaryDataFileReader(f *testing.F) {
+	for _, seed := range SeedCorpus() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := CheckReader(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// FuzzParseNext reads arbitrary messages after valid format definitions, so the fuzzer explores
+// message bodies rather than formats
+func FuzzParseNext(f *testing.F) {
+	builder := NewBuilder()
+	for _, format := range append(StandardFormats(), sampleFormats()...) {
+		if err := builder.Declare(format); err != nil {
+			f.Fatal(err)
+		}
+	}
+	formats := builder.Bytes()
+
+	for _, seed := range SeedCorpus() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, messages []byte) {
+		data := append(append([]byte{}, formats...), messages...)
+		if err := CheckReader(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzNewDataFileFormat(f *testing.F) {
+	for _, format := range append(StandardFormats(), sampleFormats()...) {
+		length, err := format.Length()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(format.Type, format.Name, length, format.Format, format.Columns, make([]byte, length-headerLength))
+	}
+	f.Add(FMTUType, "FMTU", 3, "", "", []byte{})
+	f.Add(200, "BAD", 10, "QQQ", "A,B", []byte{1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, typ int, name string, length int, format string, columns string, body []byte) {
+		if err := CheckFormat(typ, name, length, format, columns, body); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
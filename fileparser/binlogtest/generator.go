@@ -0,0 +1,250 @@
+package binlogtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+/*
+This code builds binary data file byte streams for tests of the reader. A Builder declares formats
+with FMT messages, optionally their units and multipliers with FMTU messages, and then writes
+messages of those formats from Go values, encoding each field by its format character the way
+ArduPilot does. Values are given as the reader returns them: integers for the integer and 'L'
+characters, float64 in units for the scaled 'c', 'C', 'e' and 'E' characters, strings for 'n', 'N'
+and 'Z' and []int16 for 'a' arrays. StandardFormats declares GPS and ATT messages laid out as in
+ArduPilot 4, with the GPS instance field, so a builder can produce logs close to real ones.
+*/
+
+// message types of the formats declared by the builder itself
+const (
+	FMTType  = 128
+	FMTUType = 64
+	GPSType  = 130
+	ATTType  = 131
+
+	headerLength = 3
+)
+
+const (
+	head1 = 0xA3
+	head2 = 0x95
+
+	scaledMultiplier = 100 // 'c', 'C', 'e' and 'E' fields are logged in hundredths
+)
+
+// size in bytes of each format character
+var fieldSizes = map[byte]int{
+	'a': 64, 'b': 1, 'B': 1, 'M': 1, 'c': 2, 'C': 2, 'h': 2, 'H': 2, 'e': 4, 'E': 4, 'f': 4,
+	'i': 4, 'I': 4, 'L': 4, 'n': 4, 'd': 8, 'q': 8, 'Q': 8, 'N': 16, 'Z': 64,
+}
+
+// Format is a message format declared with an FMT message. Units and Mults, when set, are written
+// in an FMTU message; a '#' unit marks the instance field.
+type Format struct {
+	Type    int
+	Name    string
+	Format  string
+	Columns string
+	Units   string
+	Mults   string
+}
+
+// Length returns the length of the messages of the format, header included, or an error for an
+// unknown format character
+func (format Format) Length() (int, error) {
+	length := headerLength
+	for i := 0; i < len(format.Format); i++ {
+		size, ok := fieldSizes[format.Format[i]]
+		if !ok {
+			return 0, fmt.Errorf("unknown format character '%c' in %s", format.Format[i], format.Name)
+		}
+		length += size
+	}
+	return length, nil
+}
+
+// StandardFormats returns the GPS and ATT formats of ArduPilot 4
+func StandardFormats() []Format {
+	return []Format{
+		{
+			Type:    GPSType,
+			Name:    "GPS",
+			Format:  "QBBIHBcLLeffffB",
+			Columns: "TimeUS,I,Status,GMS,GWk,NSats,HDop,Lat,Lng,Alt,Spd,GCrs,VZ,Yaw,U",
+			Units:   "s#-s-S-DUmnhnh-",
+			Mults:   "F--C----GGB----",
+		},
+		{
+			Type:    ATTType,
+			Name:    "ATT",
+			Format:  "QccccCCCCB",
+			Columns: "TimeUS,DesRoll,Roll,DesPitch,Pitch,DesYaw,Yaw,ErrRP,ErrYaw,AEKF",
+			Units:   "sddddhhdh-",
+			Mults:   "FBBBBBB---",
+		},
+	}
+}
+
+// Builder writes a binary data file
+type Builder struct {
+	buffer  bytes.Buffer
+	formats map[int]Format
+	units   bool // the FMTU format has been declared
+}
+
+// NewBuilder returns a builder with only the FMT format declared, as every log starts
+func NewBuilder() *Builder {
+	return &Builder{formats: map[int]Format{
+		FMTType: {Type: FMTType, Name: "FMT", Format: "BBnNZ", Columns: "Type,Length,Name,Format,Columns"},
+	}}
+}
+
+// Declare writes the FMT message of a format, followed by its FMTU message when it has units or
+// multipliers
+func (builder *Builder) Declare(format Format) error {
+	length, err := format.Length()
+	if err != nil {
+		return err
+	}
+	if err := builder.DeclareRaw(format, length); err != nil {
+		return err
+	}
+	if format.Units == "" && format.Mults == "" {
+		return nil
+	}
+	return builder.Units(format.Type, format.Units, format.Mults)
+}
+
+// DeclareRaw writes the FMT message of a format with the given length, which need not match its
+// format characters, to build malformed logs
+func (builder *Builder) DeclareRaw(format Format, length int) error {
+	if format.Type < 0 || format.Type > math.MaxUint8 || length < 0 || length > math.MaxUint8 {
+		return fmt.Errorf("type %d or length %d of %s out of range", format.Type, length, format.Name)
+	}
+	builder.formats[format.Type] = format
+	return builder.Message(FMTType, format.Type, length, format.Name, format.Format, format.Columns)
+}
+
+// Units writes the FMTU message of a declared format, declaring the FMTU format first if needed
+func (builder *Builder) Units(typ int, units string, mults string) error {
+	if !builder.units {
+		fmtu := Format{Type: FMTUType, Name: "FMTU", Format: "QBNN", Columns: "TimeUS,FmtType,UnitIds,MultIds"}
+		length, _ := fmtu.Length()
+		if err := builder.DeclareRaw(fmtu, length); err != nil {
+			return err
+		}
+		builder.units = true
+	}
+	return builder.Message(FMTUType, 0, typ, units, mults)
+}
+
+// Message writes a message of a declared format with one value per format character
+func (builder *Builder) Message(typ int, values ...interface{}) error {
+	format, ok := builder.formats[typ]
+	if !ok {
+		return fmt.Errorf("message type %d is not declared", typ)
+	}
+	if len(values) != len(format.Format) {
+		return fmt.Errorf("%s needs %d values, got %d", format.Name, len(format.Format), len(values))
+	}
+
+	body := bytes.Buffer{}
+	for i, value := range values {
+		if err := encodeField(&body, format.Format[i], value); err != nil {
+			return fmt.Errorf("failed to encode %s field %d: %v", format.Name, i, err)
+		}
+	}
+
+	builder.buffer.Write([]byte{head1, head2, byte(typ)})
+	builder.buffer.Write(body.Bytes())
+	return nil
+}
+
+// Raw writes bytes as they are, to build corrupted logs
+func (builder *Builder) Raw(data []byte) {
+	builder.buffer.Write(data)
+}
+
+// Bytes returns the data file written so far
+func (builder *Builder) Bytes() []byte {
+	return append([]byte{}, builder.buffer.Bytes()...)
+}
+
+// encodes a value as a field of the given format character
+func encodeField(body *bytes.Buffer, char byte, value interface{}) error {
+	switch char {
+	case 'n', 'N', 'Z':
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("'%c' needs a string, got %T", char, value)
+		}
+		field := make([]byte, fieldSizes[char])
+		copy(field, text)
+		body.Write(field)
+		return nil
+	case 'a':
+		array, ok := value.([]int16)
+		if !ok {
+			return fmt.Errorf("'a' needs []int16, got %T", value)
+		}
+		field := make([]int16, fieldSizes['a']/2)
+		copy(field, array)
+		return binary.Write(body, binary.LittleEndian, field)
+	}
+
+	number, ok := toFloat(value)
+	if !ok {
+		return fmt.Errorf("'%c' needs a number, got %T", char, value)
+	}
+
+	var field interface{}
+	switch char {
+	case 'b':
+		field = int8(number)
+	case 'B', 'M':
+		field = uint8(number)
+	case 'h':
+		field = int16(number)
+	case 'H':
+		field = uint16(number)
+	case 'i', 'L':
+		field = int32(number)
+	case 'I':
+		field = uint32(number)
+	case 'q':
+		field = int64(number)
+	case 'Q':
+		field = uint64(number)
+	case 'c':
+		field = int16(math.Round(number * scaledMultiplier))
+	case 'C':
+		field = uint16(math.Round(number * scaledMultiplier))
+	case 'e':
+		field = int32(math.Round(number * scaledMultiplier))
+	case 'E':
+		field = uint32(math.Round(number * scaledMultiplier))
+	case 'f':
+		field = float32(number)
+	case 'd':
+		field = number
+	default:
+		return fmt.Errorf("unknown format character '%c'", char)
+	}
+	return binary.Write(body, binary.LittleEndian, field)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	}
+	return 0, false
+}
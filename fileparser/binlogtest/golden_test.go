@@ -0,0 +1,63 @@
+package binlogtest
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden summaries in testdata")
+
+// logs of test_files compared with their golden summaries in testdata
+const goldenLogs = "../../test_files"
+
+func TestGolden5BIN(t *testing.T) {
+	checkGolden(t, "5.BIN")
+}
+
+// compares the summary of a log of test_files with its golden summary, or rewrites the golden
+// summary with -update
+func checkGolden(t *testing.T, name string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(goldenLogs, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", name+".golden")
+
+	if *update {
+		summary, err := Summary(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, []byte(summary), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompareSummary(data, string(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSampleLog(t *testing.T) {
+	data, err := SampleLog(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := Summary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10 s of GPS at 5 Hz for two instances, both ends included
+	if want := "\nGPS count 102 "; !strings.Contains(summary, want) {
+		t.Errorf("summary of the sample log has no line starting with %q:\n%s", want, summary)
+	}
+}
@@ -0,0 +1,274 @@
+package binlogtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+)
+
+/*
+This code holds the checks run by the fuzz targets and golden tests of the reader. CheckReader reads
+arbitrary data with every accessor of the reader and reports a panic, a parse that does not end or
+memory use out of proportion to the data as an error, so a fuzz target only has to call it on its
+input. CheckFormat does the same for a single format definition. Summary renders what the reader
+finds in a log as text, compared with a golden file to catch changes in decoding, and SeedCorpus
+returns the synthetic logs to start fuzzing from.
+*/
+
+const (
+	// memory the reader may allocate per byte of data, over all its passes
+	maxAllocationsPerByte = 4096
+	// memory the reader may allocate whatever the size of the data
+	baseAllocations = 16 << 20
+	// smallest message, a header without fields
+	minMessageLength = 3
+	// length of the seed flight, short so the fuzzer mutates small inputs
+	seedSeconds = 1
+)
+
+// CheckReader reads data with a new reader in every resync mode and exercises every accessor of
+// the messages. It returns an error when the reader panics, returns an error that is not a
+// ParseError, returns more messages than the data can hold or allocates memory out of proportion
+// to the data.
+func CheckReader(data []byte) error {
+	for _, mode := range []fileparser.ResyncMode{fileparser.ResyncScan, fileparser.ResyncValidate, fileparser.ResyncSalvage} {
+		if err := checkReader(data, mode); err != nil {
+			return fmt.Errorf("resync mode %d: %v", mode, err)
+		}
+	}
+	return nil
+}
+
+func checkReader(data []byte, mode fileparser.ResyncMode) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false, fileparser.WithResync(mode))
+	if err != nil {
+		return untypedError("NewBinaryDataFileReader", err)
+	}
+
+	// every message starts with its own header, so there cannot be more messages than this
+	limit := len(data)/minMessageLength + 1
+	messages := 0
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if err := untypedError("ParseNext", err); err != nil {
+				return err
+			}
+			break
+		}
+		messages++
+		if messages > limit {
+			return fmt.Errorf("more than %d messages in %d bytes, the parse does not end", limit, len(data))
+		}
+		exerciseMessage(message)
+	}
+
+	reader.VehicleInfo()
+	if _, err := reader.Validate(fileparser.DefaultValidationOptions()); err != nil {
+		return fmt.Errorf("Validate returned an error: %v", err)
+	}
+	if _, err := reader.TimeIntegrity(fileparser.DefaultTimeIntegrityOptions()); err != nil {
+		if err := untypedError("TimeIntegrity", err); err != nil {
+			return err
+		}
+	}
+	if _, err := reader.ParameterSet(); err != nil {
+		if err := untypedError("ParameterSet", err); err != nil {
+			return err
+		}
+	}
+	if _, err := reader.EventTimeline(); err != nil {
+		if err := untypedError("EventTimeline", err); err != nil {
+			return err
+		}
+	}
+	if _, err := reader.FlightModeTimeline(); err != nil {
+		if err := untypedError("FlightModeTimeline", err); err != nil {
+			return err
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+	allocated := after.TotalAlloc - before.TotalAlloc
+	if budget := uint64(baseAllocations + maxAllocationsPerByte*len(data)); allocated > budget {
+		return fmt.Errorf("allocated %d bytes reading %d bytes of data, more than %d", allocated, len(data), budget)
+	}
+	return nil
+}
+
+// returns an error when err, returned by the named call, does not wrap a ParseError with one of the
+// typed errors of the reader
+func untypedError(call string, err error) error {
+	var parseError *fileparser.ParseError
+	if !errors.As(err, &parseError) {
+		return fmt.Errorf("%s returned an error without a ParseError: %v", call, err)
+	}
+	for _, kind := range []error{fileparser.ErrTruncated, fileparser.ErrUnknownFormat, fileparser.ErrFieldType, fileparser.ErrNoGPS} {
+		if errors.Is(err, kind) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s returned a ParseError of no known kind: %v", call, err)
+}
+
+// calls every accessor of a message
+func exerciseMessage(message *fileparser.DataFileMessage) {
+	message.ToMap()
+	message.GetMode()
+	message.GetMessage()
+	message.TimeUS()
+	message.UTC()
+	for _, field := range message.FieldNames {
+		value, err := message.GetAttribute(field)
+		if err == nil {
+			message.SetAttribute(field, value)
+		}
+	}
+}
+
+// CheckFormat declares a format with the given length and writes a message of it made of body,
+// then reads the result with CheckReader. It returns an error when creating the format or reading
+// the message panics.
+func CheckFormat(typ int, name string, length int, format string, columns string, body []byte) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+
+	// formats the reader cannot create are fine, as long as it does not panic
+	fileparser.NewDataFileFormat(typ, name, length, format, strings.Split(columns, ","), nil)
+
+	builder := NewBuilder()
+	if err := builder.DeclareRaw(Format{Type: typ & 0xff, Name: name, Format: format, Columns: columns}, length&0xff); err != nil {
+		return nil
+	}
+	builder.Raw([]byte{head1, head2, byte(typ)})
+	builder.Raw(body)
+	return CheckReader(builder.Bytes())
+}
+
+// Summary reads a log and describes it as text: the number of messages of each type with the
+// first and last of them, the fields of the first message of each type and the problems found by
+// the reader
+func Summary(data []byte) (string, error) {
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false)
+	if err != nil {
+		return "", fmt.Errorf("failed to read log: %w", err)
+	}
+
+	counts := map[string]int{}
+	first := map[string]*fileparser.DataFileMessage{}
+	last := map[string]*fileparser.DataFileMessage{}
+	total := 0
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read log: %w", err)
+		}
+		total++
+		messageType := message.GetType()
+		counts[messageType]++
+		if first[messageType] == nil {
+			first[messageType] = message
+		}
+		last[messageType] = message
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{fmt.Sprintf("messages %d in %d bytes", total, len(data))}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s count %d first %d last %d", name, counts[name], first[name].Offset, last[name].Offset))
+		lines = append(lines, fmt.Sprintf("%s first %s", name, formatFields(first[name])))
+	}
+
+	report := reader.ParseReport()
+	kinds := make([]string, 0, len(report.Counts))
+	for kind := range report.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		lines = append(lines, fmt.Sprintf("diagnostic %s %d", kind, report.Counts[kind]))
+	}
+	lines = append(lines, fmt.Sprintf("skipped %d bytes", report.SkippedBytes))
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// formats the fields of a message in column order
+func formatFields(message *fileparser.DataFileMessage) string {
+	fields := []string{}
+	for _, field := range message.FieldNames {
+		value, err := message.GetAttribute(field)
+		if err != nil {
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s=%v", field, value))
+	}
+	return strings.Join(fields, " ")
+}
+
+// SeedCorpus returns logs to start fuzzing from: a synthetic flight, the same flight cut short and
+// with a corrupted region, and an empty log
+func SeedCorpus() [][]byte {
+	sample, err := SampleLog(seedSeconds)
+	if err != nil {
+		return [][]byte{{}}
+	}
+
+	corrupted := append([]byte{}, sample...)
+	for i := len(corrupted) / 2; i < len(corrupted)/2+100; i++ {
+		corrupted[i] = byte(i * 7)
+	}
+	return [][]byte{sample, sample[:len(sample)*2/3], corrupted, {}}
+}
+
+// CompareSummary compares the summary of a log with a golden summary and reports the first line
+// that differs
+func CompareSummary(data []byte, golden string) error {
+	summary, err := Summary(data)
+	if err != nil {
+		return err
+	}
+	got, want := strings.Split(summary, "\n"), strings.Split(golden, "\n")
+	for i := 0; i < len(got) || i < len(want); i++ {
+		if i >= len(got) || i >= len(want) || got[i] != want[i] {
+			return fmt.Errorf("summary differs from the golden summary at line %d:\n got: %s\nwant: %s", i+1, lineAt(got, i), lineAt(want, i))
+		}
+	}
+	return nil
+}
+
+func lineAt(lines []string, i int) string {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return "(end of summary)"
+}
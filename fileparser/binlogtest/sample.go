@@ -0,0 +1,102 @@
+package binlogtest
+
+import (
+	"math"
+)
+
+/*
+This code generates a synthetic flight log for tests. The vehicle boots, logs its parameters, arms,
+switches to AUTO and flies a circle around a home position, logging two GPS instances at 5 Hz,
+ATT at 25 Hz and an array message, and writes MSG text messages on the way, so the log covers
+every kind of field the reader decodes: integers, scaled values, positions, strings and arrays.
+*/
+
+// message types of the other formats of the sample log
+const (
+	PARMType  = 132
+	MODEType  = 133
+	MSGType   = 134
+	EVType    = 135
+	ArrayType = 136
+)
+
+const (
+	sampleWeek       = 2200 // GPS week of the sample flight, in 2022
+	sampleStartTOWMS = 300000000
+	sampleHomeLat    = -35.3632621
+	sampleHomeLng    = 149.1652374
+	sampleRadius     = 0.0005 // radius of the circle flown, in degrees
+	gpsPeriodUS      = 200000
+	attitudePeriodUS = 40000
+	bootDelayUS      = 2000000 // time since boot of the first GPS fix
+	scaledDegrees    = 1e7
+	autoMode         = 3
+	eventArmed       = 10
+	eventDisarmed    = 11
+)
+
+// sampleFormats returns the formats of the sample log other than the standard ones
+func sampleFormats() []Format {
+	return []Format{
+		{Type: PARMType, Name: "PARM", Format: "QNf", Columns: "TimeUS,Name,Value"},
+		{Type: MODEType, Name: "MODE", Format: "QMBB", Columns: "TimeUS,Mode,ModeNum,Rsn"},
+		{Type: MSGType, Name: "MSG", Format: "QZ", Columns: "TimeUS,Message"},
+		{Type: EVType, Name: "EV", Format: "QB", Columns: "TimeUS,Id"},
+		{Type: ArrayType, Name: "ARR", Format: "Qa", Columns: "TimeUS,Data"},
+	}
+}
+
+// SampleLog returns a synthetic log of a flight lasting the given number of seconds
+func SampleLog(seconds int) ([]byte, error) {
+	builder := NewBuilder()
+	for _, format := range append(StandardFormats(), sampleFormats()...) {
+		if err := builder.Declare(format); err != nil {
+			return nil, err
+		}
+	}
+
+	steps := []func() error{
+		func() error { return builder.Message(MSGType, 0, "ArduCopter V4.3.0 (synthetic)") },
+		func() error { return builder.Message(PARMType, 0, "FENCE_ENABLE", 1.0) },
+		func() error { return builder.Message(PARMType, 0, "FENCE_ALT_MAX", 100.0) },
+		func() error { return builder.Message(EVType, bootDelayUS, eventArmed) },
+		func() error { return builder.Message(MODEType, bootDelayUS, autoMode, autoMode, 2) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+
+	endUS := bootDelayUS + seconds*1000000
+	for timeUS := bootDelayUS; timeUS <= endUS; timeUS += attitudePeriodUS {
+		angle := 2 * math.Pi * float64(timeUS-bootDelayUS) / float64(endUS-bootDelayUS+1)
+		if err := builder.Message(ATTType, timeUS, 0.0, 5*math.Sin(angle), 0.0, -2.0, 90.0, 90+360*angle/(2*math.Pi), 0.1, 0.2, 1); err != nil {
+			return nil, err
+		}
+
+		if (timeUS-bootDelayUS)%gpsPeriodUS != 0 {
+			continue
+		}
+		lat := sampleHomeLat + sampleRadius*math.Sin(angle)
+		lng := sampleHomeLng + sampleRadius*math.Cos(angle)
+		towMS := sampleStartTOWMS + (timeUS-bootDelayUS)/1000
+		for instance := 0; instance < 2; instance++ {
+			if err := builder.Message(GPSType, timeUS, instance, 3, towMS, sampleWeek, 12, 0.8,
+				int(math.Round(lat*scaledDegrees)), int(math.Round(lng*scaledDegrees)), 584.0+float64(instance), 5.0, 90.0, 0.0, 0.0, 1); err != nil {
+				return nil, err
+			}
+		}
+		if err := builder.Message(ArrayType, timeUS, []int16{int16(timeUS / 1000000), -1, 2, -3}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := builder.Message(EVType, endUS, eventDisarmed); err != nil {
+		return nil, err
+	}
+	if err := builder.Message(MSGType, endUS, "Disarming motors"); err != nil {
+		return nil, err
+	}
+	return builder.Bytes(), nil
+}
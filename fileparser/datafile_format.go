@@ -51,6 +51,12 @@ var FormatToUnpackInfo = map[byte][3]interface{}{
 	'Z': {"64s", nil, string("")},
 }
 
+// size in bytes of each format character
+var formatCharSizes = map[byte]int{
+	'a': 64, 'b': 1, 'B': 1, 'M': 1, 'c': 2, 'C': 2, 'h': 2, 'H': 2, 'e': 4, 'E': 4, 'f': 4,
+	'i': 4, 'I': 4, 'L': 4, 'n': 4, 'd': 8, 'q': 8, 'Q': 8, 'N': 16, 'Z': 64,
+}
+
 // returns the byte value of a character, or 0 if the character is null
 func u_ord(c byte) byte {
 	if c == 0 {
@@ -367,22 +373,16 @@ func (dataFormat *DataFileFormat) SetUnitIds(unitIdentifiers *string) {
 	dataFormat.UnitIds = unitIdentifiers
 	instanceIndex := strings.Index(*unitIdentifiers, "#")
 
-	if instanceIndex != -1 {
+	// the instance field must be one of the fields of the format
+	if instanceIndex != -1 && instanceIndex < len(dataFormat.Columns) && instanceIndex < len(dataFormat.Format) {
 		dataFormat.InstanceField = &dataFormat.Columns[instanceIndex]
-		prefixFormat := dataFormat.Format[:instanceIndex]
-		prefixStringFormat := ""
-
-		for _, c := range prefixFormat {
-			if info, ok := FormatToUnpackInfo[byte(c)]; ok {
-				if stringFormat, ok := info[0].(string); ok {
-					prefixStringFormat += stringFormat
-				}
-			}
-		}
 
-		dataFormat.InstanceOffset = binary.Size(prefixStringFormat)
-		instance_format := dataFormat.Format[instanceIndex]
-		dataFormat.InstanceLength = binary.Size(instance_format)
+		// the instance is found in the message body after the fields before it
+		dataFormat.InstanceOffset = 0
+		for i := 0; i < instanceIndex; i++ {
+			dataFormat.InstanceOffset += formatCharSizes[dataFormat.Format[i]]
+		}
+		dataFormat.InstanceLength = formatCharSizes[dataFormat.Format[instanceIndex]]
 	}
 }
 
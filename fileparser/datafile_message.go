@@ -1,12 +1,13 @@
 package fileparser
 
 import (
-	"fmt"
 	"strings"
+	"time"
 )
 
 const (
-	base = 10
+	base              = 10
+	microsecondsPerMs = 1000
 )
 
 // DataFileMessage represents a message in the data file, this implementation specifically
@@ -18,6 +19,8 @@ type DataFileMessage struct {
 	ApplyMultiplier bool
 	FieldNames      []string
 	Parent          *BinaryDataFileReader
+	Offset          int // byte offset of the message header within the data file
+	utc             time.Time
 }
 
 func NewDFMessage(dataFormat *DataFileFormat, elements []interface{}, applyMultiplier bool, reader *BinaryDataFileReader) *DataFileMessage {
@@ -48,7 +51,10 @@ func (dataMessage *DataFileMessage) ToMap() map[string]interface{} {
 func (dataMessage *DataFileMessage) GetAttribute(field string) (interface{}, error) {
 	index, ok := dataMessage.Format.ColumnHash[field]
 	if !ok {
-		return nil, fmt.Errorf("attribute %s not found", field)
+		return nil, newParseError(dataMessage.Offset, dataMessage.Format.Name, ErrFieldType, "attribute %s not found", field)
+	}
+	if index >= len(dataMessage.Elements) || index >= len(dataMessage.Format.MessageFormats) {
+		return nil, newParseError(dataMessage.Offset, dataMessage.Format.Name, ErrFieldType, "attribute %s missing from the message", field)
 	}
 
 	value := dataMessage.Elements[index]
@@ -116,12 +122,17 @@ func nullTerm(s string) string {
 // returns nil if successful (no error)
 func (dataMessage *DataFileMessage) SetAttribute(field string, value interface{}) error {
 	i, ok := dataMessage.Format.ColumnHash[field]
-	if !ok {
-		return fmt.Errorf("AttributeError: " + field)
+	if !ok || i >= len(dataMessage.Elements) || i >= len(dataMessage.Format.MessageMults) {
+		return newParseError(dataMessage.Offset, dataMessage.Format.Name, ErrFieldType, "AttributeError: %s", field)
 	}
 
 	if dataMessage.Format.MessageMults[i] != nil && dataMessage.ApplyMultiplier {
-		value = value.(float64) / dataMessage.Format.MessageMults[i].(float64)
+		number, isFloat := value.(float64)
+		multiplier, hasMultiplier := dataMessage.Format.MessageMults[i].(float64)
+		if !isFloat || !hasMultiplier {
+			return newParseError(dataMessage.Offset, dataMessage.Format.Name, ErrFieldType, "%s needs a float64 value, got %T", field, value)
+		}
+		value = number / multiplier
 	}
 
 	dataMessage.Elements[i] = value
@@ -134,28 +145,61 @@ func (dataMessage *DataFileMessage) GetType() string {
 
 func (dataMessage *DataFileMessage) GetMessage() string {
 	for i, field := range dataMessage.FieldNames {
-		if field == "Message" {
-			// Check if the element is of type []uint8
-			if byteArray, ok := dataMessage.Elements[i].([]uint8); ok {
-				// Convert the []uint8 to a string
-				str := string(byteArray)
-				// Trim the string at the first null character
-				str = nullTerm(str)
-				return str
+		if field == "Message" && i < len(dataMessage.Elements) {
+			// 'Z' fields are unpacked as strings, older readers produced []uint8
+			switch value := dataMessage.Elements[i].(type) {
+			case string:
+				return nullTerm(value)
+			case []uint8:
+				return nullTerm(string(value))
 			}
 		}
 	}
 	return ""
 }
 
-func (dataMessage *DataFileMessage) GetMode() int {
-	for i, field := range dataMessage.FieldNames {
-		if field == "Mode" {
-			return dataMessage.Elements[i].(int)
+// TimeUS returns the time since boot of the message in microseconds, from its TimeUS field or the
+// TimeMS field of older logs. The TimeMS of GPS messages is the GPS time of week, so their boot
+// time is read from the T field instead. Returns false for messages without a boot timestamp.
+func (dataMessage *DataFileMessage) TimeUS() (int, bool) {
+	if value, err := dataMessage.GetAttribute("TimeUS"); err == nil {
+		if timeUS, ok := value.(int); ok {
+			return timeUS, true
 		}
+	}
+
+	if _, hasWeek := dataMessage.Format.ColumnHash["Week"]; hasWeek {
+		if value, err := dataMessage.GetAttribute("T"); err == nil {
+			if timeMS, ok := value.(int); ok {
+				return timeMS * microsecondsPerMs, true
+			}
+		}
+		return 0, false
+	}
 
-		if field == "ModeNum" {
-			return dataMessage.Elements[i].(int)
+	if value, err := dataMessage.GetAttribute("TimeMS"); err == nil {
+		if timeMS, ok := value.(int); ok {
+			return timeMS * microsecondsPerMs, true
+		}
+	}
+	return 0, false
+}
+
+// UTC returns the UTC time of the message, from the fitted boot time to UTC clock of the log or,
+// for messages without a boot time, the rate based interpolation between GPS messages. Returns
+// false when the log has no GPS time for the message.
+func (dataMessage *DataFileMessage) UTC() (time.Time, bool) {
+	return dataMessage.utc, !dataMessage.utc.IsZero()
+}
+
+// GetMode returns the flight mode number of a MODE message, or -1 when it has none
+func (dataMessage *DataFileMessage) GetMode() int {
+	for i, field := range dataMessage.FieldNames {
+		if (field == "Mode" || field == "ModeNum") && i < len(dataMessage.Elements) {
+			if mode, ok := dataMessage.Elements[i].(int); ok {
+				return mode
+			}
+			return -1
 		}
 	}
 	return -1
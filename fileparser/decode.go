@@ -0,0 +1,274 @@
+package fileparser
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+This code fills Go structs from messages. The fields of the struct are matched with the columns of
+the message by their dflog tag, `dflog:"Lat,scaled"`, or by their name when they have no tag; a tag
+of "-" leaves the field out. The "scaled" option converts the value to its units: latitudes and
+longitudes logged as 'L' integers become degrees, and other fields are multiplied by the multiplier
+declared for them in the FMTU message of the format, so a TimeUS field becomes seconds. The values
+of 'c', 'C', 'e' and 'E' fields are already in units when they are read. The "optional" option
+leaves the field alone when the message has no such column, which is an error otherwise.
+
+Each struct field is checked against the format character of its column once, when the mapping of
+a format to a struct type is first built; the mapping is then cached and reused for every message.
+The cache is keyed on the definition of the format rather than on the format itself, so formats
+of logs that were closed are not kept alive, and a format whose multipliers arrive later in the
+log gets a new mapping.
+*/
+
+const (
+	decodeTag      = "dflog"
+	scaledOption   = "scaled"
+	optionalOption = "optional"
+	degreesScale   = 1e-7 // scale of the 'L' latitude and longitude fields
+)
+
+// multipliers of the FMTU multiplier identifiers, from the ArduPilot logger
+var multiplierScales = map[byte]float64{
+	'2': 1e2, '1': 1e1, '0': 1, 'A': 1e-1, 'B': 1e-2, 'C': 1e-3, 'D': 1e-4, 'E': 1e-5,
+	'F': 1e-6, 'G': 1e-7, 'I': 1e-9, '!': 3.6, '/': 3600,
+}
+
+// kinds of the format characters as decoded by the reader
+const (
+	fieldSigned = iota
+	fieldUnsigned
+	fieldFloat
+	fieldString
+	fieldArray
+)
+
+var formatCharKinds = map[byte]int{
+	'b': fieldSigned, 'h': fieldSigned, 'i': fieldSigned, 'q': fieldSigned, 'L': fieldSigned,
+	'B': fieldUnsigned, 'M': fieldUnsigned, 'H': fieldUnsigned, 'I': fieldUnsigned, 'Q': fieldUnsigned,
+	'f': fieldFloat, 'd': fieldFloat, 'c': fieldFloat, 'C': fieldFloat, 'e': fieldFloat, 'E': fieldFloat,
+	'n': fieldString, 'N': fieldString, 'Z': fieldString,
+	'a': fieldArray,
+}
+
+// decodeKey identifies the mapping of a format to a struct type
+type decodeKey struct {
+	name    string
+	format  string
+	columns string
+	mults   string
+	typ     reflect.Type
+}
+
+// fieldMapping fills one struct field from one column
+type fieldMapping struct {
+	field  []int // index of the struct field, through embedded structs
+	column int
+	kind   int     // one of the field* kinds
+	scale  float64 // 0 when the value is not scaled
+}
+
+// mapping of the formats to the struct types, keyed by decodeKey
+var decodeMappings sync.Map
+
+// Decode fills the struct v points to from the fields of a message. Returns an error wrapping
+// ErrFieldType when a struct field has no matching column or cannot hold the values of its column.
+func Decode(message *DataFileMessage, v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() || target.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%w: Decode needs a pointer to a struct, got %T", ErrFieldType, v)
+	}
+	target = target.Elem()
+	if message == nil || message.Format == nil {
+		return fmt.Errorf("%w: Decode needs a message", ErrFieldType)
+	}
+
+	mappings, err := decodeMapping(message.Format, target.Type())
+	if err != nil {
+		return &ParseError{Offset: message.Offset, MessageType: message.Format.Name, Err: err}
+	}
+
+	for _, mapping := range mappings {
+		if mapping.column >= len(message.Elements) {
+			return newParseError(message.Offset, message.Format.Name, ErrFieldType, "%s missing from the message", message.Format.Columns[mapping.column])
+		}
+		field, err := target.FieldByIndexErr(mapping.field)
+		if err != nil {
+			return newParseError(message.Offset, message.Format.Name, ErrFieldType, "%s: %v", message.Format.Columns[mapping.column], err)
+		}
+		if err := setField(field, message.Elements[mapping.column], mapping); err != nil {
+			return newParseError(message.Offset, message.Format.Name, ErrFieldType, "%s: %v", message.Format.Columns[mapping.column], err)
+		}
+	}
+	return nil
+}
+
+// returns the cached mapping of a format to a struct type, building it on first use
+func decodeMapping(format *DataFileFormat, typ reflect.Type) ([]fieldMapping, error) {
+	key := decodeKey{name: format.Name, format: format.Format, columns: strings.Join(format.Columns, ","), typ: typ}
+	if format.MultIds != nil {
+		key.mults = *format.MultIds
+	}
+	if cached, ok := decodeMappings.Load(key); ok {
+		return cached.([]fieldMapping), nil
+	}
+
+	mappings := []fieldMapping{}
+	for _, structField := range reflect.VisibleFields(typ) {
+		if !structField.IsExported() || structField.Anonymous {
+			continue
+		}
+
+		name, options := structField.Name, []string{}
+		if tag, ok := structField.Tag.Lookup(decodeTag); ok {
+			if tag == "-" {
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			options = parts[1:]
+		}
+
+		column, ok := format.ColumnHash[name]
+		if !ok || column >= len(format.Format) {
+			if hasOption(options, optionalOption) {
+				continue
+			}
+			return nil, fmt.Errorf("%w: %s has no column %s for field %s", ErrFieldType, format.Name, name, structField.Name)
+		}
+
+		char := format.Format[column]
+		mapping := fieldMapping{field: structField.Index, column: column, kind: formatCharKinds[char]}
+		if hasOption(options, scaledOption) {
+			mapping.scale = columnScale(format, column)
+		}
+		if err := checkFieldType(structField.Type, mapping); err != nil {
+			return nil, fmt.Errorf("%w: field %s cannot hold %s column %s ('%c'): %v", ErrFieldType, structField.Name, format.Name, name, char, err)
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	decodeMappings.Store(key, mappings)
+	return mappings, nil
+}
+
+func hasOption(options []string, option string) bool {
+	for _, candidate := range options {
+		if candidate == option {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the scale converting a column to its units, 0 when it is already in units
+func columnScale(format *DataFileFormat, column int) float64 {
+	char := format.Format[column]
+	if char == 'L' {
+		return degreesScale
+	}
+	if formatCharKinds[char] != fieldSigned && formatCharKinds[char] != fieldUnsigned {
+		return 0
+	}
+	if format.MultIds != nil && column < len(*format.MultIds) {
+		if scale, ok := multiplierScales[(*format.MultIds)[column]]; ok && scale != 1 {
+			return scale
+		}
+	}
+	return 0
+}
+
+// checks that a struct field can hold the values of a column
+func checkFieldType(typ reflect.Type, mapping fieldMapping) error {
+	kind := typ.Kind()
+	switch {
+	case mapping.kind == fieldString:
+		if kind == reflect.String || (kind == reflect.Slice && typ.Elem().Kind() == reflect.Uint8) {
+			return nil
+		}
+		return fmt.Errorf("needs a string")
+	case mapping.kind == fieldArray:
+		if (kind == reflect.Slice || kind == reflect.Array) && typ.Elem().Kind() == reflect.Int16 {
+			return nil
+		}
+		return fmt.Errorf("needs []int16")
+	case mapping.kind == fieldFloat || mapping.scale != 0:
+		if kind == reflect.Float32 || kind == reflect.Float64 {
+			return nil
+		}
+		return fmt.Errorf("needs a float")
+	case mapping.kind == fieldSigned:
+		if isIntKind(kind) || kind == reflect.Float32 || kind == reflect.Float64 {
+			return nil
+		}
+		return fmt.Errorf("needs a signed integer or a float")
+	case mapping.kind == fieldUnsigned:
+		if isIntKind(kind) || isUintKind(kind) || kind == reflect.Float32 || kind == reflect.Float64 {
+			return nil
+		}
+		return fmt.Errorf("needs an integer or a float")
+	}
+	return fmt.Errorf("unknown format character")
+}
+
+func isIntKind(kind reflect.Kind) bool {
+	return kind == reflect.Int || kind == reflect.Int8 || kind == reflect.Int16 || kind == reflect.Int32 || kind == reflect.Int64
+}
+
+func isUintKind(kind reflect.Kind) bool {
+	return kind == reflect.Uint || kind == reflect.Uint8 || kind == reflect.Uint16 || kind == reflect.Uint32 || kind == reflect.Uint64
+}
+
+// sets a struct field from the value of a column, as decoded by the reader
+func setField(field reflect.Value, value interface{}, mapping fieldMapping) error {
+	switch element := value.(type) {
+	case string:
+		text := nullTerm(element)
+		if field.Kind() == reflect.String {
+			field.SetString(text)
+		} else {
+			field.SetBytes([]byte(text))
+		}
+		return nil
+	case []int16:
+		if field.Kind() == reflect.Slice {
+			field.Set(reflect.ValueOf(append([]int16{}, element...)).Convert(field.Type()))
+			return nil
+		}
+		for i := 0; i < field.Len() && i < len(element); i++ {
+			field.Index(i).SetInt(int64(element[i]))
+		}
+		return nil
+	case int:
+		if mapping.scale != 0 {
+			field.SetFloat(float64(element) * mapping.scale)
+			return nil
+		}
+		switch {
+		case isIntKind(field.Kind()):
+			if field.OverflowInt(int64(element)) {
+				return fmt.Errorf("%d overflows %s", element, field.Type())
+			}
+			field.SetInt(int64(element))
+		case isUintKind(field.Kind()):
+			if element < 0 || field.OverflowUint(uint64(element)) {
+				return fmt.Errorf("%d overflows %s", element, field.Type())
+			}
+			field.SetUint(uint64(element))
+		default:
+			field.SetFloat(float64(element))
+		}
+		return nil
+	case float64:
+		field.SetFloat(element)
+		return nil
+	case float32:
+		field.SetFloat(float64(element))
+		return nil
+	}
+	return fmt.Errorf("unexpected value of type %T", value)
+}
@@ -0,0 +1,125 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+const decodeType = 150
+
+// reads a log with one DEC message before the FMTU message of its format and one after, calling
+// decode on each as it is read
+func readDecodeLog(t *testing.T, decode func(message *fileparser.DataFileMessage)) {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	format := binlogtest.Format{Type: decodeType, Name: "DEC", Format: "QhLiZ", Columns: "TimeUS,Small,Lat,Alt,Text"}
+	if err := builder.Declare(format); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Message(decodeType, 1000000, 1000, -353632621, 1234, "before"); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Units(decodeType, "s-Dm-", "F-GB-"); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Message(decodeType, 2000000, 1000, -353632621, 1234, "after"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.GetType() == "DEC" {
+			count++
+			decode(message)
+		}
+	}
+	if count != 2 {
+		t.Fatalf("got %d DEC messages, want 2", count)
+	}
+}
+
+func TestDecodeTagsAndOptions(t *testing.T) {
+	var decoded struct {
+		Time    float64 `dflog:"TimeUS,scaled"`
+		Small   int16
+		Lat     float64 `dflog:",scaled"`
+		Alt     float64 `dflog:"Alt,scaled"`
+		Text    string
+		Skipped int     `dflog:"-"`
+		Missing float64 `dflog:"Missing,optional"`
+	}
+	decoded.Skipped, decoded.Missing = 7, 8
+
+	readDecodeLog(t, func(message *fileparser.DataFileMessage) {
+		if timeUS, _ := message.TimeUS(); timeUS != 2000000 {
+			return
+		}
+		// as the format is before its FMTU message is read: only the 'L' latitude is scaled
+		mults := message.Format.MultIds
+		message.Format.MultIds = nil
+		if err := fileparser.Decode(message, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Time != 2000000 || decoded.Alt != 1234 {
+			t.Errorf("got time %v and altitude %v without multipliers, want them unscaled", decoded.Time, decoded.Alt)
+		}
+
+		message.Format.MultIds = mults
+		if err := fileparser.Decode(message, &decoded); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if decoded.Time != 2 || math.Abs(decoded.Alt-12.34) > 1e-9 {
+		t.Errorf("got time %v and altitude %v after FMTU, want 2 and 12.34", decoded.Time, decoded.Alt)
+	}
+	if math.Abs(decoded.Lat+35.3632621) > 1e-9 || decoded.Small != 1000 || decoded.Text != "after" {
+		t.Errorf("got %+v", decoded)
+	}
+	if decoded.Skipped != 7 || decoded.Missing != 8 {
+		t.Errorf("skipped or optional fields were set: %+v", decoded)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var message *fileparser.DataFileMessage
+	readDecodeLog(t, func(last *fileparser.DataFileMessage) { message = last })
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"missing column", &struct{ Missing int }{}},
+		{"overflow", &struct{ Small int8 }{}},
+		{"string into integer", &struct{ Small string }{}},
+		{"integer into string", &struct{ Text int }{}},
+		{"scaled integer", &struct {
+			Alt int `dflog:",scaled"`
+		}{}},
+		{"not a pointer", struct{ Small int }{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := fileparser.Decode(message, test.v)
+			if !errors.Is(err, fileparser.ErrFieldType) {
+				t.Errorf("got %v, want ErrFieldType", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package fileparser
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+/*
+This code collects the problems found while reading a data file instead of printing them. Every bad
+header, unknown message type, truncated message, message that fails to unpack, malformed FMT message
+and header rejected by a resync is recorded as a Diagnostic with the byte offset where it was found.
+The diagnostics are passed to the handler set with WithDiagnostics and the logger set with WithLogger
+as they are found, and collected into the ParseReport of the reader together with the byte ranges
+that were skipped. A problem is reported once even though the file is read several times.
+*/
+
+// diagnostic kinds
+const (
+	DiagnosticBadHeader    = "bad_header"
+	DiagnosticUnknownType  = "unknown_type"
+	DiagnosticTruncated    = "truncated"
+	DiagnosticUnpackFailed = "unpack_failed"
+	DiagnosticBadFormat    = "bad_format"
+	DiagnosticFalseHeader  = "false_header"
+)
+
+// maxDiagnostics is the number of diagnostics kept in the ParseReport, later ones are only counted
+const maxDiagnostics = 10000
+
+// Diagnostic is a problem found while reading a data file
+type Diagnostic struct {
+	Kind        string // one of the Diagnostic* constants
+	Offset      int    // byte offset within the data file
+	Length      int    // number of bytes affected
+	MessageType int    // message type id, -1 when unknown
+	Message     string
+}
+
+// ByteRange is a range of bytes of the data file, End excluded
+type ByteRange struct {
+	Start int
+	End   int
+}
+
+// ParseReport holds the problems found while reading a data file
+type ParseReport struct {
+	Counts       map[string]int // number of diagnostics of each kind
+	Diagnostics  []Diagnostic   // the first maxDiagnostics diagnostics, in the order found
+	Skipped      []ByteRange    // byte ranges that could not be read as messages
+	SkippedBytes int
+}
+
+// Clean reports whether the file was read without problems
+func (report *ParseReport) Clean() bool {
+	return len(report.Counts) == 0
+}
+
+// ReaderOption configures a BinaryDataFileReader
+type ReaderOption func(*BinaryDataFileReader)
+
+// WithLogger logs the diagnostics of the reader as warnings, and the fields the reader looked for
+// but did not find as debug messages
+func WithLogger(logger *slog.Logger) ReaderOption {
+	return func(reader *BinaryDataFileReader) {
+		reader.logger = logger
+	}
+}
+
+// WithDiagnostics passes every diagnostic of the reader to handler as it is found
+func WithDiagnostics(handler func(Diagnostic)) ReaderOption {
+	return func(reader *BinaryDataFileReader) {
+		reader.diagnosticHandler = handler
+	}
+}
+
+// diagnosticKey identifies a diagnostic so it is reported once across passes over the file
+type diagnosticKey struct {
+	kind   string
+	offset int
+}
+
+func newParseReport() *ParseReport {
+	return &ParseReport{Counts: map[string]int{}, Diagnostics: []Diagnostic{}, Skipped: []ByteRange{}}
+}
+
+// ParseReport returns the problems found so far while reading the file
+func (reader *BinaryDataFileReader) ParseReport() *ParseReport {
+	return reader.report
+}
+
+// records a diagnostic, unless it was already reported by an earlier pass over the file
+func (reader *BinaryDataFileReader) diagnose(kind string, offset int, length int, messageType int, format string, args ...interface{}) {
+	key := diagnosticKey{kind: kind, offset: offset}
+	if reader.reported[key] {
+		return
+	}
+	reader.reported[key] = true
+
+	diagnostic := Diagnostic{Kind: kind, Offset: offset, Length: length, MessageType: messageType, Message: fmt.Sprintf(format, args...)}
+	reader.report.Counts[kind]++
+	if len(reader.report.Diagnostics) < maxDiagnostics {
+		reader.report.Diagnostics = append(reader.report.Diagnostics, diagnostic)
+	}
+
+	if reader.diagnosticHandler != nil {
+		reader.diagnosticHandler(diagnostic)
+	}
+	if reader.logger != nil {
+		reader.logger.Warn(diagnostic.Message, "kind", kind, "offset", offset, "length", length, "type", messageType)
+	}
+}
+
+// records a skipped byte range, merging it with the previous range when they touch
+func (reader *BinaryDataFileReader) skip(start int, end int) {
+	reader.report.SkippedBytes += end - start
+	if count := len(reader.report.Skipped); count > 0 && reader.report.Skipped[count-1].End == start {
+		reader.report.Skipped[count-1].End = end
+		return
+	}
+	reader.report.Skipped = append(reader.report.Skipped, ByteRange{Start: start, End: end})
+}
+
+// logs a debug message when a logger is set
+func (reader *BinaryDataFileReader) debug(message string, args ...interface{}) {
+	if reader.logger != nil {
+		reader.logger.Debug(message, args...)
+	}
+}
@@ -0,0 +1,122 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// corruptLog returns a log of GPS fixes with a run of corrupted bytes after the first ten, a
+// truncated fix at the end, the offset and length of the corrupted bytes and the offset of the
+// truncated fix
+func corruptLog(t *testing.T) ([]byte, int, int, int) {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	gps := binlogtest.StandardFormats()[0]
+	if err := builder.Declare(gps); err != nil {
+		t.Fatal(err)
+	}
+	fix := func(second int) {
+		t.Helper()
+		if err := builder.Message(gps.Type, second*1000000, 0, 3, 100000+second*1000, 2200, 10, 0.8, -353632621, 1491652374, 584.0, 0.0, 0.0, 0.0, 0.0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for second := 1; second <= 10; second++ {
+		fix(second)
+	}
+	corrupted := len(builder.Bytes())
+	garbage := bytes.Repeat([]byte{0x55}, 20)
+	builder.Raw(garbage)
+	// enough fixes after the corrupted bytes for them not to be taken for the end of the log
+	for second := 11; second < 30; second++ {
+		fix(second)
+	}
+	truncated := len(builder.Bytes())
+	fix(30)
+	data := builder.Bytes()
+	return data[:len(data)-5], corrupted, len(garbage), truncated
+}
+
+func TestDiagnostics(t *testing.T) {
+	data, corrupted, length, truncated := corruptLog(t)
+	var handled []fileparser.Diagnostic
+	var logged bytes.Buffer
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false,
+		fileparser.WithDiagnostics(func(diagnostic fileparser.Diagnostic) { handled = append(handled, diagnostic) }),
+		fileparser.WithLogger(slog.New(slog.NewTextHandler(&logged, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every pass over the file meets the same problems, they are reported once
+	for pass := 0; pass < 2; pass++ {
+		fixes := 0
+		for {
+			message, err := reader.ParseNext()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.GetType() == "GPS" {
+				fixes++
+			}
+		}
+		if fixes != 29 {
+			t.Errorf("pass %d: got %d GPS messages, want 29", pass, fixes)
+		}
+		reader.Rewind()
+	}
+	if _, err := reader.ParameterSet(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, diagnostic := range handled {
+		got = append(got, fmt.Sprintf("%s@%d+%d", diagnostic.Kind, diagnostic.Offset, diagnostic.Length))
+	}
+	// the clock pass reads up to the truncated fix before the index pass meets the corrupted bytes
+	want := []string{
+		fmt.Sprintf("%s@%d+%d", fileparser.DiagnosticTruncated, truncated, len(data)-truncated),
+		fmt.Sprintf("%s@%d+%d", fileparser.DiagnosticBadHeader, corrupted, length),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got diagnostics %v, want %v", got, want)
+	}
+
+	report := reader.ParseReport()
+	if report.Clean() {
+		t.Error("report of a corrupted log is clean")
+	}
+	if fmt.Sprint(report.Diagnostics) != fmt.Sprint(handled) {
+		t.Errorf("got report diagnostics %v, want %v", report.Diagnostics, handled)
+	}
+	if report.Counts[fileparser.DiagnosticBadHeader] != 1 || report.Counts[fileparser.DiagnosticTruncated] != 1 {
+		t.Errorf("got counts %v", report.Counts)
+	}
+	if want := []fileparser.ByteRange{{Start: corrupted, End: corrupted + length}}; fmt.Sprint(report.Skipped) != fmt.Sprint(want) || report.SkippedBytes != length {
+		t.Errorf("got skipped %v (%d bytes), want %v (%d bytes)", report.Skipped, report.SkippedBytes, want, length)
+	}
+	if lines := strings.Count(logged.String(), "level=WARN"); lines != len(want) {
+		t.Errorf("got %d warnings logged, want %d:\n%s", lines, len(want), logged.String())
+	}
+
+	clean, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data[:corrupted]), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := clean.ParseReport(); !report.Clean() || len(report.Skipped) != 0 {
+		t.Errorf("got report %+v of a clean log", report)
+	}
+}
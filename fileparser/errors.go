@@ -0,0 +1,55 @@
+package fileparser
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+This code defines the errors returned by the reader. Malformed input never makes the reader panic:
+every problem is returned as a ParseError carrying the byte offset and type of the message where it
+was found, wrapping one of the errors below so callers can tell them apart with errors.Is. The
+methods that read the whole file stop at the first message that cannot be read and return its error,
+only io.EOF ends them cleanly. A log that ends in the middle of its last message, as logs do when the
+power is cut, ends there without an error and the cut is recorded in the ParseReport, unless the
+reader is created WithStrictEnd. A damaged log can still be read in full with
+WithResync(ResyncSalvage), which skips the messages that cannot be read.
+*/
+
+var (
+	// ErrTruncated is returned for a message cut short by the end of the data
+	ErrTruncated = errors.New("truncated message")
+	// ErrUnknownFormat is returned for a message type without a valid FMT definition
+	ErrUnknownFormat = errors.New("unknown message format")
+	// ErrFieldType is returned for a field missing from a message or holding an unexpected type
+	ErrFieldType = errors.New("unexpected field type")
+	// ErrNoGPS is returned for a log without GPS positions
+	ErrNoGPS = errors.New("no GPS data")
+)
+
+// ParseError is a problem found at a message of the data file
+type ParseError struct {
+	Offset      int    // byte offset of the message within the data file, -1 when unknown
+	MessageType string // name of the message type, empty when unknown
+	Err         error  // wraps one of the Err* errors
+}
+
+func (parseError *ParseError) Error() string {
+	if parseError.MessageType != "" {
+		return fmt.Sprintf("%s message at %d: %v", parseError.MessageType, parseError.Offset, parseError.Err)
+	}
+	return fmt.Sprintf("at %d: %v", parseError.Offset, parseError.Err)
+}
+
+func (parseError *ParseError) Unwrap() error {
+	return parseError.Err
+}
+
+// returns a ParseError wrapping kind with a description of the problem
+func newParseError(offset int, messageType string, kind error, format string, args ...interface{}) error {
+	return &ParseError{
+		Offset:      offset,
+		MessageType: messageType,
+		Err:         fmt.Errorf("%w: %s", kind, fmt.Sprintf(format, args...)),
+	}
+}
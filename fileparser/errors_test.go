@@ -0,0 +1,93 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// a log cut short in the middle of a message
+func truncatedLog(t *testing.T) []byte {
+	t.Helper()
+	data, err := binlogtest.SampleLog(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data[:len(data)-5]
+}
+
+func TestTruncatedLogEndsAtTheCut(t *testing.T) {
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(truncatedLog(t)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.EventTimeline(); err != nil {
+		t.Errorf("EventTimeline: %v", err)
+	}
+	if got := reader.ParseReport().Counts[fileparser.DiagnosticTruncated]; got != 1 {
+		t.Errorf("got %d truncated messages reported, want 1", got)
+	}
+}
+
+func TestStrictEndReturnsParseError(t *testing.T) {
+	data := truncatedLog(t)
+
+	_, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false, fileparser.WithStrictEnd())
+	if !errors.Is(err, fileparser.ErrTruncated) {
+		t.Fatalf("got %v, want ErrTruncated", err)
+	}
+	var parseError *fileparser.ParseError
+	if !errors.As(err, &parseError) {
+		t.Fatalf("got %T, want a ParseError", err)
+	}
+	if parseError.Offset <= 0 || parseError.Offset >= len(data) || parseError.MessageType == "" {
+		t.Errorf("got offset %d and type %q, want the offset and type of the last message", parseError.Offset, parseError.MessageType)
+	}
+}
+
+func TestSalvageReadsTruncatedLog(t *testing.T) {
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(truncatedLog(t)), false, fileparser.WithResync(fileparser.ResyncSalvage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := map[string]func() error{
+		"FlightModeTimeline": func() error { _, err := reader.FlightModeTimeline(); return err },
+		"ParameterSet":       func() error { _, err := reader.ParameterSet(); return err },
+		"EventTimeline":      func() error { _, err := reader.EventTimeline(); return err },
+		"TimeIntegrity": func() error {
+			_, err := reader.TimeIntegrity(fileparser.DefaultTimeIntegrityOptions())
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if got := reader.ParseReport().Counts[fileparser.DiagnosticTruncated]; got == 0 {
+		t.Errorf("no truncated message reported")
+	}
+}
+
+func TestMissingFieldReturnsErrFieldType(t *testing.T) {
+	data, err := binlogtest.SampleLog(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := reader.ParseNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := message.GetAttribute("NoSuchField"); !errors.Is(err, fileparser.ErrFieldType) {
+		t.Errorf("got %v, want ErrFieldType", err)
+	}
+}
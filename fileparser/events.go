@@ -0,0 +1,392 @@
+package fileparser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+/*
+This code decodes the ERR, EV, ARM and MSG messages into a single time ordered event timeline.
+ERR messages carry a subsystem and an error code whose meaning depends on the subsystem, EV messages
+carry an event id, ARM messages record the arming state with the method used to arm or disarm, and
+MSG messages carry the text sent to the ground station. Each event is stamped with the time since
+boot, its UTC time from the fitted clock of the log and the last known vehicle position.
+*/
+
+// event categories
+const (
+	EventCategoryError   = "error"
+	EventCategoryEvent   = "event"
+	EventCategoryArming  = "arming"
+	EventCategoryMessage = "message"
+)
+
+const (
+	errorCodeResolved  = 0
+	errorCodeOccurred  = 1
+	minimumGPSFixState = 3    // GPS Status of a 3D fix
+	latLngScale        = 1e-7 // 'L' fields are degrees * 1e7
+)
+
+// ArduPilot LogErrorSubsystem, logged in the Subsys field of ERR messages
+var errorSubsystems = map[int]string{
+	1:  "MAIN",
+	2:  "RADIO",
+	3:  "COMPASS",
+	4:  "OPTFLOW",
+	5:  "FAILSAFE_RADIO",
+	6:  "FAILSAFE_BATT",
+	7:  "FAILSAFE_GPS",
+	8:  "FAILSAFE_GCS",
+	9:  "FAILSAFE_FENCE",
+	10: "FLIGHT_MODE",
+	11: "GPS",
+	12: "CRASH_CHECK",
+	13: "FLIP",
+	14: "AUTOTUNE",
+	15: "PARACHUTES",
+	16: "EKFCHECK",
+	17: "FAILSAFE_EKFINAV",
+	18: "BARO",
+	19: "CPU",
+	20: "FAILSAFE_ADSB",
+	21: "TERRAIN",
+	22: "NAVIGATION",
+	23: "FAILSAFE_TERRAIN",
+	24: "EKF_PRIMARY",
+	25: "THRUST_LOSS_CHECK",
+	26: "FAILSAFE_SENSORS",
+	27: "FAILSAFE_LEAK",
+	28: "PILOT_INPUT",
+	29: "FAILSAFE_VIBE",
+	30: "INTERNAL_ERROR",
+	31: "FAILSAFE_DEADRECKON",
+}
+
+// ArduPilot LogErrorCode values that only apply to a single subsystem
+var errorCodes = map[string]map[int]string{
+	"MAIN":              {1: "INS_DELAY"},
+	"RADIO":             {0: "ERROR_RESOLVED", 2: "LATE_FRAME"},
+	"COMPASS":           {0: "ERROR_RESOLVED", 1: "FAILED_TO_INITIALISE", 4: "UNHEALTHY"},
+	"OPTFLOW":           {1: "FAILED_TO_INITIALISE"},
+	"BARO":              {0: "ERROR_RESOLVED", 1: "FAILED_TO_INITIALISE", 4: "UNHEALTHY"},
+	"GPS":               {0: "ERROR_RESOLVED", 2: "GPS_GLITCH"},
+	"CRASH_CHECK":       {1: "CRASH", 2: "LOSS_OF_CONTROL"},
+	"FLIP":              {2: "FLIP_ABANDONED"},
+	"PARACHUTES":        {2: "TOO_LOW", 3: "LANDED"},
+	"EKFCHECK":          {0: "BAD_VARIANCE_CLEARED", 2: "BAD_VARIANCE"},
+	"TERRAIN":           {2: "MISSING_TERRAIN_DATA"},
+	"NAVIGATION":        {2: "FAILED_TO_SET_DESTINATION", 3: "RESTARTED_RTL", 4: "FAILED_CIRCLE_INIT", 5: "DEST_OUTSIDE_FENCE", 6: "RTL_MISSING_RNGFND"},
+	"THRUST_LOSS_CHECK": {0: "ERROR_RESOLVED", 1: "FAILSAFE_OCCURRED"},
+	"PILOT_INPUT":       {0: "ERROR_RESOLVED", 1: "THROTTLE_INPUT_LOST"},
+	"INTERNAL_ERROR":    {1: "INTERNAL_ERRORS_DETECTED"},
+}
+
+// ArduPilot LogEvent, logged in the Id field of EV messages
+var eventNames = map[int]string{
+	10: "ARMED",
+	11: "DISARMED",
+	15: "AUTO_ARMED",
+	17: "LAND_COMPLETE_MAYBE",
+	18: "LAND_COMPLETE",
+	19: "LOST_GPS",
+	21: "FLIP_START",
+	22: "FLIP_END",
+	25: "SET_HOME",
+	26: "SET_SIMPLE_ON",
+	27: "SET_SIMPLE_OFF",
+	28: "NOT_LANDED",
+	29: "SET_SUPERSIMPLE_ON",
+	30: "AUTOTUNE_INITIALISED",
+	31: "AUTOTUNE_OFF",
+	32: "AUTOTUNE_RESTART",
+	33: "AUTOTUNE_SUCCESS",
+	34: "AUTOTUNE_FAILED",
+	35: "AUTOTUNE_REACHED_LIMIT",
+	36: "AUTOTUNE_PILOT_TESTING",
+	37: "AUTOTUNE_SAVEDGAINS",
+	38: "SAVE_TRIM",
+	39: "SAVEWP_ADD_WP",
+	41: "FENCE_ENABLE",
+	42: "FENCE_DISABLE",
+	43: "ACRO_TRAINER_OFF",
+	44: "ACRO_TRAINER_LEVELING",
+	45: "ACRO_TRAINER_LIMITED",
+	46: "GRIPPER_GRAB",
+	47: "GRIPPER_RELEASE",
+	49: "PARACHUTE_DISABLED",
+	50: "PARACHUTE_ENABLED",
+	51: "PARACHUTE_RELEASED",
+	52: "LANDING_GEAR_DEPLOYED",
+	53: "LANDING_GEAR_RETRACTED",
+	54: "MOTORS_EMERGENCY_STOPPED",
+	55: "MOTORS_EMERGENCY_STOP_CLEARED",
+	56: "MOTORS_INTERLOCK_DISABLED",
+	57: "MOTORS_INTERLOCK_ENABLED",
+	58: "ROTOR_RUNUP_COMPLETE",
+	59: "ROTOR_SPEED_BELOW_CRITICAL",
+	60: "EKF_ALT_RESET",
+	61: "LAND_CANCELLED_BY_PILOT",
+	62: "EKF_YAW_RESET",
+	63: "AVOIDANCE_ADSB_ENABLE",
+	64: "AVOIDANCE_ADSB_DISABLE",
+	65: "AVOIDANCE_PROXIMITY_ENABLE",
+	66: "AVOIDANCE_PROXIMITY_DISABLE",
+	67: "GPS_PRIMARY_CHANGED",
+	71: "ZIGZAG_STORE_A",
+	72: "ZIGZAG_STORE_B",
+	73: "LAND_REPO_ACTIVE",
+	74: "STANDBY_ENABLE",
+	75: "STANDBY_DISABLE",
+	76: "FENCE_FLOOR_ENABLE",
+	77: "FENCE_FLOOR_DISABLE",
+	80: "SURFACED",
+	81: "NOT_SURFACED",
+	82: "BOTTOMED",
+	83: "NOT_BOTTOMED",
+}
+
+// ArduPilot AP_Arming::Method, logged in the Method field of ARM messages
+var armingMethods = map[int]string{
+	0:   "RUDDER",
+	1:   "MAVLINK",
+	2:   "AUXSWITCH",
+	3:   "MOTORTEST",
+	4:   "SCRIPTING",
+	5:   "TERMINATION",
+	6:   "CPUFAILSAFE",
+	7:   "BATTERYFAILSAFE",
+	8:   "SOLOPAUSEWHENLANDED",
+	9:   "AFS",
+	10:  "ADSBCOLLISIONACTION",
+	11:  "PARACHUTE_RELEASE",
+	12:  "CRASH",
+	13:  "LANDED",
+	14:  "MISSIONEXIT",
+	15:  "FENCEBREACH",
+	16:  "RADIOFAILSAFE",
+	17:  "DISARMDELAY",
+	18:  "GCSFAILSAFE",
+	19:  "TERRRAINFAILSAFE",
+	20:  "FAILSAFE_ACTION_TERMINATE",
+	21:  "TERRAINFAILSAFE",
+	22:  "MOTORDETECTDONE",
+	23:  "BADFLOWOFCONTROL",
+	24:  "EKFFAILSAFE",
+	25:  "GCS_FAILSAFE_SURFACEFAILED",
+	26:  "GCS_FAILSAFE_HOLDFAILED",
+	27:  "TAKEOFFTIMEOUT",
+	28:  "AUTOLANDED",
+	29:  "PILOT_INPUT_FAILSAFE",
+	30:  "TOYMODELANDTHROTTLE",
+	31:  "TOYMODELANDFORCE",
+	32:  "LANDING",
+	33:  "DEADRECKON_FAILSAFE",
+	34:  "BLACKBOX",
+	35:  "DDS",
+	100: "UNKNOWN",
+}
+
+// Event is a decoded ERR, EV, ARM or MSG message
+type Event struct {
+	Time        time.Duration // time since boot, from the message or the last timestamped message
+	UTC         time.Time     // zero until the first GPS fix with a valid time
+	Category    string        // one of the EventCategory* constants
+	Name        string        // e.g. "ARMED", "FAILSAFE_RADIO" or the MSG text
+	Description string        // decoded error code, arming method or event detail
+	Code        int           // EV id, ERR error code or ARM state
+	Subsystem   int           // ERR subsystem, 0 for other categories
+	Lat         float64
+	Lng         float64
+	Alt         float64
+	HasPosition bool // false until the first GPS fix
+	Offset      int  // byte offset of the message within the data file
+}
+
+// EventRecorder builds the event timeline one message at a time, for callers that read the log
+// themselves
+type EventRecorder struct {
+	clock       *UTCClock
+	events      []Event
+	lastTimeUS  int
+	lat         float64
+	lng         float64
+	alt         float64
+	hasPosition bool
+}
+
+// NewEventRecorder returns a recorder stamping the events with the fitted clock of the reader
+func (reader *BinaryDataFileReader) NewEventRecorder() *EventRecorder {
+	return &EventRecorder{clock: reader.utcClock, events: []Event{}}
+}
+
+// Add records a message read from the log, in the order the messages were logged
+func (recorder *EventRecorder) Add(message *DataFileMessage) {
+	if timeUS, ok := message.TimeUS(); ok {
+		recorder.lastTimeUS = timeUS
+	}
+
+	messageType := message.GetType()
+	if messageType == MsgTypeGPS {
+		if lat, lng, alt, ok := GPSFixPosition(message); ok {
+			recorder.lat, recorder.lng, recorder.alt, recorder.hasPosition = lat, lng, alt, true
+		}
+		return
+	}
+
+	event, ok := decodeEvent(messageType, message)
+	if !ok {
+		return
+	}
+
+	event.Time = time.Duration(recorder.lastTimeUS) * time.Microsecond
+	event.UTC, _ = recorder.clock.UTC(message.Offset, recorder.lastTimeUS)
+	event.Lat, event.Lng, event.Alt, event.HasPosition = recorder.lat, recorder.lng, recorder.alt, recorder.hasPosition
+	event.Offset = message.Offset
+	recorder.events = append(recorder.events, event)
+}
+
+// Events returns the events recorded so far
+func (recorder *EventRecorder) Events() []Event {
+	return recorder.events
+}
+
+// EventTimeline reads the whole file and returns the decoded ERR, EV, ARM and MSG messages in the
+// order they were logged. The reader is rewound before and after. Returns the error of a message
+// that cannot be read.
+func (reader *BinaryDataFileReader) EventTimeline() ([]Event, error) {
+	reader.rewind()
+	defer reader.rewind()
+
+	recorder := reader.NewEventRecorder()
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		recorder.Add(message)
+	}
+
+	return recorder.Events(), nil
+}
+
+// GPSFixPosition returns the position of a GPS message with a 3D fix, with Lat and Lng scaled to
+// degrees
+func GPSFixPosition(message *DataFileMessage) (float64, float64, float64, bool) {
+	status, err := processAttribute(message, "Status")
+	if err != nil || status < minimumGPSFixState {
+		return 0, 0, 0, false
+	}
+
+	lat, errLat := processAttribute(message, "Lat")
+	lng, errLng := processAttribute(message, "Lng")
+	if errLat != nil || errLng != nil || (lat == 0 && lng == 0) {
+		return 0, 0, 0, false
+	}
+
+	alt := 0.0
+	if value, err := message.GetAttribute("Alt"); err == nil {
+		switch altitude := value.(type) {
+		case float64:
+			alt = altitude
+		case int:
+			alt = float64(altitude)
+		}
+	}
+	return float64(lat) * latLngScale, float64(lng) * latLngScale, alt, true
+}
+
+// decodes an ERR, EV, ARM or MSG message, returns false for other message types
+func decodeEvent(messageType string, message *DataFileMessage) (Event, bool) {
+	switch messageType {
+	case "ERR":
+		subsystem, _ := processAttribute(message, "Subsys")
+		code, _ := processAttribute(message, "ECode")
+		return Event{
+			Category:    EventCategoryError,
+			Name:        ErrorSubsystemString(subsystem),
+			Description: ErrorCodeString(subsystem, code),
+			Code:        code,
+			Subsystem:   subsystem,
+		}, true
+	case "EV":
+		id, _ := processAttribute(message, "Id")
+		return Event{
+			Category: EventCategoryEvent,
+			Name:     EventString(id),
+			Code:     id,
+		}, true
+	case "ARM":
+		state, _ := processAttribute(message, "ArmState")
+		event := Event{Category: EventCategoryArming, Name: "DISARMED", Code: state}
+		if state != 0 {
+			event.Name = "ARMED"
+		}
+		if method, err := processAttribute(message, "Method"); err == nil {
+			event.Description = ArmingMethodString(method)
+		}
+		if forced, err := processAttribute(message, "Forced"); err == nil && forced != 0 {
+			event.Description += " (forced)"
+		}
+		return event, true
+	case "MSG":
+		text := message.GetMessage()
+		if text == "" {
+			return Event{}, false
+		}
+		return Event{Category: EventCategoryMessage, Name: text}, true
+	}
+	return Event{}, false
+}
+
+// ErrorSubsystemString returns the name of an ERR subsystem
+func ErrorSubsystemString(subsystem int) string {
+	if name, ok := errorSubsystems[subsystem]; ok {
+		return name
+	}
+	return fmt.Sprintf("Subsystem(%d)", subsystem)
+}
+
+// ErrorCodeString returns the meaning of an ERR error code, which depends on the subsystem
+func ErrorCodeString(subsystem int, code int) string {
+	name := ErrorSubsystemString(subsystem)
+	if codes, ok := errorCodes[name]; ok {
+		if codeName, ok := codes[code]; ok {
+			return codeName
+		}
+	}
+
+	switch {
+	case name == "FLIGHT_MODE":
+		return fmt.Sprintf("FAILED_TO_SET_MODE(%d)", code)
+	case name == "EKF_PRIMARY":
+		return fmt.Sprintf("PRIMARY_CHANGED_TO_CORE(%d)", code)
+	case code == errorCodeResolved:
+		return "ERROR_RESOLVED"
+	case code == errorCodeOccurred && strings.HasPrefix(name, "FAILSAFE_"):
+		return "FAILSAFE_OCCURRED"
+	}
+	return fmt.Sprintf("ErrorCode(%d)", code)
+}
+
+// EventString returns the name of an EV event id
+func EventString(id int) string {
+	if name, ok := eventNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("Event(%d)", id)
+}
+
+// ArmingMethodString returns the name of an ARM arming or disarming method
+func ArmingMethodString(method int) string {
+	if name, ok := armingMethods[method]; ok {
+		return name
+	}
+	return fmt.Sprintf("Method(%d)", method)
+}
@@ -0,0 +1,114 @@
+package fileparser_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+const (
+	errType = 138
+	armType = 139
+)
+
+var (
+	errFormat = binlogtest.Format{Type: errType, Name: "ERR", Format: "QBB", Columns: "TimeUS,Subsys,ECode"}
+	armFormat = binlogtest.Format{Type: armType, Name: "ARM", Format: "QBIBB", Columns: "TimeUS,ArmState,ArmChecks,Forced,Method"}
+	evFormat  = binlogtest.Format{Type: binlogtest.EVType, Name: "EV", Format: "QB", Columns: "TimeUS,Id"}
+)
+
+func TestEventTimeline(t *testing.T) {
+	const startMS = 100000000
+	second := 1000000
+	formats := append(binlogtest.StandardFormats(), errFormat, armFormat, evFormat, msgFormat)
+	messages := [][]interface{}{
+		{binlogtest.MSGType, 0, "ArduCopter V4.5.1 (1a2b3c4d)"},
+		{errType, 1 * second, 11, 2},
+		gpsFix(2*second, startMS+2000),
+		{armType, 3 * second, 1, 0, 0, 2},
+		{binlogtest.EVType, 3 * second, 10},
+		{errType, 4 * second, 5, 1},
+		{errType, 5 * second, 10, 4},
+		{errType, 5 * second, 24, 2},
+		{errType, 6 * second, 3, 0},
+		{errType, 6 * second, 40, 7},
+		{binlogtest.EVType, 7 * second, 99},
+		// an empty text is not an event
+		{binlogtest.MSGType, 7 * second, ""},
+		{armType, 8 * second, 0, 0, 1, 1},
+		{binlogtest.EVType, 8 * second, 11},
+	}
+	reader := logReader(t, formats, messages)
+
+	events, err := reader.EventTimeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, event := range events {
+		got = append(got, fmt.Sprintf("%s %s %q %d@%v", event.Category, event.Name, event.Description, event.Code, event.Time))
+	}
+	want := []string{
+		`message ArduCopter V4.5.1 (1a2b3c4d) "" 0@0s`,
+		`error GPS "GPS_GLITCH" 2@1s`,
+		`arming ARMED "AUXSWITCH" 1@3s`,
+		`event ARMED "" 10@3s`,
+		`error FAILSAFE_RADIO "FAILSAFE_OCCURRED" 1@4s`,
+		`error FLIGHT_MODE "FAILED_TO_SET_MODE(4)" 4@5s`,
+		`error EKF_PRIMARY "PRIMARY_CHANGED_TO_CORE(2)" 2@5s`,
+		`error COMPASS "ERROR_RESOLVED" 0@6s`,
+		`error Subsystem(40) "ErrorCode(7)" 7@6s`,
+		`event Event(99) "" 99@7s`,
+		`arming DISARMED "MAVLINK (forced)" 0@8s`,
+		`event DISARMED "" 11@8s`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	// the subsystem of errors, the fitted UTC time and the last GPS position
+	if events[1].Subsystem != 11 || events[3].Subsystem != 0 {
+		t.Errorf("got subsystems %d and %d, want 11 and 0", events[1].Subsystem, events[3].Subsystem)
+	}
+	for i, event := range events {
+		if want := gpsUTC(startMS + float64(event.Time/time.Millisecond)); event.UTC.Sub(want).Abs() > clockTestTolerance {
+			t.Errorf("event %d: got UTC %v, want %v", i, event.UTC, want)
+		}
+		if wantPosition := i > 1; event.HasPosition != wantPosition {
+			t.Errorf("event %d: got position %v, want %v", i, event.HasPosition, wantPosition)
+		} else if wantPosition && (event.Lat != -35.3632621 || event.Lng != 149.1652374 || event.Alt != 584) {
+			t.Errorf("event %d: got position %v %v %v", i, event.Lat, event.Lng, event.Alt)
+		}
+	}
+}
+
+func TestEventNames(t *testing.T) {
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{fileparser.ErrorSubsystemString(9), "FAILSAFE_FENCE"},
+		{fileparser.ErrorCodeString(9, 0), "ERROR_RESOLVED"},
+		{fileparser.ErrorCodeString(12, 1), "CRASH"},
+		{fileparser.ErrorCodeString(16, 0), "BAD_VARIANCE_CLEARED"},
+		// a code of 1 is a failsafe only for the failsafe subsystems
+		{fileparser.ErrorCodeString(1, 1), "INS_DELAY"},
+		{fileparser.ErrorCodeString(13, 1), "ErrorCode(1)"},
+		{fileparser.EventString(18), "LAND_COMPLETE"},
+		{fileparser.ArmingMethodString(17), "DISARMDELAY"},
+		{fileparser.ArmingMethodString(99), "Method(99)"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("got %s, want %s", test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package fileparser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+This code decodes the flight mode numbers logged in MODE messages. The meaning of a mode number
+depends on the vehicle family, so the table is chosen from the MavType detected by the reader
+(see vehicle_info.go). The Rsn field of newer MODE messages records why the mode changed and is
+decoded to the ArduPilot ModeReason name.
+*/
+
+// ArduPlane
+var modeMappingAPM = map[int]string{
+	0:  "MANUAL",
+	1:  "CIRCLE",
+	2:  "STABILIZE",
+	3:  "TRAINING",
+	4:  "ACRO",
+	5:  "FBWA",
+	6:  "FBWB",
+	7:  "CRUISE",
+	8:  "AUTOTUNE",
+	10: "AUTO",
+	11: "RTL",
+	12: "LOITER",
+	13: "TAKEOFF",
+	14: "AVOID_ADSB",
+	15: "GUIDED",
+	16: "INITIALISING",
+	17: "QSTABILIZE",
+	18: "QHOVER",
+	19: "QLOITER",
+	20: "QLAND",
+	21: "QRTL",
+	22: "QAUTOTUNE",
+	23: "QACRO",
+	24: "THERMAL",
+	25: "LOITERALTQLAND",
+	26: "AUTOLAND",
+}
+
+// ArduCopter
+var modeMappingACM = map[int]string{
+	0:  "STABILIZE",
+	1:  "ACRO",
+	2:  "ALT_HOLD",
+	3:  "AUTO",
+	4:  "GUIDED",
+	5:  "LOITER",
+	6:  "RTL",
+	7:  "CIRCLE",
+	8:  "POSITION",
+	9:  "LAND",
+	10: "OF_LOITER",
+	11: "DRIFT",
+	13: "SPORT",
+	14: "FLIP",
+	15: "AUTOTUNE",
+	16: "POSHOLD",
+	17: "BRAKE",
+	18: "THROW",
+	19: "AVOID_ADSB",
+	20: "GUIDED_NOGPS",
+	21: "SMART_RTL",
+	22: "FLOWHOLD",
+	23: "FOLLOW",
+	24: "ZIGZAG",
+	25: "SYSTEMID",
+	26: "AUTOROTATE",
+	27: "AUTO_RTL",
+}
+
+// ArduRover, also used for boats
+var modeMappingRover = map[int]string{
+	0:  "MANUAL",
+	1:  "ACRO",
+	3:  "STEERING",
+	4:  "HOLD",
+	5:  "LOITER",
+	6:  "FOLLOW",
+	7:  "SIMPLE",
+	8:  "DOCK",
+	9:  "CIRCLE",
+	10: "AUTO",
+	11: "RTL",
+	12: "SMART_RTL",
+	15: "GUIDED",
+	16: "INITIALISING",
+}
+
+// ArduSub
+var modeMappingSub = map[int]string{
+	0:  "STABILIZE",
+	1:  "ACRO",
+	2:  "ALT_HOLD",
+	3:  "AUTO",
+	4:  "GUIDED",
+	7:  "CIRCLE",
+	9:  "SURFACE",
+	16: "POSHOLD",
+	19: "MANUAL",
+	20: "MOTOR_DETECT",
+	21: "SURFTRAK",
+}
+
+// AntennaTracker
+var modeMappingTracker = map[int]string{
+	0:  "MANUAL",
+	1:  "STOP",
+	2:  "SCAN",
+	3:  "SERVO_TEST",
+	4:  "GUIDED",
+	10: "AUTO",
+	16: "INITIALISING",
+}
+
+// Blimp
+var modeMappingBlimp = map[int]string{
+	0: "LAND",
+	1: "MANUAL",
+	2: "VELOCITY",
+	3: "LOITER",
+	4: "RTL",
+}
+
+// ArduPilot ModeReason, logged in the Rsn field of MODE messages
+var modeReasons = map[int]string{
+	0:  "UNKNOWN",
+	1:  "RC_COMMAND",
+	2:  "GCS_COMMAND",
+	3:  "RADIO_FAILSAFE",
+	4:  "BATTERY_FAILSAFE",
+	5:  "GCS_FAILSAFE",
+	6:  "EKF_FAILSAFE",
+	7:  "GPS_GLITCH",
+	8:  "MISSION_END",
+	9:  "THROTTLE_LAND_ESCAPE",
+	10: "FENCE_BREACHED",
+	11: "TERRAIN_FAILSAFE",
+	12: "BRAKE_TIMEOUT",
+	13: "FLIP_COMPLETE",
+	14: "AVOIDANCE",
+	15: "AVOIDANCE_RECOVERY",
+	16: "THROW_COMPLETE",
+	17: "TERMINATE",
+	18: "TOY_MODE",
+	19: "CRASH_FAILSAFE",
+	20: "SOARING_FBW_B_WITH_MOTOR_RUNNING",
+	21: "SOARING_THERMAL_DETECTED",
+	22: "SOARING_THERMAL_ESTIMATE_DETERIORATED",
+	23: "VTOL_FAILED_TRANSITION",
+	24: "VTOL_FAILED_TAKEOFF",
+	25: "FAILSAFE",
+	26: "INITIALISED",
+	27: "SURFACE_COMPLETE",
+	28: "BAD_DEPTH",
+	29: "LEAK_FAILSAFE",
+	30: "SERVOTEST",
+	31: "STARTUP",
+	32: "SCRIPTING",
+	33: "UNAVAILABLE",
+	34: "AUTOROTATION_START",
+	35: "AUTOROTATION_BAILOUT",
+	36: "SOARING_ALT_TOO_HIGH",
+	37: "SOARING_ALT_TOO_LOW",
+	38: "SOARING_DRIFT_EXCEEDED",
+	39: "RTL_COMPLETE_SWITCHING_TO_VTOL_LAND_RTL",
+	40: "RTL_COMPLETE_SWITCHING_TO_FIXEDWING_AUTOLAND",
+	41: "MISSION_CMD",
+	42: "FRSKY_COMMAND",
+	43: "FENCE_RETURN_PREVIOUS_MODE",
+	44: "QRTL_INSTEAD_OF_RTL",
+	45: "AUTO_RTL_EXIT",
+	46: "LOITER_ALT_REACHED_QLAND",
+	47: "LOITER_ALT_IN_VTOL",
+	48: "RADIO_FAILSAFE_RECOVERY",
+	49: "QLAND_INSTEAD_OF_RTL",
+	50: "DEADRECKON_FAILSAFE",
+	51: "MODE_TAKEOFF_FAILSAFE",
+	52: "DDS_COMMAND",
+}
+
+// FlightModeSpan is a period of the log spent in a single flight mode
+type FlightModeSpan struct {
+	Start      time.Duration // time since boot when the mode was entered
+	End        time.Duration // time since boot when the next mode was entered, or the end of the log
+	Mode       string
+	ModeNumber int
+	Reason     string // why the mode was entered, "UNKNOWN" when the log does not record it
+	ReasonCode int
+}
+
+// returns the mode table for the vehicle family of a MavType. Unknown vehicles use the ArduCopter
+// table, as the parser always did before the vehicle type was taken into account.
+func modeMapping(mavType MavType) map[int]string {
+	switch mavType {
+	case MavTypeFixedWing, MavTypeFlappingWing, MavTypeVtolTailsitterDuorotor, MavTypeVtolTailsitterQuadrotor,
+		MavTypeVtolTiltrotor, MavTypeVtolFixedrotor, MavTypeVtolTailsitter, MavTypeVtolTiltwing, MavTypeVtolReserved5:
+		return modeMappingAPM
+	case MavTypeGroundRover, MavTypeSurfaceBoat:
+		return modeMappingRover
+	case MavTypeSubmarine:
+		return modeMappingSub
+	case MavTypeAntennaTracker:
+		return modeMappingTracker
+	case MavTypeAirship:
+		return modeMappingBlimp
+	default:
+		return modeMappingACM
+	}
+}
+
+// returns the name of a mode number for the vehicle type
+func modeString(mavType MavType, modeNumber int) string {
+	if mode, ok := modeMapping(mavType)[modeNumber]; ok {
+		return mode
+	}
+	return fmt.Sprintf("Mode(%d)", modeNumber)
+}
+
+// ModeReasonString returns the name of an ArduPilot mode change reason
+func ModeReasonString(reason int) string {
+	if name, ok := modeReasons[reason]; ok {
+		return name
+	}
+	return fmt.Sprintf("Reason(%d)", reason)
+}
+
+// ModeName returns the name of a mode number for the vehicle type detected by the reader
+func (reader *BinaryDataFileReader) ModeName(modeNumber int) string {
+	return modeString(reader.MavType, modeNumber)
+}
+
+// FlightModeTimeline reads the whole file and returns the flight modes in the order they were
+// entered. Mode names are decoded with the vehicle type detected over the whole log, so a MODE
+// message logged before the firmware banner is still named correctly. The reader is rewound
+// before and after. Returns the error of a message that cannot be read.
+func (reader *BinaryDataFileReader) FlightModeTimeline() ([]FlightModeSpan, error) {
+	reader.rewind()
+	defer reader.rewind()
+
+	recorder := &FlightModeRecorder{}
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		recorder.Add(message)
+	}
+
+	return recorder.Spans(reader.MavType), nil
+}
+
+// FlightModeRecorder builds the flight mode timeline one message at a time, for callers that read
+// the log themselves. The zero value is ready to use.
+type FlightModeRecorder struct {
+	spans      []FlightModeSpan
+	lastTimeUS int
+}
+
+// Add records a message read from the log, in the order the messages were logged
+func (recorder *FlightModeRecorder) Add(message *DataFileMessage) {
+	if timeUS, ok := message.TimeUS(); ok {
+		recorder.lastTimeUS = timeUS
+	}
+
+	if message.GetType() != "MODE" {
+		return
+	}
+
+	modeNumber := message.GetMode()
+	if modeNumber == -1 {
+		return
+	}
+
+	start := time.Duration(recorder.lastTimeUS) * time.Microsecond
+	if len(recorder.spans) > 0 {
+		recorder.spans[len(recorder.spans)-1].End = start
+	}
+
+	reasonCode := 0
+	if reason, err := message.GetAttribute("Rsn"); err == nil {
+		reasonCode, _ = reason.(int)
+	}
+
+	recorder.spans = append(recorder.spans, FlightModeSpan{
+		Start:      start,
+		ModeNumber: modeNumber,
+		ReasonCode: reasonCode,
+		Reason:     ModeReasonString(reasonCode),
+	})
+}
+
+// Spans returns the flight modes recorded so far, the last one ending at the last time since boot
+// seen, with the mode names of the vehicle type
+func (recorder *FlightModeRecorder) Spans(mavType MavType) []FlightModeSpan {
+	spans := make([]FlightModeSpan, len(recorder.spans))
+	copy(spans, recorder.spans)
+	if len(spans) > 0 {
+		spans[len(spans)-1].End = time.Duration(recorder.lastTimeUS) * time.Microsecond
+	}
+	for i := range spans {
+		spans[i].Mode = modeString(mavType, spans[i].ModeNumber)
+	}
+	return spans
+}
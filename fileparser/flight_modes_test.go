@@ -0,0 +1,169 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// logReader builds a log of the formats and messages, each message given as its type followed by
+// its values, and opens it
+func logReader(t *testing.T, formats []binlogtest.Format, messages [][]interface{}) *fileparser.BinaryDataFileReader {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	for _, format := range formats {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, message := range messages {
+		if err := builder.Message(message[0].(int), message[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+var (
+	modeFormat = binlogtest.Format{Type: binlogtest.MODEType, Name: "MODE", Format: "QMBB", Columns: "TimeUS,Mode,ModeNum,Rsn"}
+	msgFormat  = binlogtest.Format{Type: binlogtest.MSGType, Name: "MSG", Format: "QZ", Columns: "TimeUS,Message"}
+	parmFormat = binlogtest.Format{Type: binlogtest.PARMType, Name: "PARM", Format: "QNf", Columns: "TimeUS,Name,Value"}
+)
+
+func TestModeNames(t *testing.T) {
+	tests := []struct {
+		banner     string
+		frameClass float64 // FRAME_CLASS parameter, not logged when 0
+		mode       int
+		want       string
+	}{
+		{"ArduCopter V4.5.1 (1a2b3c4d)", 0, 5, "LOITER"},
+		{"ArduCopter V4.5.1 (1a2b3c4d)", 6, 27, "AUTO_RTL"},
+		{"ArduPlane V4.5.1 (1a2b3c4d)", 0, 5, "FBWA"},
+		{"ArduPlane V4.5.1 (1a2b3c4d)", 0, 19, "QLOITER"},
+		{"ArduRover V4.5.1 (1a2b3c4d)", 0, 4, "HOLD"},
+		{"ArduRover V4.5.1 (1a2b3c4d)", 2, 4, "HOLD"},
+		{"ArduSub V4.5.1 (1a2b3c4d)", 0, 19, "MANUAL"},
+		{"AntennaTracker V4.5.1 (1a2b3c4d)", 0, 2, "SCAN"},
+		{"Blimp V4.5.1 (1a2b3c4d)", 0, 2, "VELOCITY"},
+		// logs without a banner are read as Copter logs
+		{"", 0, 5, "LOITER"},
+		{"ArduPlane V4.5.1 (1a2b3c4d)", 0, 9, "Mode(9)"},
+	}
+
+	for _, test := range tests {
+		messages := [][]interface{}{}
+		if test.banner != "" {
+			messages = append(messages, []interface{}{binlogtest.MSGType, 0, test.banner})
+		}
+		if test.frameClass != 0 {
+			messages = append(messages, []interface{}{binlogtest.PARMType, 0, "FRAME_CLASS", test.frameClass})
+		}
+		messages = append(messages, []interface{}{binlogtest.MODEType, 1000000, test.mode, test.mode, 1})
+		reader := logReader(t, []binlogtest.Format{msgFormat, parmFormat, modeFormat}, messages)
+
+		if got := reader.ModeName(test.mode); got != test.want {
+			t.Errorf("%q frame class %v: mode %d is %s, want %s", test.banner, test.frameClass, test.mode, got, test.want)
+		}
+		spans, err := reader.FlightModeTimeline()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spans) != 1 || spans[0].Mode != test.want {
+			t.Errorf("%q frame class %v: got timeline %+v, want mode %s", test.banner, test.frameClass, spans, test.want)
+		}
+	}
+}
+
+func TestModeReasonString(t *testing.T) {
+	tests := map[int]string{0: "UNKNOWN", 1: "RC_COMMAND", 3: "RADIO_FAILSAFE", 10: "FENCE_BREACHED", 52: "DDS_COMMAND", 200: "Reason(200)"}
+	for reason, want := range tests {
+		if got := fileparser.ModeReasonString(reason); got != want {
+			t.Errorf("reason %d: got %s, want %s", reason, got, want)
+		}
+	}
+}
+
+func TestFlightModeTimeline(t *testing.T) {
+	second := 1000000
+	attFormat := binlogtest.StandardFormats()[1]
+	tests := []struct {
+		name     string
+		formats  []binlogtest.Format
+		messages [][]interface{}
+		want     []string // mode@start-end reason
+	}{
+		{
+			// the banner follows the first MODE message, the names still come from it
+			name:    "plane",
+			formats: []binlogtest.Format{modeFormat, msgFormat, attFormat},
+			messages: [][]interface{}{
+				{binlogtest.MODEType, 1 * second, 0, 0, 26},
+				{binlogtest.MSGType, 1 * second, "ArduPlane V4.5.1 (1a2b3c4d)"},
+				{binlogtest.ATTType, 2 * second, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				{binlogtest.MODEType, 3 * second, 10, 10, 1},
+				{binlogtest.MODEType, 5 * second, 11, 11, 3},
+				{binlogtest.ATTType, 8 * second, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			},
+			want: []string{"MANUAL@1s-3s INITIALISED", "AUTO@3s-5s RC_COMMAND", "RTL@5s-8s RADIO_FAILSAFE"},
+		},
+		{
+			// the last mode lasts until the last message with a time since boot
+			name:    "copter without reasons",
+			formats: []binlogtest.Format{{Type: binlogtest.MODEType, Name: "MODE", Format: "QMB", Columns: "TimeUS,Mode,ModeNum"}, attFormat},
+			messages: [][]interface{}{
+				{binlogtest.MODEType, 1 * second, 0, 0},
+				{binlogtest.MODEType, 2 * second, 6, 6},
+				{binlogtest.ATTType, 4 * second, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			},
+			want: []string{"STABILIZE@1s-2s UNKNOWN", "RTL@2s-4s UNKNOWN"},
+		},
+		{
+			name:     "no modes",
+			formats:  []binlogtest.Format{attFormat},
+			messages: [][]interface{}{{binlogtest.ATTType, 1 * second, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+			want:     []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := logReader(t, test.formats, test.messages)
+			spans, err := reader.FlightModeTimeline()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, span := range spans {
+				got = append(got, fmt.Sprintf("%s@%v-%v %s", span.Mode, span.Start, span.End, span.Reason))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// the recorder gives the same timeline to callers that read the log themselves
+	reader := logReader(t, tests[0].formats, tests[0].messages)
+	recorder := &fileparser.FlightModeRecorder{}
+	for {
+		message, err := reader.ParseNext()
+		if err != nil {
+			break
+		}
+		recorder.Add(message)
+	}
+	spans := recorder.Spans(reader.MavType)
+	if len(spans) != 3 || spans[2].End != 8*time.Second || spans[1].ModeNumber != 10 || spans[2].ReasonCode != 3 {
+		t.Errorf("recorder: got %+v", spans)
+	}
+}
@@ -1,21 +1,39 @@
 package fileparser
 
 import (
-	"log"
+	"math"
+	"time"
+
+	"github.com/edancain/telemetry_parser/gpstime"
+)
+
+const (
+	MillisecondsInSecond = 0.001
 )
 
+// Constants of the GPS to Unix time conversion, which now lives in the gpstime package
 const (
-	MillisecondsInSecond  = 0.001
-	SecondsInDay          = 86400
-	DaysInYear            = 365
-	YearsInLeapCycle      = 4
-	EpochLeapYearOffset   = 1980
-	EpochStartYear        = 1969
-	EpochDaysFromYear     = 6
-	EpochDaysFromWeekday  = 2
-	DaysInWeek            = 7
-	EpochDaysOffset       = 10
-	LeapYearAdjustment    = 1
+	// Deprecated: use gpstime.ToTime or gpstime.ToUnix.
+	SecondsInDay = 86400
+	// Deprecated: use gpstime.ToTime or gpstime.ToUnix.
+	DaysInYear = 365
+	// Deprecated: use gpstime.ToTime or gpstime.ToUnix.
+	YearsInLeapCycle = 4
+	// Deprecated: use gpstime.Epoch.
+	EpochLeapYearOffset = 1980
+	// Deprecated: use gpstime.Epoch.
+	EpochStartYear = 1969
+	// Deprecated: use gpstime.Epoch.
+	EpochDaysFromYear = 6
+	// Deprecated: use gpstime.Epoch.
+	EpochDaysFromWeekday = 2
+	// Deprecated: use gpstime.SecondsPerWeek.
+	DaysInWeek = gpstime.SecondsPerWeek / SecondsInDay
+	// Deprecated: use gpstime.Epoch.
+	EpochDaysOffset = 10
+	// Deprecated: use gpstime.Epoch.
+	LeapYearAdjustment = 1
+	// Deprecated: the GPS-UTC offset changes as leap seconds are inserted; use gpstime.LeapSeconds.
 	LeapSecondsAdjustment = 18
 )
 
@@ -25,6 +43,7 @@ type GPSInterpolated struct {
 	CountsSinceGPS map[string]int
 	Timebase       float64
 	Timestamp      float64
+	firstTimebase  float64
 }
 
 func NewGPSInterpolated() *GPSInterpolated {
@@ -41,6 +60,7 @@ func NewGPSInterpolated() *GPSInterpolated {
 func (clock *GPSInterpolated) RewindEvent() {
 	clock.Counts = make(map[string]int)
 	clock.CountsSinceGPS = make(map[string]int)
+	clock.Timebase = clock.firstTimebase
 }
 
 func (clock *GPSInterpolated) FindTimeBase(message *DataFileMessage, firstUsStamp int) {
@@ -56,19 +76,30 @@ func (clock *GPSInterpolated) FindTimeBase(message *DataFileMessage, firstUsStam
 		return
 	}
 
-	t := clock.GPSTimeToUnixTime(week, timeMs)
+	t := clock.messageUnixTime(message, week, timeMs)
 
 	var v = t - float64(firstUsStamp)*MillisecondsInSecond
 	clock.SetTimebase(v)
+	clock.firstTimebase = v
 	clock.Timestamp = clock.Timebase + float64(firstUsStamp)*MillisecondsInSecond
 }
 
+// GPSTimeToUnixTime converts a GPS week and time of week in milliseconds to a time in seconds
+// since 1970, with the leap seconds of the time
 func (clock *GPSInterpolated) GPSTimeToUnixTime(week int, msec int) float64 {
-	// convert GPS week and TOW (Time Of Week) to a time in seconds since 1970
-	// epoch := 86400 * (10*365 + int((1980-1969)/4) + 1 + 6 - 2)
-	// return float64(epoch) + float64(86400*7*week) + float64(msec)* 0.001 - 18
-	epoch := SecondsInDay * (EpochDaysOffset*DaysInYear + int((EpochLeapYearOffset-EpochStartYear)/YearsInLeapCycle) + LeapYearAdjustment + EpochDaysFromYear - EpochDaysFromWeekday)
-	return float64(epoch) + float64(SecondsInDay*DaysInWeek*week) + float64(msec)*MillisecondsInSecond - LeapSecondsAdjustment
+	return gpstime.ToUnix(week, msec)
+}
+
+// returns the Unix time in seconds of the GPS time of a message, with the GPS-UTC offset broadcast
+// by the receiver when the message logs it and the leap second table otherwise
+func (clock *GPSInterpolated) messageUnixTime(message *DataFileMessage, week int, msec int) float64 {
+	for _, field := range gpsLeapSecondFields {
+		if leap, err := processAttribute(message, field); err == nil && leap > 0 {
+			utc := gpstime.WeekTOWToTimeWithLeapSeconds(week, time.Duration(msec)*time.Millisecond, leap)
+			return float64(utc.UnixMicro()) / microsecondsPerSecond
+		}
+	}
+	return clock.GPSTimeToUnixTime(week, msec)
 }
 
 func (clock *GPSInterpolated) MessageArrived(message *DataFileMessage) {
@@ -119,12 +150,14 @@ func (clock *GPSInterpolated) GPSMessageArrived(message *DataFileMessage) {
 	}
 
 	// If no valid GPS time found, return
-	if gpsWeek == nil || gpsTimems == nil {
+	week, weekOK := gpsWeek.(int)
+	timems, timeOK := gpsTimems.(int)
+	if !weekOK || !timeOK {
 		return
 	}
 
 	// Convert GPS time to Unix time
-	t := clock.GPSTimeToUnixTime(gpsWeek.(int), gpsTimems.(int))
+	t := clock.messageUnixTime(message, week, timems)
 	deltat := t - clock.Timebase
 
 	// If the time difference is non-positive, return
@@ -148,17 +181,21 @@ func (clock *GPSInterpolated) GPSMessageArrived(message *DataFileMessage) {
 	clock.CountsSinceGPS = make(map[string]int)
 }
 
-func (clock *GPSInterpolated) SetMessageTimestamp(message *DataFileMessage) {
+// InterpolatedTimestamp estimates the Unix time of a message from the last GPS time base and the
+// number of messages of the same type seen since then
+func (clock *GPSInterpolated) InterpolatedTimestamp(message *DataFileMessage) float64 {
 	rate := clock.MsgRate[message.GetType()]
 	if rate == 0 {
 		rate = 50
 	}
 	count := clock.CountsSinceGPS[message.GetType()]
-	err := message.SetAttribute("_timestamp", clock.Timebase+float64(count)/rate)
-	if err != nil {
-		// intentionally ignoring error
-		log.Printf("Failed to set attribute _timestamp: %v", err)
-	}
+	return clock.Timebase + float64(count)/rate
+}
+
+// SetMessageTimestamp sets the UTC time of a message to its interpolated timestamp
+func (clock *GPSInterpolated) SetMessageTimestamp(message *DataFileMessage) {
+	seconds, fraction := math.Modf(clock.InterpolatedTimestamp(message))
+	message.utc = time.Unix(int64(seconds), int64(math.Round(fraction*microsecondsPerSecond))*int64(time.Microsecond)).UTC()
 }
 
 func (clock *GPSInterpolated) SetTimebase(base float64) {
@@ -0,0 +1,49 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+	"github.com/edancain/telemetry_parser/gpstime"
+)
+
+func TestGPSMessageArrivedUsesReceiverLeapSeconds(t *testing.T) {
+	const week, tow = 2200, 100000000 // 2022, when the table has 18 leap seconds
+	tests := []struct {
+		leap int
+		want time.Time
+	}{
+		{0, gpstime.ToTime(week, tow)},
+		{17, gpstime.ToTime(week, tow).Add(time.Second)},
+	}
+	for _, test := range tests {
+		builder := binlogtest.NewBuilder()
+		format := binlogtest.Format{Type: binlogtest.GPSType, Name: "GPS", Format: "QBIHb", Columns: "TimeUS,Status,GMS,GWk,Leap"}
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+		if err := builder.Message(format.Type, 1000000, 3, tow, week, test.leap); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := reader.ParseNext()
+		for err == nil && message.GetType() != "GPS" {
+			message, err = reader.ParseNext()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clock := fileparser.NewGPSInterpolated()
+		clock.GPSMessageArrived(message)
+		if got := time.UnixMicro(int64(clock.Timebase * 1e6)).UTC(); !got.Equal(test.want) {
+			t.Errorf("leap %d: got time base %v, want %v", test.leap, got, test.want)
+		}
+	}
+}
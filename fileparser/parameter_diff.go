@@ -0,0 +1,147 @@
+package fileparser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// parameter difference statuses
+const (
+	ParameterAdded   = "added"
+	ParameterRemoved = "removed"
+	ParameterChanged = "changed"
+)
+
+// ParameterDifference is a parameter that differs between two logs. Old is nil for added parameters
+// and New is nil for removed parameters.
+type ParameterDifference struct {
+	Name   string   `json:"name"`
+	Status string   `json:"status"`
+	Old    *float64 `json:"old,omitempty"`
+	New    *float64 `json:"new,omitempty"`
+}
+
+// ParameterDiff lists the parameters added, removed and changed between a baseline log and a
+// candidate log, each in alphabetical order
+type ParameterDiff struct {
+	Prefixes []string              `json:"prefixes,omitempty"`
+	Added    []ParameterDifference `json:"added"`
+	Removed  []ParameterDifference `json:"removed"`
+	Changed  []ParameterDifference `json:"changed"`
+}
+
+// DiffLogParameters opens two logs and compares the parameters in effect at the end of each. The
+// baseline is usually a known-good log. When prefixes are given only parameters starting with one of
+// them are compared, e.g. "ATC_" or "EK3_".
+func DiffLogParameters(baseline io.Reader, candidate io.Reader, prefixes ...string) (*ParameterDiff, error) {
+	baselineReader, err := NewBinaryDataFileReader(baseline, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline log: %w", err)
+	}
+
+	candidateReader, err := NewBinaryDataFileReader(candidate, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read candidate log: %w", err)
+	}
+
+	baselineParams, err := baselineReader.ParameterSet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline parameters: %w", err)
+	}
+
+	candidateParams, err := candidateReader.ParameterSet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read candidate parameters: %w", err)
+	}
+
+	return DiffParameters(baselineParams, candidateParams, prefixes...), nil
+}
+
+// DiffParameters compares the final parameter values of two parameter sets
+func DiffParameters(baseline *ParameterSet, candidate *ParameterSet, prefixes ...string) *ParameterDiff {
+	diff := &ParameterDiff{
+		Prefixes: prefixes,
+		Added:    []ParameterDifference{},
+		Removed:  []ParameterDifference{},
+		Changed:  []ParameterDifference{},
+	}
+
+	for _, name := range baseline.Names() {
+		if !hasParameterPrefix(name, prefixes) {
+			continue
+		}
+
+		oldValue := baseline.final[name]
+		newValue, ok := candidate.final[name]
+		switch {
+		case !ok:
+			diff.Removed = append(diff.Removed, ParameterDifference{Name: name, Status: ParameterRemoved, Old: &oldValue})
+		case float32(oldValue) != float32(newValue):
+			diff.Changed = append(diff.Changed, ParameterDifference{Name: name, Status: ParameterChanged, Old: &oldValue, New: &newValue})
+		}
+	}
+
+	for _, name := range candidate.Names() {
+		if !hasParameterPrefix(name, prefixes) {
+			continue
+		}
+		if _, ok := baseline.final[name]; !ok {
+			newValue := candidate.final[name]
+			diff.Added = append(diff.Added, ParameterDifference{Name: name, Status: ParameterAdded, New: &newValue})
+		}
+	}
+
+	return diff
+}
+
+// reports whether a parameter name starts with one of the prefixes, or there are no prefixes
+func hasParameterPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, strings.ToUpper(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty reports whether the two logs have the same parameters
+func (diff *ParameterDiff) Empty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+// WriteText writes the differences as text, one parameter per line: "+ NAME = value" for added,
+// "- NAME = value" for removed and "~ NAME: old -> new" for changed parameters
+func (diff *ParameterDiff) WriteText(w io.Writer) error {
+	lines := []string{
+		fmt.Sprintf("%d added, %d removed, %d changed", len(diff.Added), len(diff.Removed), len(diff.Changed)),
+	}
+	for _, difference := range diff.Added {
+		lines = append(lines, fmt.Sprintf("+ %s = %s", difference.Name, formatParamValue(*difference.New)))
+	}
+	for _, difference := range diff.Removed {
+		lines = append(lines, fmt.Sprintf("- %s = %s", difference.Name, formatParamValue(*difference.Old)))
+	}
+	for _, difference := range diff.Changed {
+		lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", difference.Name, formatParamValue(*difference.Old), formatParamValue(*difference.New)))
+	}
+
+	if _, err := io.WriteString(w, strings.Join(lines, "\n")+"\n"); err != nil {
+		return fmt.Errorf("failed to write parameter diff: %v", err)
+	}
+	return nil
+}
+
+// WriteJSON writes the differences as an indented JSON document
+func (diff *ParameterDiff) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(diff); err != nil {
+		return fmt.Errorf("failed to write parameter diff: %v", err)
+	}
+	return nil
+}
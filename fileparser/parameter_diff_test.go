@@ -0,0 +1,146 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// paramLog builds a log of PARM messages, each given as a name followed by its value
+func paramLog(t *testing.T, params ...interface{}) *bytes.Reader {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	if err := builder.Declare(parmFormat); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(params); i += 2 {
+		if err := builder.Message(binlogtest.PARMType, 0, params[i], params[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bytes.NewReader(builder.Bytes())
+}
+
+// describes the differences of a diff as "status NAME old->new", nil values written as -
+func describeDiff(diff *fileparser.ParameterDiff) []string {
+	value := func(value *float64) string {
+		if value == nil {
+			return "-"
+		}
+		return fmt.Sprint(float32(*value))
+	}
+	got := []string{}
+	for _, differences := range [][]fileparser.ParameterDifference{diff.Added, diff.Removed, diff.Changed} {
+		for _, difference := range differences {
+			got = append(got, fmt.Sprintf("%s %s %s->%s", difference.Status, difference.Name, value(difference.Old), value(difference.New)))
+		}
+	}
+	return got
+}
+
+func TestDiffLogParameters(t *testing.T) {
+	baseline := []interface{}{
+		"ATC_RAT_RLL_P", 0.135, "ATC_RAT_PIT_P", 0.135, "EK3_ENABLE", 1.0, "FENCE_ENABLE", 0.0,
+		// changed in flight, the final value is compared
+		"ATC_ACCEL_R_MAX", 110000.0, "ATC_ACCEL_R_MAX", 72000.0,
+		// logged as float32, the same value read back is not a change
+		"INS_GYRO_FILTER", 0.1,
+	}
+	candidate := []interface{}{
+		"ATC_RAT_RLL_P", 0.15, "ATC_ACCEL_R_MAX", 72000.0, "EK3_ENABLE", 1.0, "FENCE_ENABLE", 1.0,
+		"EK3_SRC1_YAW", 2.0, "INS_GYRO_FILTER", float64(float32(0.1)),
+	}
+
+	tests := []struct {
+		name     string
+		prefixes []string
+		want     []string
+	}{
+		{
+			name: "all",
+			want: []string{
+				"added EK3_SRC1_YAW -->2",
+				"removed ATC_RAT_PIT_P 0.135->-",
+				"changed ATC_RAT_RLL_P 0.135->0.15",
+				"changed FENCE_ENABLE 0->1",
+			},
+		},
+		{
+			// prefixes match regardless of case
+			name:     "prefixes",
+			prefixes: []string{"atc_", "EK3_"},
+			want: []string{
+				"added EK3_SRC1_YAW -->2",
+				"removed ATC_RAT_PIT_P 0.135->-",
+				"changed ATC_RAT_RLL_P 0.135->0.15",
+			},
+		},
+		{
+			name:     "no match",
+			prefixes: []string{"RC"},
+			want:     []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff, err := fileparser.DiffLogParameters(paramLog(t, baseline...), paramLog(t, candidate...), test.prefixes...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describeDiff(diff); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			if diff.Empty() != (len(test.want) == 0) {
+				t.Errorf("got empty %v with %d differences", diff.Empty(), len(test.want))
+			}
+		})
+	}
+
+	// the same log has no differences
+	diff, err := fileparser.DiffLogParameters(paramLog(t, baseline...), paramLog(t, baseline...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("got differences of a log with itself: %v", describeDiff(diff))
+	}
+}
+
+func TestParameterDiffOutput(t *testing.T) {
+	diff, err := fileparser.DiffLogParameters(paramLog(t, "A", 1.0, "B", 2.0), paramLog(t, "B", 0.5, "C", 3.0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	if err := diff.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if want := "1 added, 1 removed, 1 changed\n+ C = 3\n- A = 1\n~ B: 2 -> 0.5\n"; text.String() != want {
+		t.Errorf("got text %q, want %q", text.String(), want)
+	}
+
+	var document bytes.Buffer
+	if err := diff.WriteJSON(&document); err != nil {
+		t.Fatal(err)
+	}
+	decoded := map[string][]map[string]interface{}{}
+	if err := json.Unmarshal(document.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	added, removed, changed := decoded["added"], decoded["removed"], decoded["changed"]
+	if len(added) != 1 || added[0]["name"] != "C" || added[0]["new"] != 3.0 || added[0]["old"] != nil {
+		t.Errorf("got added %v", added)
+	}
+	if len(removed) != 1 || removed[0]["status"] != fileparser.ParameterRemoved || removed[0]["old"] != 1.0 || removed[0]["new"] != nil {
+		t.Errorf("got removed %v", removed)
+	}
+	if len(changed) != 1 || changed[0]["old"] != 2.0 || changed[0]["new"] != 0.5 {
+		t.Errorf("got changed %v", changed)
+	}
+}
@@ -0,0 +1,269 @@
+package fileparser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+This code extracts the vehicle parameters from PARM messages. ArduPilot logs every parameter when
+logging starts, and logs a parameter again whenever it is changed. The first value logged for a
+parameter is treated as its boot value and every later value that differs is recorded as a change,
+so the value of a parameter can be looked up at any point of the log. Changes are keyed on the byte
+offset of their PARM message, as the time since boot starts over when the vehicle reboots during a
+log; their UTC time is recorded when the log has GPS time. Newer logs also record the
+firmware default in the Default field of PARM.
+*/
+
+const (
+	parameterMessage    = "PARM"
+	parameterFloatBits  = 32 // PARM values are logged as float32
+	parameterFileFormat = "%s,%s\n"
+)
+
+// ParameterChange is a parameter value changed while the log was recorded
+type ParameterChange struct {
+	Name     string
+	Value    float64
+	Previous float64
+	Time     time.Duration // time since boot of the change, from the PARM message or the last timestamped message
+	UTC      time.Time     // UTC time of the change, zero when the boot of the change has no GPS time
+	Offset   int           // byte offset of the PARM message within the data file
+}
+
+// ParameterDefault is a parameter whose value differs from the firmware default
+type ParameterDefault struct {
+	Name    string
+	Value   float64
+	Default float64
+}
+
+// ParameterSet holds the parameters logged at boot and every change made during the log
+type ParameterSet struct {
+	boot     map[string]float64
+	defaults map[string]float64
+	final    map[string]float64
+	changes  []ParameterChange
+}
+
+// Param returns the value of a parameter as of the most recently read message
+func (reader *BinaryDataFileReader) Param(name string) (float64, bool) {
+	value, ok := reader.params[name].(float64)
+	return value, ok
+}
+
+// ParameterSet reads the whole file and returns the parameters logged in it. The reader is rewound
+// before and after. Returns the error of a message that cannot be read.
+func (reader *BinaryDataFileReader) ParameterSet() (*ParameterSet, error) {
+	reader.rewind()
+	defer reader.rewind()
+
+	params := &ParameterSet{
+		boot:     make(map[string]float64),
+		defaults: make(map[string]float64),
+		final:    make(map[string]float64),
+		changes:  []ParameterChange{},
+	}
+	var lastTimeUS int
+	var lastUTC time.Time
+
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if timeUS, ok := message.TimeUS(); ok {
+			lastTimeUS = timeUS
+			lastUTC, _ = message.UTC()
+		}
+		if message.GetType() != parameterMessage {
+			continue
+		}
+
+		name, value, ok := parameterValue(message)
+		if !ok {
+			continue
+		}
+		if defaultValue, err := message.GetAttribute("Default"); err == nil {
+			if defaultNumber, ok := defaultValue.(float64); ok && !math.IsNaN(defaultNumber) {
+				params.defaults[name] = defaultNumber
+			}
+		}
+
+		previous, seen := params.final[name]
+		switch {
+		case !seen:
+			params.boot[name] = value
+		case previous != value:
+			params.changes = append(params.changes, ParameterChange{
+				Name:     name,
+				Value:    value,
+				Previous: previous,
+				Time:     time.Duration(lastTimeUS) * time.Microsecond,
+				UTC:      lastUTC,
+				Offset:   message.Offset,
+			})
+		}
+		params.final[name] = value
+	}
+
+	return params, nil
+}
+
+// returns the name and value of a PARM message
+func parameterValue(message *DataFileMessage) (string, float64, bool) {
+	nameValue, err := message.GetAttribute("Name")
+	if err != nil {
+		return "", 0, false
+	}
+	name, ok := nameValue.(string)
+	if !ok || nullTerm(name) == "" {
+		return "", 0, false
+	}
+
+	value, err := message.GetAttribute("Value")
+	if err != nil {
+		return "", 0, false
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return "", 0, false
+	}
+	return nullTerm(name), number, true
+}
+
+// records the parameter value of a PARM message as the current value
+func (reader *BinaryDataFileReader) updateParams(dataMessage *DataFileMessage) {
+	if name, value, ok := parameterValue(dataMessage); ok {
+		reader.params[name] = value
+	}
+}
+
+// Names returns the names of every logged parameter in alphabetical order
+func (params *ParameterSet) Names() []string {
+	names := make([]string, 0, len(params.final))
+	for name := range params.final {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Boot returns the value of a parameter when logging started
+func (params *ParameterSet) Boot(name string) (float64, bool) {
+	value, ok := params.boot[name]
+	return value, ok
+}
+
+// Final returns the value of a parameter at the end of the log
+func (params *ParameterSet) Final(name string) (float64, bool) {
+	value, ok := params.final[name]
+	return value, ok
+}
+
+// Default returns the firmware default of a parameter, when the log records it
+func (params *ParameterSet) Default(name string) (float64, bool) {
+	value, ok := params.defaults[name]
+	return value, ok
+}
+
+// Changes returns the parameter changes in the order they were logged
+func (params *ParameterSet) Changes() []ParameterChange {
+	return params.changes
+}
+
+// ValueAt returns the value of a parameter as of the message at a byte offset, including a change
+// logged at that offset
+func (params *ParameterSet) ValueAt(name string, offset int) (float64, bool) {
+	value, ok := params.boot[name]
+	if !ok {
+		return 0, false
+	}
+
+	for _, change := range params.changes {
+		if change.Offset > offset {
+			break
+		}
+		if change.Name == name {
+			value = change.Value
+		}
+	}
+	return value, true
+}
+
+// ValuesAt returns the value of every parameter as of the message at a byte offset
+func (params *ParameterSet) ValuesAt(offset int) map[string]float64 {
+	values := make(map[string]float64, len(params.boot))
+	for name, value := range params.boot {
+		values[name] = value
+	}
+
+	for _, change := range params.changes {
+		if change.Offset > offset {
+			break
+		}
+		values[change.Name] = change.Value
+	}
+	return values
+}
+
+// NonDefault returns the parameters whose final value differs from the firmware default, for logs
+// that record defaults
+func (params *ParameterSet) NonDefault() []ParameterDefault {
+	nonDefault := []ParameterDefault{}
+	for _, name := range params.Names() {
+		defaultValue, ok := params.defaults[name]
+		if !ok {
+			continue
+		}
+		if value := params.final[name]; float32(value) != float32(defaultValue) {
+			nonDefault = append(nonDefault, ParameterDefault{Name: name, Value: value, Default: defaultValue})
+		}
+	}
+	return nonDefault
+}
+
+// WriteParamFile writes the final parameter values in the Mission Planner .param format
+func (params *ParameterSet) WriteParamFile(w io.Writer) error {
+	return WriteParamFile(w, params.final)
+}
+
+// WriteParamFileAt writes the parameter values as of the message at a byte offset in the Mission
+// Planner .param format
+func (params *ParameterSet) WriteParamFileAt(w io.Writer, offset int) error {
+	return WriteParamFile(w, params.ValuesAt(offset))
+}
+
+// WriteParamFile writes parameter values in the Mission Planner .param format, one NAME,VALUE line
+// per parameter in alphabetical order
+func WriteParamFile(w io.Writer, values map[string]float64) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buffered := bufio.NewWriter(w)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(buffered, parameterFileFormat, name, formatParamValue(values[name])); err != nil {
+			return fmt.Errorf("failed to write parameter %s: %v", name, err)
+		}
+	}
+	return buffered.Flush()
+}
+
+// formats a value with the shortest representation of its float32, so 0.1 is not written as
+// 0.10000000149011612
+func formatParamValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, parameterFloatBits)
+}
@@ -0,0 +1,120 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+var parmDefaultFormat = binlogtest.Format{Type: binlogtest.PARMType, Name: "PARM", Format: "QNff", Columns: "TimeUS,Name,Value,Default"}
+
+// gpsFix returns a GPS message at a time since boot and a GPS time of week in clockTestWeek
+func gpsFix(bootUS int, gpsMS int) []interface{} {
+	return []interface{}{binlogtest.GPSType, bootUS, 0, 3, gpsMS, clockTestWeek, 12, 0.8, -353632621, 1491652374, 584.0, 0.0, 0.0, 0.0, 0.0, 1}
+}
+
+func TestParameterSetValueAt(t *testing.T) {
+	// the vehicle reboots without restarting the log, so the second change of ATC_RAT_RLL_P has an
+	// earlier time since boot than the first
+	const startMS, rebootMS = 100000000, 100100000
+	second := 1000000
+	formats := append(binlogtest.StandardFormats(), parmDefaultFormat)
+	messages := [][]interface{}{
+		{binlogtest.PARMType, 0, "ATC_RAT_RLL_P", 0.135, 0.135},
+		{binlogtest.PARMType, 0, "FENCE_ENABLE", 0.0, 0.0},
+		gpsFix(1*second, startMS+1000),
+		{binlogtest.PARMType, 2 * second, "ATC_RAT_RLL_P", 0.15, 0.135},
+		gpsFix(3*second, startMS+3000),
+		{binlogtest.PARMType, 0, "ATC_RAT_RLL_P", 0.15, 0.135},
+		{binlogtest.PARMType, 0, "FENCE_ENABLE", 0.0, 0.0},
+		gpsFix(1*second, rebootMS+1000),
+		{binlogtest.PARMType, 1 * second, "FENCE_ENABLE", 1.0, 0.0},
+		gpsFix(2*second, rebootMS+2000),
+		{binlogtest.PARMType, 2 * second, "ATC_RAT_RLL_P", 0.12, 0.135},
+		gpsFix(3*second, rebootMS+3000),
+	}
+	reader := logReader(t, formats, messages)
+	params, err := reader.ParameterSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := readClockLog(t, reader)
+	if len(logged) != len(messages) {
+		t.Fatalf("got %d messages, want %d", len(logged), len(messages))
+	}
+	offset := func(i int) int { return logged[i].Offset }
+
+	changes := params.Changes()
+	if len(changes) != 3 {
+		t.Fatalf("got %d changes, want 3: %+v", len(changes), changes)
+	}
+	wantChanges := []struct {
+		name     string
+		value    float64
+		previous float64
+		time     time.Duration
+		utc      time.Time
+		message  int
+	}{
+		{"ATC_RAT_RLL_P", 0.15, 0.135, 2 * time.Second, gpsUTC(startMS + 2000), 3},
+		{"FENCE_ENABLE", 1, 0, 1 * time.Second, gpsUTC(rebootMS + 1000), 8},
+		{"ATC_RAT_RLL_P", 0.12, 0.15, 2 * time.Second, gpsUTC(rebootMS + 2000), 10},
+	}
+	for i, want := range wantChanges {
+		change := changes[i]
+		if change.Name != want.name || float32(change.Value) != float32(want.value) || float32(change.Previous) != float32(want.previous) ||
+			change.Time != want.time || change.UTC.Sub(want.utc).Abs() > clockTestTolerance || change.Offset != offset(want.message) {
+			t.Errorf("change %d: got %+v, want %+v at offset %d", i, change, want, offset(want.message))
+		}
+	}
+
+	tests := []struct {
+		name    string
+		message int
+		want    float64
+	}{
+		{"ATC_RAT_RLL_P", 0, 0.135},
+		{"ATC_RAT_RLL_P", 2, 0.135},
+		{"ATC_RAT_RLL_P", 3, 0.15},
+		{"ATC_RAT_RLL_P", 4, 0.15},
+		// the later boot has an earlier time since boot, the value carries over
+		{"ATC_RAT_RLL_P", 8, 0.15},
+		{"ATC_RAT_RLL_P", 9, 0.15},
+		{"ATC_RAT_RLL_P", 10, 0.12},
+		{"ATC_RAT_RLL_P", 11, 0.12},
+		{"FENCE_ENABLE", 7, 0},
+		{"FENCE_ENABLE", 8, 1},
+		{"FENCE_ENABLE", 11, 1},
+	}
+	for _, test := range tests {
+		got, ok := params.ValueAt(test.name, offset(test.message))
+		if !ok || float32(got) != float32(test.want) {
+			t.Errorf("%s at message %d: got %v %v, want %v", test.name, test.message, got, ok, test.want)
+		}
+	}
+	if _, ok := params.ValueAt("NOT_LOGGED", offset(11)); ok {
+		t.Error("got a value of a parameter that is not logged")
+	}
+
+	if got, _ := params.Boot("ATC_RAT_RLL_P"); float32(got) != 0.135 {
+		t.Errorf("got boot value %v, want 0.135", got)
+	}
+	if got, _ := params.Final("ATC_RAT_RLL_P"); float32(got) != 0.12 {
+		t.Errorf("got final value %v, want 0.12", got)
+	}
+	nonDefault := params.NonDefault()
+	if len(nonDefault) != 2 || nonDefault[0].Name != "ATC_RAT_RLL_P" || nonDefault[1].Name != "FENCE_ENABLE" {
+		t.Errorf("got non-default parameters %+v", nonDefault)
+	}
+
+	var file bytes.Buffer
+	if err := params.WriteParamFileAt(&file, offset(9)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ATC_RAT_RLL_P,0.15\nFENCE_ENABLE,1\n"; file.String() != want {
+		t.Errorf("got .param file %q, want %q", file.String(), want)
+	}
+}
@@ -0,0 +1,121 @@
+package fileparser
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+/*
+This code reports the progress of a parse and lets the caller cancel it. The reader makes several
+passes over the file: the clock pass fits the GPS clock, the index pass finds the offset of every
+message and the read pass returns the messages to the caller, again each time the reader is rewound.
+The progress handler is called about a hundred times per pass with the bytes processed, the messages
+decoded, the time spent and an estimate of the time left in the pass. The context given to
+NewBinaryDataFileReaderContext is checked while the data is read, during the passes of the
+constructor and by every ParseNext, which returns the context error once it is cancelled.
+*/
+
+// progress stages, one per pass over the file
+const (
+	ProgressClock = "clock"
+	ProgressIndex = "index"
+	ProgressRead  = "read"
+)
+
+const (
+	progressSteps       = 100  // progress reports per pass
+	cancelCheckInterval = 1024 // messages between context checks of the index pass
+)
+
+// Progress is the progress of a pass over the file
+type Progress struct {
+	Stage      string // one of the Progress* constants
+	Bytes      int    // bytes processed in this pass
+	TotalBytes int
+	Messages   int           // messages decoded in this pass
+	Elapsed    time.Duration // time spent in this pass
+	ETA        time.Duration // estimated time left in this pass, 0 until some bytes are processed
+}
+
+// Percent returns the bytes processed as a percentage of the file
+func (progress Progress) Percent() float64 {
+	if progress.TotalBytes == 0 {
+		return PercentMultiplier
+	}
+	return PercentMultiplier * float64(progress.Bytes) / float64(progress.TotalBytes)
+}
+
+// WithProgress passes the progress of every pass over the file to handler
+func WithProgress(handler func(Progress)) ReaderOption {
+	return func(reader *BinaryDataFileReader) {
+		reader.progress.handler = handler
+	}
+}
+
+// progressState tracks the progress of the current pass
+type progressState struct {
+	handler  func(Progress)
+	stage    string
+	start    time.Time
+	messages int
+	next     int // bytes processed at the next report
+	done     bool
+}
+
+// starts a new pass over the file
+func (reader *BinaryDataFileReader) startPass(stage string) {
+	reader.progress.stage = stage
+	reader.progress.messages = 0
+	reader.progress.next = 0
+	reader.progress.done = false
+	if reader.progress.handler != nil {
+		reader.progress.start = time.Now()
+	}
+}
+
+// counts a message decoded and reports the progress when it has moved on by a step
+func (reader *BinaryDataFileReader) messageProgress(bytes int) {
+	reader.progress.messages++
+	if reader.progress.handler == nil || bytes < reader.progress.next {
+		return
+	}
+	reader.progress.next = bytes + max(reader.dataLen/progressSteps, 1)
+	reader.reportProgress(bytes)
+}
+
+// reports the end of the pass, once
+func (reader *BinaryDataFileReader) finishPass() {
+	if reader.progress.handler == nil || reader.progress.done {
+		return
+	}
+	reader.progress.done = true
+	reader.reportProgress(reader.dataLen)
+}
+
+func (reader *BinaryDataFileReader) reportProgress(bytes int) {
+	progress := Progress{
+		Stage:      reader.progress.stage,
+		Bytes:      bytes,
+		TotalBytes: reader.dataLen,
+		Messages:   reader.progress.messages,
+		Elapsed:    time.Since(reader.progress.start),
+	}
+	if bytes > 0 && bytes < reader.dataLen {
+		progress.ETA = time.Duration(float64(progress.Elapsed) * float64(reader.dataLen-bytes) / float64(bytes))
+	}
+	reader.progress.handler(progress)
+}
+
+// contextReader stops reading once its context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,125 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+// readAll reads the messages of the reader up to the end of the file, returns the first error
+// other than io.EOF
+func readAll(reader *fileparser.BinaryDataFileReader) error {
+	for {
+		_, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	data, err := binlogtest.SampleLog(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []fileparser.Progress
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(data), false,
+		fileparser.WithProgress(func(progress fileparser.Progress) { reports = append(reports, progress) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the passes reaching 100%, in order
+	finished := func() []string {
+		stages := []string{}
+		for _, progress := range reports {
+			if progress.Percent() == 100 {
+				stages = append(stages, progress.Stage)
+			}
+		}
+		return stages
+	}
+	if got, want := finished(), []string{fileparser.ProgressClock, fileparser.ProgressIndex}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got passes %v finished by the constructor, want %v", got, want)
+	}
+
+	// reading past the end of the file finishes the read pass once, each rewind starts another
+	for pass := 0; pass < 2; pass++ {
+		if err := readAll(reader); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ParseNext(); !errors.Is(err, io.EOF) {
+			t.Fatalf("got %v after the end of the file, want io.EOF", err)
+		}
+		reader.Rewind()
+	}
+	if got := finished(); len(got) != 4 || got[2] != fileparser.ProgressRead || got[3] != fileparser.ProgressRead {
+		t.Errorf("got passes %v finished, want two read passes after the constructor", got)
+	}
+
+	// within a pass the bytes and messages only go up, and stop at the size of the file
+	for i, progress := range reports {
+		if progress.TotalBytes != len(data) || progress.Bytes > progress.TotalBytes {
+			t.Fatalf("report %d: got %d of %d bytes, file of %d", i, progress.Bytes, progress.TotalBytes, len(data))
+		}
+		if i == 0 || reports[i-1].Percent() == 100 {
+			continue
+		}
+		if previous := reports[i-1]; progress.Bytes < previous.Bytes || progress.Messages < previous.Messages {
+			t.Errorf("report %d: progress went back from %+v to %+v", i, previous, progress)
+		}
+	}
+	if len(reports) < 4*10 {
+		t.Errorf("got %d reports, want some within every pass", len(reports))
+	}
+}
+
+func TestProgressCancel(t *testing.T) {
+	data, err := binlogtest.SampleLog(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelled before the reader is created
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fileparser.NewBinaryDataFileReaderContext(ctx, bytes.NewReader(data), false); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v creating the reader, want %v", err, context.Canceled)
+	}
+
+	// cancelled by the progress handler while the reader is created
+	ctx, cancel = context.WithCancel(context.Background())
+	cancelOn := func(stage string) fileparser.ReaderOption {
+		return fileparser.WithProgress(func(progress fileparser.Progress) {
+			if progress.Stage == stage && progress.Percent() >= 50 {
+				cancel()
+			}
+		})
+	}
+	if _, err := fileparser.NewBinaryDataFileReaderContext(ctx, bytes.NewReader(data), false, cancelOn(fileparser.ProgressIndex)); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v cancelling the index pass, want %v", err, context.Canceled)
+	}
+
+	// cancelled while the messages are read
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	reader, err := fileparser.NewBinaryDataFileReaderContext(ctx, bytes.NewReader(data), false, cancelOn(fileparser.ProgressRead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readAll(reader); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v reading the messages, want %v", err, context.Canceled)
+	}
+	if _, err := reader.ParseNext(); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v after the cancellation, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,124 @@
+package fileparser
+
+import (
+	"strings"
+)
+
+/*
+This code finds the way back to the messages after a corrupted region of a log. Reading a damaged
+log, the reader skips bytes until it finds the 0xA3 0x95 header again, but the pair also turns up
+by chance in corrupted data and the reader then locks onto a message that is not there. When the
+reader has skipped bytes, a candidate header is only taken if the messages after it also start with
+a valid header at the length given by the format of the message before, and if its time since boot
+is close to the last message read or small enough to follow a reboot, and an FMT message is only
+taken if it defines a new message type or repeats a known definition. Salvage mode goes further for
+damaged or truncated SD card dumps: a message that cannot be unpacked, or runs past the end of the
+data, is skipped and the reader carries on from the next byte instead of stopping.
+*/
+
+// ResyncMode selects how the reader finds the next message after bytes it could not read
+type ResyncMode int
+
+const (
+	// ResyncScan takes the first header with a known message type, as older readers did
+	ResyncScan ResyncMode = iota
+	// ResyncValidate only takes a header when the messages after it and its time since boot confirm it
+	ResyncValidate
+	// ResyncSalvage validates headers like ResyncValidate and skips messages that cannot be read
+	// instead of stopping at the first one
+	ResyncSalvage
+)
+
+const (
+	resyncConfirmations   = 2                          // message headers after a candidate header that must be valid
+	resyncTimeToleranceUS = 1 * microsecondsPerSecond  // how far the time since boot may go back after a resync
+	maxResyncTimeJumpUS   = 60 * microsecondsPerSecond // how far the time since boot may go forward after a resync
+)
+
+// WithResync sets how the reader finds the next message after bytes it could not read. The
+// default is ResyncValidate.
+func WithResync(mode ResyncMode) ReaderOption {
+	return func(reader *BinaryDataFileReader) {
+		reader.resync = mode
+	}
+}
+
+// WithStrictEnd makes a message cut short by the end of the data an ErrTruncated error. By default
+// such a message, the normal end of a log written until the power was cut, ends the data and is
+// only recorded as a DiagnosticTruncated.
+func WithStrictEnd() ReaderOption {
+	return func(reader *BinaryDataFileReader) {
+		reader.strictEnd = true
+	}
+}
+
+// reports whether a truncated message at offset is the cut off end of the log, read as the end of
+// the data
+func (reader *BinaryDataFileReader) truncatedTail(offset int) bool {
+	return !reader.strictEnd && reader.dataLen-offset < EndOfFileGarbageLimit
+}
+
+// reports whether the header at offset is followed by resyncConfirmations more message headers,
+// each at the length given by the format of the message before, or by the end of the data
+func (reader *BinaryDataFileReader) confirmHeader(offset int) bool {
+	for i := 0; i <= resyncConfirmations; i++ {
+		if i > 0 && offset+headerSizeAdjustment > reader.dataLen {
+			// the data ends after a confirmed message
+			return true
+		}
+		if offset+headerSizeAdjustment > reader.dataLen ||
+			reader.dataMap[offset] != reader.HEAD1 || reader.dataMap[offset+1] != reader.HEAD2 {
+			return false
+		}
+
+		format, ok := reader.formats[int(reader.dataMap[offset+2])]
+		if !ok || format.Len < headerSizeAdjustment {
+			return false
+		}
+		offset += format.Len
+	}
+	return true
+}
+
+// reports whether the time since boot of a message read after a resync is close to the last
+// message read, or small enough for the flight controller to have rebooted in between
+func (reader *BinaryDataFileReader) plausibleTime(message *DataFileMessage) bool {
+	timeUS, ok := message.TimeUS()
+	if !ok || !reader.hasLastTime {
+		return true
+	}
+
+	bootUS := int64(timeUS)
+	if bootUS < maxResyncTimeJumpUS {
+		return true
+	}
+	return bootUS >= reader.lastTimeUS-resyncTimeToleranceUS && bootUS <= reader.lastTimeUS+maxResyncTimeJumpUS
+}
+
+// reports whether an FMT message read after a resync defines a new message type or repeats the
+// definition already known for its type
+func (reader *BinaryDataFileReader) plausibleFormat(elements []interface{}) bool {
+	if len(elements) < 5 {
+		return false
+	}
+	formatType, ok := elements[0].(int)
+	if !ok {
+		return false
+	}
+	existing, ok := reader.formats[formatType]
+	if !ok {
+		return true
+	}
+	length, _ := elements[1].(int)
+	name, _ := elements[2].(string)
+	format, _ := elements[3].(string)
+	columns, _ := elements[4].(string)
+	return existing.Name == nullTerm(name) && existing.Len == length && existing.Format == nullTerm(format) &&
+		strings.Join(existing.Columns, ",") == nullTerm(columns)
+}
+
+// moves the reader to the byte after a message header that was not taken, to look for the next one
+func (reader *BinaryDataFileReader) salvageFrom(messageOffset int) {
+	reader.offset = messageOffset + 1
+	reader.remaining = reader.dataLen - reader.offset
+}
@@ -0,0 +1,65 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+func TestResyncRejectsFalseFMTRedefiningAFormat(t *testing.T) {
+	builder := binlogtest.NewBuilder()
+	gps := binlogtest.StandardFormats()[0]
+	if err := builder.Declare(gps); err != nil {
+		t.Fatal(err)
+	}
+	gpsMessage := func(timeUS int) {
+		t.Helper()
+		if err := builder.Message(gps.Type, timeUS, 0, 3, 100000, 2200, 10, 0.8, -353632621, 1491652374, 584.0, 0.0, 0.0, 0.0, 0.0, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gpsMessage(1000000)
+
+	// corrupted bytes, then an FMT message redefining GPS that lines up with the messages after it
+	builder.Raw([]byte{0x00, 0x01, 0x02})
+	fake := binlogtest.NewBuilder()
+	if err := fake.Declare(binlogtest.Format{Type: gps.Type, Name: "GPS", Format: "QB", Columns: "TimeUS,A"}); err != nil {
+		t.Fatal(err)
+	}
+	builder.Raw(fake.Bytes())
+	for i := 2; i <= 5; i++ {
+		gpsMessage(i * 1000000)
+	}
+
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixes := 0
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.GetType() != "GPS" {
+			continue
+		}
+		if _, err := message.GetAttribute("Lat"); err != nil {
+			t.Fatalf("GPS message at %d read with the false format: %v", message.Offset, err)
+		}
+		fixes++
+	}
+	if fixes != 5 {
+		t.Errorf("got %d GPS messages, want 5", fixes)
+	}
+	if reader.ParseReport().Counts[fileparser.DiagnosticFalseHeader] == 0 {
+		t.Errorf("false FMT header not reported")
+	}
+}
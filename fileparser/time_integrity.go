@@ -0,0 +1,207 @@
+package fileparser
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/edancain/telemetry_parser/gpstime"
+)
+
+/*
+This code checks the timing of a log. A brownout reboots the flight controller while the log carries
+on, so TimeUS jumps backwards; a stalled logger leaves gaps between consecutive messages; and a GPS
+receiver with a week number bug jumps its GPS time by whole weeks, most often when the week rolls
+over. Each of these is reported with the byte offset of the message where it was found, along with
+the drift of the flight controller clock against GPS time and how closely the GPS fixes follow the
+fitted clock. The report carries a clock refitted across the discontinuities: a new fit starts at
+every backwards jump of TimeUS, not only those large enough to be taken for a reboot, and GPS times
+are shifted back by the whole weeks of a rollover. A rollover moves the GPS time to a date with a
+different count of leap seconds, so the jump of its UTC time is off whole weeks by that difference
+unless the receiver logs the GPS-UTC offset itself. CompensateClock makes the reader timestamp its
+messages with that clock. Other GPS time jumps are reported only, as the fit already leaves out
+fixes far from the rest.
+*/
+
+// time discontinuity kinds
+const (
+	TimeBackwards   = "time_backwards"
+	LoggingGap      = "logging_gap"
+	GPSTimeJump     = "gps_time_jump"
+	GPSWeekRollover = "gps_week_rollover"
+)
+
+const (
+	microsecondsPerWeek = int64(gpstime.WeekDuration / time.Microsecond)
+	partsPerMillion     = 1e6
+)
+
+// TimeIntegrityOptions holds the thresholds of the time integrity checks
+type TimeIntegrityOptions struct {
+	// BackwardsTolerance is how far TimeUS may go back between messages before it is reported.
+	// Some messages carry the time their data was sampled, a little before they were written.
+	BackwardsTolerance time.Duration
+	// GapThreshold is the longest time between consecutive messages before it is reported.
+	GapThreshold time.Duration
+	// GPSJumpThreshold is how far the offset between GPS time and TimeUS may move between GPS
+	// fixes before it is reported.
+	GPSJumpThreshold time.Duration
+}
+
+// DefaultTimeIntegrityOptions returns thresholds suited to logs written at the usual rates
+func DefaultTimeIntegrityOptions() TimeIntegrityOptions {
+	return TimeIntegrityOptions{
+		BackwardsTolerance: 100 * time.Millisecond,
+		GapThreshold:       time.Second,
+		GPSJumpThreshold:   500 * time.Millisecond,
+	}
+}
+
+// TimeDiscontinuity is a jump in the boot time or GPS time of a log
+type TimeDiscontinuity struct {
+	Kind        string        // one of the TimeBackwards, LoggingGap, GPSTimeJump or GPSWeekRollover constants
+	Offset      int           // byte offset of the message after the discontinuity
+	MessageType string        // type of the message after the discontinuity
+	Time        time.Duration // time since boot of the message after the discontinuity
+	Jump        time.Duration // size of the jump, negative when the time went backwards
+}
+
+// ClockDrift is the drift of the flight controller clock against GPS time over one boot
+type ClockDrift struct {
+	Start       time.Duration // time since boot of the first GPS fix of the fit
+	End         time.Duration // time since boot of the last GPS fix of the fit
+	Fixes       int           // GPS fixes used in the fit
+	Rejected    int           // GPS fixes left out of the fit
+	DriftPPM    float64       // how much faster GPS time runs than the boot time, in parts per million
+	MaxResidual time.Duration // largest distance of a fitted GPS fix from the fitted clock
+}
+
+// TimeIntegrityReport holds the result of the time integrity checks of a log
+type TimeIntegrityReport struct {
+	Messages        int // messages with a boot time checked
+	Discontinuities []TimeDiscontinuity
+	Drift           []ClockDrift
+	clock           *UTCClock // clock refitted across the discontinuities
+}
+
+// Clean reports whether no discontinuity was found
+func (report *TimeIntegrityReport) Clean() bool {
+	return len(report.Discontinuities) == 0
+}
+
+// TimeIntegrity reads the whole file and checks its boot times and GPS times. The reader is
+// rewound before and after. Returns the error of a message that cannot be read.
+func (reader *BinaryDataFileReader) TimeIntegrity(options TimeIntegrityOptions) (*TimeIntegrityReport, error) {
+	reader.rewind()
+	defer reader.rewind()
+
+	report := &TimeIntegrityReport{Discontinuities: []TimeDiscontinuity{}, Drift: []ClockDrift{}}
+	clock := newUTCClock()
+	var lastBootUS, lastFixOffsetUS, correctionUS int64
+	hasBoot, hasFix := false, false
+
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		timeUS, ok := message.TimeUS()
+		if !ok {
+			continue
+		}
+		report.Messages++
+		bootUS := int64(timeUS)
+
+		discontinuity := TimeDiscontinuity{Offset: message.Offset, MessageType: message.GetType(), Time: time.Duration(bootUS) * time.Microsecond}
+		switch {
+		case hasBoot && bootUS < lastBootUS-options.BackwardsTolerance.Microseconds():
+			discontinuity.Kind, discontinuity.Jump = TimeBackwards, time.Duration(bootUS-lastBootUS)*time.Microsecond
+			report.Discontinuities = append(report.Discontinuities, discontinuity)
+			clock.breaks[message.Offset] = true
+			lastBootUS, hasFix = bootUS, false
+		case hasBoot && bootUS-lastBootUS > options.GapThreshold.Microseconds():
+			discontinuity.Kind, discontinuity.Jump = LoggingGap, time.Duration(bootUS-lastBootUS)*time.Microsecond
+			report.Discontinuities = append(report.Discontinuities, discontinuity)
+		}
+		if !hasBoot || bootUS > lastBootUS {
+			lastBootUS, hasBoot = bootUS, true
+		}
+
+		messageType := message.GetType()
+		if messageType == MsgTypeGPS || messageType == MsgTypeGPS2 {
+			if utc, ok := GPSMessageTime(message); ok {
+				offsetUS := utc.UnixMicro() + correctionUS - bootUS
+				if hasFix {
+					offsetUS, correctionUS = checkGPSJump(report, clock, discontinuity, offsetUS-lastFixOffsetUS, options, utc, offsetUS, correctionUS)
+				}
+				lastFixOffsetUS, hasFix = offsetUS, true
+			}
+		}
+
+		clock.add(message)
+	}
+
+	clock.fit()
+	report.clock = clock
+	for _, segment := range clock.segments {
+		if !segment.valid {
+			continue
+		}
+		report.Drift = append(report.Drift, ClockDrift{
+			Start:       time.Duration(segment.firstFixUS) * time.Microsecond,
+			End:         time.Duration(segment.lastFixUS) * time.Microsecond,
+			Fixes:       segment.fitted,
+			Rejected:    segment.rejected,
+			DriftPPM:    segment.drift * partsPerMillion,
+			MaxResidual: time.Duration(segment.maxResidualUS) * time.Microsecond,
+		})
+	}
+	return report, nil
+}
+
+// reports a jump of the offset between GPS time and boot time. A jump of whole weeks, give or take
+// the leap seconds between the two dates, is a week rollover and is corrected in the clock from this
+// message on. utc is the GPS time of the fix as logged. Returns the corrected offset and the total
+// correction.
+func checkGPSJump(report *TimeIntegrityReport, clock *UTCClock, discontinuity TimeDiscontinuity, jumpUS int64, options TimeIntegrityOptions, utc time.Time, offsetUS int64, correctionUS int64) (int64, int64) {
+	threshold := options.GPSJumpThreshold.Microseconds()
+	if jumpUS <= threshold && jumpUS >= -threshold {
+		return offsetUS, correctionUS
+	}
+
+	discontinuity.Kind, discontinuity.Jump = GPSTimeJump, time.Duration(jumpUS)*time.Microsecond
+	weeks := int64(math.Round(float64(jumpUS) / float64(microsecondsPerWeek)))
+	if weeks == 0 {
+		report.Discontinuities = append(report.Discontinuities, discontinuity)
+		return offsetUS, correctionUS
+	}
+
+	// the leap seconds of the rolled over date when they came from the table, none when the
+	// receiver logged its own offset
+	shifted := utc.Add(-time.Duration(weeks*microsecondsPerWeek) * time.Microsecond)
+	leapUS := int64(gpstime.LeapSeconds(shifted)-gpstime.LeapSeconds(utc)) * microsecondsPerSecond
+	for _, remainderUS := range []int64{0, leapUS} {
+		if difference := jumpUS - weeks*microsecondsPerWeek - remainderUS; difference <= threshold && difference >= -threshold {
+			discontinuity.Kind = GPSWeekRollover
+			correction := -weeks*microsecondsPerWeek - remainderUS
+			clock.corrections[discontinuity.Offset] = correction
+			offsetUS += correction
+			correctionUS += correction
+			break
+		}
+	}
+	report.Discontinuities = append(report.Discontinuities, discontinuity)
+	return offsetUS, correctionUS
+}
+
+// CompensateClock makes the reader timestamp its messages with the clock refitted across the
+// discontinuities of a time integrity report of the same file
+func (reader *BinaryDataFileReader) CompensateClock(report *TimeIntegrityReport) {
+	if report != nil && report.clock != nil {
+		reader.utcClock = report.clock
+	}
+}
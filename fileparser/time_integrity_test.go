@@ -0,0 +1,163 @@
+package fileparser_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+	"github.com/edancain/telemetry_parser/gpstime"
+)
+
+// steadyEntries returns count samples 100 ms apart from a boot time, an ATT message each and a
+// GPS fix every other one starting with the first, at GPS times from gpsMS in the given week
+func steadyEntries(bootUS int, gpsMS int, week int, count int) []clockEntry {
+	entries := []clockEntry{}
+	for i := 0; i < count; i++ {
+		if i%2 == 0 {
+			entries = append(entries, clockEntry{bootUS: bootUS + i*100000, gpsMS: gpsMS + i*100, week: week})
+		}
+		entries = append(entries, clockEntry{bootUS: bootUS + i*100000})
+	}
+	return entries
+}
+
+func TestTimeIntegrity(t *testing.T) {
+	const startMS = 100000000
+	// the receiver of the rollover reports a week 1024 weeks early, in 2002 with 13 leap seconds
+	const rolledWeek = clockTestWeek - 1024
+
+	tests := []struct {
+		name       string
+		entries    [][]clockEntry
+		want       []string // kind@time since boot of the discontinuities
+		wantJump   time.Duration
+		wantDrift  int
+		wantGPSMS  func(part int, bootUS int) float64 // GPS time in ms of a message in each part of the log
+		compensate bool                               // the default clock gets the log wrong
+	}{
+		{
+			name:      "clean",
+			entries:   [][]clockEntry{steadyEntries(1000000, startMS, 0, 100)},
+			want:      []string{},
+			wantDrift: 1,
+			wantGPSMS: func(_ int, bootUS int) float64 { return startMS + float64(bootUS-1000000)/1000 },
+		},
+		{
+			// TimeUS steps back 500 ms, too little to be taken for a reboot by the default clock
+			name:       "time backwards",
+			entries:    [][]clockEntry{steadyEntries(1000000, startMS, 0, 50), steadyEntries(5400000, startMS+5000, 0, 50)},
+			want:       []string{"time_backwards@5.4s"},
+			wantJump:   -500 * time.Millisecond,
+			wantDrift:  2,
+			compensate: true,
+			wantGPSMS: func(part int, bootUS int) float64 {
+				if part == 0 {
+					return startMS + float64(bootUS-1000000)/1000
+				}
+				return startMS + 5000 + float64(bootUS-5400000)/1000
+			},
+		},
+		{
+			name:      "logging gap",
+			entries:   [][]clockEntry{steadyEntries(1000000, startMS, 0, 50), steadyEntries(9000000, startMS+8000, 0, 50)},
+			want:      []string{"logging_gap@9s"},
+			wantJump:  3100 * time.Millisecond,
+			wantDrift: 1,
+			wantGPSMS: func(_ int, bootUS int) float64 { return startMS + float64(bootUS-1000000)/1000 },
+		},
+		{
+			// most fixes are after the rollover, so the default clock fits the wrong week
+			name:       "week rollover",
+			entries:    [][]clockEntry{steadyEntries(1000000, startMS, 0, 30), steadyEntries(4000000, startMS+3000, rolledWeek, 70)},
+			want:       []string{"gps_week_rollover@4s"},
+			wantJump:   -1024*gpstime.WeekDuration + 5*time.Second,
+			wantDrift:  1,
+			compensate: true,
+			wantGPSMS:  func(_ int, bootUS int) float64 { return startMS + float64(bootUS-1000000)/1000 },
+		},
+		{
+			// the fit leaves out the fixes before the jump, so the log is timestamped from those after
+			name:      "GPS time jump",
+			entries:   [][]clockEntry{steadyEntries(1000000, startMS, 0, 30), steadyEntries(4000000, startMS+6000, 0, 70)},
+			want:      []string{"gps_time_jump@4s"},
+			wantJump:  3 * time.Second,
+			wantDrift: 1,
+			wantGPSMS: func(_ int, bootUS int) float64 { return startMS + 3000 + float64(bootUS-1000000)/1000 },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := []clockEntry{}
+			parts := []int{}
+			for part, partEntries := range test.entries {
+				entries = append(entries, partEntries...)
+				for range partEntries {
+					parts = append(parts, part)
+				}
+			}
+			reader := clockLog(t, entries)
+
+			report, err := reader.TimeIntegrity(fileparser.DefaultTimeIntegrityOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, discontinuity := range report.Discontinuities {
+				got = append(got, fmt.Sprintf("%s@%v", discontinuity.Kind, discontinuity.Time))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("got discontinuities %v, want %v", got, test.want)
+			}
+			if len(report.Discontinuities) > 0 && report.Discontinuities[0].Jump != test.wantJump {
+				t.Errorf("got jump %v, want %v", report.Discontinuities[0].Jump, test.wantJump)
+			}
+			if report.Clean() != (len(test.want) == 0) {
+				t.Errorf("got clean %v with %d discontinuities", report.Clean(), len(test.want))
+			}
+			// and the FMTU messages of the standard formats
+			if want := len(entries) + len(binlogtest.StandardFormats()); report.Messages != want {
+				t.Errorf("got %d messages checked, want %d", report.Messages, want)
+			}
+			if len(report.Drift) != test.wantDrift {
+				t.Fatalf("got %d clock fits, want %d", len(report.Drift), test.wantDrift)
+			}
+			for _, drift := range report.Drift {
+				if drift.DriftPPM > 1 || drift.DriftPPM < -1 || drift.MaxResidual > time.Millisecond {
+					t.Errorf("got drift %.3f ppm with residual %v, want none", drift.DriftPPM, drift.MaxResidual)
+				}
+			}
+
+			// the refitted clock timestamps every message right; the default clock only some
+			check := func(messages []*fileparser.DataFileMessage) (int, error) {
+				wrong, first := 0, error(nil)
+				for i, message := range messages {
+					bootUS, _ := message.TimeUS()
+					want := gpsUTC(test.wantGPSMS(parts[i], bootUS))
+					if got, ok := message.UTC(); !ok || got.Sub(want).Abs() > clockTestTolerance {
+						if wrong == 0 {
+							first = fmt.Errorf("%s at %d us: got %v, want %v", message.GetType(), bootUS, got, want)
+						}
+						wrong++
+					}
+				}
+				return wrong, first
+			}
+			wrong, err := check(readClockLog(t, reader))
+			if wrong > 0 && !test.compensate {
+				t.Errorf("default clock: %v", err)
+			}
+			if wrong == 0 && test.compensate {
+				t.Errorf("default clock already timestamps the log right")
+			}
+
+			reader.Rewind()
+			reader.CompensateClock(report)
+			if wrong, err := check(readClockLog(t, reader)); wrong > 0 {
+				t.Errorf("refitted clock, %d messages wrong: %v", wrong, err)
+			}
+		})
+	}
+}
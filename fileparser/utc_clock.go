@@ -0,0 +1,245 @@
+package fileparser
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/edancain/telemetry_parser/gpstime"
+)
+
+/*
+This code maps the time since boot of every message onto UTC. Every message of a modern log carries
+its boot time in TimeUS (TimeMS in older logs) and every GPS fix carries both its boot time and its
+GPS week and time of week, so the offset between the two clocks is fitted as a straight line over
+all the GPS fixes of the log. The slope absorbs the drift of the flight controller clock against
+GPS time. A log can hold several boots when the vehicle is rebooted without restarting the log, so
+a new segment with its own fit starts wherever the boot time jumps backwards. GPS fixes whose offset
+is far from the median of their segment, such as the first fixes after a cold start whose time of
+week is not yet settled, are left out of the fit.
+Messages without a boot time keep the legacy rate based interpolation of GPSInterpolated.
+*/
+
+const (
+	clockResetToleranceUS = 1000000 // backwards boot time jump that starts a new segment
+	maxClockResidualUS    = 500000  // GPS fixes further than this from the median offset are ignored
+	microsecondsPerSecond = 1000000
+)
+
+// fields of the GPS messages that log the GPS-UTC offset broadcast by the receiver
+var gpsLeapSecondFields = []string{"Leap", "LeapS"}
+
+// clockFix is a GPS fix with its time since boot and its UTC time, both in microseconds
+type clockFix struct {
+	bootUS int64
+	unixUS int64
+}
+
+// clockSegment is the fitted boot time to UTC mapping of a single boot
+type clockSegment struct {
+	startOffset   int   // byte offset of the first message of the boot
+	lastBootUS    int64 // latest boot time seen in the boot, to detect the next reset
+	fixes         []clockFix
+	originUS      int64   // boot time the fit is relative to
+	offsetUS      float64 // UTC minus boot time at originUS
+	drift         float64 // change of the offset per microsecond of boot time
+	valid         bool
+	firstFixUS    int64 // boot time of the first GPS fix used in the fit
+	lastFixUS     int64 // boot time of the last GPS fix used in the fit
+	fitted        int   // GPS fixes used in the fit
+	rejected      int   // GPS fixes left out of the fit
+	maxResidualUS int64 // largest distance of a fitted GPS fix from the line
+}
+
+// UTCClock maps the time since boot of the messages of a log onto UTC
+type UTCClock struct {
+	segments     []clockSegment
+	breaks       map[int]bool  // byte offsets of messages that start a new segment besides boot resets
+	corrections  map[int]int64 // GPS time corrections in microseconds applied from a byte offset on
+	correctionUS int64         // sum of the corrections applied so far
+}
+
+// newUTCClock creates an empty clock, filled by add and fitted by fit
+func newUTCClock() *UTCClock {
+	return &UTCClock{segments: []clockSegment{}, breaks: map[int]bool{}, corrections: map[int]int64{}}
+}
+
+// add records the boot time of a message, starting a new segment when it jumps backwards, and the
+// GPS time of a GPS fix
+func (clock *UTCClock) add(message *DataFileMessage) {
+	bootUS, ok := message.TimeUS()
+	if !ok {
+		return
+	}
+
+	if correction, ok := clock.corrections[message.Offset]; ok {
+		clock.correctionUS += correction
+	}
+	if len(clock.segments) == 0 || clock.breaks[message.Offset] || int64(bootUS) < clock.segments[len(clock.segments)-1].lastBootUS-clockResetToleranceUS {
+		clock.segments = append(clock.segments, clockSegment{startOffset: message.Offset})
+	}
+	segment := &clock.segments[len(clock.segments)-1]
+	if int64(bootUS) > segment.lastBootUS {
+		segment.lastBootUS = int64(bootUS)
+	}
+
+	messageType := message.GetType()
+	if messageType != MsgTypeGPS && messageType != MsgTypeGPS2 {
+		return
+	}
+	if utc, ok := GPSMessageTime(message); ok {
+		segment.fixes = append(segment.fixes, clockFix{bootUS: int64(bootUS), unixUS: utc.UnixMicro() + clock.correctionUS})
+	}
+}
+
+// fit fits the offset of every segment from its GPS fixes
+func (clock *UTCClock) fit() {
+	for i := range clock.segments {
+		clock.segments[i].fit()
+		clock.segments[i].fixes = nil
+	}
+}
+
+// fits the offset between boot time and UTC as a line over the fixes close to the median offset
+func (segment *clockSegment) fit() {
+	if len(segment.fixes) == 0 {
+		return
+	}
+
+	offsets := make([]int64, len(segment.fixes))
+	for i, fix := range segment.fixes {
+		offsets[i] = fix.unixUS - fix.bootUS
+	}
+	sorted := append([]int64(nil), offsets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+
+	fixes := []clockFix{}
+	for i, fix := range segment.fixes {
+		if offsets[i]-median <= maxClockResidualUS && median-offsets[i] <= maxClockResidualUS {
+			fixes = append(fixes, fix)
+		}
+	}
+
+	// least squares fit of the offset against the boot time since the first fix
+	segment.originUS = fixes[0].bootUS
+	var sumX, sumY, sumXX, sumXY float64
+	for _, fix := range fixes {
+		x := float64(fix.bootUS - segment.originUS)
+		y := float64(fix.unixUS - fix.bootUS)
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	count := float64(len(fixes))
+	denominator := count*sumXX - sumX*sumX
+	if denominator != 0 {
+		segment.drift = (count*sumXY - sumX*sumY) / denominator
+	}
+	segment.offsetUS = (sumY - segment.drift*sumX) / count
+	segment.valid = true
+
+	segment.firstFixUS, segment.lastFixUS = fixes[0].bootUS, fixes[len(fixes)-1].bootUS
+	segment.fitted, segment.rejected = len(fixes), len(segment.fixes)-len(fixes)
+	for _, fix := range fixes {
+		fitted := segment.offsetUS + segment.drift*float64(fix.bootUS-segment.originUS)
+		residual := int64(math.Abs(math.Round(float64(fix.unixUS-fix.bootUS) - fitted)))
+		if residual > segment.maxResidualUS {
+			segment.maxResidualUS = residual
+		}
+	}
+}
+
+// Valid reports whether the log has a GPS time for at least one of its boots
+func (clock *UTCClock) Valid() bool {
+	for _, segment := range clock.segments {
+		if segment.valid {
+			return true
+		}
+	}
+	return false
+}
+
+// UTC returns the UTC time of a time since boot in microseconds, for the boot holding the message
+// at the given byte offset. Returns false when that boot has no GPS time.
+func (clock *UTCClock) UTC(offset int, bootUS int) (time.Time, bool) {
+	index := sort.Search(len(clock.segments), func(i int) bool { return clock.segments[i].startOffset > offset }) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(clock.segments) || !clock.segments[index].valid {
+		return time.Time{}, false
+	}
+
+	segment := clock.segments[index]
+	offsetUS := segment.offsetUS + segment.drift*float64(int64(bootUS)-segment.originUS)
+	return time.UnixMicro(int64(bootUS) + int64(math.Round(offsetUS))).UTC(), true
+}
+
+// GPSMessageTime returns the UTC time of a GPS message from GWk/GMS or Week/TimeMS. The GPS-UTC
+// offset broadcast by the receiver is used when the message logs it, the leap second table otherwise.
+func GPSMessageTime(message *DataFileMessage) (time.Time, bool) {
+	for _, names := range [][2]string{{"GWk", "GMS"}, {"Week", "TimeMS"}} {
+		week, errWeek := processAttribute(message, names[0])
+		ms, errMs := processAttribute(message, names[1])
+		if errWeek != nil || errMs != nil || week == 0 {
+			continue
+		}
+
+		tow := time.Duration(ms) * time.Millisecond
+		for _, field := range gpsLeapSecondFields {
+			if leap, err := processAttribute(message, field); err == nil && leap > 0 {
+				return gpstime.WeekTOWToTimeWithLeapSeconds(week, tow, leap), true
+			}
+		}
+		return gpstime.WeekTOWToTime(week, tow), true
+	}
+	return time.Time{}, false
+}
+
+// initUTCClock reads the whole file once to fit the boot time to UTC mapping of every boot
+func (reader *BinaryDataFileReader) initUTCClock() error {
+	reader.rewind()
+	clock := newUTCClock()
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		clock.add(message)
+	}
+	clock.fit()
+	reader.utcClock = clock
+	reader.rewind()
+	return nil
+}
+
+// UTCClock returns the fitted boot time to UTC mapping of the log
+func (reader *BinaryDataFileReader) UTCClock() *UTCClock {
+	return reader.utcClock
+}
+
+// timestamps a message with its UTC time from the fitted clock, or from the legacy interpolation
+// when it has no boot time
+func (reader *BinaryDataFileReader) timestampMessage(message *DataFileMessage) {
+	if reader.clock != nil {
+		reader.clock.MessageArrived(message)
+	}
+
+	if bootUS, ok := message.TimeUS(); ok {
+		if reader.utcClock != nil {
+			message.utc, _ = reader.utcClock.UTC(message.Offset, bootUS)
+		}
+		return
+	}
+
+	if reader.clock != nil && reader.clock.Timebase != 0 {
+		reader.clock.SetMessageTimestamp(message)
+	}
+}
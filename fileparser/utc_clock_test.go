@@ -0,0 +1,220 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+	"github.com/edancain/telemetry_parser/gpstime"
+)
+
+const (
+	clockTestWeek = 2200
+	clockTestType = 150 // a message without a boot time
+	// the least squares fit in floating point is off by a few microseconds
+	clockTestTolerance = 10 * time.Microsecond
+)
+
+// clockEntry is a message of a synthetic clock log: a GPS fix when gpsMS is set, an ATT message
+// otherwise, or a message without a boot time when untimed is set
+type clockEntry struct {
+	bootUS  int
+	gpsMS   int
+	week    int // GPS week of the fix, clockTestWeek when 0
+	untimed bool
+}
+
+// clockLog builds a log of the entries, with their byte offsets
+func clockLog(t *testing.T, entries []clockEntry) *fileparser.BinaryDataFileReader {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	formats := append(binlogtest.StandardFormats(), binlogtest.Format{Type: clockTestType, Name: "RAW", Format: "f", Columns: "Val"})
+	for _, format := range formats {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, entry := range entries {
+		var err error
+		switch {
+		case entry.untimed:
+			err = builder.Message(clockTestType, 1.0)
+		case entry.gpsMS != 0:
+			week := entry.week
+			if week == 0 {
+				week = clockTestWeek
+			}
+			err = builder.Message(binlogtest.GPSType, entry.bootUS, 0, 3, entry.gpsMS, week, 12, 0.8, -353632621, 1491652374, 584.0, 0.0, 0.0, 0.0, 0.0, 1)
+		default:
+			err = builder.Message(binlogtest.ATTType, entry.bootUS, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+// readClockLog returns the messages of the log other than FMT and FMTU, in order
+func readClockLog(t *testing.T, reader *fileparser.BinaryDataFileReader) []*fileparser.DataFileMessage {
+	t.Helper()
+	messages := []*fileparser.DataFileMessage{}
+	for {
+		message, err := reader.ParseNext()
+		if err != nil {
+			break
+		}
+		if messageType := message.GetType(); messageType != "FMT" && messageType != "FMTU" {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func gpsUTC(ms float64) time.Time {
+	return gpstime.WeekTOWToTime(clockTestWeek, time.Duration(ms*float64(time.Millisecond)))
+}
+
+func TestUTCClockFitsDrift(t *testing.T) {
+	// the boot clock runs 200 ppm slow against GPS time, 20 ms over the 100 s of the log
+	const startMS, drift = 100000000, 1.0002
+	entries := []clockEntry{}
+	for second := 1; second <= 101; second++ {
+		bootUS := second * 1000000
+		entries = append(entries, clockEntry{bootUS: bootUS, gpsMS: startMS + int(float64(bootUS)*drift/1000)}, clockEntry{bootUS: bootUS + 500000})
+	}
+	reader := clockLog(t, entries)
+
+	for _, message := range readClockLog(t, reader) {
+		bootUS, _ := message.TimeUS()
+		want := gpsUTC(startMS + float64(bootUS)*drift/1000)
+		got, ok := message.UTC()
+		if !ok || got.Sub(want).Abs() > time.Millisecond {
+			t.Fatalf("%s at %d us: got %v, want %v", message.GetType(), bootUS, got, want)
+		}
+	}
+}
+
+func TestUTCClockRejectsOutlyingFixes(t *testing.T) {
+	// the first fixes after a cold start are seconds off before the time of week settles
+	const startMS = 100000000
+	entries := []clockEntry{}
+	for second := 1; second <= 20; second++ {
+		gpsMS := startMS + second*1000
+		if second <= 3 {
+			gpsMS -= 2000
+		}
+		entries = append(entries, clockEntry{bootUS: second * 1000000, gpsMS: gpsMS}, clockEntry{bootUS: second*1000000 + 500000})
+	}
+	reader := clockLog(t, entries)
+
+	for _, message := range readClockLog(t, reader) {
+		bootUS, _ := message.TimeUS()
+		want := gpsUTC(startMS + float64(bootUS)/1000)
+		if got, ok := message.UTC(); !ok || got.Sub(want).Abs() > clockTestTolerance {
+			t.Fatalf("%s at %d us: got %v, want %v", message.GetType(), bootUS, got, want)
+		}
+	}
+}
+
+func TestUTCClockSegments(t *testing.T) {
+	// the vehicle reboots after 10 s without restarting the log; the second boot gets its GPS fix
+	// 100 s later in GPS time, and a third boot never gets a fix
+	const startMS, rebootMS = 100000000, 100110000
+	entries := []clockEntry{}
+	for second := 1; second <= 10; second++ {
+		entries = append(entries, clockEntry{bootUS: second * 1000000, gpsMS: startMS + second*1000}, clockEntry{bootUS: second*1000000 + 500000})
+	}
+	for second := 1; second <= 10; second++ {
+		entries = append(entries, clockEntry{bootUS: second*1000000 + 500000}, clockEntry{bootUS: second * 1000000, gpsMS: rebootMS + second*1000})
+	}
+	for second := 1; second <= 3; second++ {
+		entries = append(entries, clockEntry{bootUS: second * 1000000})
+	}
+	reader := clockLog(t, entries)
+
+	messages := readClockLog(t, reader)
+	if len(messages) != len(entries) {
+		t.Fatalf("got %d messages, want %d", len(messages), len(entries))
+	}
+	for i, message := range messages {
+		bootUS, _ := message.TimeUS()
+		got, ok := message.UTC()
+		switch {
+		case i < 20:
+			if want := gpsUTC(startMS + float64(bootUS)/1000); !ok || got.Sub(want).Abs() > clockTestTolerance {
+				t.Errorf("first boot, %s at %d us: got %v, want %v", message.GetType(), bootUS, got, want)
+			}
+		case i < 40:
+			if want := gpsUTC(rebootMS + float64(bootUS)/1000); !ok || got.Sub(want).Abs() > clockTestTolerance {
+				t.Errorf("second boot, %s at %d us: got %v, want %v", message.GetType(), bootUS, got, want)
+			}
+		default:
+			if ok {
+				t.Errorf("boot without GPS, %s at %d us: got %v", message.GetType(), bootUS, got)
+			}
+		}
+	}
+
+	// the same time since boot maps to the boot holding the byte offset
+	clock := reader.UTCClock()
+	if !clock.Valid() {
+		t.Fatal("clock with GPS fixes is not valid")
+	}
+	tests := []struct {
+		message int
+		want    time.Time
+		ok      bool
+	}{
+		{0, gpsUTC(startMS + 5000), true},
+		{19, gpsUTC(startMS + 5000), true},
+		{20, gpsUTC(rebootMS + 5000), true},
+		{39, gpsUTC(rebootMS + 5000), true},
+		{40, time.Time{}, false},
+	}
+	for _, test := range tests {
+		offset := messages[test.message].Offset
+		got, ok := clock.UTC(offset, 5000000)
+		if ok != test.ok || got.Sub(test.want).Abs() > clockTestTolerance {
+			t.Errorf("UTC at offset %d: got %v %v, want %v %v", offset, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestUTCClockLegacyInterpolation(t *testing.T) {
+	// messages without a boot time are placed after the last GPS fix by their rate, four a second
+	const startMS, perSecond = 100000000, 4
+	entries := []clockEntry{}
+	for second := 1; second <= 10; second++ {
+		entries = append(entries, clockEntry{bootUS: second * 1000000, gpsMS: startMS + second*1000})
+		for i := 0; i < perSecond; i++ {
+			entries = append(entries, clockEntry{untimed: true})
+		}
+	}
+	reader := clockLog(t, entries)
+
+	// the first read and a read after a rewind are timestamped alike
+	for pass := 0; pass < 2; pass++ {
+		fixMS, untimed := 0.0, 0
+		for _, message := range readClockLog(t, reader) {
+			if bootUS, ok := message.TimeUS(); ok {
+				fixMS, untimed = startMS+float64(bootUS)/1000, 0
+				continue
+			}
+			untimed++
+			want := gpsUTC(fixMS + float64(untimed*1000/perSecond))
+			if got, ok := message.UTC(); !ok || !got.Equal(want) {
+				t.Fatalf("pass %d: %s %d after the fix: got %v, want %v", pass, message.GetType(), untimed, got, want)
+			}
+		}
+		reader.Rewind()
+	}
+}
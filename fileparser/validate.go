@@ -0,0 +1,409 @@
+package fileparser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+This code checks whether a log is healthy before it is archived. It reads the whole file and checks
+that every FMT message declares the length its format characters add up to and a column for every
+character, that a message type is not defined twice with different formats, that every FMTU message
+refers to a defined type, which formats are never used, whether the log ends in a truncated message,
+whether message streams stop for much longer than their usual interval, and that the messages needed
+to make sense of a log are present. The problems found by the reader itself, from the ParseReport,
+are reported too, and a message that stops the reader is reported as an error along with everything
+found before it. Findings are ranked by severity: errors make the log unhealthy, warnings are worth
+a look and info findings are normal in many logs.
+*/
+
+// finding severities, from the most severe
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// validation checks
+const (
+	CheckFormatLength      = "fmt_length"
+	CheckFormatColumns     = "fmt_columns"
+	CheckDuplicateFormat   = "duplicate_fmt"
+	CheckConflictingFormat = "conflicting_fmt"
+	CheckFormatUnits       = "fmtu_unknown_type"
+	CheckUnusedFormat      = "unused_fmt"
+	CheckTruncatedTail     = "truncated_tail"
+	CheckCorruptData       = "corrupt_data"
+	CheckMessageRate       = "message_rate"
+	CheckMissingMessage    = "missing_message"
+)
+
+// rank of each severity in the report
+var severityRank = map[string]int{SeverityError: 0, SeverityWarning: 1, SeverityInfo: 2}
+
+// ValidationOptions selects the messages a log must carry and the threshold of the rate check
+type ValidationOptions struct {
+	// Required messages are reported as errors when missing, Expected messages as warnings
+	Required []string
+	Expected []string
+	// RateGapFactor is how many times longer than its median interval a message stream may stop
+	// before it is reported, MinRateGap the shortest stop reported.
+	RateGapFactor float64
+	MinRateGap    time.Duration
+}
+
+// DefaultValidationOptions returns the checks suited to ArduPilot logs. VER messages are only
+// written by newer firmware, so their absence is a warning.
+func DefaultValidationOptions() ValidationOptions {
+	return ValidationOptions{
+		Required:      []string{MsgTypeGPS, "PARM"},
+		Expected:      []string{"VER"},
+		RateGapFactor: 10,
+		MinRateGap:    time.Second,
+	}
+}
+
+// Finding is a problem found by the validation of a log
+type Finding struct {
+	Severity    string `json:"severity"`               // one of the Severity* constants
+	Check       string `json:"check"`                  // one of the Check* constants
+	Offset      int    `json:"offset"`                 // byte offset of the message concerned, -1 for the whole log
+	MessageType string `json:"message_type,omitempty"` // name of the message type concerned
+	Message     string `json:"message"`
+}
+
+// ValidationReport lists the findings of the validation of a log, the most severe first
+type ValidationReport struct {
+	Messages int       `json:"messages"` // messages read
+	Healthy  bool      `json:"healthy"`  // no error was found
+	Findings []Finding `json:"findings"`
+}
+
+// format definition from an FMT message
+type formatDefinition struct {
+	offset  int
+	name    string
+	length  int
+	format  string
+	columns string
+}
+
+// interval statistics of a message stream
+type messageStream struct {
+	lastUS    int64
+	hasLast   bool
+	intervals []int64
+	offsets   []int // offset of the message ending each interval
+}
+
+// Validate reads the whole file and checks the health of the log. The reader is rewound before
+// and after. A message that cannot be read ends the checks with a finding; other errors, such as
+// a cancelled context, are returned.
+func (reader *BinaryDataFileReader) Validate(options ValidationOptions) (*ValidationReport, error) {
+	reader.rewind()
+	defer reader.rewind()
+
+	report := &ValidationReport{Findings: []Finding{}}
+	definitions := map[int][]formatDefinition{}
+	counts := map[string]int{}
+	streams := map[string]*messageStream{}
+	unitTypes := map[int]int{}
+
+	for {
+		message, err := reader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseError *ParseError
+		if errors.As(err, &parseError) {
+			check := CheckCorruptData
+			if errors.Is(err, ErrTruncated) {
+				check = CheckTruncatedTail
+			}
+			report.add(SeverityError, check, parseError.Offset, parseError.MessageType, "reading stopped: %v", err)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Messages++
+		messageType := message.GetType()
+		counts[messageType]++
+
+		switch messageType {
+		case FormatName:
+			if definition, typ, ok := formatDefinitionOf(message); ok {
+				definitions[typ] = append(definitions[typ], definition)
+			}
+		case "FMTU":
+			if value, err := message.GetAttribute("FmtType"); err == nil {
+				if typ, ok := value.(int); ok {
+					if _, seen := unitTypes[typ]; !seen {
+						unitTypes[typ] = message.Offset
+					}
+				}
+			}
+		}
+
+		if timeUS, ok := message.TimeUS(); ok {
+			stream, ok := streams[messageType]
+			if !ok {
+				stream = &messageStream{}
+				streams[messageType] = stream
+			}
+			stream.add(int64(timeUS), message.Offset)
+		}
+	}
+
+	report.checkFormats(definitions, counts)
+	report.checkFormatUnits(definitions, unitTypes)
+	report.checkParseReport(reader.report)
+	report.checkMessageRates(streams, options)
+	report.checkMissingMessages(counts, options)
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if severityRank[a.Severity] != severityRank[b.Severity] {
+			return severityRank[a.Severity] < severityRank[b.Severity]
+		}
+		return a.Offset < b.Offset
+	})
+	report.Healthy = true
+	for _, finding := range report.Findings {
+		if finding.Severity == SeverityError {
+			report.Healthy = false
+		}
+	}
+	return report, nil
+}
+
+// reads the format definition of an FMT message and the type it defines
+func formatDefinitionOf(message *DataFileMessage) (formatDefinition, int, bool) {
+	if len(message.Elements) < 5 {
+		return formatDefinition{}, 0, false
+	}
+	typ, ok := message.Elements[0].(int)
+	if !ok {
+		return formatDefinition{}, 0, false
+	}
+	length, _ := message.Elements[1].(int)
+	name, _ := message.Elements[2].(string)
+	format, _ := message.Elements[3].(string)
+	columns, _ := message.Elements[4].(string)
+	return formatDefinition{
+		offset:  message.Offset,
+		name:    nullTerm(name),
+		length:  length,
+		format:  nullTerm(format),
+		columns: nullTerm(columns),
+	}, typ, true
+}
+
+func (report *ValidationReport) add(severity string, check string, offset int, messageType string, format string, args ...interface{}) {
+	report.Findings = append(report.Findings, Finding{
+		Severity:    severity,
+		Check:       check,
+		Offset:      offset,
+		MessageType: messageType,
+		Message:     fmt.Sprintf(format, args...),
+	})
+}
+
+// checks the length and columns of every format, its other definitions and whether it is used
+func (report *ValidationReport) checkFormats(definitions map[int][]formatDefinition, counts map[string]int) {
+	types := make([]int, 0, len(definitions))
+	for typ := range definitions {
+		types = append(types, typ)
+	}
+	sort.Ints(types)
+
+	for _, typ := range types {
+		first := definitions[typ][0]
+
+		length := headerSizeAdjustment
+		for i := 0; i < len(first.format); i++ {
+			size, ok := formatCharSizes[first.format[i]]
+			if !ok {
+				report.add(SeverityError, CheckFormatLength, first.offset, first.name,
+					"%s (type %d) has unknown format character '%c' in %q", first.name, typ, first.format[i], first.format)
+				length = -1
+				break
+			}
+			length += size
+		}
+		if length >= 0 && length != first.length {
+			report.add(SeverityError, CheckFormatLength, first.offset, first.name,
+				"%s (type %d) declares length %d but its format %q adds up to %d", first.name, typ, first.length, first.format, length)
+		}
+
+		columns := 0
+		if first.columns != "" {
+			columns = len(strings.Split(first.columns, ","))
+		}
+		if columns != len(first.format) {
+			report.add(SeverityError, CheckFormatColumns, first.offset, first.name,
+				"%s (type %d) has %d columns for %d format characters", first.name, typ, columns, len(first.format))
+		}
+
+		for _, other := range definitions[typ][1:] {
+			if other == (formatDefinition{offset: other.offset, name: first.name, length: first.length, format: first.format, columns: first.columns}) {
+				report.add(SeverityInfo, CheckDuplicateFormat, other.offset, other.name,
+					"%s (type %d) is defined again at %d", other.name, typ, other.offset)
+				continue
+			}
+			report.add(SeverityError, CheckConflictingFormat, other.offset, other.name,
+				"type %d is defined as %s %q at %d and as %s %q at %d", typ, first.name, first.format, first.offset, other.name, other.format, other.offset)
+		}
+
+		if first.name != FormatName && counts[first.name] == 0 {
+			report.add(SeverityInfo, CheckUnusedFormat, first.offset, first.name, "%s (type %d) is defined but never logged", first.name, typ)
+		}
+	}
+}
+
+// checks that every FMTU message refers to a defined type
+func (report *ValidationReport) checkFormatUnits(definitions map[int][]formatDefinition, unitTypes map[int]int) {
+	for typ, offset := range unitTypes {
+		if _, ok := definitions[typ]; !ok {
+			report.add(SeverityWarning, CheckFormatUnits, offset, "FMTU", "FMTU at %d refers to type %d, which has no FMT", offset, typ)
+		}
+	}
+}
+
+// reports the problems found by the reader
+func (report *ValidationReport) checkParseReport(parseReport *ParseReport) {
+	for _, diagnostic := range parseReport.Diagnostics {
+		switch diagnostic.Kind {
+		case DiagnosticBadFormat:
+			// reported from the FMT message itself by checkFormats
+		case DiagnosticTruncated:
+			report.add(SeverityWarning, CheckTruncatedTail, diagnostic.Offset, "", "%s", diagnostic.Message)
+		case DiagnosticFalseHeader:
+			report.add(SeverityWarning, CheckCorruptData, diagnostic.Offset, "", "%s", diagnostic.Message)
+		default:
+			report.add(SeverityError, CheckCorruptData, diagnostic.Offset, "", "%s", diagnostic.Message)
+		}
+	}
+	if dropped := totalDiagnostics(parseReport) - len(parseReport.Diagnostics); dropped > 0 {
+		report.add(SeverityError, CheckCorruptData, -1, "", "%d more problems found by the reader", dropped)
+	}
+}
+
+func totalDiagnostics(parseReport *ParseReport) int {
+	total := 0
+	for _, count := range parseReport.Counts {
+		total += count
+	}
+	return total
+}
+
+// records the interval from the previous message of the stream
+func (stream *messageStream) add(timeUS int64, offset int) {
+	if stream.hasLast && timeUS >= stream.lastUS {
+		stream.intervals = append(stream.intervals, timeUS-stream.lastUS)
+		stream.offsets = append(stream.offsets, offset)
+	}
+	stream.lastUS, stream.hasLast = timeUS, true
+}
+
+// minimum intervals of a stream before its rate is checked
+const minRateIntervals = 10
+
+// reports message streams that stop for much longer than their median interval
+func (report *ValidationReport) checkMessageRates(streams map[string]*messageStream, options ValidationOptions) {
+	names := make([]string, 0, len(streams))
+	for name := range streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stream := streams[name]
+		if len(stream.intervals) < minRateIntervals {
+			continue
+		}
+		sorted := append([]int64{}, stream.intervals...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		median := sorted[len(sorted)/2]
+
+		threshold := int64(float64(median) * options.RateGapFactor)
+		if threshold < options.MinRateGap.Microseconds() {
+			threshold = options.MinRateGap.Microseconds()
+		}
+
+		count, longest, longestOffset := 0, int64(0), -1
+		for i, gap := range stream.intervals {
+			if gap <= threshold {
+				continue
+			}
+			count++
+			if gap > longest {
+				longest, longestOffset = gap, stream.offsets[i]
+			}
+		}
+		if count > 0 {
+			report.add(SeverityWarning, CheckMessageRate, longestOffset, name,
+				"%s stops %d times for longer than %s, its usual interval is %s, the longest stop is %s",
+				name, count, time.Duration(threshold)*time.Microsecond, time.Duration(median)*time.Microsecond,
+				time.Duration(longest)*time.Microsecond)
+		}
+	}
+}
+
+// reports the required and expected messages missing from the log
+func (report *ValidationReport) checkMissingMessages(counts map[string]int, options ValidationOptions) {
+	for _, name := range options.Required {
+		if counts[name] == 0 {
+			report.add(SeverityError, CheckMissingMessage, -1, name, "no %s messages", name)
+		}
+	}
+	for _, name := range options.Expected {
+		if counts[name] == 0 {
+			report.add(SeverityWarning, CheckMissingMessage, -1, name, "no %s messages", name)
+		}
+	}
+}
+
+// WriteText writes the findings as text, one per line after a summary line
+func (report *ValidationReport) WriteText(w io.Writer) error {
+	status := "HEALTHY"
+	if !report.Healthy {
+		status = "UNHEALTHY"
+	}
+	severities := map[string]int{}
+	for _, finding := range report.Findings {
+		severities[finding.Severity]++
+	}
+	lines := []string{
+		fmt.Sprintf("%s: %d errors, %d warnings, %d info in %d messages",
+			status, severities[SeverityError], severities[SeverityWarning], severities[SeverityInfo], report.Messages),
+	}
+
+	for _, finding := range report.Findings {
+		location := ""
+		if finding.Offset >= 0 {
+			location = fmt.Sprintf(" at %d", finding.Offset)
+		}
+		lines = append(lines, fmt.Sprintf("%-7s %s%s: %s", finding.Severity, finding.Check, location, finding.Message))
+	}
+
+	if _, err := io.WriteString(w, strings.Join(lines, "\n")+"\n"); err != nil {
+		return fmt.Errorf("failed to write validation report: %v", err)
+	}
+	return nil
+}
+
+// WriteJSON writes the findings as an indented JSON document
+func (report *ValidationReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("failed to write validation report: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package fileparser_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+func TestValidateReportsRejectedFormats(t *testing.T) {
+	builder := binlogtest.NewBuilder()
+	for _, format := range binlogtest.StandardFormats() {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a column missing from the format, and a length that does not match the format
+	columns := binlogtest.Format{Type: 150, Name: "COLS", Format: "Qf", Columns: "TimeUS,A,B"}
+	if err := builder.DeclareRaw(columns, 15); err != nil {
+		t.Fatal(err)
+	}
+	length := binlogtest.Format{Type: 151, Name: "LEN", Format: "Qf", Columns: "TimeUS,A"}
+	if err := builder.DeclareRaw(length, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Message(binlogtest.ATTType, 1000, 1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := fileparser.NewBinaryDataFileReader(bytes.NewReader(builder.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := reader.Validate(fileparser.DefaultValidationOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]string{}
+	for _, finding := range report.Findings {
+		if finding.Check == fileparser.CheckCorruptData {
+			t.Errorf("rejected FMT reported as corrupt data: %s", finding.Message)
+		}
+		found[finding.MessageType+" "+finding.Check] = finding.Severity
+	}
+	for _, want := range []string{"COLS " + fileparser.CheckFormatColumns, "LEN " + fileparser.CheckFormatLength} {
+		if found[want] != fileparser.SeverityError {
+			t.Errorf("no %s error in %+v", want, report.Findings)
+		}
+	}
+	if report.Healthy {
+		t.Errorf("log with rejected formats reported healthy")
+	}
+}
@@ -0,0 +1,379 @@
+package fileparser
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+This code identifies the vehicle and firmware that wrote the log. Newer logs carry a VER message with
+the board, firmware version, git hash and build vehicle. Every log carries the boot banner in MSG
+messages ("ArduCopter V4.5.1 (1a2b3c4d)", the OS and board lines and "Frame: QUAD/X"), and the frame
+parameters (FRAME_CLASS, FRAME_TYPE and their QuadPlane equivalents) describe the airframe. The
+sources are combined into a VehicleInfo as the messages are read, with VER taking precedence over the
+banner, and the vehicle MavType is refined from the frame class.
+*/
+
+// firmware families as named in the boot banner
+const (
+	VehicleCopter  = "ArduCopter"
+	VehiclePlane   = "ArduPlane"
+	VehicleRover   = "ArduRover"
+	VehicleSub     = "ArduSub"
+	VehicleTracker = "AntennaTracker"
+	VehicleBlimp   = "Blimp"
+)
+
+const buildDirectoryHeli = 13
+
+// FIRMWARE_VERSION_TYPE values logged in the FWT field of VER messages
+var firmwareTypes = map[int]string{
+	0:   "dev",
+	64:  "alpha",
+	128: "beta",
+	192: "rc",
+	255: "official",
+}
+
+// firmware family for each APM_BUILD_DIRECTORY value logged in the BU field of VER messages
+var buildVehicleNames = map[int]string{
+	1:  VehicleRover,
+	2:  VehicleCopter,
+	3:  VehiclePlane,
+	4:  VehicleTracker,
+	7:  VehicleSub,
+	12: VehicleBlimp,
+	13: VehicleCopter,
+}
+
+// MavType for each firmware family, before the frame class is taken into account
+var vehicleMavTypes = map[string]MavType{
+	VehicleCopter:  MavTypeQuadrotor,
+	VehiclePlane:   MavTypeFixedWing,
+	VehicleRover:   MavTypeGroundRover,
+	VehicleSub:     MavTypeSubmarine,
+	VehicleTracker: MavTypeAntennaTracker,
+	VehicleBlimp:   MavTypeAirship,
+}
+
+// Copter FRAME_CLASS parameter values, also used by Q_FRAME_CLASS
+var copterFrameClasses = map[int]string{
+	0:  "UNDEFINED",
+	1:  "QUAD",
+	2:  "HEXA",
+	3:  "OCTA",
+	4:  "OCTAQUAD",
+	5:  "Y6",
+	6:  "HELI",
+	7:  "TRI",
+	8:  "SINGLE",
+	9:  "COAX",
+	10: "BICOPTER",
+	11: "HELI_DUAL",
+	12: "DODECAHEXA",
+	13: "HELI_QUAD",
+	14: "DECA",
+	15: "SCRIPTING_MATRIX",
+	16: "6DOF_SCRIPTING",
+	17: "DYNAMIC_SCRIPTING_MATRIX",
+}
+
+// Rover FRAME_CLASS parameter values
+var roverFrameClasses = map[int]string{
+	0: "UNDEFINED",
+	1: "ROVER",
+	2: "BOAT",
+	3: "BALANCEBOT",
+}
+
+// Copter FRAME_TYPE parameter values, also used by Q_FRAME_TYPE and the FRAME parameter of Copter 3.x
+var copterFrameTypes = map[int]string{
+	0:  "PLUS",
+	1:  "X",
+	2:  "V",
+	3:  "H",
+	4:  "V_TAIL",
+	5:  "A_TAIL",
+	10: "Y6B",
+	11: "Y6F",
+	12: "BF_X",
+	13: "DJI_X",
+	14: "CW_X",
+	15: "I",
+	16: "NYT_PLUS",
+	17: "NYT_X",
+	18: "BF_X_REV",
+	19: "Y4",
+}
+
+// MavType for each multicopter frame class, as named by the parameters and the banner
+var frameMavTypes = map[string]MavType{
+	"QUAD":       MavTypeQuadrotor,
+	"HEXA":       MavTypeHexarotor,
+	"OCTA":       MavTypeOctorotor,
+	"OCTAQUAD":   MavTypeOctorotor,
+	"OCTA_QUAD":  MavTypeOctorotor,
+	"Y6":         MavTypeHexarotor,
+	"HELI":       MavTypeHelicopter,
+	"HELI_DUAL":  MavTypeHelicopter,
+	"HELI_QUAD":  MavTypeHelicopter,
+	"TRI":        MavTypeTricopter,
+	"COAX":       MavTypeCoaxial,
+	"DODECAHEXA": MavTypeDodecarotor,
+	"DECA":       MavTypeDecarotor,
+}
+
+var (
+	// "ArduCopter V4.5.1 (1a2b3c4d)", "ArduPlane V4.6.0-beta2 (1a2b3c4d)", "APM:Copter V3.3 (1a2b3c4d)"
+	bannerPattern = regexp.MustCompile(`^(ArduCopter|ArduPlane|ArduRover|APMrover2|ArduSub|AntennaTracker|Blimp|APM:Copter|APM:Plane|APM:Rover)\s+V(\d+)\.(\d+)(?:\.(\d+))?(?:-?([A-Za-z]+\d*))?(?:\s+\(([0-9a-fA-F]+)\))?`)
+	// "ChibiOS: 1a2b3c4d" or "PX4: dea2cfd1 NuttX: 7a62e351"
+	osPattern = regexp.MustCompile(`(ChibiOS|NuttX):\s*([0-9a-fA-F]+)`)
+	// "CubeOrange 003A0033 31385106 34383436" or "PX4v2 001A0023 32334703 33363339"
+	boardPattern = regexp.MustCompile(`^(\S+)\s+([0-9A-F]{8}\s+[0-9A-F]{8}\s+[0-9A-F]{8})$`)
+	// "Frame: HEXA" or "Frame: QUAD/X"
+	framePattern = regexp.MustCompile(`^Frame:\s*([A-Z0-9_]+)(?:/(\S+))?`)
+)
+
+// FirmwareVersion is the semantic version of the firmware that wrote the log
+type FirmwareVersion struct {
+	Major int
+	Minor int
+	Patch int
+	Type  string // release type: "official", "rc", "beta", "alpha" or "dev", empty when unknown
+}
+
+// String returns the version as major.minor.patch, with the release type appended for
+// pre-release firmware
+func (version FirmwareVersion) String() string {
+	semver := fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch)
+	if version.Type != "" && version.Type != "official" {
+		semver += "-" + version.Type
+	}
+	return semver
+}
+
+// VehicleInfo describes the vehicle, board and firmware that wrote the log
+type VehicleInfo struct {
+	Vehicle        string  // firmware family, one of the Vehicle* constants, empty when unknown
+	MavType        MavType // vehicle type refined from the frame class
+	Version        FirmwareVersion
+	GitHash        string
+	FirmwareString string // firmware description from VER, or the boot banner
+	BoardType      int    // APJ board type from VER, 0 when unknown
+	BoardSubtype   int
+	BoardName      string // board name from the boot banner, e.g. "CubeOrange"
+	BoardSerial    string
+	OS             string // "ChibiOS" or "NuttX"
+	OSHash         string
+	FrameClass     string // frame class name, e.g. "QUAD", "HELI" or "BOAT"
+	FrameType      string // frame type name, e.g. "X" or "PLUS"
+}
+
+// vehicleIdentity holds the VehicleInfo of a reader with the sources it is resolved from
+type vehicleIdentity struct {
+	info              VehicleInfo
+	hasVersionMessage bool // VER has been read, so the banner no longer overrides the version
+	heartbeatType     *MavType
+	frameClassParam   *int
+	frameTypeParam    *int
+	bannerFrameClass  string
+	bannerFrameType   string
+}
+
+// VehicleInfo returns the vehicle and firmware identification gathered from the log
+func (reader *BinaryDataFileReader) VehicleInfo() VehicleInfo {
+	return reader.vehicle.info
+}
+
+// updates the vehicle identification from VER, MSG, PARM and HEARTBEAT messages
+func (reader *BinaryDataFileReader) updateVehicleInfo(messageType string, dataMessage *DataFileMessage) {
+	identity := &reader.vehicle
+
+	switch messageType {
+	case "VER":
+		identity.updateFromVersion(dataMessage)
+	case "MSG":
+		identity.updateFromBanner(dataMessage.GetMessage())
+	case parameterMessage:
+		identity.updateFromParameter(dataMessage)
+	case "HEARTBEAT", "HEAR":
+		for _, field := range []string{"type", "Type"} {
+			if value, err := processAttribute(dataMessage, field); err == nil {
+				mavType := MavType(value)
+				identity.heartbeatType = &mavType
+				break
+			}
+		}
+	default:
+		return
+	}
+
+	identity.resolve()
+	if identity.info.MavType != MavTypeGeneric {
+		reader.MavType = identity.info.MavType
+	}
+}
+
+// reads the board, version and build fields of a VER message
+func (identity *vehicleIdentity) updateFromVersion(dataMessage *DataFileMessage) {
+	identity.hasVersionMessage = true
+
+	if build, err := processAttribute(dataMessage, "BU"); err == nil {
+		if vehicle, ok := buildVehicleNames[build]; ok {
+			identity.info.Vehicle = vehicle
+		}
+		// helicopters are built as a separate Copter firmware
+		if build == buildDirectoryHeli && identity.bannerFrameClass == "" {
+			identity.bannerFrameClass = "HELI"
+		}
+	}
+	if boardType, err := processAttribute(dataMessage, "BT"); err == nil {
+		identity.info.BoardType = boardType
+	}
+	if boardSubtype, err := processAttribute(dataMessage, "BST"); err == nil {
+		identity.info.BoardSubtype = boardSubtype
+	}
+	if major, err := processAttribute(dataMessage, "Maj"); err == nil {
+		identity.info.Version.Major = major
+	}
+	if minor, err := processAttribute(dataMessage, "Min"); err == nil {
+		identity.info.Version.Minor = minor
+	}
+	if patch, err := processAttribute(dataMessage, "Pat"); err == nil {
+		identity.info.Version.Patch = patch
+	}
+	if firmwareType, err := processAttribute(dataMessage, "FWT"); err == nil {
+		if name, ok := firmwareTypes[firmwareType]; ok {
+			identity.info.Version.Type = name
+		}
+	}
+	if gitHash, err := processAttribute(dataMessage, "GH"); err == nil {
+		identity.info.GitHash = fmt.Sprintf("%08x", uint32(gitHash))
+	}
+	if value, err := dataMessage.GetAttribute("FWS"); err == nil {
+		if firmwareString, ok := value.(string); ok && nullTerm(firmwareString) != "" {
+			identity.info.FirmwareString = nullTerm(firmwareString)
+		}
+	}
+}
+
+// reads the firmware, OS, board and frame lines of the boot banner
+func (identity *vehicleIdentity) updateFromBanner(message string) {
+	if match := bannerPattern.FindStringSubmatch(message); match != nil {
+		if !identity.hasVersionMessage {
+			identity.info.Vehicle = bannerVehicleName(match[1])
+			identity.info.Version.Major, _ = strconv.Atoi(match[2])
+			identity.info.Version.Minor, _ = strconv.Atoi(match[3])
+			identity.info.Version.Patch, _ = strconv.Atoi(match[4])
+			identity.info.Version.Type = bannerReleaseType(match[5])
+			identity.info.GitHash = strings.ToLower(match[6])
+			identity.info.FirmwareString = message
+		}
+		return
+	}
+
+	if match := osPattern.FindStringSubmatch(message); match != nil {
+		identity.info.OS = match[1]
+		identity.info.OSHash = strings.ToLower(match[2])
+		return
+	}
+
+	if match := boardPattern.FindStringSubmatch(message); match != nil {
+		identity.info.BoardName = match[1]
+		identity.info.BoardSerial = strings.Join(strings.Fields(match[2]), " ")
+		return
+	}
+
+	if match := framePattern.FindStringSubmatch(message); match != nil {
+		identity.bannerFrameClass = match[1]
+		identity.bannerFrameType = match[2]
+	}
+}
+
+// reads the frame class and type parameters
+func (identity *vehicleIdentity) updateFromParameter(dataMessage *DataFileMessage) {
+	name, value, ok := parameterValue(dataMessage)
+	if !ok {
+		return
+	}
+	parameter := int(value)
+
+	// the QuadPlane parameters only describe the frame when no multicopter parameter does
+	switch name {
+	case "FRAME_CLASS":
+		identity.frameClassParam = &parameter
+	case "Q_FRAME_CLASS":
+		if identity.frameClassParam == nil || identity.info.Vehicle == VehiclePlane {
+			identity.frameClassParam = &parameter
+		}
+	case "FRAME_TYPE", "FRAME":
+		identity.frameTypeParam = &parameter
+	case "Q_FRAME_TYPE":
+		if identity.frameTypeParam == nil || identity.info.Vehicle == VehiclePlane {
+			identity.frameTypeParam = &parameter
+		}
+	}
+}
+
+// combines the sources into the frame names and MavType. A HEARTBEAT type is used as logged, the
+// frame class refines copters and rovers, and otherwise the firmware family decides.
+func (identity *vehicleIdentity) resolve() {
+	identity.info.FrameClass = identity.bannerFrameClass
+	if identity.frameClassParam != nil {
+		frameClasses := copterFrameClasses
+		if identity.info.Vehicle == VehicleRover {
+			frameClasses = roverFrameClasses
+		}
+		if name, ok := frameClasses[*identity.frameClassParam]; ok && name != "UNDEFINED" {
+			identity.info.FrameClass = name
+		}
+	}
+
+	identity.info.FrameType = identity.bannerFrameType
+	if identity.frameTypeParam != nil && identity.info.Vehicle != VehicleRover {
+		if name, ok := copterFrameTypes[*identity.frameTypeParam]; ok {
+			identity.info.FrameType = name
+		}
+	}
+
+	switch {
+	case identity.heartbeatType != nil:
+		identity.info.MavType = *identity.heartbeatType
+	case identity.info.Vehicle == VehicleCopter && frameMavTypes[identity.info.FrameClass] != MavTypeGeneric:
+		identity.info.MavType = frameMavTypes[identity.info.FrameClass]
+	case identity.info.Vehicle == VehicleRover && identity.info.FrameClass == "BOAT":
+		identity.info.MavType = MavTypeSurfaceBoat
+	default:
+		identity.info.MavType = vehicleMavTypes[identity.info.Vehicle]
+	}
+}
+
+// returns the firmware family for the vehicle name in a boot banner
+func bannerVehicleName(name string) string {
+	switch name {
+	case "APMrover2", "APM:Rover":
+		return VehicleRover
+	case "APM:Copter":
+		return VehicleCopter
+	case "APM:Plane":
+		return VehiclePlane
+	}
+	return name
+}
+
+// returns the release type for the version suffix of a boot banner, "beta2" is a beta release
+func bannerReleaseType(suffix string) string {
+	if suffix == "" {
+		return "official"
+	}
+
+	suffix = strings.ToLower(strings.TrimRight(suffix, "0123456789"))
+	for _, name := range firmwareTypes {
+		if suffix == name {
+			return name
+		}
+	}
+	return suffix
+}
@@ -0,0 +1,161 @@
+package fileparser_test
+
+import (
+	"testing"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+)
+
+const verType = 137
+
+var verFormat = binlogtest.Format{Type: verType, Name: "VER", Format: "QBHBBBBIZB", Columns: "TimeUS,BT,BST,Maj,Min,Pat,FWT,GH,FWS,BU"}
+
+func TestVehicleInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages [][]interface{}
+		want     fileparser.VehicleInfo
+	}{
+		{
+			name: "boot banner",
+			messages: [][]interface{}{
+				{binlogtest.MSGType, 0, "ArduCopter V4.5.1 (1A2B3C4D)"},
+				{binlogtest.MSGType, 0, "ChibiOS: 5e6f7a8b"},
+				{binlogtest.MSGType, 0, "CubeOrange 003A0033 31385106 34383436"},
+				{binlogtest.MSGType, 0, "Frame: HEXA/X"},
+			},
+			want: fileparser.VehicleInfo{
+				Vehicle:        fileparser.VehicleCopter,
+				MavType:        fileparser.MavTypeHexarotor,
+				Version:        fileparser.FirmwareVersion{Major: 4, Minor: 5, Patch: 1, Type: "official"},
+				GitHash:        "1a2b3c4d",
+				FirmwareString: "ArduCopter V4.5.1 (1A2B3C4D)",
+				BoardName:      "CubeOrange",
+				BoardSerial:    "003A0033 31385106 34383436",
+				OS:             "ChibiOS",
+				OSHash:         "5e6f7a8b",
+				FrameClass:     "HEXA",
+				FrameType:      "X",
+			},
+		},
+		{
+			// the banner of an older build does not override the version message
+			name: "version message",
+			messages: [][]interface{}{
+				{verType, 0, 140, 1, 4, 6, 0, 128, 0xdeadbeef, "ArduPlane V4.6.0-beta1 (deadbeef)", 3},
+				{binlogtest.MSGType, 0, "ArduPlane V4.5.1 (1a2b3c4d)"},
+			},
+			want: fileparser.VehicleInfo{
+				Vehicle:        fileparser.VehiclePlane,
+				MavType:        fileparser.MavTypeFixedWing,
+				Version:        fileparser.FirmwareVersion{Major: 4, Minor: 6, Patch: 0, Type: "beta"},
+				GitHash:        "deadbeef",
+				FirmwareString: "ArduPlane V4.6.0-beta1 (deadbeef)",
+				BoardType:      140,
+				BoardSubtype:   1,
+			},
+		},
+		{
+			name: "helicopter build",
+			messages: [][]interface{}{
+				{verType, 0, 140, 0, 4, 5, 2, 255, 0x1a2b3c4d, "ArduCopter V4.5.2 (1a2b3c4d)", 13},
+			},
+			want: fileparser.VehicleInfo{
+				Vehicle:        fileparser.VehicleCopter,
+				MavType:        fileparser.MavTypeHelicopter,
+				Version:        fileparser.FirmwareVersion{Major: 4, Minor: 5, Patch: 2, Type: "official"},
+				GitHash:        "1a2b3c4d",
+				FirmwareString: "ArduCopter V4.5.2 (1a2b3c4d)",
+				BoardType:      140,
+				FrameClass:     "HELI",
+			},
+		},
+		{
+			// the frame parameters take precedence over the banner
+			name: "frame parameters",
+			messages: [][]interface{}{
+				{binlogtest.MSGType, 0, "ArduCopter V4.5.1 (1a2b3c4d)"},
+				{binlogtest.MSGType, 0, "Frame: QUAD/PLUS"},
+				{binlogtest.PARMType, 0, "FRAME_CLASS", 3.0},
+				{binlogtest.PARMType, 0, "FRAME_TYPE", 1.0},
+			},
+			want: fileparser.VehicleInfo{
+				Vehicle:        fileparser.VehicleCopter,
+				MavType:        fileparser.MavTypeOctorotor,
+				Version:        fileparser.FirmwareVersion{Major: 4, Minor: 5, Patch: 1, Type: "official"},
+				GitHash:        "1a2b3c4d",
+				FirmwareString: "ArduCopter V4.5.1 (1a2b3c4d)",
+				FrameClass:     "OCTA",
+				FrameType:      "X",
+			},
+		},
+		{
+			// the lift motors of a QuadPlane describe the frame, it is still a plane
+			name: "quadplane",
+			messages: [][]interface{}{
+				{binlogtest.MSGType, 0, "ArduPlane V4.5.1 (1a2b3c4d)"},
+				{binlogtest.PARMType, 0, "Q_FRAME_CLASS", 1.0},
+				{binlogtest.PARMType, 0, "Q_FRAME_TYPE", 1.0},
+			},
+			want: fileparser.VehicleInfo{
+				Vehicle:        fileparser.VehiclePlane,
+				MavType:        fileparser.MavTypeFixedWing,
+				Version:        fileparser.FirmwareVersion{Major: 4, Minor: 5, Patch: 1, Type: "official"},
+				GitHash:        "1a2b3c4d",
+				FirmwareString: "ArduPlane V4.5.1 (1a2b3c4d)",
+				FrameClass:     "QUAD",
+				FrameType:      "X",
+			},
+		},
+		{
+			name: "boat",
+			messages: [][]interface{}{
+				{binlogtest.MSGType, 0, "APMrover2 V3.5.0 (1a2b3c4d)"},
+				{binlogtest.PARMType, 0, "FRAME_CLASS", 2.0},
+				{binlogtest.PARMType, 0, "FRAME_TYPE", 1.0},
+			},
+			want: fileparser.VehicleInfo{
+				Vehicle:        fileparser.VehicleRover,
+				MavType:        fileparser.MavTypeSurfaceBoat,
+				Version:        fileparser.FirmwareVersion{Major: 3, Minor: 5, Patch: 0, Type: "official"},
+				GitHash:        "1a2b3c4d",
+				FirmwareString: "APMrover2 V3.5.0 (1a2b3c4d)",
+				FrameClass:     "BOAT",
+			},
+		},
+		{
+			name:     "unknown",
+			messages: [][]interface{}{{binlogtest.MSGType, 0, "Initialising"}},
+			want:     fileparser.VehicleInfo{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := logReader(t, []binlogtest.Format{verFormat, msgFormat, parmFormat}, test.messages)
+			if got := reader.VehicleInfo(); got != test.want {
+				t.Errorf("got %+v\nwant %+v", got, test.want)
+			}
+			if test.want.MavType != fileparser.MavTypeGeneric && reader.MavType != test.want.MavType {
+				t.Errorf("got reader MavType %v, want %v", reader.MavType, test.want.MavType)
+			}
+		})
+	}
+}
+
+func TestFirmwareVersionString(t *testing.T) {
+	tests := []struct {
+		version fileparser.FirmwareVersion
+		want    string
+	}{
+		{fileparser.FirmwareVersion{Major: 4, Minor: 5, Patch: 1, Type: "official"}, "4.5.1"},
+		{fileparser.FirmwareVersion{Major: 4, Minor: 6, Type: "beta"}, "4.6.0-beta"},
+		{fileparser.FirmwareVersion{Major: 3, Minor: 3}, "3.3.0"},
+	}
+	for _, test := range tests {
+		if got := test.version.String(); got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package gpstime
+
+import (
+	"time"
+)
+
+/*
+This code converts between GPS time, given as a GPS week and time of week (TOW), UTC as a time.Time
+and Unix time. GPS time started at the GPS epoch, 1980-01-06 00:00:00 UTC, and has no leap seconds,
+so it runs ahead of UTC by the number of leap seconds inserted since then. The offset is taken from
+a table of the leap seconds keyed by the UTC date they took effect, unless the caller has the offset
+broadcast by the receiver. All conversions keep microsecond precision.
+*/
+
+const (
+	SecondsPerWeek = 604800
+	WeekDuration   = SecondsPerWeek * time.Second
+)
+
+// Epoch is the start of GPS time
+var Epoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// leapSecond is the GPS-UTC offset in seconds that applies from a UTC date
+type leapSecond struct {
+	date   time.Time
+	offset int
+}
+
+// leap seconds inserted since the GPS epoch, from the IERS Bulletin C
+var leapSeconds = []leapSecond{
+	{time.Date(1981, time.July, 1, 0, 0, 0, 0, time.UTC), 1},
+	{time.Date(1982, time.July, 1, 0, 0, 0, 0, time.UTC), 2},
+	{time.Date(1983, time.July, 1, 0, 0, 0, 0, time.UTC), 3},
+	{time.Date(1985, time.July, 1, 0, 0, 0, 0, time.UTC), 4},
+	{time.Date(1988, time.January, 1, 0, 0, 0, 0, time.UTC), 5},
+	{time.Date(1990, time.January, 1, 0, 0, 0, 0, time.UTC), 6},
+	{time.Date(1991, time.January, 1, 0, 0, 0, 0, time.UTC), 7},
+	{time.Date(1992, time.July, 1, 0, 0, 0, 0, time.UTC), 8},
+	{time.Date(1993, time.July, 1, 0, 0, 0, 0, time.UTC), 9},
+	{time.Date(1994, time.July, 1, 0, 0, 0, 0, time.UTC), 10},
+	{time.Date(1996, time.January, 1, 0, 0, 0, 0, time.UTC), 11},
+	{time.Date(1997, time.July, 1, 0, 0, 0, 0, time.UTC), 12},
+	{time.Date(1999, time.January, 1, 0, 0, 0, 0, time.UTC), 13},
+	{time.Date(2006, time.January, 1, 0, 0, 0, 0, time.UTC), 14},
+	{time.Date(2009, time.January, 1, 0, 0, 0, 0, time.UTC), 15},
+	{time.Date(2012, time.July, 1, 0, 0, 0, 0, time.UTC), 16},
+	{time.Date(2015, time.July, 1, 0, 0, 0, 0, time.UTC), 17},
+	{time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), 18},
+}
+
+// LeapSeconds returns the GPS-UTC offset in seconds at a UTC time
+func LeapSeconds(utc time.Time) int {
+	for i := len(leapSeconds) - 1; i >= 0; i-- {
+		if !utc.Before(leapSeconds[i].date) {
+			return leapSeconds[i].offset
+		}
+	}
+	return 0
+}
+
+// LeapSecondsAtGPS returns the GPS-UTC offset in seconds at a GPS week and time of week
+func LeapSecondsAtGPS(week int, tow time.Duration) int {
+	gps := gpsTime(week, tow)
+	for i := len(leapSeconds) - 1; i >= 0; i-- {
+		// the leap second dates are UTC, so they fall later on the GPS time scale by their offset
+		if !gps.Before(leapSeconds[i].date.Add(time.Duration(leapSeconds[i].offset) * time.Second)) {
+			return leapSeconds[i].offset
+		}
+	}
+	return 0
+}
+
+// returns GPS time as a time.Time on the GPS time scale, without leap seconds
+func gpsTime(week int, tow time.Duration) time.Time {
+	return Epoch.Add(time.Duration(week)*WeekDuration + tow)
+}
+
+// WeekTOWToTime converts a GPS week and time of week to UTC, using the leap second table
+func WeekTOWToTime(week int, tow time.Duration) time.Time {
+	return WeekTOWToTimeWithLeapSeconds(week, tow, LeapSecondsAtGPS(week, tow))
+}
+
+// WeekTOWToTimeWithLeapSeconds converts a GPS week and time of week to UTC with a known GPS-UTC
+// offset, such as the one broadcast by the receiver
+func WeekTOWToTimeWithLeapSeconds(week int, tow time.Duration, leapSeconds int) time.Time {
+	return gpsTime(week, tow).Add(-time.Duration(leapSeconds) * time.Second).Truncate(time.Microsecond)
+}
+
+// ToTime converts a GPS week and time of week in milliseconds, as logged by ArduPilot, to UTC
+func ToTime(week int, towMS int) time.Time {
+	return WeekTOWToTime(week, time.Duration(towMS)*time.Millisecond)
+}
+
+// FromTime converts a time to a GPS week and time of week
+func FromTime(t time.Time) (int, time.Duration) {
+	utc := t.UTC().Truncate(time.Microsecond)
+	elapsed := utc.Add(time.Duration(LeapSeconds(utc)) * time.Second).Sub(Epoch)
+	week := int(elapsed / WeekDuration)
+	if elapsed < 0 && elapsed%WeekDuration != 0 {
+		week--
+	}
+	return week, elapsed - time.Duration(week)*WeekDuration
+}
+
+// ToUnixMicro converts a GPS week and time of week in milliseconds to Unix time in microseconds
+func ToUnixMicro(week int, towMS int) int64 {
+	return ToTime(week, towMS).UnixMicro()
+}
+
+// ToUnix converts a GPS week and time of week in milliseconds to Unix time in seconds
+func ToUnix(week int, towMS int) float64 {
+	return float64(ToUnixMicro(week, towMS)) / float64(time.Second/time.Microsecond)
+}
+
+// FromUnixMicro converts Unix time in microseconds to a GPS week and time of week
+func FromUnixMicro(unixUS int64) (int, time.Duration) {
+	return FromTime(time.UnixMicro(unixUS))
+}
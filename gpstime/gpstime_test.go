@@ -0,0 +1,137 @@
+package gpstime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeapSecondsAtGPS(t *testing.T) {
+	// the leap second of 2017-01-01 00:00:00 UTC took effect at 00:00:18 GPS time, in week 1930
+	tests := []struct {
+		week int
+		tow  time.Duration
+		want int
+	}{
+		{0, 0, 0},
+		{1929, WeekDuration - time.Second, 17},
+		{1930, 0, 17},
+		{1930, 18*time.Second - time.Microsecond, 17},
+		{1930, 18 * time.Second, 18},
+		{2305, 0, 18},
+		{-1, 0, 0},
+	}
+
+	for _, test := range tests {
+		if got := LeapSecondsAtGPS(test.week, test.tow); got != test.want {
+			t.Errorf("LeapSecondsAtGPS(%d, %v) = %d, want %d", test.week, test.tow, got, test.want)
+		}
+	}
+}
+
+func TestLeapSeconds(t *testing.T) {
+	tests := []struct {
+		utc  time.Time
+		want int
+	}{
+		{time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC), 0},
+		{time.Date(2016, time.December, 31, 23, 59, 59, 999999000, time.UTC), 17},
+		{time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), 18},
+	}
+
+	for _, test := range tests {
+		if got := LeapSeconds(test.utc); got != test.want {
+			t.Errorf("LeapSeconds(%v) = %d, want %d", test.utc, got, test.want)
+		}
+	}
+}
+
+func TestWeekTOWRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		week int
+		tow  time.Duration
+		utc  time.Time
+	}{
+		{"epoch", 0, 0, Epoch},
+		{"before the first leap second", 52, 3*24*time.Hour + 1500*time.Microsecond, time.Date(1981, time.January, 7, 0, 0, 0, 1500000, time.UTC)},
+		{"before the epoch", -1, 5*time.Second + 7*time.Microsecond, time.Date(1979, time.December, 30, 0, 0, 5, 7000, time.UTC)},
+		{"after the 2017 leap second", 1930, 18 * time.Second, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"microseconds", 2305, 477063123456 * time.Microsecond, time.Date(2024, time.March, 15, 12, 30, 45, 123456000, time.UTC)},
+		{"end of week", 2305, WeekDuration - time.Microsecond, time.Date(2024, time.March, 16, 23, 59, 41, 999999000, time.UTC)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := WeekTOWToTime(test.week, test.tow); !got.Equal(test.utc) {
+				t.Errorf("WeekTOWToTime(%d, %v) = %v, want %v", test.week, test.tow, got, test.utc)
+			}
+			week, tow := FromTime(test.utc)
+			if week != test.week || tow != test.tow {
+				t.Errorf("FromTime(%v) = %d, %v, want %d, %v", test.utc, week, tow, test.week, test.tow)
+			}
+			// sub-microsecond precision is dropped
+			week, tow = FromTime(test.utc.Add(999 * time.Nanosecond))
+			if week != test.week || tow != test.tow {
+				t.Errorf("FromTime(%v + 999ns) = %d, %v, want %d, %v", test.utc, week, tow, test.week, test.tow)
+			}
+		})
+	}
+}
+
+func TestFromTimeBeforeEpoch(t *testing.T) {
+	utc := time.Date(1975, time.June, 1, 12, 34, 56, 123456000, time.UTC)
+	week, tow := FromTime(utc)
+	if week >= 0 || tow < 0 || tow >= WeekDuration {
+		t.Fatalf("FromTime(%v) = %d, %v, want a negative week and a time of week within it", utc, week, tow)
+	}
+	if got := WeekTOWToTime(week, tow); !got.Equal(utc) {
+		t.Errorf("WeekTOWToTime(FromTime(%v)) = %v", utc, got)
+	}
+}
+
+func TestToUnixMicro(t *testing.T) {
+	tests := []struct {
+		week   int
+		towMS  int
+		unixUS int64
+	}{
+		{0, 0, 315964800000000},             // 1980-01-06 00:00:00 UTC
+		{1930, 18000, 1483228800000000},     // 2017-01-01 00:00:00 UTC
+		{2086, 259218000, 1577836800000000}, // 2020-01-01 00:00:00 UTC
+		{2305, 477063123, 1710505845123000}, // 2024-03-15 12:30:45.123 UTC
+		{1929, 604799000, 1483228782000000}, // 2016-12-31 23:59:42 UTC, with 17 leap seconds
+	}
+
+	for _, test := range tests {
+		if got := ToUnixMicro(test.week, test.towMS); got != test.unixUS {
+			t.Errorf("ToUnixMicro(%d, %d) = %d, want %d", test.week, test.towMS, got, test.unixUS)
+		}
+		week, tow := FromUnixMicro(test.unixUS)
+		if got := ToUnixMicro(week, int(tow/time.Millisecond)); got != test.unixUS {
+			t.Errorf("ToUnixMicro(FromUnixMicro(%d)) = %d", test.unixUS, got)
+		}
+	}
+}
+
+func TestWeekTOWToTimeWithLeapSeconds(t *testing.T) {
+	tests := []struct {
+		week        int
+		tow         time.Duration
+		leapSeconds int
+		want        time.Time
+	}{
+		{1930, 18 * time.Second, 18, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		// a receiver that has not received the new offset yet
+		{1930, 18 * time.Second, 17, time.Date(2017, time.January, 1, 0, 0, 1, 0, time.UTC)},
+		{2305, 477063123456*time.Microsecond + 789*time.Nanosecond, 18, time.Date(2024, time.March, 15, 12, 30, 45, 123456000, time.UTC)},
+		{0, 0, 0, Epoch},
+		// a negative time of week counts back into the previous week
+		{1930, -time.Second, 17, time.Date(2016, time.December, 31, 23, 59, 42, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if got := WeekTOWToTimeWithLeapSeconds(test.week, test.tow, test.leapSeconds); !got.Equal(test.want) {
+			t.Errorf("WeekTOWToTimeWithLeapSeconds(%d, %v, %d) = %v, want %v", test.week, test.tow, test.leapSeconds, got, test.want)
+		}
+	}
+}
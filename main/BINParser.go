@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"time"
 
+	"github.com/edancain/telemetry_parser/analysis"
 	"github.com/edancain/telemetry_parser/fileparser"
 
 	"github.com/peterstace/simplefeatures/geom"
@@ -37,38 +41,52 @@ func ConvertToGeoJSONFeature(g geom.Geometry, id interface{}, properties map[str
 }
 
 type BINParser struct {
+	Options GeometryOptions
+	// Context, when set, cancels the parse once it is done
+	Context context.Context
+	// Progress, when set, receives the progress of every pass over the file
+	Progress func(fileparser.Progress)
 }
 
 func (p *BINParser) ParseGeometry(r io.Reader) (*geom.Geometry, error) {
-	data, err := extractData(r)
+	data, err := p.extractData(r)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse data: %v", err)
+		return nil, fmt.Errorf("failed to parse data: %w", err)
 	}
 
-	// how to get the datetime out of the data
-	firstElement := data[0]
-	gpsTime := getTimeFromGPS(firstElement)
-	fmt.Println("GPS Time:", gpsTime)
-	fmt.Println("Total unique GPS messages:", len(data))
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: no GPS positions found in file", fileparser.ErrNoGPS)
+	}
 
-	return createGeometry(data)
+	return createGeometry(reduceTrack(data, p.Options), p.Options)
 }
 
-func extractData(file io.Reader) ([]map[string]interface{}, error) {
-	var data []map[string]interface{}
+func (p *BINParser) extractData(file io.Reader) ([]TrackPoint, error) {
+	var data []TrackPoint
 	var zeroTimeBase = false
+	options := p.Options
 
-	dfreader, err := fileparser.NewBinaryDataFileReader(file, zeroTimeBase)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create binary data file reader: %v", err)
+	ctx := p.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// parse problems are reported on stderr, as the reader used to print them
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	readerOptions := []fileparser.ReaderOption{fileparser.WithLogger(logger)}
+	if p.Progress != nil {
+		readerOptions = append(readerOptions, fileparser.WithProgress(p.Progress))
 	}
 
-	if _, ok := dfreader.Messages["GPS"]; !ok {
-		return nil, fmt.Errorf("no GPS data found in file")
+	dfreader, err := fileparser.NewBinaryDataFileReaderContext(ctx, file, zeroTimeBase, readerOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create binary data file reader: %w", err)
 	}
 
-	datafileMessage, _ := dfreader.ParseNext()
+	if !hasFormat(dfreader, fileparser.MsgTypeGPS) {
+		return nil, fmt.Errorf("%w: no GPS data found in file", fileparser.ErrNoGPS)
+	}
 
 	//currentMessages := dfreader.Messages
 	messageCount := 0
@@ -78,95 +96,121 @@ func extractData(file io.Reader) ([]map[string]interface{}, error) {
 	// we will have multiple copies of the same position. This is due to the write rate for
 	// other sensors within the Pixhawk. i.e. IMU.
 	seenTimes := make(map[int]bool)
+	// time since boot of each point, to place the takeoffs and landings on the track
+	bootTimes := []time.Duration{}
+	detectorOptions := analysis.DefaultDetectorOptions()
+	detectorOptions.Vehicle = dfreader.VehicleInfo().Vehicle
+	detector := analysis.NewTakeoffLandingDetector(detectorOptions)
 	// Iterate over all messages
 
-	for datafileMessage != nil {
+	for {
+		message, err := dfreader.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message: %w", err)
+		}
+
 		messageCount++
-		if gpsValues, ok := dfreader.Messages["GPS"]; ok {
-			processGPSValues(gpsValues, seenTimes, &data)
+		detector.Update(message, dfreader.Armed())
+		if gpsValues, ok := dfreader.Messages["GPS"]; ok && gpsValues != nil {
+			if err := processGPSValues(dfreader, gpsValues, seenTimes, &data, options); err != nil {
+				return nil, err
+			}
+			if len(bootTimes) < len(data) {
+				bootUS, _ := gpsValues.TimeUS()
+				bootTimes = append(bootTimes, time.Duration(bootUS)*time.Microsecond)
+			}
 		}
+	}
 
-		datafileMessage, _ = dfreader.ParseNext()
+	markDetectedEvents(data, bootTimes, detector.Events())
+	return data, nil
+}
 
-		fmt.Printf("%.1f%%\n", dfreader.Percent)
+// reports whether the log declares a format for a message type
+func hasFormat(dfreader *fileparser.BinaryDataFileReader, name string) bool {
+	for _, format := range dfreader.Formats() {
+		if format.Name == name {
+			return true
+		}
 	}
-	return data, nil
+	return false
 }
 
-func processGPSValues(gpsValues *fileparser.DataFileMessage, seenTimes map[int]bool, data *[]map[string]interface{}) {
-	latInterface, _ := gpsValues.GetAttribute("Lat")
-	lat := float64(latInterface.(int)) / ScalingFactorGPS
-	lonInterface, _ := gpsValues.GetAttribute("Lng")
-	lon := float64(lonInterface.(int)) / ScalingFactorGPS
+func processGPSValues(dfreader *fileparser.BinaryDataFileReader, gpsValues *fileparser.DataFileMessage, seenTimes map[int]bool, data *[]TrackPoint, options GeometryOptions) error {
+	lat, err := gpsCoordinate(gpsValues, "Lat")
+	if err != nil {
+		return err
+	}
+	lon, err := gpsCoordinate(gpsValues, "Lng")
+	if err != nil {
+		return err
+	}
 
 	if lat != 0 && lon != 0 {
 		entryDict := createEntryDict(gpsValues)
-		time, ok := entryDict["TimeMS"].(int)
+		time, ok := gpsTimeKey(entryDict)
 		if ok && !seenTimes[time] {
 			seenTimes[time] = true
-			*data = append(*data, entryDict)
+			*data = append(*data, TrackPoint{
+				Lon:    lon,
+				Lat:    lat,
+				Alt:    altitudeFor(dfreader, gpsValues, options.AltitudeSource),
+				Time:   gpsFixTime(gpsValues),
+				Mode:   dfreader.FlightMode(),
+				Armed:  dfreader.Armed(),
+				Fields: entryDict,
+			})
 		}
 	}
+	return nil
 }
 
-func createEntryDict(gpsValues *fileparser.DataFileMessage) map[string]interface{} {
-	entryDict := make(map[string]interface{})
-	for i, field := range gpsValues.FieldNames {
-		if field == "Lat" || field == "Lng" {
-			entryDict[field] = float64(gpsValues.Elements[i].(int)) / ScalingFactorGPS
-		} else {
-			entryDict[field] = gpsValues.Elements[i]
+// returns a latitude or longitude of a GPS message in degrees
+func gpsCoordinate(gpsValues *fileparser.DataFileMessage, field string) (float64, error) {
+	value, err := gpsValues.GetAttribute(field)
+	if err != nil {
+		return 0, err
+	}
+	coordinate, ok := value.(int)
+	if !ok {
+		return 0, &fileparser.ParseError{
+			Offset:      gpsValues.Offset,
+			MessageType: gpsValues.GetType(),
+			Err:         fmt.Errorf("%w: %s is %T, not an integer", fileparser.ErrFieldType, field, value),
 		}
 	}
-	return entryDict
+	return float64(coordinate) / ScalingFactorGPS, nil
 }
 
-func getTimeFromGPS(gpsData map[string]interface{}) time.Time {
-	// Extract the GPS week and time in milliseconds
-	gpsWeek := gpsData["Week"].(int)
-	gpsTimeMS := gpsData["TimeMS"].(int)
-
-	// Calculate the total seconds since the GPS epoch (1980-01-06)
-	gpsEpoch := time.Date(1980, 1, 6, 0, 0, 0, 0, time.UTC)
-	totalSeconds := float64(gpsWeek*604800) + float64(gpsTimeMS)/1000.0
-
-	// Add the total seconds to the GPS epoch to get the actual time
-	gpsTime := gpsEpoch.Add(time.Duration(totalSeconds) * time.Second)
-
-	return gpsTime
+// returns the value identifying a GPS fix: TimeMS for older logs, GMS (GPS milliseconds) for newer ones
+func gpsTimeKey(entryDict map[string]interface{}) (int, bool) {
+	for _, field := range []string{"TimeMS", "GMS", "TimeUS"} {
+		if time, ok := entryDict[field].(int); ok {
+			return time, true
+		}
+	}
+	return 0, false
 }
 
-func createGeometry(data []map[string]interface{}) (*geom.Geometry, error) {
-	var coords []float64
-
-	for _, record := range data {
-		lat, ok1 := record["Lat"].(float64)
-		lng, ok2 := record["Lng"].(float64)
-
-		if !ok1 || !ok2 {
-			return nil, fmt.Errorf("missing or invalid Lat or Lng in record: %v", record)
+func createEntryDict(gpsValues *fileparser.DataFileMessage) map[string]interface{} {
+	entryDict := make(map[string]interface{})
+	for i, field := range gpsValues.FieldNames {
+		if i >= len(gpsValues.Elements) {
+			break
+		}
+		if coordinate, ok := gpsValues.Elements[i].(int); ok && (field == "Lat" || field == "Lng") {
+			entryDict[field] = float64(coordinate) / ScalingFactorGPS
+		} else {
+			entryDict[field] = gpsValues.Elements[i]
 		}
-
-		// Append lng and lat to the coords slice
-		coords = append(coords, lng, lat)
 	}
-
-	sequence := geom.NewSequence(coords, geom.DimXY)
-	lineString := geom.NewLineString(sequence)
-	geometry := lineString.AsGeometry()
-	return &geometry, nil
+	return entryDict
 }
 
 func main() {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered from panic:", r)
-			buf := make([]byte, 1<<16)
-			runtime.Stack(buf, true)
-			fmt.Printf("%s\n", buf)
-		}
-	}()
-
 	// Get the directory of the currently executing file
 	_, currentFile, _, ok := runtime.Caller(0)
 	if !ok {
@@ -188,7 +232,13 @@ func main() {
 	// Create an io.Reader from the file
 	r := io.Reader(file)
 
-	parser := BINParser{}
+	parser := BINParser{
+		Progress: func(progress fileparser.Progress) {
+			if progress.Stage == fileparser.ProgressRead {
+				fmt.Printf("%.1f%%\n", progress.Percent())
+			}
+		},
+	}
 
 	geometry, err := parser.ParseGeometry(r)
 	if err != nil {
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+
+	"github.com/peterstace/simplefeatures/geom"
+)
+
+// AltitudeSource selects which message supplies the Z ordinate of the track geometry
+type AltitudeSource int
+
+const (
+	AltitudeGPS        AltitudeSource = iota // GPS Alt, altitude above mean sea level
+	AltitudeRelHome                          // POS RelHomeAlt, altitude relative to the home position
+	AltitudeBarometric                       // BARO Alt, barometric altitude relative to the boot position
+)
+
+const (
+	nanosecondsInSecond = 1e9
+)
+
+// message type and field providing the altitude for each AltitudeSource
+var altitudeFields = map[AltitudeSource][2]string{
+	AltitudeGPS:        {"GPS", "Alt"},
+	AltitudeRelHome:    {"POS", "RelHomeAlt"},
+	AltitudeBarometric: {"BARO", "Alt"},
+}
+
+// GeometryOptions controls how the flight track geometry is built. The zero value produces a 2D
+// (DimXY) LineString, matching the original behaviour of ParseGeometry.
+type GeometryOptions struct {
+	// CoordinatesType selects the ordinates written to the geometry. DimXYZ adds the altitude,
+	// DimXYM adds the Unix time in seconds and DimXYZM adds both. Measured geometries leave out
+	// the fixes without GPS time.
+	CoordinatesType geom.CoordinatesType
+	// AltitudeSource selects the message used for the Z ordinate.
+	AltitudeSource AltitudeSource
+	// ResampleInterval, when non-zero, resamples the track at a fixed time step, interpolating
+	// the position and altitude between the surrounding fixes.
+	ResampleInterval time.Duration
+	// MinDistance, when non-zero, drops points closer than this many meters to the last kept point.
+	MinDistance float64
+	// Simplify selects the line simplification algorithm applied last, with SimplifyTolerance
+	// as its tolerance in meters.
+	Simplify          SimplifyMethod
+	SimplifyTolerance float64
+	// SplitOnArming, SplitOnModeChange and MaxGPSGap select where ParseSegments splits the track:
+	// on arming state changes, on flight mode changes and on gaps between GPS fixes longer than
+	// MaxGPSGap.
+	SplitOnArming     bool
+	SplitOnModeChange bool
+	MaxGPSGap         time.Duration
+}
+
+// TrackPoint is a single GPS position of the flight track
+type TrackPoint struct {
+	Lon    float64
+	Lat    float64
+	Alt    float64   // altitude in meters from the selected AltitudeSource
+	Time   time.Time // UTC time of the GPS fix, zero if the message carries no GPS time
+	Mode   string    // flight mode active when the fix was logged
+	Armed  bool      // arming state when the fix was logged
+	Key    bool      // key vertices are always kept by simplification, resampling and decimation
+	Fields map[string]interface{}
+}
+
+// returns the altitude for a GPS fix from the latest message of the selected source. Sources
+// other than GPS fall back to 0 until their first message has been read.
+func altitudeFor(dfreader *fileparser.BinaryDataFileReader, gpsValues *fileparser.DataFileMessage, source AltitudeSource) float64 {
+	field, ok := altitudeFields[source]
+	if !ok {
+		field = altitudeFields[AltitudeGPS]
+	}
+
+	message := gpsValues
+	if field[0] != fileparser.MsgTypeGPS {
+		message = dfreader.Messages[field[0]]
+	}
+	if message == nil {
+		return 0
+	}
+
+	value, err := message.GetAttribute(field[1])
+	if err != nil {
+		return 0
+	}
+
+	switch altitude := value.(type) {
+	case float64:
+		return altitude
+	case int:
+		return float64(altitude)
+	}
+	return 0
+}
+
+// returns the UTC time of a GPS fix from its week and time of week fields, with the leap seconds
+// logged by the receiver when there are any. This is the only GPS time conversion of the track.
+func gpsFixTime(gpsValues *fileparser.DataFileMessage) time.Time {
+	utc, _ := fileparser.GPSMessageTime(gpsValues)
+	return utc
+}
+
+// returns the M ordinate for a point, the Unix time of the fix in seconds. Returns false for a fix
+// without GPS time.
+func measureFor(point TrackPoint) (float64, bool) {
+	if point.Time.IsZero() {
+		return 0, false
+	}
+	return float64(point.Time.UnixNano()) / nanosecondsInSecond, true
+}
+
+// builds the LineString of the points. Measured geometries leave out the fixes without GPS time, as
+// they have no M ordinate, and fail when no fix has one.
+func createGeometry(data []TrackPoint, options GeometryOptions) (*geom.Geometry, error) {
+	var coords []float64
+	ctype := options.CoordinatesType
+
+	for _, record := range data {
+		if math.IsNaN(record.Lat) || math.IsNaN(record.Lon) {
+			return nil, fmt.Errorf("missing or invalid Lat or Lng in record: %v", record.Fields)
+		}
+		measure, hasMeasure := measureFor(record)
+		if ctype.IsMeasured() && !hasMeasure {
+			continue
+		}
+
+		// Append lng and lat to the coords slice, followed by the optional Z and M ordinates
+		coords = append(coords, record.Lon, record.Lat)
+		if ctype.Is3D() {
+			coords = append(coords, record.Alt)
+		}
+		if ctype.IsMeasured() {
+			coords = append(coords, measure)
+		}
+	}
+	if ctype.IsMeasured() && len(coords) == 0 && len(data) > 0 {
+		return nil, fmt.Errorf("%w: no GPS fix with a GPS time for the M ordinate", fileparser.ErrNoGPS)
+	}
+
+	sequence := geom.NewSequence(coords, ctype)
+	lineString := geom.NewLineString(sequence)
+	geometry := lineString.AsGeometry()
+	return &geometry, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+	"github.com/edancain/telemetry_parser/gpstime"
+
+	"github.com/peterstace/simplefeatures/geom"
+)
+
+const (
+	geometryTestWeek    = 2200
+	geometryTestStartMS = 300000000
+	posType             = 140
+	baroType            = 141
+)
+
+// a log of three GPS fixes 1 s apart with POS and BARO messages between them, the second fix
+// without GPS time
+func altitudeLog(t *testing.T) []byte {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	formats := append(binlogtest.StandardFormats(),
+		binlogtest.Format{Type: posType, Name: "POS", Format: "QLLfff", Columns: "TimeUS,Lat,Lng,Alt,RelHomeAlt,RelOriginAlt"},
+		binlogtest.Format{Type: baroType, Name: "BARO", Format: "QBff", Columns: "TimeUS,I,Alt,Press"},
+	)
+	for _, format := range formats {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fix := func(second int, gpsMS int, week int, alt float64) error {
+		return builder.Message(binlogtest.GPSType, second*1000000, 0, 3, gpsMS, week, 12, 0.8, -353632621, 1491652374+second*1000, alt, 0.0, 0.0, 0.0, 0.0, 1)
+	}
+	steps := []func() error{
+		func() error { return fix(1, geometryTestStartMS+1000, geometryTestWeek, 584.0) },
+		func() error { return builder.Message(posType, 1100000, -353632621, 1491652374, 594.0, 10.0, 10.0) },
+		func() error { return builder.Message(baroType, 1100000, 0, 12.0, 101000.0) },
+		func() error { return fix(2, 0, 0, 586.0) },
+		func() error { return builder.Message(posType, 2100000, -353632621, 1491652374, 604.0, 20.0, 20.0) },
+		func() error { return builder.Message(baroType, 2100000, 0, 22.0, 100900.0) },
+		func() error { return fix(3, geometryTestStartMS+3000, geometryTestWeek, 590.0) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return builder.Bytes()
+}
+
+// returns the Z or M ordinates of a LineString
+func ordinates(t *testing.T, geometry *geom.Geometry, measure bool) []float64 {
+	t.Helper()
+	line, ok := geometry.AsLineString()
+	if !ok {
+		t.Fatalf("got %s, want a LineString", geometry.Type())
+	}
+	sequence := line.Coordinates()
+	values := make([]float64, sequence.Length())
+	for i := range values {
+		if measure {
+			values[i] = sequence.Get(i).M
+		} else {
+			values[i] = sequence.Get(i).Z
+		}
+	}
+	return values
+}
+
+func TestParseGeometryAltitudeAndMeasure(t *testing.T) {
+	unix := func(ms int) float64 {
+		utc := gpstime.WeekTOWToTime(geometryTestWeek, time.Duration(ms)*time.Millisecond)
+		return float64(utc.UnixNano()) / nanosecondsInSecond
+	}
+	// the sources other than GPS have no altitude until their first message
+	tests := []struct {
+		source AltitudeSource
+		want   []float64
+	}{
+		{AltitudeGPS, []float64{584, 586, 590}},
+		{AltitudeRelHome, []float64{0, 10, 20}},
+		{AltitudeBarometric, []float64{0, 12, 22}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.source), func(t *testing.T) {
+			parser := BINParser{Options: GeometryOptions{CoordinatesType: geom.DimXYZ, AltitudeSource: test.source}}
+			geometry, err := parser.ParseGeometry(bytes.NewReader(altitudeLog(t)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ordinates(t, geometry, false); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got Z %v, want %v", got, test.want)
+			}
+
+			// the fix without GPS time has no M ordinate and is left out
+			parser.Options.CoordinatesType = geom.DimXYZM
+			geometry, err = parser.ParseGeometry(bytes.NewReader(altitudeLog(t)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := ordinates(t, geometry, false), []float64{test.want[0], test.want[2]}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got Z %v, want %v", got, want)
+			}
+			wantM := []float64{unix(geometryTestStartMS + 1000), unix(geometryTestStartMS + 3000)}
+			if got := ordinates(t, geometry, true); fmt.Sprint(got) != fmt.Sprint(wantM) {
+				t.Errorf("got M %v, want %v", got, wantM)
+			}
+		})
+	}
+}
+
+func TestCreateGeometryWithoutGPSTime(t *testing.T) {
+	points := []TrackPoint{{Lon: 149.1652374, Lat: -35.3632621, Alt: 584}, {Lon: 149.1653374, Lat: -35.3632621, Alt: 586}}
+
+	geometry, err := createGeometry(points, GeometryOptions{CoordinatesType: geom.DimXYZ})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ordinates(t, geometry, false); fmt.Sprint(got) != "[584 586]" {
+		t.Errorf("got Z %v, want [584 586]", got)
+	}
+
+	for _, ctype := range []geom.CoordinatesType{geom.DimXYM, geom.DimXYZM} {
+		if _, err := createGeometry(points, GeometryOptions{CoordinatesType: ctype}); !errors.Is(err, fileparser.ErrNoGPS) {
+			t.Errorf("%s: got error %v, want %v", ctype, err, fileparser.ErrNoGPS)
+		}
+	}
+}
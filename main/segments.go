@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser"
+
+	"github.com/peterstace/simplefeatures/geom"
+)
+
+// reasons a new track segment was started
+const (
+	SegmentStartOfLog = "start"
+	SegmentArmed      = "armed"
+	SegmentDisarmed   = "disarmed"
+	SegmentModeChange = "mode_change"
+	SegmentGPSGap     = "gps_gap"
+)
+
+const minSegmentPoints = 2
+
+// TrackSegment is a continuous part of the flight track with a single arming state, and a single
+// flight mode when splitting on mode changes
+type TrackSegment struct {
+	Points      []TrackPoint
+	Start       time.Time
+	End         time.Time
+	Mode        string
+	Armed       bool
+	StartReason string // why the segment was started, one of the Segment* constants
+}
+
+// ParseSegments splits the flight track on the arming, flight mode and GPS gap boundaries selected
+// in the parser options. Each segment is reduced with the resampling and simplification options.
+// Segments with fewer than two GPS positions are dropped as they cannot form a line.
+func (p *BINParser) ParseSegments(r io.Reader) ([]TrackSegment, error) {
+	data, err := p.extractData(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse data: %w", err)
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: no GPS positions found in file", fileparser.ErrNoGPS)
+	}
+
+	segments := []TrackSegment{}
+	for _, segment := range splitTrack(data, p.Options) {
+		segment.Points = reduceTrack(segment.Points, p.Options)
+		if len(segment.Points) >= minSegmentPoints {
+			segments = append(segments, segment)
+		}
+	}
+	return segments, nil
+}
+
+// ParseMultiLineString returns the track segments as a single MultiLineString geometry
+func (p *BINParser) ParseMultiLineString(r io.Reader) (*geom.Geometry, error) {
+	segments, err := p.ParseSegments(r)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]geom.LineString, 0, len(segments))
+	for _, segment := range segments {
+		geometry, err := createGeometry(segment.Points, p.Options)
+		if err != nil {
+			return nil, err
+		}
+		line, _ := geometry.AsLineString()
+		lines = append(lines, line)
+	}
+
+	geometry := geom.NewMultiLineString(lines).AsGeometry()
+	return &geometry, nil
+}
+
+// ParseFeatures returns one GeoJSON feature per track segment, with the segment start and end UTC
+// times, flight mode, arming state and start reason as properties
+func (p *BINParser) ParseFeatures(r io.Reader) ([]GeoJSONFeature, error) {
+	segments, err := p.ParseSegments(r)
+	if err != nil {
+		return nil, err
+	}
+
+	features := make([]GeoJSONFeature, 0, len(segments))
+	for i, segment := range segments {
+		geometry, err := createGeometry(segment.Points, p.Options)
+		if err != nil {
+			return nil, err
+		}
+
+		features = append(features, ConvertToGeoJSONFeature(*geometry, i, map[string]interface{}{
+			"start":        formatSegmentTime(segment.Start),
+			"end":          formatSegmentTime(segment.End),
+			"mode":         segment.Mode,
+			"armed":        segment.Armed,
+			"start_reason": segment.StartReason,
+			"points":       len(segment.Points),
+		}))
+	}
+	return features, nil
+}
+
+// splits the points into segments wherever the arming state changes, the flight mode changes or
+// the time between two fixes exceeds MaxGPSGap, as selected in options
+func splitTrack(points []TrackPoint, options GeometryOptions) []TrackSegment {
+	segments := []TrackSegment{}
+	var current *TrackSegment
+
+	for i, point := range points {
+		reason := ""
+		switch {
+		case i == 0:
+			reason = SegmentStartOfLog
+		case options.SplitOnArming && point.Armed != points[i-1].Armed:
+			reason = SegmentDisarmed
+			if point.Armed {
+				reason = SegmentArmed
+			}
+		case options.SplitOnModeChange && point.Mode != points[i-1].Mode:
+			reason = SegmentModeChange
+		case options.MaxGPSGap > 0 && !point.Time.IsZero() && !points[i-1].Time.IsZero() && point.Time.Sub(points[i-1].Time) > options.MaxGPSGap:
+			reason = SegmentGPSGap
+		}
+
+		if reason != "" {
+			segments = append(segments, TrackSegment{
+				Start:       point.Time,
+				Mode:        point.Mode,
+				Armed:       point.Armed,
+				StartReason: reason,
+			})
+			current = &segments[len(segments)-1]
+		}
+
+		current.Points = append(current.Points, point)
+		current.End = point.Time
+	}
+	return segments
+}
+
+func formatSegmentTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/fileparser/binlogtest"
+	"github.com/edancain/telemetry_parser/gpstime"
+)
+
+func TestSplitTrack(t *testing.T) {
+	start := time.Date(2022, 3, 9, 12, 0, 0, 0, time.UTC)
+	// a point per second, the arming state, mode and time of each point overridden per case
+	track := func(armed []bool, modes []string, gaps map[int]time.Duration) []TrackPoint {
+		points, _ := straightTrack(armed)
+		var shift time.Duration
+		for i := range points {
+			shift += gaps[i]
+			points[i].Time = points[i].Time.Add(shift)
+			if modes != nil {
+				points[i].Mode = modes[i]
+			}
+		}
+		return points
+	}
+	armed := []bool{false, true, true, true, true, false}
+	modes := []string{"STABILIZE", "STABILIZE", "AUTO", "AUTO", "RTL", "RTL"}
+
+	tests := []struct {
+		name    string
+		points  []TrackPoint
+		options GeometryOptions
+		want    []string // reason mode armed points start-end, times from the first point
+	}{
+		{
+			name:   "no split",
+			points: track(armed, modes, map[int]time.Duration{3: time.Minute}),
+			want:   []string{"start STABILIZE false 6 0s-1m5s"},
+		},
+		{
+			name:    "arming",
+			points:  track(armed, modes, nil),
+			options: GeometryOptions{SplitOnArming: true},
+			want:    []string{"start STABILIZE false 1 0s-0s", "armed STABILIZE true 4 1s-4s", "disarmed RTL false 1 5s-5s"},
+		},
+		{
+			name:    "mode change",
+			points:  track(armed, modes, nil),
+			options: GeometryOptions{SplitOnModeChange: true},
+			want:    []string{"start STABILIZE false 2 0s-1s", "mode_change AUTO true 2 2s-3s", "mode_change RTL true 2 4s-5s"},
+		},
+		{
+			// an arming change and a mode change at the same point start a single segment
+			name:    "arming and mode change",
+			points:  track([]bool{false, false, true, true}, []string{"STABILIZE", "STABILIZE", "AUTO", "RTL"}, nil),
+			options: GeometryOptions{SplitOnArming: true, SplitOnModeChange: true},
+			want:    []string{"start STABILIZE false 2 0s-1s", "armed AUTO true 1 2s-2s", "mode_change RTL true 1 3s-3s"},
+		},
+		{
+			name:    "GPS gap",
+			points:  track(armed, nil, map[int]time.Duration{2: 1500 * time.Millisecond, 4: 3 * time.Second}),
+			options: GeometryOptions{MaxGPSGap: 2 * time.Second},
+			want:    []string{"start AUTO false 2 0s-1s", "gps_gap AUTO true 2 3.5s-4.5s", "gps_gap AUTO true 2 8.5s-9.5s"},
+		},
+		{
+			// the time between a fix without GPS time and the next is unknown
+			name: "GPS gap after a fix without GPS time",
+			points: func() []TrackPoint {
+				points := track(armed, nil, map[int]time.Duration{3: time.Minute})
+				points[2].Time = time.Time{}
+				return points
+			}(),
+			options: GeometryOptions{MaxGPSGap: 2 * time.Second},
+			want:    []string{"start AUTO false 6 0s-1m5s"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			for _, segment := range splitTrack(test.points, test.options) {
+				for _, point := range segment.Points {
+					if test.options.SplitOnModeChange && point.Mode != segment.Mode || test.options.SplitOnArming && point.Armed != segment.Armed {
+						t.Errorf("%s segment holds a %s point armed %v", segment.StartReason, point.Mode, point.Armed)
+					}
+				}
+				got = append(got, fmt.Sprintf("%s %s %v %d %v-%v", segment.StartReason, segment.Mode, segment.Armed, len(segment.Points), segment.Start.Sub(start), segment.End.Sub(start)))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v\nwant %v", got, test.want)
+			}
+		})
+	}
+}
+
+// a log of GPS fixes once a second in STABILIZE then AUTO, with a 5 s gap in the fixes
+func segmentLog(t *testing.T) []byte {
+	t.Helper()
+	builder := binlogtest.NewBuilder()
+	formats := append(binlogtest.StandardFormats(), binlogtest.Format{Type: binlogtest.MODEType, Name: "MODE", Format: "QMBB", Columns: "TimeUS,Mode,ModeNum,Rsn"})
+	for _, format := range formats {
+		if err := builder.Declare(format); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := [][]interface{}{{binlogtest.MODEType, 500000, 0, 0, 1}}
+	for _, second := range []int{1, 2, 3, 4, 5, 10, 11} {
+		if second == 4 {
+			messages = append(messages, []interface{}{binlogtest.MODEType, 3500000, 3, 3, 1})
+		}
+		messages = append(messages, []interface{}{binlogtest.GPSType, second * 1000000, 0, 3, geometryTestStartMS + second*1000, geometryTestWeek, 12, 0.8, -353632621, 1491652374 + second*1000, 584.0, 0.0, 0.0, 0.0, 0.0, 1})
+	}
+	for _, message := range messages {
+		if err := builder.Message(message[0].(int), message[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return builder.Bytes()
+}
+
+func TestParseFeatures(t *testing.T) {
+	utc := func(second int) string {
+		return gpstime.WeekTOWToTime(geometryTestWeek, time.Duration(geometryTestStartMS+second*1000)*time.Millisecond).Format(time.RFC3339Nano)
+	}
+	parser := BINParser{Options: GeometryOptions{SplitOnModeChange: true, MaxGPSGap: 2 * time.Second}}
+	features, err := parser.ParseFeatures(bytes.NewReader(segmentLog(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]interface{}{
+		{"start": utc(1), "end": utc(3), "mode": "STABILIZE", "armed": false, "start_reason": SegmentStartOfLog, "points": 3},
+		{"start": utc(4), "end": utc(5), "mode": "AUTO", "armed": false, "start_reason": SegmentModeChange, "points": 2},
+		{"start": utc(10), "end": utc(11), "mode": "AUTO", "armed": false, "start_reason": SegmentGPSGap, "points": 2},
+	}
+	if len(features) != len(want) {
+		t.Fatalf("got %d features, want %d", len(features), len(want))
+	}
+	for i, feature := range features {
+		if fmt.Sprint(feature.Properties) != fmt.Sprint(want[i]) {
+			t.Errorf("feature %d: got %v\nwant %v", i, feature.Properties, want[i])
+		}
+		if feature.ID != i {
+			t.Errorf("feature %d: got id %v", i, feature.ID)
+		}
+		if line, ok := feature.Geometry.AsLineString(); !ok || line.Coordinates().Length() != want[i]["points"] {
+			t.Errorf("feature %d: got geometry %v", i, feature.Geometry.AsText())
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/edancain/telemetry_parser/analysis"
+)
+
+/*
+This code reduces the number of points in a flight track before the geometry is built. Raw GPS at
+5-10 Hz produces very large geometries for long flights, so the track can be resampled at a fixed
+time step, decimated to a minimum spacing and simplified with the Douglas-Peucker or Visvalingam
+algorithms. Key vertices (the first and last points, flight mode and arming changes, takeoffs and
+landings, and any point marked Key) are never removed, so the simplified track still starts, ends,
+takes off, lands and changes mode where the flight did.
+*/
+
+// SimplifyMethod selects the line simplification algorithm
+type SimplifyMethod int
+
+const (
+	SimplifyNone           SimplifyMethod = iota // no simplification
+	SimplifyDouglasPeucker                       // keeps points further than the tolerance from the simplified line
+	SimplifyVisvalingam                          // removes points whose effective triangle area is below tolerance²
+)
+
+const (
+	earthRadiusMeters = 6371008.8
+	degreesToRadians  = math.Pi / 180.0
+)
+
+// applies the resampling, decimation and simplification selected in options, in that order
+func reduceTrack(points []TrackPoint, options GeometryOptions) []TrackPoint {
+	if len(points) < 3 {
+		return points
+	}
+
+	reduced := markKeyVertices(points)
+	if options.ResampleInterval > 0 {
+		reduced = resampleTrack(reduced, options.ResampleInterval)
+	}
+	if options.MinDistance > 0 {
+		reduced = decimateTrack(reduced, options.MinDistance)
+	}
+	if options.SimplifyTolerance > 0 {
+		switch options.Simplify {
+		case SimplifyDouglasPeucker:
+			reduced = simplifyBetweenKeys(reduced, func(run []TrackPoint) []TrackPoint {
+				return douglasPeucker(run, options.SimplifyTolerance)
+			})
+		case SimplifyVisvalingam:
+			reduced = simplifyBetweenKeys(reduced, func(run []TrackPoint) []TrackPoint {
+				return visvalingam(run, options.SimplifyTolerance*options.SimplifyTolerance)
+			})
+		}
+	}
+	return reduced
+}
+
+// returns a copy of the track with the first and last points and every flight mode or arming
+// change marked as key vertices
+func markKeyVertices(points []TrackPoint) []TrackPoint {
+	marked := make([]TrackPoint, len(points))
+	copy(marked, points)
+
+	for i := range marked {
+		if i == 0 || i == len(marked)-1 || marked[i].Mode != marked[i-1].Mode || marked[i].Armed != marked[i-1].Armed {
+			marked[i].Key = true
+		}
+	}
+	return marked
+}
+
+// marks the first point at or after each detected takeoff and landing as a key vertex. bootTimes
+// holds the time since boot of each point.
+func markDetectedEvents(points []TrackPoint, bootTimes []time.Duration, events []analysis.DetectedEvent) {
+	for _, event := range events {
+		i := sort.Search(len(bootTimes), func(i int) bool { return bootTimes[i] >= event.Time })
+		if i < len(points) {
+			points[i].Key = true
+		}
+	}
+}
+
+// samples the track every interval from its first fix, interpolating between the surrounding
+// fixes. Key vertices are kept at their original time. Tracks without GPS time are left unchanged.
+func resampleTrack(points []TrackPoint, interval time.Duration) []TrackPoint {
+	for _, point := range points {
+		if point.Time.IsZero() {
+			return points
+		}
+	}
+
+	resampled := []TrackPoint{}
+	next := 0
+	for sampleTime := points[0].Time; !sampleTime.After(points[len(points)-1].Time); sampleTime = sampleTime.Add(interval) {
+		// add the key vertices that fall before this sample
+		for next < len(points) && !points[next].Time.After(sampleTime) {
+			if points[next].Key && !points[next].Time.Equal(sampleTime) {
+				resampled = append(resampled, points[next])
+			}
+			next++
+		}
+
+		if next > 0 && points[next-1].Time.Equal(sampleTime) {
+			resampled = append(resampled, points[next-1])
+			continue
+		}
+		if next == 0 || next == len(points) {
+			continue
+		}
+		resampled = append(resampled, interpolatePoint(points[next-1], points[next], sampleTime))
+	}
+
+	// add the remaining key vertices, including the last point
+	for ; next < len(points); next++ {
+		if points[next].Key {
+			resampled = append(resampled, points[next])
+		}
+	}
+	return resampled
+}
+
+// linearly interpolates the position and altitude between two fixes at the given time
+func interpolatePoint(before TrackPoint, after TrackPoint, at time.Time) TrackPoint {
+	span := after.Time.Sub(before.Time)
+	fraction := 0.0
+	if span > 0 {
+		fraction = float64(at.Sub(before.Time)) / float64(span)
+	}
+
+	return TrackPoint{
+		Lon:    before.Lon + (after.Lon-before.Lon)*fraction,
+		Lat:    before.Lat + (after.Lat-before.Lat)*fraction,
+		Alt:    before.Alt + (after.Alt-before.Alt)*fraction,
+		Time:   at,
+		Mode:   before.Mode,
+		Armed:  before.Armed,
+		Fields: before.Fields,
+	}
+}
+
+// drops points closer than minDistance meters to the previously kept point
+func decimateTrack(points []TrackPoint, minDistance float64) []TrackPoint {
+	decimated := []TrackPoint{points[0]}
+	for i := 1; i < len(points); i++ {
+		last := decimated[len(decimated)-1]
+		if points[i].Key || i == len(points)-1 || haversineDistance(last, points[i]) >= minDistance {
+			decimated = append(decimated, points[i])
+		}
+	}
+	return decimated
+}
+
+// splits the track at its key vertices and simplifies each run between them separately
+func simplifyBetweenKeys(points []TrackPoint, simplify func(run []TrackPoint) []TrackPoint) []TrackPoint {
+	simplified := []TrackPoint{points[0]}
+	start := 0
+	for i := 1; i < len(points); i++ {
+		if !points[i].Key && i != len(points)-1 {
+			continue
+		}
+
+		run := simplify(points[start : i+1])
+		simplified = append(simplified, run[1:]...)
+		start = i
+	}
+	return simplified
+}
+
+// Douglas-Peucker simplification: keeps the point furthest from the line between the ends of the
+// run when it is further than tolerance meters away, and recurses on both halves
+func douglasPeucker(points []TrackPoint, tolerance float64) []TrackPoint {
+	if len(points) < 3 {
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		span := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		furthest, maxDistance := -1, 0.0
+		for i := span[0] + 1; i < span[1]; i++ {
+			distance := segmentDistance(points[i], points[span[0]], points[span[1]])
+			if distance > maxDistance {
+				furthest, maxDistance = i, distance
+			}
+		}
+
+		if furthest != -1 && maxDistance > tolerance {
+			keep[furthest] = true
+			stack = append(stack, [2]int{span[0], furthest}, [2]int{furthest, span[1]})
+		}
+	}
+
+	return keptPoints(points, keep)
+}
+
+// visvalingamVertex is a point of the run in the Visvalingam priority queue
+type visvalingamVertex struct {
+	index    int
+	area     float64
+	previous int
+	next     int
+	heapPos  int
+	removed  bool
+}
+
+type visvalingamQueue []*visvalingamVertex
+
+func (queue visvalingamQueue) Len() int           { return len(queue) }
+func (queue visvalingamQueue) Less(i, j int) bool { return queue[i].area < queue[j].area }
+func (queue visvalingamQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].heapPos = i
+	queue[j].heapPos = j
+}
+func (queue *visvalingamQueue) Push(x interface{}) {
+	vertex := x.(*visvalingamVertex)
+	vertex.heapPos = len(*queue)
+	*queue = append(*queue, vertex)
+}
+func (queue *visvalingamQueue) Pop() interface{} {
+	old := *queue
+	vertex := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return vertex
+}
+
+// Visvalingam-Whyatt simplification: repeatedly removes the point forming the smallest triangle
+// with its neighbours until every remaining triangle is at least minArea square meters
+func visvalingam(points []TrackPoint, minArea float64) []TrackPoint {
+	if len(points) < 3 {
+		return points
+	}
+
+	vertices := make([]*visvalingamVertex, len(points))
+	queue := visvalingamQueue{}
+	for i := range points {
+		vertices[i] = &visvalingamVertex{index: i, previous: i - 1, next: i + 1, area: math.Inf(1)}
+		if i > 0 && i < len(points)-1 {
+			vertices[i].area = triangleArea(points[i-1], points[i], points[i+1])
+			heap.Push(&queue, vertices[i])
+		}
+	}
+
+	for queue.Len() > 0 {
+		vertex := heap.Pop(&queue).(*visvalingamVertex)
+		if vertex.area >= minArea {
+			break
+		}
+
+		vertex.removed = true
+		previous, next := vertices[vertex.previous], vertices[vertex.next]
+		previous.next = next.index
+		next.previous = previous.index
+
+		// the neighbours form new triangles, never with a smaller area than the removed point
+		for _, neighbour := range []*visvalingamVertex{previous, next} {
+			if neighbour.previous < 0 || neighbour.next >= len(points) {
+				continue
+			}
+			area := triangleArea(points[neighbour.previous], points[neighbour.index], points[neighbour.next])
+			neighbour.area = math.Max(area, vertex.area)
+			heap.Fix(&queue, neighbour.heapPos)
+		}
+	}
+
+	keep := make([]bool, len(points))
+	for i, vertex := range vertices {
+		keep[i] = !vertex.removed
+	}
+	return keptPoints(points, keep)
+}
+
+func keptPoints(points []TrackPoint, keep []bool) []TrackPoint {
+	kept := []TrackPoint{}
+	for i, point := range points {
+		if keep[i] {
+			kept = append(kept, point)
+		}
+	}
+	return kept
+}
+
+// great circle distance between two points in meters
+func haversineDistance(a TrackPoint, b TrackPoint) float64 {
+	lat1, lat2 := a.Lat*degreesToRadians, b.Lat*degreesToRadians
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * degreesToRadians
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// projects a point to meters east and north of the origin using an equirectangular projection,
+// accurate enough over the short distances between neighbouring track points
+func projectMeters(origin TrackPoint, point TrackPoint) (float64, float64) {
+	x := (point.Lon - origin.Lon) * degreesToRadians * earthRadiusMeters * math.Cos(origin.Lat*degreesToRadians)
+	y := (point.Lat - origin.Lat) * degreesToRadians * earthRadiusMeters
+	return x, y
+}
+
+// distance in meters from a point to the segment between start and end
+func segmentDistance(point TrackPoint, start TrackPoint, end TrackPoint) float64 {
+	px, py := projectMeters(start, point)
+	ex, ey := projectMeters(start, end)
+
+	lengthSquared := ex*ex + ey*ey
+	if lengthSquared == 0 {
+		return math.Hypot(px, py)
+	}
+
+	t := math.Max(0, math.Min(1, (px*ex+py*ey)/lengthSquared))
+	return math.Hypot(px-t*ex, py-t*ey)
+}
+
+// area in square meters of the triangle formed by three points
+func triangleArea(a TrackPoint, b TrackPoint, c TrackPoint) float64 {
+	bx, by := projectMeters(a, b)
+	cx, cy := projectMeters(a, c)
+	return math.Abs(bx*cy-cx*by) / 2
+}
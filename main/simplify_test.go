@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edancain/telemetry_parser/analysis"
+)
+
+// a straight track of n points one second apart, with the given arming state per point
+func straightTrack(armed []bool) ([]TrackPoint, []time.Duration) {
+	start := time.Date(2022, 3, 9, 12, 0, 0, 0, time.UTC)
+	points := make([]TrackPoint, len(armed))
+	bootTimes := make([]time.Duration, len(armed))
+	for i := range points {
+		points[i] = TrackPoint{Lon: 149.1652374 + float64(i)*1e-4, Lat: -35.3632621, Time: start.Add(time.Duration(i) * time.Second), Mode: "AUTO", Armed: armed[i]}
+		bootTimes[i] = time.Duration(10+i) * time.Second
+	}
+	return points, bootTimes
+}
+
+func TestSimplifyKeepsArmingTakeoffAndLanding(t *testing.T) {
+	armed := []bool{false, false, true, true, true, true, true, true, true, true, false, false}
+	points, bootTimes := straightTrack(armed)
+	markDetectedEvents(points, bootTimes, []analysis.DetectedEvent{
+		{Kind: analysis.DetectedTakeoff, Time: 13500 * time.Millisecond},
+		{Kind: analysis.DetectedLanding, Time: 18 * time.Second},
+	})
+
+	reduced := reduceTrack(points, GeometryOptions{Simplify: SimplifyDouglasPeucker, SimplifyTolerance: 1000})
+
+	kept := map[time.Time]bool{}
+	for _, point := range reduced {
+		kept[point.Time] = true
+	}
+	// first and last points, arming at 2, takeoff at 4, landing at 8 and disarming at 10
+	for _, i := range []int{0, 2, 4, 8, 10, 11} {
+		if !kept[points[i].Time] {
+			t.Errorf("point %d was simplified away", i)
+		}
+	}
+	if len(reduced) != 6 {
+		t.Errorf("got %d points, want 6", len(reduced))
+	}
+}
+
+func TestResampleKeepsArmingState(t *testing.T) {
+	points, _ := straightTrack([]bool{true, true, true, true})
+	resampled := resampleTrack(markKeyVertices(points), 300*time.Millisecond)
+	for _, point := range resampled {
+		if !point.Armed {
+			t.Fatalf("resampled point at %v lost its arming state", point.Time)
+		}
+	}
+}